@@ -0,0 +1,1315 @@
+package abs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ABS replica default settings.
+const (
+	DefaultSyncInterval = 10 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+)
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.WALSegmentLister = (*Replica)(nil)
+var _ litestream.WALSegmentReader = (*Replica)(nil)
+var _ litestream.ReplicaStatusReporter = (*Replica)(nil)
+var _ litestream.ReplicaMaintainer = (*Replica)(nil)
+var _ litestream.ReplicaSyncer = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to an Azure Blob Storage container.
+type Replica struct {
+	db           *litestream.DB // source database
+	name         string         // replica name, optional
+	containerURL *azblob.ContainerURL
+
+	mu         sync.RWMutex
+	snapshotMu sync.Mutex
+	pos        litestream.Pos // last position
+	syncErr    error          // error from last sync, if any
+	snapshotAt time.Time      // time of most recent snapshot, if known
+	monitorAt  time.Time      // start of current monitor sync, if any
+
+	wg     sync.WaitGroup
+	cancel func()
+
+	snapshotTotalGauge          prometheus.Gauge
+	walBytesCounter             prometheus.Counter
+	walIndexGauge               prometheus.Gauge
+	walOffsetGauge              prometheus.Gauge
+	putOperationTotalCounter    prometheus.Counter
+	putOperationBytesCounter    prometheus.Counter
+	getOperationTotalCounter    prometheus.Counter
+	getOperationBytesCounter    prometheus.Counter
+	listOperationTotalCounter   prometheus.Counter
+	deleteOperationTotalCounter prometheus.Counter
+	retryCounter                prometheus.Counter
+	circuitOpenGauge            prometheus.Gauge
+	circuitOpenCounter          prometheus.Counter
+
+	// Azure credentials. The account key is used for shared key auth.
+	// Otherwise, the SAS token is appended to each request, if set.
+	AccountName string
+	AccountKey  string
+	SASToken    string
+
+	// Azure container information
+	Bucket string
+	Path   string
+
+	// Overrides the blob service endpoint. Defaults to the public Azure
+	// endpoint for the account. Used for connecting to Azurite, in which case
+	// the account name should be included in the path
+	// (e.g. "http://127.0.0.1:10000/devstoreaccount1").
+	Endpoint string
+
+	// Time between syncs with the shadow WAL.
+	SyncInterval time.Duration
+
+	// Time to keep snapshots and related WAL files.
+	// Database is snapshotted after interval and older WAL files are discarded.
+	Retention time.Duration
+
+	// Tiered retention policy. Overrides Retention, if set.
+	RetentionPolicy litestream.RetentionPolicy
+
+	// Time between retention checks.
+	RetentionCheckInterval time.Duration
+
+	// Time between validation checks.
+	ValidationInterval time.Duration
+
+	// Codec used to compress snapshots & WAL files. Defaults to lz4.
+	Codec litestream.Codec
+
+	// If set, snapshots & WAL files are encrypted before being uploaded.
+	Encryptor *litestream.Encryptor
+
+	// Policy used to retry failed uploads, lists & deletes.
+	RetryPolicy litestream.RetryPolicy
+
+	// Rejects operations after repeated transient failures so the replica
+	// backs off while Azure is unavailable. Disabled if nil.
+	CircuitBreaker *litestream.CircuitBreaker
+
+	// If true, replica monitors database for changes automatically.
+	// Set to false if replica is being used synchronously (such as in tests).
+	MonitorEnabled bool
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		db:     db,
+		name:   name,
+		cancel: func() {},
+
+		SyncInterval:           DefaultSyncInterval,
+		Codec:                  &litestream.LZ4Codec{},
+		Retention:              DefaultRetention,
+		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		RetryPolicy:            litestream.NewRetryPolicy(),
+		CircuitBreaker:         litestream.NewCircuitBreaker(),
+
+		MonitorEnabled: true,
+	}
+
+	var dbPath string
+	if db != nil {
+		dbPath = db.Path()
+	}
+	r.snapshotTotalGauge = internal.ReplicaSnapshotTotalGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
+	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.putOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.putOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.getOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.getOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.listOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "LIST")
+	r.deleteOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "DELETE")
+	r.retryCounter = internal.ReplicaRetryTotalCounterVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenGauge = internal.ReplicaCircuitOpenGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenCounter = internal.ReplicaCircuitOpenTotalCounterVec.WithLabelValues(dbPath, r.Name())
+
+	return r
+}
+
+// Name returns the name of the replica. Returns the type if no name set.
+func (r *Replica) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.Type()
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "abs"
+}
+
+// DB returns the parent database reference.
+func (r *Replica) DB() *litestream.DB {
+	return r.db
+}
+
+// LastPos returns the last successfully replicated position.
+func (r *Replica) LastPos() litestream.Pos {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pos
+}
+
+// LastSyncError returns the error from the most recent sync, if any.
+func (r *Replica) LastSyncError() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.syncErr
+}
+
+// LastSnapshotAt returns the time of the most recent snapshot created or
+// listed by the replica. Returns a zero time if no snapshot has been seen.
+func (r *Replica) LastSnapshotAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotAt
+}
+
+// setLastSnapshotAt updates the time of the most recent snapshot if t is later.
+func (r *Replica) setLastSnapshotAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.snapshotAt) {
+		r.snapshotAt = t
+	}
+}
+
+// MonitorBusySince returns the time the monitor began syncing the current
+// change. Returns a zero time if the monitor is waiting for changes.
+func (r *Replica) MonitorBusySince() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.monitorAt
+}
+
+// setMonitorBusySince sets the start time of the current monitor sync.
+func (r *Replica) setMonitorBusySince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitorAt = t
+}
+
+// GenerationDir returns the path to a generation's root directory.
+func (r *Replica) GenerationDir(generation string) string {
+	return path.Join(r.Path, "generations", generation)
+}
+
+// SnapshotDir returns the path to a generation's snapshot directory.
+func (r *Replica) SnapshotDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "snapshots")
+}
+
+// SnapshotPath returns the path to a snapshot file.
+func (r *Replica) SnapshotPath(generation string, index int) string {
+	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, litestream.SnapshotExt, r.Codec.Ext()))
+}
+
+// MaxSnapshotIndex returns the highest index for the snapshots.
+func (r *Replica) MaxSnapshotIndex(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	index := -1
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation {
+			continue
+		} else if index == -1 || snapshot.Index > index {
+			index = snapshot.Index
+		}
+	}
+	if index == -1 {
+		return 0, fmt.Errorf("no snapshots found")
+	}
+	return index, nil
+}
+
+// WALDir returns the path to a generation's WAL directory
+func (r *Replica) WALDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "wal")
+}
+
+// Generations returns a list of available generation names.
+func (r *Replica) Generations(ctx context.Context) ([]string, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	if err := r.eachPrefix(ctx, path.Join(r.Path, "generations")+"/", func(prefix string) error {
+		name := path.Base(prefix)
+		if !litestream.IsGenerationName(name) {
+			return nil
+		}
+		generations = append(generations, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return generations, nil
+}
+
+// GenerationStats returns stats for a generation.
+func (r *Replica) GenerationStats(ctx context.Context, generation string) (stats litestream.GenerationStats, err error) {
+	if err := r.Init(ctx); err != nil {
+		return stats, err
+	}
+
+	// Determine stats for all snapshots.
+	n, min, max, err := r.objectStats(ctx, r.SnapshotDir(generation), litestream.IsSnapshotPath)
+	if err != nil {
+		return stats, err
+	}
+	stats.SnapshotN = n
+	stats.CreatedAt, stats.UpdatedAt = min, max
+
+	// Update stats if we have WAL files.
+	n, min, max, err = r.objectStats(ctx, r.WALDir(generation), litestream.IsWALPath)
+	if err != nil {
+		return stats, err
+	} else if n == 0 {
+		return stats, nil
+	}
+
+	stats.WALN = n
+	if stats.CreatedAt.IsZero() || min.Before(stats.CreatedAt) {
+		stats.CreatedAt = min
+	}
+	if stats.UpdatedAt.IsZero() || max.After(stats.UpdatedAt) {
+		stats.UpdatedAt = max
+	}
+	return stats, nil
+}
+
+// objectStats returns the count & time range of objects under dir that match fn.
+func (r *Replica) objectStats(ctx context.Context, dir string, fn func(string) bool) (n int, min, max time.Time, err error) {
+	if err := r.eachBlob(ctx, dir+"/", func(item *azblob.BlobItemInternal) error {
+		if !fn(path.Base(item.Name)) {
+			return nil
+		}
+		modTime := item.Properties.LastModified.UTC()
+
+		n++
+		if min.IsZero() || modTime.Before(min) {
+			min = modTime
+		}
+		if max.IsZero() || modTime.After(max) {
+			max = modTime
+		}
+		return nil
+	}); err != nil {
+		return n, min, max, err
+	}
+	return n, min, max, nil
+}
+
+// Snapshots returns a list of available snapshots in the replica.
+func (r *Replica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.SnapshotInfo
+	for _, generation := range generations {
+		if err := r.eachBlob(ctx, r.SnapshotDir(generation)+"/", func(item *azblob.BlobItemInternal) error {
+			key := path.Base(item.Name)
+			index, _, err := litestream.ParseSnapshotPath(key)
+			if err != nil {
+				return nil
+			}
+
+			infos = append(infos, &litestream.SnapshotInfo{
+				Name:       key,
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Size:       blobSize(item),
+				CreatedAt:  blobCreatedAt(item),
+			})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// WALs returns a list of available WAL files in the replica.
+func (r *Replica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.WALInfo
+	for _, generation := range generations {
+		segments, err := r.WALSegments(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+
+		var prev *litestream.WALInfo
+		for _, info := range segments {
+			// Update previous record if generation & index match.
+			if prev != nil && prev.Index == info.Index {
+				prev.Size += info.Size
+				prev.CreatedAt = info.CreatedAt
+				continue
+			}
+
+			// Append new WAL record and keep reference to append additional
+			// size for segmented WAL files.
+			prev = info
+			infos = append(infos, prev)
+		}
+	}
+
+	return infos, nil
+}
+
+// WALSegments returns a list of WAL segments in a generation, in order.
+func (r *Replica) WALSegments(ctx context.Context, generation string) ([]*litestream.WALInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.WALInfo
+	if err := r.eachBlob(ctx, r.WALDir(generation)+"/", func(item *azblob.BlobItemInternal) error {
+		key := path.Base(item.Name)
+
+		index, offset, _, err := litestream.ParseWALPath(key)
+		if err != nil {
+			return nil
+		}
+
+		infos = append(infos, &litestream.WALInfo{
+			Name:       key,
+			Replica:    r.Name(),
+			Generation: generation,
+			Index:      index,
+			Offset:     offset,
+			Size:       blobSize(item),
+			CreatedAt:  blobCreatedAt(item),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// eachBlob iterates over all blobs with the given prefix and calls fn for each.
+func (r *Replica) eachBlob(ctx context.Context, prefix string, fn func(*azblob.BlobItemInternal) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		var resp *azblob.ListBlobsFlatSegmentResponse
+		if err := r.retry(ctx, func() (err error) {
+			resp, err = r.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+			return err
+		}); err != nil {
+			return err
+		}
+		r.listOperationTotalCounter.Inc()
+
+		for i := range resp.Segment.BlobItems {
+			if err := fn(&resp.Segment.BlobItems[i]); err != nil {
+				return err
+			}
+		}
+		marker = resp.NextMarker
+	}
+	return nil
+}
+
+// eachPrefix iterates over all "directories" directly below prefix and calls fn for each.
+func (r *Replica) eachPrefix(ctx context.Context, prefix string, fn func(string) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		var resp *azblob.ListBlobsHierarchySegmentResponse
+		if err := r.retry(ctx, func() (err error) {
+			resp, err = r.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{Prefix: prefix})
+			return err
+		}); err != nil {
+			return err
+		}
+		r.listOperationTotalCounter.Inc()
+
+		for _, p := range resp.Segment.BlobPrefixes {
+			if err := fn(p.Name); err != nil {
+				return err
+			}
+		}
+		marker = resp.NextMarker
+	}
+	return nil
+}
+
+// Start starts replication for a given generation.
+func (r *Replica) Start(ctx context.Context) {
+	// Ignore if replica is being used sychronously.
+	if !r.MonitorEnabled {
+		return
+	}
+
+	// Stop previous replication.
+	r.Stop()
+
+	// Wrap context with cancelation.
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	// Start goroutines to manage replica data.
+	r.wg.Add(3)
+	go func() { defer r.wg.Done(); r.monitor(ctx) }()
+	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.validator(ctx) }()
+}
+
+// Stop cancels any outstanding replication and blocks until finished.
+func (r *Replica) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// monitor runs in a separate goroutine and continuously replicates the DB.
+func (r *Replica) monitor(ctx context.Context) {
+	ticker := time.NewTicker(r.SyncInterval)
+	defer ticker.Stop()
+
+	// Continuously check for new data to replicate.
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+
+	for initial := true; ; initial = false {
+		// Enforce a minimum time between synchronization.
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		// Wait for changes to the database.
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		}
+
+		// Fetch new notify channel before replicating data.
+		notify = r.db.Notify()
+
+		// Synchronize the shadow wal into the replication directory. The start
+		// time is tracked so a stalled sync can be detected by health checks.
+		r.setMonitorBusySince(time.Now())
+		err := r.Sync(ctx)
+		r.setMonitorBusySince(time.Time{})
+		if err != nil {
+			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
+			continue
+		}
+	}
+}
+
+// retainer runs in a separate goroutine and handles retention.
+func (r *Replica) retainer(ctx context.Context) {
+	ticker := time.NewTicker(r.RetentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.EnforceRetention(ctx); err != nil {
+				log.Printf("%s(%s): retain error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// validator runs in a separate goroutine and handles periodic validation.
+func (r *Replica) validator(ctx context.Context) {
+	// Initialize counters since validation occurs infrequently.
+	for _, status := range []string{"ok", "error"} {
+		internal.ReplicaValidationTotalCounterVec.WithLabelValues(r.db.Path(), r.Name(), status).Add(0)
+	}
+
+	if r.ValidationInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ValidationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := litestream.ValidateReplica(ctx, r); err != nil {
+				log.Printf("%s(%s): validation error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// CalcPos returns the position for the replica for the current generation.
+// Returns a zero value if there is no active generation.
+func (r *Replica) CalcPos(ctx context.Context, generation string) (pos litestream.Pos, err error) {
+	if err := r.Init(ctx); err != nil {
+		return pos, err
+	}
+
+	pos.Generation = generation
+
+	// Find maximum snapshot index.
+	if pos.Index, err = r.MaxSnapshotIndex(generation); err != nil {
+		return litestream.Pos{}, err
+	}
+
+	index := -1
+	var offset int64
+	if err := r.eachBlob(ctx, r.WALDir(generation)+"/", func(item *azblob.BlobItemInternal) error {
+		idx, off, _, err := litestream.ParseWALPath(path.Base(item.Name))
+		if err != nil {
+			return nil // invalid wal filename
+		}
+
+		if index == -1 || idx > index {
+			index, offset = idx, 0 // start tracking new wal
+		} else if idx == index && off > offset {
+			offset = off // update offset
+		}
+		return nil
+	}); err != nil {
+		return litestream.Pos{}, err
+	}
+	if index == -1 {
+		return pos, nil // no wal files
+	}
+	pos.Index = index
+	pos.Offset = offset
+
+	return pos, nil
+}
+
+// snapshot copies the entire database to the replica path.
+func (r *Replica) snapshot(ctx context.Context, generation string, index int) error {
+	// Acquire a read lock on the database during snapshot to prevent checkpoints.
+	tx, err := r.db.SQLDB().Begin()
+	if err != nil {
+		return err
+	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Open database file handle.
+	f, err := os.Open(r.db.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshotPath := r.SnapshotPath(generation, index)
+	startTime := time.Now()
+
+	var n int64
+	if err := r.retry(ctx, func() (err error) {
+		// Rewind in case a previous attempt read part of the database.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		n, err = r.uploadSnapshot(ctx, f, snapshotPath)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n)) // compressed bytes
+
+	r.setLastSnapshotAt(time.Now())
+	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+
+	return nil
+}
+
+// uploadSnapshot compresses & optionally encrypts the database file to key.
+// Returns the number of bytes uploaded.
+func (r *Replica) uploadSnapshot(ctx context.Context, f *os.File, key string) (int64, error) {
+	pr, pw := io.Pipe()
+	cw := &countWriter{w: pw}
+	ew, err := litestream.NewEncryptWriter(cw, r.Encryptor)
+	if err != nil {
+		return 0, err
+	}
+
+	zw, err := r.Codec.NewWriter(ew)
+	if err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(zw, f); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		} else if err := zw.Close(); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(ew.Close())
+	}()
+
+	// Wait for the copy to stop before the file is reused or closed. Closing
+	// the pipe unblocks the copy if the upload fails.
+	defer func() { _ = pr.Close(); <-done }()
+
+	blobURL := r.containerURL.NewBlockBlobURL(key)
+	if _, err := azblob.UploadStreamToBlockBlob(ctx, pr, blobURL, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 16,
+	}); err != nil {
+		return 0, err
+	}
+	<-done
+
+	return cw.n, nil
+}
+
+// snapshotN returns the number of snapshots for a generation.
+func (r *Replica) snapshotN(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, snapshot := range snapshots {
+		if snapshot.Generation == generation {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Init initializes the connection to Azure. No-op if already initialized.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.containerURL != nil {
+		return nil
+	}
+
+	// Use shared key auth if an account key is provided. Otherwise requests
+	// are sent anonymously and are authorized by the SAS token, if any.
+	var credential azblob.Credential
+	if r.AccountKey != "" {
+		if credential, err = azblob.NewSharedKeyCredential(r.AccountName, r.AccountKey); err != nil {
+			return fmt.Errorf("cannot create azure credential: %w", err)
+		}
+	} else {
+		credential = azblob.NewAnonymousCredential()
+	}
+
+	// Construct & parse endpoint unless already set.
+	endpoint := r.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", r.AccountName)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("cannot parse azure endpoint: %w", err)
+	}
+	u.Path = path.Join("/", u.Path, r.Bucket)
+	u.RawQuery = strings.TrimPrefix(r.SASToken, "?")
+
+	// Build pipeline with a long timeout so large snapshots can be uploaded.
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{
+			TryTimeout: 24 * time.Hour,
+		},
+	})
+
+	containerURL := azblob.NewContainerURL(*u, pipeline)
+	r.containerURL = &containerURL
+
+	return nil
+}
+
+// retry calls fn using the replica's retry policy. Returns
+// litestream.ErrCircuitOpen without calling fn if the circuit breaker is open.
+func (r *Replica) retry(ctx context.Context, fn func() error) error {
+	if err := r.CircuitBreaker.Allow(); err != nil {
+		r.circuitOpenCounter.Inc()
+		return err
+	}
+
+	var attempt int
+	err := r.RetryPolicy.Do(ctx, isRetryable, func() error {
+		if attempt++; attempt > 1 {
+			r.retryCounter.Inc()
+		}
+		return fn()
+	})
+
+	// Only transient errors indicate that Azure is unavailable. A canceled
+	// operation says nothing about Azure so its outcome is not recorded.
+	if err != nil && ctx.Err() == context.Canceled {
+		r.CircuitBreaker.Release()
+	} else {
+		r.CircuitBreaker.Record(err != nil && (isRetryable(err) || ctx.Err() != nil))
+	}
+	if r.CircuitBreaker.IsOpen() {
+		r.circuitOpenGauge.Set(1)
+	} else {
+		r.circuitOpenGauge.Set(0)
+	}
+	return err
+}
+
+// isRetryable returns true if err is a transient Azure or network error. The
+// Azure pipeline also retries some of these errors for individual requests.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// Storage errors also implement net.Error so classify them by status.
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		if resp := serr.Response(); resp != nil {
+			return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		}
+		return serr.Temporary()
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTransient returns true if err is a transient error or the operation was
+// rejected by an open circuit breaker.
+func isTransient(err error) bool {
+	return errors.Is(err, litestream.ErrCircuitOpen) || isRetryable(err)
+}
+
+// Sync replays data from the shadow WAL and uploads it to Azure.
+func (r *Replica) Sync(ctx context.Context) (err error) {
+	// Track the sync error & clear last position if an error occurs. The
+	// position is kept after a transient error as Azure is unchanged.
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.syncErr = err
+		if err != nil && !isTransient(err) {
+			r.pos = litestream.Pos{}
+		}
+	}()
+
+	// Connect to Azure, if necessary.
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Find current position of database.
+	dpos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if dpos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	generation := dpos.Generation
+
+	// Calculate position if we don't have a previous position or if the generation changes.
+	// Ensure sync & retainer do not snapshot at the same time.
+	if lastPos := r.LastPos(); lastPos.IsZero() || lastPos.Generation != generation {
+		if err := func() error {
+			r.snapshotMu.Lock()
+			defer r.snapshotMu.Unlock()
+
+			// Create snapshot if no snapshots exist for generation.
+			if n, err := r.snapshotN(generation); err != nil {
+				return err
+			} else if n == 0 {
+				if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+					return err
+				}
+				r.snapshotTotalGauge.Set(1.0)
+			} else {
+				r.snapshotTotalGauge.Set(float64(n))
+			}
+
+			// Determine position, if necessary.
+			pos, err := r.CalcPos(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("cannot determine replica position: %w", err)
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.pos = pos
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Read all WAL files since the last position.
+	for {
+		if err = r.syncWAL(ctx); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replica) syncWAL(ctx context.Context) (err error) {
+	rd, err := r.db.ShadowWALReader(r.LastPos())
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+	defer rd.Close()
+
+	// Read to intermediate buffer to determine size.
+	pos := rd.Pos()
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	ew, err := litestream.NewEncryptWriter(&buf, r.Encryptor)
+	if err != nil {
+		return err
+	}
+
+	zw, err := r.Codec.NewWriter(ew)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return err
+	} else if err := zw.Close(); err != nil {
+		return err
+	} else if err := ew.Close(); err != nil {
+		return err
+	}
+	n := buf.Len()
+
+	// Build a WAL path with the index/offset as well as size so we can ensure
+	// that files are contiguous without having to decompress.
+	walPath := path.Join(
+		r.WALDir(rd.Pos().Generation),
+		litestream.FormatWALPathWithOffset(pos.Index, pos.Offset)+r.Codec.Ext(),
+	)
+
+	blobURL := r.containerURL.NewBlockBlobURL(walPath)
+	if err := r.retry(ctx, func() error {
+		_, err := azblob.UploadBufferToBlockBlob(ctx, buf.Bytes(), blobURL, azblob.UploadToBlockBlobOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n)) // compressed bytes
+
+	// Save last replicated position.
+	r.mu.Lock()
+	r.pos = rd.Pos()
+	r.mu.Unlock()
+
+	// Track raw bytes processed & current position.
+	r.walBytesCounter.Add(float64(len(b))) // raw bytes
+	r.walIndexGauge.Set(float64(rd.Pos().Index))
+	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
+
+	return nil
+}
+
+// SnapshotReader returns a reader for snapshot data at the given generation/index.
+func (r *Replica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Find snapshot key as the compression extension may vary.
+	key, err := r.snapshotKey(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pipe download to return an io.Reader.
+	blobURL := r.containerURL.NewBlobURL(key)
+	resp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if isNotExists(err) {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	r.getOperationTotalCounter.Inc()
+	r.getOperationBytesCounter.Add(float64(resp.ContentLength()))
+
+	// Decrypt, if necessary, and decompress the snapshot file.
+	rc := resp.Body(azblob.RetryReaderOptions{})
+	dr, err := litestream.NewDecryptReader(rc, r.Encryptor)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+
+	zr, err := litestream.NewCodecReader(dr, key)
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return internal.NewReadCloser(zr, rc), nil
+}
+
+// snapshotKey returns the key of the snapshot at the given generation/index.
+// Returns os.ErrNotExist if no matching snapshot is found.
+func (r *Replica) snapshotKey(ctx context.Context, generation string, index int) (string, error) {
+	var key string
+	if err := r.eachBlob(ctx, path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x", index)), func(item *azblob.BlobItemInternal) error {
+		if idx, _, err := litestream.ParseSnapshotPath(path.Base(item.Name)); err == nil && idx == index && key == "" {
+			key = item.Name
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	} else if key == "" {
+		return "", os.ErrNotExist
+	}
+	return key, nil
+}
+
+// WALReader returns a reader for WAL data at the given index.
+// Returns os.ErrNotExist if no matching index is found.
+func (r *Replica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.WALReaderFrom(ctx, generation, index, 0)
+}
+
+// WALReaderFrom returns a reader for WAL data in index starting at offset.
+// Segments which end before offset are not downloaded.
+func (r *Replica) WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Collect all files for the index.
+	var keys []string
+	if err := r.eachBlob(ctx, path.Join(r.WALDir(generation), fmt.Sprintf("%08x_", index)), func(item *azblob.BlobItemInternal) error {
+		if _, _, _, err := litestream.ParseWALPath(path.Base(item.Name)); err != nil {
+			return nil
+		}
+		keys = append(keys, item.Name)
+		return nil
+	}); err != nil {
+		return nil, err
+	} else if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Skip segments which end before offset.
+	var start int64
+	for i := len(keys) - 1; i >= 0; i-- {
+		if _, off, _, _ := litestream.ParseWALPath(path.Base(keys[i])); off <= offset {
+			keys, start = keys[i:], off
+			break
+		}
+	}
+
+	// Open each file and concatenate into a multi-reader.
+	var buf bytes.Buffer
+	pos := start
+	for _, key := range keys {
+		// Ensure offset is correct as we copy segments into buffer.
+		_, off, _, _ := litestream.ParseWALPath(path.Base(key))
+		if off != pos {
+			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at remote offset %d, expected offset %d", generation, index, off, pos)
+		}
+
+		blobURL := r.containerURL.NewBlobURL(key)
+		resp, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return nil, err
+		}
+		rd := resp.Body(azblob.RetryReaderOptions{})
+		defer rd.Close()
+
+		r.getOperationTotalCounter.Inc()
+		r.getOperationBytesCounter.Add(float64(resp.ContentLength()))
+
+		dr, err := litestream.NewDecryptReader(rd, r.Encryptor)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := litestream.NewCodecReader(dr, key)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := io.Copy(&buf, zr)
+		if err != nil {
+			return nil, err
+		} else if err := zr.Close(); err != nil {
+			return nil, err
+		}
+		pos += n
+	}
+
+	return internal.Discard(ioutil.NopCloser(&buf), offset-start)
+}
+
+// Snapshot creates a snapshot of the database at its current position.
+// No snapshot is created if one already exists for the current WAL index.
+func (r *Replica) Snapshot(ctx context.Context) error {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Ensure sync & retainer do not snapshot at the same time.
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	pos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if pos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	return r.snapshot(ctx, pos.Generation, pos.Index)
+}
+
+// EnforceRetention forces a new snapshot once the retention interval has passed.
+// Older snapshots and WAL files are then removed.
+func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Ensure sync & retainer do not snapshot at the same time.
+	var all, snapshots, walSnapshots []*litestream.SnapshotInfo
+	if err := func() error {
+		r.snapshotMu.Lock()
+		defer r.snapshotMu.Unlock()
+
+		// Find current position of database.
+		pos, err := r.db.Pos()
+		if err != nil {
+			return fmt.Errorf("cannot determine current generation: %w", err)
+		} else if pos.IsZero() {
+			return fmt.Errorf("no generation, waiting for data")
+		}
+
+		// Obtain list of snapshots that are within the retention period.
+		if all, err = r.Snapshots(ctx); err != nil {
+			return fmt.Errorf("cannot obtain snapshot list: %w", err)
+		}
+		r.setLastSnapshotAt(litestream.LatestSnapshotTime(all))
+		now := time.Now()
+		snapshots, walSnapshots = litestream.RetainSnapshots(all, r.Retention, r.RetentionPolicy, now)
+
+		// If no retained snapshots with WAL exist or the retention policy has
+		// no snapshot for its finest interval, create a new snapshot.
+		if litestream.FindMinSnapshotByGeneration(walSnapshots, pos.Generation) == nil ||
+			(r.RetentionPolicy.SnapshotDue(all, pos.Generation, now) && !litestream.ContainsSnapshot(all, pos.Generation, pos.Index)) {
+			if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+				return fmt.Errorf("cannot snapshot: %w", err)
+			}
+			info := &litestream.SnapshotInfo{Generation: pos.Generation, Index: pos.Index}
+			snapshots, walSnapshots = append(snapshots, info), append(walSnapshots, info)
+		}
+
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// Loop over generations and delete unretained snapshots & WAL files.
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot obtain generations: %w", err)
+	}
+	for _, generation := range generations {
+		// Find earliest retained snapshot for this generation.
+		snapshot := litestream.FindMinSnapshotByGeneration(snapshots, generation)
+
+		// Delete generations if it has no snapshots being retained.
+		if snapshot == nil {
+			if err := r.deleteGenerationBefore(ctx, generation, -1, nil, nil); err != nil {
+				return fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
+			}
+			continue
+		}
+
+		// Otherwise delete unretained snapshots & all WAL files before the
+		// lowest index that retains WAL. Generations retained only by coarser
+		// policy tiers keep no WAL files.
+		walIndex := math.MaxInt32
+		if snapshot := litestream.FindMinSnapshotByGeneration(walSnapshots, generation); snapshot != nil {
+			walIndex = snapshot.Index
+		}
+		if err := r.deleteGenerationBefore(ctx, generation, walIndex, all, snapshots); err != nil {
+			return fmt.Errorf("cannot delete generation %q files before index %d: %w", generation, walIndex, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteGenerationBefore deletes WAL files before index & listed snapshots
+// that are not retained. All files are deleted if index is -1.
+func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string, index int, snapshots, retained []*litestream.SnapshotInfo) (err error) {
+	// Collect all files for the generation.
+	var keys []string
+	if err := r.eachBlob(ctx, r.GenerationDir(generation)+"/", func(item *azblob.BlobItemInternal) error {
+		// Skip retained snapshots, snapshots created since listing & WALs
+		// that are after the search index unless -1.
+		if index != -1 {
+			if idx, _, err := litestream.ParseSnapshotPath(path.Base(item.Name)); err == nil {
+				if !litestream.ContainsSnapshot(snapshots, generation, idx) || litestream.ContainsSnapshot(retained, generation, idx) {
+					return nil
+				}
+			} else if idx, _, _, err := litestream.ParseWALPath(path.Base(item.Name)); err == nil && idx >= index {
+				return nil
+			}
+		}
+
+		keys = append(keys, item.Name)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Azure does not support batch deletes via this API so delete each blob individually.
+	for _, key := range keys {
+		blobURL := r.containerURL.NewBlobURL(key)
+		if err := r.retry(ctx, func() error {
+			if _, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{}); err != nil && !isNotExists(err) {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+	}
+
+	log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, len(keys))
+
+	return nil
+}
+
+// blobSize returns the content length of a listed blob.
+func blobSize(item *azblob.BlobItemInternal) int64 {
+	if item.Properties.ContentLength == nil {
+		return 0
+	}
+	return *item.Properties.ContentLength
+}
+
+// blobCreatedAt returns the creation time of a listed blob. Falls back to the
+// last modified time if the creation time is unavailable.
+func blobCreatedAt(item *azblob.BlobItemInternal) time.Time {
+	if item.Properties.CreationTime != nil {
+		return item.Properties.CreationTime.UTC()
+	}
+	return item.Properties.LastModified.UTC()
+}
+
+// isNotExists returns true if err is an Azure "blob not found" error.
+func isNotExists(err error) bool {
+	var serr azblob.StorageError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return serr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+}
+
+// Azure Blob Storage metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "abs",
+		Name:      "operation_total",
+		Help:      "The number of ABS operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "abs",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by ABS operations",
+	}, []string{"db", "name", "type"})
+)
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
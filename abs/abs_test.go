@@ -0,0 +1,648 @@
+package abs_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/abs"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Azurite's well-known development account credentials.
+const (
+	AccountName = "devstoreaccount1"
+	AccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func TestReplica_Sync(t *testing.T) {
+	// Ensure replica can sync using shared key auth and be restored.
+	t.Run("SharedKey", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write to the database multiple times and sync periodically so that
+		// multiple WAL indexes & segments are uploaded.
+		n := db.MinCheckpointPageN * 2
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure positions match.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Index == 0 {
+			t.Fatal("expected multiple wal indexes")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		// Calculated position points to the start of the last WAL segment.
+		if calcPos, err := r.CalcPos(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if calcPos.Generation != pos.Generation || calcPos.Index != pos.Index || calcPos.Offset > pos.Offset {
+			t.Fatalf("CalcPos()=%v, want <= %v", calcPos, pos)
+		}
+
+		// Restore from the replica & verify data.
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := testingutil.MustOpenSQLDB(t, outputPath)
+		defer testingutil.MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure replica can sync when authorized by a SAS token.
+	t.Run("SAS", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+		s.SASToken = "sv=2019-12-12&sig=xyz"
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.AccountKey, r.SASToken = "", "?"+s.SASToken
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if generations, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(generations), 1; got != want {
+			t.Fatalf("len(Generations())=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure requests are rejected if credentials are not provided.
+	t.Run("ErrUnauthorized", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.AccountKey = ""
+
+		if _, err := r.Generations(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestReplica_Snapshot(t *testing.T) {
+	// Ensure uploaded snapshot & WAL bytes are counted after compression.
+	t.Run("PutBytes", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (?)`, strings.Repeat("x", 1000)); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		s.mu.Lock()
+		for _, key := range s.keys() {
+			n += len(s.blobs[key].data)
+		}
+		s.mu.Unlock()
+
+		if got, want := MustGatherOperationBytes(t, db.Path(), "PUT"), float64(n); got != want {
+			t.Fatalf("operation_bytes=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_SnapshotReader(t *testing.T) {
+	// Ensure a missing snapshot returns a "not exist" error.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		r := abs.NewReplica(nil, "")
+		r.AccountName, r.AccountKey = AccountName, AccountKey
+		r.Bucket, r.Path, r.Endpoint = "container", "db", s.URL+"/"+AccountName
+
+		if _, err := r.SnapshotReader(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+}
+
+func TestReplica_Retry(t *testing.T) {
+	// Ensure failed requests are retried.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+
+		s.FailNext(2)
+		MustSyncRows(t, db, sqldb, r, 1)
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure the replica position is kept after a transient failure so the
+	// next sync does not recalculate it from the replica.
+	t.Run("KeepPos", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		requestN := s.RequestN()
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := s.RequestN()-requestN, 1; got != want {
+			t.Fatalf("requests=%d, want %d", got, want) // wal upload only, no listing
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure requests are rejected without contacting Azure while the circuit
+	// breaker is open & that a successful trial closes it.
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		now := time.Now()
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		r.CircuitBreaker = &litestream.CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Now: func() time.Time { return now }}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if !r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected open circuit")
+		}
+
+		requestN := s.RequestN()
+		if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrCircuitOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := s.RequestN(); got != requestN {
+			t.Fatalf("unexpected requests while circuit open: n=%d", got-requestN)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		now = now.Add(time.Hour)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected closed circuit")
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+}
+
+// MustSyncRows inserts n rows into the "foo" table, syncing the database &
+// replica after each one. Returns the current generation.
+func MustSyncRows(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *abs.Replica, n int) string {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE IF NOT EXISTS foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pos.Generation
+}
+
+// MustRestoreRowCount restores the generation from r & verifies the number of
+// rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r *abs.Replica, generation string, n int) {
+	tb.Helper()
+
+	outputPath := filepath.Join(tb.TempDir(), "db")
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath, opt.Generation = outputPath, generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	other := testingutil.MustOpenSQLDB(tb, outputPath)
+	defer testingutil.MustCloseSQLDB(tb, other)
+
+	var count int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+		tb.Fatal(err)
+	} else if got, want := count, n; got != want {
+		tb.Fatalf("n=%d, want %d", got, want)
+	}
+}
+
+// MustGatherOperationBytes returns the ABS operation bytes metric for a
+// database & operation type.
+func MustGatherOperationBytes(tb testing.TB, dbPath, typ string) (v float64) {
+	tb.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "litestream_abs_operation_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["db"] == dbPath && labels["type"] == typ {
+				v += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return v
+}
+
+// Server is a minimal, in-memory implementation of the Azure Blob Storage API.
+type Server struct {
+	*httptest.Server
+
+	// If set, requests must include the token's signature instead of a shared key.
+	SASToken string
+
+	mu       sync.Mutex
+	blobs    map[string]*blob             // keyed by "container/name"
+	blocks   map[string]map[string][]byte // staged blocks by blob key & block ID
+	requestN int                          // number of requests received
+	failN    int                          // number of subsequent requests to fail
+	failing  bool                         // if true, all requests fail
+}
+
+type blob struct {
+	name      string
+	data      []byte
+	createdAt time.Time
+}
+
+// MustOpenServer returns a new, running emulator on a random local port.
+func MustOpenServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := &Server{
+		blobs:  make(map[string]*blob),
+		blocks: make(map[string]map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewReplica returns a new replica connected to the server using shared key auth.
+func (s *Server) NewReplica(tb testing.TB, db *litestream.DB) *abs.Replica {
+	r := abs.NewReplica(db, "")
+	r.AccountName, r.AccountKey = AccountName, AccountKey
+	r.Bucket, r.Path, r.Endpoint = "container", "db", s.URL+"/"+AccountName
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+	return r
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requestN++
+	fail := s.failing || s.failN > 0
+	if s.failN > 0 {
+		s.failN--
+	}
+	s.mu.Unlock()
+
+	// Throttle failed requests as the Azure pipeline retries 5xx responses
+	// itself with a backoff of several seconds.
+	if fail {
+		writeError(w, http.StatusTooManyRequests, "TooManyRequests")
+		return
+	}
+
+	if !s.authorized(r) {
+		writeError(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	// Paths are in the form of "/account/container[/blob]".
+	a := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(a) < 2 || a[0] != AccountName {
+		writeError(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+	container := a[1]
+
+	q := r.URL.Query()
+	switch {
+	case r.Method == "GET" && len(a) == 2 && q.Get("comp") == "list":
+		s.handleList(w, r, container)
+	case r.Method == "PUT" && len(a) == 3 && q.Get("comp") == "block":
+		s.handleStageBlock(w, r, container+"/"+a[2])
+	case r.Method == "PUT" && len(a) == 3 && q.Get("comp") == "blocklist":
+		s.handleCommitBlockList(w, r, container+"/"+a[2])
+	case r.Method == "PUT" && len(a) == 3:
+		s.handlePut(w, r, container+"/"+a[2])
+	case r.Method == "GET" && len(a) == 3:
+		s.handleGet(w, r, container+"/"+a[2])
+	case r.Method == "DELETE" && len(a) == 3:
+		s.handleDelete(w, r, container+"/"+a[2])
+	default:
+		writeError(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// authorized returns true if the request has a shared key signature or SAS token.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.SASToken != "" {
+		return r.URL.Query().Get("sig") != ""
+	}
+	return strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+AccountName+":")
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request, container string) {
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+
+	type blobPrefix struct {
+		Name string `xml:"Name"`
+	}
+	type blobProperties struct {
+		CreationTime  string `xml:"Creation-Time"`
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int    `xml:"Content-Length"`
+	}
+	type blobItem struct {
+		Name       string         `xml:"Name"`
+		Properties blobProperties `xml:"Properties"`
+	}
+	var result struct {
+		XMLName    xml.Name     `xml:"EnumerationResults"`
+		Prefix     string       `xml:"Prefix"`
+		Blobs      []blobItem   `xml:"Blobs>Blob"`
+		Prefixes   []blobPrefix `xml:"Blobs>BlobPrefix"`
+		NextMarker string       `xml:"NextMarker"`
+	}
+	result.Prefix = prefix
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, key := range s.keys() {
+		b := s.blobs[key]
+		if !strings.HasPrefix(key, container+"/") || !strings.HasPrefix(b.name, prefix) {
+			continue
+		}
+
+		// Collapse blobs below the delimiter into a single prefix.
+		if delimiter != "" {
+			if i := strings.Index(b.name[len(prefix):], delimiter); i >= 0 {
+				if p := b.name[:len(prefix)+i+len(delimiter)]; !seen[p] {
+					seen[p] = true
+					result.Prefixes = append(result.Prefixes, blobPrefix{Name: p})
+				}
+				continue
+			}
+		}
+
+		result.Blobs = append(result.Blobs, blobItem{
+			Name: b.name,
+			Properties: blobProperties{
+				CreationTime:  b.createdAt.UTC().Format(http.TimeFormat),
+				LastModified:  b.createdAt.UTC().Format(http.TimeFormat),
+				ContentLength: len(b.data),
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) handleStageBlock(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blocks[key] == nil {
+		s.blocks[key] = make(map[string][]byte)
+	}
+	s.blocks[key][r.URL.Query().Get("blockid")] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleCommitBlockList(w http.ResponseWriter, r *http.Request, key string) {
+	var list struct {
+		Latest []string `xml:"Latest"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidXmlDocument")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []byte
+	for _, id := range list.Latest {
+		block, ok := s.blocks[key][id]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "InvalidBlockList")
+			return
+		} else if _, err := base64.StdEncoding.DecodeString(id); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidBlockId")
+			return
+		}
+		data = append(data, block...)
+	}
+	delete(s.blocks, key)
+
+	s.putBlob(key, data)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putBlob(key, data)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	b := s.blobs[key]
+	s.mu.Unlock()
+
+	if b == nil {
+		writeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b.data)))
+	_, _ = w.Write(b.data)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[key]; !ok {
+		writeError(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	delete(s.blobs, key)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SetFailing sets whether all subsequent requests fail with a 429 error.
+func (s *Server) SetFailing(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = v
+}
+
+// FailNext fails the next n requests with a 429 error.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failN = n
+}
+
+// RequestN returns the number of requests received.
+func (s *Server) RequestN() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestN
+}
+
+// putBlob writes data to a blob. Must be called under lock.
+func (s *Server) putBlob(key string, data []byte) {
+	s.blobs[key] = &blob{
+		name:      key[strings.Index(key, "/")+1:],
+		data:      data,
+		createdAt: time.Now(),
+	}
+}
+
+// keys returns a sorted list of blob keys. Must be called under lock.
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.blobs))
+	for key := range s.blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><Error><Code>` + code + `</Code><Message>` + code + `</Message></Error>`))
+}
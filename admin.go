@@ -0,0 +1,256 @@
+package litestream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminHandler serves a JSON API for inspecting replication status and
+// triggering maintenance operations on databases & replicas.
+//
+//	GET  /dbs                                    list databases & replicas
+//	POST /dbs/checkpoint?db=PATH[&mode=MODE]     checkpoint a database
+//	POST /dbs/snapshot?db=PATH[&replica=NAME]    snapshot replicas
+//	POST /dbs/retention?db=PATH[&replica=NAME]   enforce replica retention
+//	POST /dbs/validate?db=PATH[&replica=NAME]    validate replicas
+//
+// Replica operations apply to all replicas of the database if no replica
+// name is specified. Successful operations return the database's status.
+//
+// Replica status is reported from the state tracked by each replica so
+// listing databases does not read from replica storage.
+type AdminHandler struct {
+	mu  sync.RWMutex
+	dbs []*DB
+
+	// If true, the POST endpoints which modify databases & replicas are
+	// enabled. Otherwise they return 403 Forbidden. Disabled by default as
+	// the API does not authenticate requests.
+	Writable bool
+}
+
+// NewAdminHandler returns a new instance of AdminHandler for dbs.
+func NewAdminHandler(dbs []*DB) *AdminHandler {
+	return &AdminHandler{dbs: dbs}
+}
+
+// SetDBs replaces the list of databases served by the handler.
+func (h *AdminHandler) SetDBs(dbs []*DB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dbs = dbs
+}
+
+// DBs returns the list of databases served by the handler.
+func (h *AdminHandler) DBs() []*DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dbs
+}
+
+// ServeHTTP routes requests to the appropriate handler.
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/dbs":
+		h.handleDBs(w, r)
+	case "/dbs/checkpoint":
+		h.handleCheckpoint(w, r)
+	case "/dbs/snapshot":
+		h.handleReplicaOp(w, r, "snapshot", func(ctx context.Context, r Replica) error {
+			m, ok := r.(ReplicaMaintainer)
+			if !ok {
+				return fmt.Errorf("not supported by %s replica", r.Type())
+			}
+			return m.Snapshot(ctx)
+		})
+	case "/dbs/retention":
+		h.handleReplicaOp(w, r, "retention", func(ctx context.Context, r Replica) error {
+			m, ok := r.(ReplicaMaintainer)
+			if !ok {
+				return fmt.Errorf("not supported by %s replica", r.Type())
+			}
+			return m.EnforceRetention(ctx)
+		})
+	case "/dbs/validate":
+		h.handleReplicaOp(w, r, "validate", ValidateReplica)
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+func (h *AdminHandler) handleDBs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	dbs := h.DBs()
+	a := make([]*adminDBStatus, len(dbs))
+	for i, db := range dbs {
+		a[i] = newAdminDBStatus(db)
+	}
+	writeAdminJSON(w, http.StatusOK, a)
+}
+
+func (h *AdminHandler) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	db, ok := h.lookupDB(w, r)
+	if !ok {
+		return
+	}
+
+	mode := strings.ToUpper(r.URL.Query().Get("mode"))
+	switch mode {
+	case "":
+		mode = CheckpointModePassive
+	case CheckpointModePassive, CheckpointModeFull, CheckpointModeRestart, CheckpointModeTruncate:
+	default:
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid checkpoint mode: %q", mode))
+		return
+	}
+
+	log.Printf("%s: admin: checkpoint mode=%s", db.Path(), mode)
+	if err := db.Checkpoint(mode); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("checkpoint: %w", err))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, newAdminDBStatus(db))
+}
+
+// handleReplicaOp executes fn against the named replica or, if no name is
+// specified, against each of the database's replicas.
+func (h *AdminHandler) handleReplicaOp(w http.ResponseWriter, r *http.Request, op string, fn func(context.Context, Replica) error) {
+	db, ok := h.lookupDB(w, r)
+	if !ok {
+		return
+	}
+
+	replicas := db.ReplicasSnapshot()
+	if name := r.URL.Query().Get("replica"); name != "" {
+		replica := db.Replica(name)
+		if replica == nil {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("replica not found: %q", name))
+			return
+		}
+		replicas = []Replica{replica}
+	}
+
+	for _, replica := range replicas {
+		log.Printf("%s(%s): admin: %s", db.Path(), replica.Name(), op)
+		if err := fn(r.Context(), replica); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("%s %s: %w", op, replica.Name(), err))
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, newAdminDBStatus(db))
+}
+
+// lookupDB returns the database specified by the "db" query parameter.
+// Writes an error response & returns false if the request is invalid or if
+// the handler is not writable.
+func (h *AdminHandler) lookupDB(w http.ResponseWriter, r *http.Request) (*DB, bool) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return nil, false
+	} else if !h.Writable {
+		writeAdminError(w, http.StatusForbidden, fmt.Errorf("admin api is read-only"))
+		return nil, false
+	}
+
+	path := r.URL.Query().Get("db")
+	if path == "" {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("db required"))
+		return nil, false
+	}
+
+	for _, db := range h.DBs() {
+		if db.Path() == path {
+			return db, true
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, fmt.Errorf("database not found: %q", path))
+	return nil, false
+}
+
+// adminDBStatus is the JSON representation of a database's status.
+type adminDBStatus struct {
+	Path     string                `json:"path"`
+	Pos      *adminPos             `json:"pos,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Replicas []*adminReplicaStatus `json:"replicas"`
+}
+
+func newAdminDBStatus(db *DB) *adminDBStatus {
+	replicas := db.ReplicasSnapshot()
+	status := &adminDBStatus{
+		Path:     db.Path(),
+		Replicas: make([]*adminReplicaStatus, len(replicas)),
+	}
+
+	if pos, err := db.Pos(); err != nil {
+		status.Error = err.Error()
+	} else if !pos.IsZero() {
+		status.Pos = newAdminPos(pos)
+	}
+
+	for i, r := range replicas {
+		status.Replicas[i] = newAdminReplicaStatus(r)
+	}
+	return status
+}
+
+// adminReplicaStatus is the JSON representation of a replica's status.
+type adminReplicaStatus struct {
+	Name           string     `json:"name"`
+	Type           string     `json:"type"`
+	LastPos        *adminPos  `json:"last_pos,omitempty"`
+	LastSyncError  string     `json:"last_sync_error,omitempty"`
+	LastSnapshotAt *time.Time `json:"last_snapshot_at,omitempty"`
+}
+
+func newAdminReplicaStatus(r Replica) *adminReplicaStatus {
+	status := &adminReplicaStatus{Name: r.Name(), Type: r.Type()}
+	if pos := r.LastPos(); !pos.IsZero() {
+		status.LastPos = newAdminPos(pos)
+	}
+
+	if r, ok := r.(ReplicaStatusReporter); ok {
+		if err := r.LastSyncError(); err != nil {
+			status.LastSyncError = err.Error()
+		}
+		if t := r.LastSnapshotAt(); !t.IsZero() {
+			status.LastSnapshotAt = &t
+		}
+	}
+	return status
+}
+
+// adminPos is the JSON representation of a Pos.
+type adminPos struct {
+	Generation string `json:"generation"`
+	Index      int    `json:"index"`
+	Offset     int64  `json:"offset"`
+}
+
+func newAdminPos(pos Pos) *adminPos {
+	return &adminPos{Generation: pos.Generation, Index: pos.Index, Offset: pos.Offset}
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("http: cannot write response: %s", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,232 @@
+package litestream_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestAdminHandler(t *testing.T) {
+	// Ensure databases & replicas are listed with their status.
+	t.Run("DBs", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewAdminHandler([]*litestream.DB{db})
+		var dbs []adminDBStatus
+		MustServeJSON(t, h, "GET", "/dbs", http.StatusOK, &dbs)
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := len(dbs), 1; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		} else if got, want := dbs[0].Path, db.Path(); got != want {
+			t.Fatalf("Path=%q, want %q", got, want)
+		} else if got, want := dbs[0].Pos, newAdminPos(pos); got != want {
+			t.Fatalf("Pos=%#v, want %#v", got, want)
+		} else if got, want := len(dbs[0].Replicas), 1; got != want {
+			t.Fatalf("len(Replicas)=%d, want %d", got, want)
+		}
+
+		status := dbs[0].Replicas[0]
+		if got, want := status.Name, "file"; got != want {
+			t.Fatalf("Name=%q, want %q", got, want)
+		} else if got, want := status.LastPos, newAdminPos(pos); got != want {
+			t.Fatalf("LastPos=%#v, want %#v", got, want)
+		} else if status.LastSyncError != "" {
+			t.Fatalf("unexpected sync error: %s", status.LastSyncError)
+		} else if status.LastSnapshotAt == "" {
+			t.Fatal("expected last snapshot time")
+		}
+
+		// Ensure status is reported from the replica's state instead of
+		// reading from the replica's storage.
+		if err := os.RemoveAll(r.Path()); err != nil {
+			t.Fatal(err)
+		}
+		MustServeJSON(t, h, "GET", "/dbs", http.StatusOK, &dbs)
+		if got, want := dbs[0].Replicas[0].LastSnapshotAt, status.LastSnapshotAt; got != want {
+			t.Fatalf("LastSnapshotAt=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure the last sync error is reported.
+	t.Run("LastSyncError", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Replica cannot sync before the database has a generation.
+		if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+
+		var dbs []adminDBStatus
+		MustServeJSON(t, litestream.NewAdminHandler([]*litestream.DB{db}), "GET", "/dbs", http.StatusOK, &dbs)
+		if got, want := dbs[0].Replicas[0].LastSyncError, "no generation, waiting for data"; got != want {
+			t.Fatalf("LastSyncError=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure a checkpoint can be triggered.
+	t.Run("Checkpoint", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewAdminHandler([]*litestream.DB{db})
+		h.Writable = true
+		MustServeJSON(t, h, "POST", "/dbs/checkpoint?mode=truncate&db="+url.QueryEscape(db.Path()), http.StatusOK, nil)
+
+		// Ensure WAL has been truncated.
+		if fi, err := os.Stat(db.WALPath()); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() != 0 {
+			t.Fatalf("unexpected WAL size: %d", fi.Size())
+		}
+
+		MustServeJSON(t, h, "POST", "/dbs/checkpoint?mode=bad&db="+url.QueryEscape(db.Path()), http.StatusBadRequest, nil)
+	})
+
+	// Ensure a snapshot can be triggered for a named replica.
+	t.Run("Snapshot", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewAdminHandler([]*litestream.DB{db})
+		h.Writable = true
+		var status adminDBStatus
+		MustServeJSON(t, h, "POST", "/dbs/snapshot?replica=file&db="+url.QueryEscape(db.Path()), http.StatusOK, &status)
+		if status.Replicas[0].LastSnapshotAt == "" {
+			t.Fatal("expected last snapshot time")
+		}
+
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+
+		// Retention should not remove the only snapshot.
+		MustServeJSON(t, h, "POST", "/dbs/retention?db="+url.QueryEscape(db.Path()), http.StatusOK, nil)
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure operations which modify databases or replicas are rejected unless
+	// the handler is writable.
+	t.Run("ReadOnly", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewAdminHandler([]*litestream.DB{db})
+		MustServeJSON(t, h, "GET", "/dbs", http.StatusOK, nil)
+		for _, op := range []string{"checkpoint", "snapshot", "retention", "validate"} {
+			MustServeJSON(t, h, "POST", "/dbs/"+op+"?db="+url.QueryEscape(db.Path()), http.StatusForbidden, nil)
+		}
+
+		if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(snapshots) != 0 {
+			t.Fatalf("unexpected snapshots: %d", len(snapshots))
+		}
+	})
+
+	// Ensure invalid requests return errors.
+	t.Run("Errors", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		NewTestFileReplica(t, db)
+
+		h := litestream.NewAdminHandler([]*litestream.DB{db})
+		h.Writable = true
+		MustServeJSON(t, h, "POST", "/dbs", http.StatusMethodNotAllowed, nil)
+		MustServeJSON(t, h, "GET", "/dbs/snapshot?db="+url.QueryEscape(db.Path()), http.StatusMethodNotAllowed, nil)
+		MustServeJSON(t, h, "POST", "/dbs/snapshot", http.StatusBadRequest, nil)
+		MustServeJSON(t, h, "POST", "/dbs/snapshot?db=/no/such/db", http.StatusNotFound, nil)
+		MustServeJSON(t, h, "POST", "/dbs/snapshot?replica=x&db="+url.QueryEscape(db.Path()), http.StatusNotFound, nil)
+		MustServeJSON(t, h, "POST", "/dbs/snapshot?db="+url.QueryEscape(db.Path()), http.StatusInternalServerError, nil)
+		MustServeJSON(t, h, "GET", "/foo", http.StatusNotFound, nil)
+	})
+}
+
+type adminDBStatus struct {
+	Path     string               `json:"path"`
+	Pos      adminPos             `json:"pos"`
+	Replicas []adminReplicaStatus `json:"replicas"`
+}
+
+type adminReplicaStatus struct {
+	Name           string   `json:"name"`
+	LastPos        adminPos `json:"last_pos"`
+	LastSyncError  string   `json:"last_sync_error"`
+	LastSnapshotAt string   `json:"last_snapshot_at"`
+}
+
+type adminPos struct {
+	Generation string `json:"generation"`
+	Index      int    `json:"index"`
+	Offset     int64  `json:"offset"`
+}
+
+func newAdminPos(pos litestream.Pos) adminPos {
+	return adminPos{Generation: pos.Generation, Index: pos.Index, Offset: pos.Offset}
+}
+
+// MustServeJSON executes a request against h, verifies the status code,
+// and decodes the response body into v, if not nil.
+func MustServeJSON(tb testing.TB, h http.Handler, method, target string, code int, v interface{}) {
+	tb.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if got, want := w.Code, code; got != want {
+		tb.Fatalf("%s %s: code=%d, want %d: %s", method, target, got, want, w.Body.String())
+	} else if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+		tb.Fatalf("Content-Type=%q, want %q", got, want)
+	}
+
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
@@ -16,8 +16,9 @@ type DatabasesCommand struct{}
 // Run executes the command.
 func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
+	var noExpandEnv bool
 	fs := flag.NewFlagSet("litestream-databases", flag.ContinueOnError)
-	registerConfigFlag(fs, &configPath)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -29,7 +30,7 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 	if configPath == "" {
 		return errors.New("-config required")
 	}
-	config, err := ReadConfigFile(configPath)
+	config, err := ReadConfigFile(configPath, !noExpandEnv)
 	if err != nil {
 		return err
 	}
@@ -38,8 +39,14 @@ func (c *DatabasesCommand) Run(ctx context.Context, args []string) (err error) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
 	defer w.Flush()
 
+	// Expand directories & glob patterns to the databases they match.
+	dbConfigs, err := config.ExpandDBs()
+	if err != nil {
+		return err
+	}
+
 	fmt.Fprintln(w, "path\treplicas")
-	for _, dbConfig := range config.DBs {
+	for _, dbConfig := range dbConfigs {
 		db, err := newDBFromConfig(&config, dbConfig)
 		if err != nil {
 			return err
@@ -74,6 +81,9 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
 `[1:],
 		DefaultConfigPath(),
 	)
@@ -0,0 +1,15 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setExecProcAttr starts cmd in a new process group so that signals from the
+// terminal, such as Ctrl-C, are not delivered to it in addition to the
+// signals forwarded by the program.
+func setExecProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,11 @@
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setExecProcAttr is a no-op on Windows as Ctrl-C cannot be forwarded to the
+// subcommand if it is started in a new process group.
+func setExecProcAttr(cmd *exec.Cmd) {}
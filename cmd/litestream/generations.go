@@ -19,8 +19,9 @@ type GenerationsCommand struct{}
 // Run executes the command.
 func (c *GenerationsCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
+	var noExpandEnv bool
 	fs := flag.NewFlagSet("litestream-generations", flag.ContinueOnError)
-	registerConfigFlag(fs, &configPath)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
 	replicaName := fs.String("replica", "", "replica name")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
@@ -40,7 +41,7 @@ func (c *GenerationsCommand) Run(ctx context.Context, args []string) (err error)
 		}
 	} else if configPath != "" {
 		// Load configuration.
-		config, err := ReadConfigFile(configPath)
+		config, err := ReadConfigFile(configPath, !noExpandEnv)
 		if err != nil {
 			return err
 		}
@@ -128,6 +129,9 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
 	-replica NAME
 	    Optional, filters by replica.
 
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
@@ -11,11 +13,16 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/abs"
+	"github.com/benbjohnson/litestream/gcs"
 	"github.com/benbjohnson/litestream/s3"
+	"github.com/benbjohnson/litestream/sftp"
 	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/yaml.v2"
 )
@@ -31,12 +38,31 @@ func main() {
 	m := NewMain()
 	if err := m.Run(context.Background(), os.Args[1:]); err == flag.ErrHelp {
 		os.Exit(1)
+	} else if e, ok := err.(*ExitError); ok {
+		if e.Err != nil {
+			fmt.Fprintln(os.Stderr, e.Err)
+		}
+		os.Exit(e.Code)
 	} else if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// ExitError is returned by a command to exit with a specific status code.
+type ExitError struct {
+	Code int
+	Err  error // optional, printed before exiting
+}
+
+// Error returns the underlying error message, if any.
+func (e *ExitError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 // Main represents the main program execution.
 type Main struct{}
 
@@ -57,6 +83,8 @@ func (m *Main) Run(ctx context.Context, args []string) (err error) {
 		return (&DatabasesCommand{}).Run(ctx, args)
 	case "generations":
 		return (&GenerationsCommand{}).Run(ctx, args)
+	case "rebuild-manifest":
+		return (&RebuildManifestCommand{}).Run(ctx, args)
 	case "replicate":
 		return (&ReplicateCommand{}).Run(ctx, args)
 	case "restore":
@@ -87,48 +115,120 @@ Usage:
 
 The commands are:
 
-	databases    list databases specified in config file
-	generations  list available generations for a database
-	replicate    runs a server to replicate databases
-	restore      recovers database backup from a replica
-	snapshots    list available snapshots for a database
-	version      prints the binary version
-	wal          list available WAL files for a database
+	databases         list databases specified in config file
+	generations       list available generations for a database
+	rebuild-manifest  rebuilds S3 replica manifests from a listing
+	replicate         runs a server to replicate databases
+	restore           recovers database backup from a replica
+	snapshots         list available snapshots for a database
+	version           prints the binary version
+	wal               list available WAL files for a database
 `[1:])
 }
 
 // Config represents a configuration file for the litestream daemon.
 type Config struct {
-	// Bind address for serving metrics.
+	// Bind address for serving metrics, admin API & health checks.
 	Addr string `yaml:"addr"`
 
+	// If true, admin API endpoints which checkpoint, snapshot, enforce
+	// retention or validate are enabled. Otherwise the admin API is read-only.
+	AdminAPI bool `yaml:"admin-api"`
+
+	// Health check thresholds. Readiness fails if a replica lags behind its
+	// database by more than MaxLag or MaxLagBytes or if MaxSyncErrors
+	// consecutive database syncs fail. Liveness fails if a database monitor
+	// has not ticked, or a replica sync has not finished, within MonitorTimeout.
+	MaxLag         time.Duration `yaml:"max-lag"`
+	MaxLagBytes    int64         `yaml:"max-lag-bytes"`
+	MaxSyncErrors  int           `yaml:"max-sync-errors"`
+	MonitorTimeout time.Duration `yaml:"monitor-timeout"`
+
+	// Frequency at which database paths specified as a directory or glob
+	// pattern are checked for added or removed databases.
+	WatchInterval time.Duration `yaml:"watch-interval"`
+
+	// Global checkpoint & monitor settings. Used by databases that do not
+	// specify their own settings.
+	MinCheckpointPageN *int           `yaml:"min-checkpoint-page-count"`
+	MaxCheckpointPageN *int           `yaml:"max-checkpoint-page-count"`
+	CheckpointInterval *time.Duration `yaml:"checkpoint-interval"`
+	MonitorInterval    *time.Duration `yaml:"monitor-interval"`
+
 	// List of databases to manage.
 	DBs []*DBConfig `yaml:"dbs"`
 
 	// Global S3 settings
-	AccessKeyID     string `yaml:"access-key-id"`
-	SecretAccessKey string `yaml:"secret-access-key"`
-	Region          string `yaml:"region"`
-	Bucket          string `yaml:"bucket"`
+	AccessKeyID         string `yaml:"access-key-id"`
+	AccessKeyIDFile     string `yaml:"access-key-id-file"`
+	SecretAccessKey     string `yaml:"secret-access-key"`
+	SecretAccessKeyFile string `yaml:"secret-access-key-file"`
+	Region              string `yaml:"region"`
+	Bucket              string `yaml:"bucket"`
 }
 
 // DefaultConfig returns a new instance of Config with defaults set.
 func DefaultConfig() Config {
-	return Config{}
+	return Config{
+		MonitorTimeout: litestream.DefaultMonitorTimeout,
+		WatchInterval:  DefaultWatchInterval,
+	}
 }
 
-// DBConfig returns database configuration by path.
+// DBConfig returns database configuration by path. If the path is matched by
+// a directory or glob pattern then the configuration is expanded for it.
 func (c *Config) DBConfig(path string) *DBConfig {
 	for _, dbConfig := range c.DBs {
 		if dbConfig.Path == path {
 			return dbConfig
 		}
 	}
+	for _, dbConfig := range c.DBs {
+		if dbConfig.IsPattern() && dbConfig.Match(path) {
+			return dbConfig.ForPath(path)
+		}
+	}
 	return nil
 }
 
+// ExpandDBs returns the configuration for every database. Directories & glob
+// patterns are expanded to the databases that currently match them. Explicitly
+// specified databases take precedence over pattern matches.
+func (c *Config) ExpandDBs() ([]*DBConfig, error) {
+	var a, matches []*DBConfig
+	m := make(map[string]struct{})
+	for _, dbConfig := range c.DBs {
+		if !dbConfig.IsPattern() {
+			a = append(a, dbConfig)
+			m[dbConfig.Path] = struct{}{}
+			continue
+		}
+
+		dbConfigs, err := dbConfig.Expand()
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, dbConfigs...)
+	}
+
+	for _, dbConfig := range matches {
+		if _, ok := m[dbConfig.Path]; ok {
+			continue
+		}
+		m[dbConfig.Path] = struct{}{}
+		a = append(a, dbConfig)
+	}
+	return a, nil
+}
+
 // ReadConfigFile unmarshals config from filename. Expands path if needed.
-func ReadConfigFile(filename string) (_ Config, err error) {
+// References to environment variables (e.g. "${VAR}") are replaced by their
+// values before unmarshaling, if expandEnv is true.
+//
+// Expansion is textual so a value containing a newline or YAML syntax such as
+// ": " changes the structure of the document. Use a "-file" setting for values
+// which may contain these characters.
+func ReadConfigFile(filename string, expandEnv bool) (_ Config, err error) {
 	config := DefaultConfig()
 
 	// Expand filename, if necessary.
@@ -137,14 +237,35 @@ func ReadConfigFile(filename string) (_ Config, err error) {
 		return config, err
 	}
 
-	// Read & deserialize configuration.
-	if buf, err := ioutil.ReadFile(filename); os.IsNotExist(err) {
+	// Read configuration & expand environment variables, if specified.
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
 		return config, fmt.Errorf("config file not found: %s", filename)
 	} else if err != nil {
 		return config, err
-	} else if err := yaml.Unmarshal(buf, &config); err != nil {
+	}
+	if expandEnv {
+		buf = expandEnvBytes(buf)
+	}
+
+	// Deserialize configuration.
+	if err := yaml.Unmarshal(buf, &config); err != nil {
+		return config, err
+	}
+
+	// Read credentials from secret files.
+	if err := readSecretFile(&config.AccessKeyID, config.AccessKeyIDFile, "access-key-id"); err != nil {
+		return config, err
+	} else if err := readSecretFile(&config.SecretAccessKey, config.SecretAccessKeyFile, "secret-access-key"); err != nil {
 		return config, err
 	}
+	for _, dbConfig := range config.DBs {
+		for _, rc := range dbConfig.Replicas {
+			if err := rc.readSecretFiles(); err != nil {
+				return config, fmt.Errorf("%s: %w", dbConfig.Path, err)
+			}
+		}
+	}
 
 	// Normalize paths.
 	for _, dbConfig := range config.DBs {
@@ -153,31 +274,450 @@ func ReadConfigFile(filename string) (_ Config, err error) {
 		}
 	}
 
+	for _, dbConfig := range config.DBs {
+		if err := dbConfig.Validate(); err != nil {
+			return config, err
+		} else if err := config.dbSettings(dbConfig).Validate(); err != nil {
+			return config, fmt.Errorf("%s: %w", dbConfig.Path, err)
+		}
+	}
+
 	return config, nil
 }
 
+// dbSettings returns the checkpoint & monitor settings for a database. Unset
+// settings fall back to the global settings & then to the defaults.
+func (c *Config) dbSettings(dbc *DBConfig) dbSettings {
+	s := dbSettings{
+		MinCheckpointPageN: litestream.DefaultMinCheckpointPageN,
+		MaxCheckpointPageN: litestream.DefaultMaxCheckpointPageN,
+		CheckpointInterval: litestream.DefaultCheckpointInterval,
+		MonitorInterval:    litestream.DefaultMonitorInterval,
+	}
+
+	for _, v := range []*int{c.MinCheckpointPageN, dbc.MinCheckpointPageN} {
+		if v != nil {
+			s.MinCheckpointPageN = *v
+		}
+	}
+	for _, v := range []*int{c.MaxCheckpointPageN, dbc.MaxCheckpointPageN} {
+		if v != nil {
+			s.MaxCheckpointPageN = *v
+		}
+	}
+	for _, v := range []*time.Duration{c.CheckpointInterval, dbc.CheckpointInterval} {
+		if v != nil {
+			s.CheckpointInterval = *v
+		}
+	}
+	for _, v := range []*time.Duration{c.MonitorInterval, dbc.MonitorInterval} {
+		if v != nil {
+			s.MonitorInterval = *v
+		}
+	}
+	return s
+}
+
+// dbSettings represents the checkpoint & monitor settings for a database.
+type dbSettings struct {
+	MinCheckpointPageN int
+	MaxCheckpointPageN int
+	CheckpointInterval time.Duration
+	MonitorInterval    time.Duration
+}
+
+// Validate returns an error if the settings are out of range. A zero maximum
+// page count or checkpoint interval disables forced or timed checkpoints.
+func (s dbSettings) Validate() error {
+	if s.MinCheckpointPageN <= 0 {
+		return fmt.Errorf("min-checkpoint-page-count must be greater than zero")
+	} else if s.MaxCheckpointPageN < 0 {
+		return fmt.Errorf("max-checkpoint-page-count cannot be negative")
+	} else if s.MaxCheckpointPageN > 0 && s.MaxCheckpointPageN < s.MinCheckpointPageN {
+		return fmt.Errorf("max-checkpoint-page-count must be greater than or equal to min-checkpoint-page-count")
+	} else if s.CheckpointInterval < 0 {
+		return fmt.Errorf("checkpoint-interval cannot be negative")
+	} else if s.MonitorInterval <= 0 {
+		return fmt.Errorf("monitor-interval must be greater than zero")
+	}
+	return nil
+}
+
+// envVarRegex matches environment variable references, e.g. "${VAR}".
+var envVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvBytes replaces "${VAR}" references in buf with the value of the
+// environment variable. Unset variables are replaced with a blank string.
+// Unlike os.ExpandEnv(), a "$" without braces is left as-is.
+func expandEnvBytes(buf []byte) []byte {
+	return envVarRegex.ReplaceAllFunc(buf, func(m []byte) []byte {
+		return []byte(os.Getenv(string(envVarRegex.FindSubmatch(m)[1])))
+	})
+}
+
+// readSecretFile sets *p to the contents of filename, if specified. Trailing
+// whitespace such as a final newline is removed. Returns an error if the value
+// is also set directly in the config.
+func readSecretFile(p *string, filename, name string) error {
+	if filename == "" {
+		return nil
+	} else if *p != "" {
+		return fmt.Errorf("cannot specify both %s and %s-file", name, name)
+	}
+
+	filename, err := expand(filename)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read %s-file: %w", name, err)
+	}
+	*p = strings.TrimRight(string(buf), " \t\r\n")
+	return nil
+}
+
+// DefaultWatchInterval is the default frequency at which directories & glob
+// patterns are checked for added or removed databases.
+const DefaultWatchInterval = 1 * time.Second
+
+// DBNamePlaceholder is replaced in replica paths & URLs by the name of each
+// database matched by a directory or glob pattern.
+const DBNamePlaceholder = "{{name}}"
+
 // DBConfig represents the configuration for a single database.
+//
+// The path may also be a directory or a glob pattern (e.g. "/data/*.db") to
+// replicate every SQLite database within it. Each replica path or URL must
+// then contain "{{name}}" which is replaced by the file name of each database
+// without its extension.
 type DBConfig struct {
 	Path     string           `yaml:"path"`
 	Replicas []*ReplicaConfig `yaml:"replicas"`
+
+	// Checkpoint & monitor settings. Defaults to the global settings.
+	MinCheckpointPageN *int           `yaml:"min-checkpoint-page-count"`
+	MaxCheckpointPageN *int           `yaml:"max-checkpoint-page-count"`
+	CheckpointInterval *time.Duration `yaml:"checkpoint-interval"`
+	MonitorInterval    *time.Duration `yaml:"monitor-interval"`
+
+	// Paths skipped by Expand() as their name is used by another database.
+	// Used so each collision is only logged once.
+	skipped map[string]struct{}
+}
+
+// Validate returns an error if a pattern's replicas do not each contain the
+// name placeholder. Otherwise, matched databases would overwrite each other.
+func (c *DBConfig) Validate() error {
+	if !c.IsPattern() {
+		return nil
+	}
+	for _, rc := range c.Replicas {
+		if !strings.Contains(rc.Path, DBNamePlaceholder) && !strings.Contains(rc.URL, DBNamePlaceholder) {
+			return fmt.Errorf("replica path for %s must contain %s", c.Path, DBNamePlaceholder)
+		}
+	}
+	return nil
+}
+
+// IsPattern returns true if the path is a glob pattern or a directory.
+func (c *DBConfig) IsPattern() bool {
+	if strings.ContainsAny(c.Path, "*?[") {
+		return true
+	}
+	fi, err := os.Stat(c.Path)
+	return err == nil && fi.IsDir()
+}
+
+// Match returns true if path is a database matched by the pattern.
+func (c *DBConfig) Match(path string) bool {
+	if strings.ContainsAny(c.Path, "*?[") {
+		ok, _ := filepath.Match(c.Path, path)
+		return ok
+	}
+	return filepath.Dir(path) == filepath.Clean(c.Path)
+}
+
+// Expand returns a configuration for each SQLite database currently matched
+// by the pattern. Databases with the same name as an earlier matched database
+// are skipped with a warning as they would overwrite its replicas.
+func (c *DBConfig) Expand() ([]*DBConfig, error) {
+	pattern := c.Path
+	if !strings.ContainsAny(pattern, "*?[") {
+		pattern = filepath.Join(pattern, "*")
+	}
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database pattern %q: %w", c.Path, err)
+	}
+
+	var a []*DBConfig
+	names := make(map[string]string)
+	for _, path := range paths {
+		if ok, err := isSQLiteFile(path); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+
+		// Ensure databases do not overwrite each other's replicas.
+		name := DBName(path)
+		if other, ok := names[name]; ok {
+			if _, ok := c.skipped[path]; !ok {
+				log.Printf("%s: skipping database with same name as %s: %q", path, other, name)
+				if c.skipped == nil {
+					c.skipped = make(map[string]struct{})
+				}
+				c.skipped[path] = struct{}{}
+			}
+			continue
+		}
+		names[name] = path
+
+		a = append(a, c.ForPath(path))
+	}
+	return a, nil
+}
+
+// ForPath returns a copy of the configuration for the database at path. The
+// name placeholder in replica paths & URLs is replaced with the database name.
+func (c *DBConfig) ForPath(path string) *DBConfig {
+	name := DBName(path)
+	other := *c
+	other.Path, other.Replicas, other.skipped = path, nil, nil
+	for _, rc := range c.Replicas {
+		replicaConfig := *rc
+		replicaConfig.Path = strings.Replace(replicaConfig.Path, DBNamePlaceholder, name, -1)
+		replicaConfig.URL = strings.Replace(replicaConfig.URL, DBNamePlaceholder, name, -1)
+		other.Replicas = append(other.Replicas, &replicaConfig)
+	}
+	return &other
+}
+
+// DBName returns the name of the database at path used by replica path
+// templates. This is the file name without its extension.
+func DBName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
 }
 
+// isSQLiteFile returns true if path is a regular file with a SQLite header.
+// Returns false for the WAL & shared memory files alongside a database.
+func isSQLiteFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil // removed since listing
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return false, err
+	} else if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil // empty or newly created
+	} else if err != nil {
+		return false, err
+	}
+	return string(header) == sqliteHeader, nil
+}
+
+// sqliteHeader is the magic string at the start of every SQLite database.
+const sqliteHeader = "SQLite format 3\x00"
+
 // ReplicaConfig represents the configuration for a single replica in a database.
 type ReplicaConfig struct {
-	Type                   string        `yaml:"type"` // "file", "s3"
-	Name                   string        `yaml:"name"` // name of replica, optional.
-	Path                   string        `yaml:"path"`
-	URL                    string        `yaml:"url"`
-	Retention              time.Duration `yaml:"retention"`
-	RetentionCheckInterval time.Duration `yaml:"retention-check-interval"`
-	SyncInterval           time.Duration `yaml:"sync-interval"` // s3 only
-	ValidationInterval     time.Duration `yaml:"validation-interval"`
+	Type                   string                 `yaml:"type"` // "file", "s3", "gcs", "abs", "sftp"
+	Name                   string                 `yaml:"name"` // name of replica, optional.
+	Path                   string                 `yaml:"path"`
+	URL                    string                 `yaml:"url"`
+	Retention              time.Duration          `yaml:"retention"`
+	RetentionPolicy        []*RetentionTierConfig `yaml:"retention-policy"`
+	RetentionCheckInterval time.Duration          `yaml:"retention-check-interval"`
+	SyncInterval           time.Duration          `yaml:"sync-interval"`     // s3, gcs, abs & sftp only
+	SnapshotInterval       time.Duration          `yaml:"snapshot-interval"` // file & s3 only
+	SnapshotMode           string                 `yaml:"snapshot-mode"`     // file & s3 only
+	ValidationInterval     time.Duration          `yaml:"validation-interval"`
+	Compression            string                 `yaml:"compression"` // "lz4", "zstd", "gzip"
+	CompressionLevel       int                    `yaml:"compression-level"`
+	Retry                  *RetryConfig           `yaml:"retry"`           // s3, gcs, abs & sftp only
+	CircuitBreaker         *CircuitBreakerConfig  `yaml:"circuit-breaker"` // s3, gcs, abs & sftp only
 
 	// S3 settings
-	AccessKeyID     string `yaml:"access-key-id"`
-	SecretAccessKey string `yaml:"secret-access-key"`
-	Region          string `yaml:"region"`
-	Bucket          string `yaml:"bucket"`
+	AccessKeyID         string `yaml:"access-key-id"`
+	AccessKeyIDFile     string `yaml:"access-key-id-file"`
+	SecretAccessKey     string `yaml:"secret-access-key"`
+	SecretAccessKeyFile string `yaml:"secret-access-key-file"`
+	Region              string `yaml:"region"`
+	Bucket              string `yaml:"bucket"`
+	ForcePathStyle      bool   `yaml:"force-path-style"`
+	SkipVerify          bool   `yaml:"skip-verify"`
+	MaxSegmentSize      int64  `yaml:"max-segment-size"`
+	UploadBufferSize    int64  `yaml:"upload-buffer-size"`
+
+	// Time between manifest updates by the S3 replica's background sync.
+	ManifestFlushInterval time.Duration `yaml:"manifest-flush-interval"`
+
+	// S3 assumed role settings
+	RoleARN              string `yaml:"role-arn"`
+	RoleExternalID       string `yaml:"role-external-id"`
+	RoleSessionName      string `yaml:"role-session-name"`
+	WebIdentityTokenFile string `yaml:"web-identity-token-file"`
+	STSEndpoint          string `yaml:"sts-endpoint"`
+
+	// S3 server-side encryption, storage class & tagging settings
+	SSE                  string            `yaml:"sse"` // "AES256", "aws:kms"
+	SSEKMSKeyID          string            `yaml:"sse-kms-key-id"`
+	SSECustomerKey       string            `yaml:"sse-customer-key"` // base64-encoded
+	SSECustomerKeyFile   string            `yaml:"sse-customer-key-file"`
+	SnapshotStorageClass string            `yaml:"snapshot-storage-class"`
+	WALStorageClass      string            `yaml:"wal-storage-class"`
+	Tags                 map[string]string `yaml:"tags"`
+
+	// S3, GCS & ABS settings
+	Endpoint string `yaml:"endpoint"`
+
+	// GCS settings
+	CredentialsPath string `yaml:"credentials-path"`
+
+	// ABS settings
+	AccountName    string `yaml:"account-name"`
+	AccountKey     string `yaml:"account-key"`
+	AccountKeyFile string `yaml:"account-key-file"`
+	SASToken       string `yaml:"sas-token"`
+	SASTokenFile   string `yaml:"sas-token-file"`
+
+	// SFTP settings
+	Host                  string `yaml:"host"`
+	User                  string `yaml:"user"`
+	Password              string `yaml:"password"`
+	PasswordFile          string `yaml:"password-file"`
+	KeyPath               string `yaml:"key-path"`
+	KnownHostsPath        string `yaml:"known-hosts-path"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure-ignore-host-key"`
+
+	// Encryption settings
+	EncryptionKeyPath  string   `yaml:"encryption-key-path"`
+	DecryptionKeyPaths []string `yaml:"decryption-key-paths"` // previous keys, for rotation
+	AllowPlaintext     bool     `yaml:"allow-plaintext"`      // read data written before encryption
+}
+
+// RetentionTierConfig represents the configuration for a single tier of a
+// replica's retention policy. One snapshot is kept per interval for snapshots
+// created within the duration.
+type RetentionTierConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// newRetentionPolicyFromConfig returns the replica's tiered retention policy.
+// Returns nil if no tiers are configured.
+func newRetentionPolicyFromConfig(rc *ReplicaConfig) (litestream.RetentionPolicy, error) {
+	var policy litestream.RetentionPolicy
+	for _, tc := range rc.RetentionPolicy {
+		policy = append(policy, litestream.RetentionTier{Interval: tc.Interval, Duration: tc.Duration})
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// RetryConfig represents the configuration for retrying failed replica
+// operations. Unset fields use the defaults. Not used by file replicas.
+type RetryConfig struct {
+	MaxAttempts *int          `yaml:"max-attempts"`
+	MinBackoff  time.Duration `yaml:"min-backoff"`
+	MaxBackoff  time.Duration `yaml:"max-backoff"`
+	Jitter      *float64      `yaml:"jitter"`
+}
+
+// newRetryPolicyFromConfig returns the replica's retry policy.
+func newRetryPolicyFromConfig(rc *ReplicaConfig) (litestream.RetryPolicy, error) {
+	policy := litestream.NewRetryPolicy()
+	if rc.Retry == nil {
+		return policy, nil
+	}
+
+	if v := rc.Retry.MaxAttempts; v != nil {
+		policy.MaxAttempts = *v
+	}
+	if v := rc.Retry.MinBackoff; v > 0 {
+		policy.MinBackoff = v
+	}
+	if v := rc.Retry.MaxBackoff; v > 0 {
+		policy.MaxBackoff = v
+	}
+	if v := rc.Retry.Jitter; v != nil {
+		if *v < 0 || *v > 1 {
+			return policy, fmt.Errorf("retry jitter must be between 0 and 1")
+		}
+		policy.Jitter = *v
+	}
+
+	if policy.MaxBackoff < policy.MinBackoff {
+		return policy, fmt.Errorf("retry max-backoff must be greater than or equal to min-backoff")
+	}
+	return policy, nil
+}
+
+// CircuitBreakerConfig represents the configuration for a replica's circuit
+// breaker. Unset fields use the defaults. A zero threshold disables it. Not
+// used by file replicas.
+type CircuitBreakerConfig struct {
+	Threshold   *int          `yaml:"threshold"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxCooldown time.Duration `yaml:"max-cooldown"`
+}
+
+// newCircuitBreakerFromConfig returns the replica's circuit breaker.
+// Returns nil if the circuit breaker is disabled.
+func newCircuitBreakerFromConfig(rc *ReplicaConfig) *litestream.CircuitBreaker {
+	b := litestream.NewCircuitBreaker()
+	if rc.CircuitBreaker == nil {
+		return b
+	}
+
+	if v := rc.CircuitBreaker.Threshold; v != nil {
+		if *v <= 0 {
+			return nil
+		}
+		b.Threshold = *v
+	}
+	if v := rc.CircuitBreaker.Cooldown; v > 0 {
+		b.Cooldown = v
+	}
+	if v := rc.CircuitBreaker.MaxCooldown; v > 0 {
+		b.MaxCooldown = v
+	}
+	return b
+}
+
+// readSecretFiles sets credentials from their "-file" variants, if specified.
+func (c *ReplicaConfig) readSecretFiles() error {
+	for _, v := range []struct {
+		p        *string
+		filename string
+		name     string
+	}{
+		{&c.AccessKeyID, c.AccessKeyIDFile, "access-key-id"},
+		{&c.SecretAccessKey, c.SecretAccessKeyFile, "secret-access-key"},
+		{&c.AccountKey, c.AccountKeyFile, "account-key"},
+		{&c.SASToken, c.SASTokenFile, "sas-token"},
+		{&c.Password, c.PasswordFile, "password"},
+		{&c.SSECustomerKey, c.SSECustomerKeyFile, "sse-customer-key"},
+	} {
+		if err := readSecretFile(v.p, v.filename, v.name); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewReplicaFromURL returns a new Replica instance configured from a URL.
@@ -194,6 +734,23 @@ func NewReplicaFromURL(s string) (litestream.Replica, error) {
 	case "s3":
 		r := s3.NewReplica(nil, "")
 		r.Bucket, r.Path = host, path
+		if r.Endpoint, r.ForcePathStyle, r.SkipVerify, err = parseS3ReplicaURLQuery(s); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case "gcs":
+		r := gcs.NewReplica(nil, "")
+		r.Bucket, r.Path = host, path
+		return r, nil
+	case "abs":
+		r := abs.NewReplica(nil, "")
+		r.AccountName = host
+		r.Bucket, r.Path = splitABSPath(path)
+		return r, nil
+	case "sftp":
+		r := sftp.NewReplica(nil, "")
+		r.Host, r.Path = host, path
+		r.User, r.Password = parseReplicaURLUser(s)
 		return r, nil
 	default:
 		return nil, fmt.Errorf("invalid replica url type: %s", s)
@@ -212,6 +769,15 @@ func ParseReplicaURL(s string) (scheme, host, urlpath string, err error) {
 		scheme, u.Scheme = u.Scheme, ""
 		return scheme, "", path.Clean(u.String()), nil
 
+	case "s3":
+		if _, _, _, err := parseS3ReplicaURLQuery(s); err != nil {
+			return "", "", "", err
+		}
+		return u.Scheme, u.Host, strings.TrimPrefix(path.Clean(u.Path), "/"), nil
+
+	case "sftp":
+		return u.Scheme, u.Host, path.Clean(u.Path), nil
+
 	case "":
 		return u.Scheme, u.Host, u.Path, fmt.Errorf("replica url scheme required: %s", s)
 
@@ -220,6 +786,47 @@ func ParseReplicaURL(s string) (scheme, host, urlpath string, err error) {
 	}
 }
 
+// parseReplicaURLUser returns the username & password from a replica URL, if set.
+func parseReplicaURLUser(s string) (username, password string) {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return "", ""
+	}
+	password, _ = u.User.Password()
+	return u.User.Username(), password
+}
+
+// parseS3ReplicaURLQuery returns the S3 endpoint settings from the replica URL
+// query parameters (e.g. "s3://bucket/path?endpoint=localhost:9000&force-path-style=true").
+func parseS3ReplicaURLQuery(s string) (endpoint string, forcePathStyle, skipVerify bool, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false, false, err
+	}
+
+	q := u.Query()
+	if v := q.Get("force-path-style"); v != "" {
+		if forcePathStyle, err = strconv.ParseBool(v); err != nil {
+			return "", false, false, fmt.Errorf("invalid force-path-style value: %q", v)
+		}
+	}
+	if v := q.Get("skip-verify"); v != "" {
+		if skipVerify, err = strconv.ParseBool(v); err != nil {
+			return "", false, false, fmt.Errorf("invalid skip-verify value: %q", v)
+		}
+	}
+	return q.Get("endpoint"), forcePathStyle, skipVerify, nil
+}
+
+// splitABSPath splits a path from an ABS URL into its container & blob path.
+func splitABSPath(s string) (container, path string) {
+	a := strings.SplitN(s, "/", 2)
+	if len(a) == 1 {
+		return a[0], ""
+	}
+	return a[0], a[1]
+}
+
 // isURL returns true if s can be parsed and has a scheme.
 func isURL(s string) bool {
 	u, err := url.Parse(s)
@@ -245,8 +852,9 @@ func DefaultConfigPath() string {
 	return "/etc/litestream.yml"
 }
 
-func registerConfigFlag(fs *flag.FlagSet, p *string) {
-	fs.StringVar(p, "config", DefaultConfigPath(), "config path")
+func registerConfigFlag(fs *flag.FlagSet, configPath *string, noExpandEnv *bool) {
+	fs.StringVar(configPath, "config", DefaultConfigPath(), "config path")
+	fs.BoolVar(noExpandEnv, "no-expand-env", false, "do not expand env vars in config")
 }
 
 // newDBFromConfig instantiates a DB based on a configuration.
@@ -256,8 +864,11 @@ func newDBFromConfig(c *Config, dbc *DBConfig) (*litestream.DB, error) {
 		return nil, err
 	}
 
-	// Initialize database with given path.
+	// Initialize database with given path & settings.
 	db := litestream.NewDB(path)
+	s := c.dbSettings(dbc)
+	db.MinCheckpointPageN, db.MaxCheckpointPageN = s.MinCheckpointPageN, s.MaxCheckpointPageN
+	db.CheckpointInterval, db.MonitorInterval = s.CheckpointInterval, s.MonitorInterval
 
 	// Instantiate and attach replicas.
 	for _, rc := range dbc.Replicas {
@@ -283,6 +894,12 @@ func newReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *Repli
 		return newFileReplicaFromConfig(db, c, dbc, rc)
 	case "s3":
 		return newS3ReplicaFromConfig(db, c, dbc, rc)
+	case "gcs":
+		return newGCSReplicaFromConfig(db, c, dbc, rc)
+	case "abs":
+		return newABSReplicaFromConfig(db, c, dbc, rc)
+	case "sftp":
+		return newSFTPReplicaFromConfig(db, c, dbc, rc)
 	default:
 		return nil, fmt.Errorf("unknown replica type in config: %q", rc.Type)
 	}
@@ -307,12 +924,29 @@ func newFileReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *R
 	}
 
 	r := litestream.NewFileReplica(db, rc.Name, path)
+	if r.Codec, err = litestream.NewCodec(rc.Compression, rc.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if r.Encryptor, err = newEncryptorFromConfig(rc); err != nil {
+		return nil, err
+	}
+
 	if v := rc.Retention; v > 0 {
 		r.Retention = v
 	}
+	if r.RetentionPolicy, err = newRetentionPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
 	if v := rc.RetentionCheckInterval; v > 0 {
 		r.RetentionCheckInterval = v
 	}
+	if v := rc.SnapshotInterval; v > 0 {
+		r.SnapshotInterval = v
+	}
+	if err := litestream.ValidateSnapshotMode(rc.SnapshotMode); err != nil {
+		return nil, err
+	}
+	r.SnapshotMode = rc.SnapshotMode
 	if v := rc.ValidationInterval; v > 0 {
 		r.ValidationInterval = v
 	}
@@ -327,11 +961,23 @@ func newS3ReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *Rep
 	}
 
 	path := rc.Path
+	endpoint, forcePathStyle, skipVerify := rc.Endpoint, rc.ForcePathStyle, rc.SkipVerify
 	if rc.URL != "" {
 		_, bucket, path, err = ParseReplicaURL(rc.URL)
 		if err != nil {
 			return nil, err
 		}
+
+		// Only override endpoint settings if they are specified in the URL.
+		urlEndpoint, urlForcePathStyle, urlSkipVerify, err := parseS3ReplicaURLQuery(rc.URL)
+		if err != nil {
+			return nil, err
+		}
+		if urlEndpoint != "" {
+			endpoint = urlEndpoint
+		}
+		forcePathStyle = forcePathStyle || urlForcePathStyle
+		skipVerify = skipVerify || urlSkipVerify
 	}
 
 	// Use global or replica-specific S3 settings.
@@ -360,22 +1006,302 @@ func newS3ReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *Rep
 	r.Region = region
 	r.Bucket = bucket
 	r.Path = path
+	r.Endpoint = endpoint
+	r.ForcePathStyle = forcePathStyle
+	r.SkipVerify = skipVerify
+
+	if rc.WebIdentityTokenFile != "" && rc.RoleARN == "" {
+		return nil, fmt.Errorf("%s: s3 role-arn required for web-identity-token-file", db.Path())
+	}
+	r.RoleARN = rc.RoleARN
+	r.RoleExternalID = rc.RoleExternalID
+	r.RoleSessionName = rc.RoleSessionName
+	r.STSEndpoint = rc.STSEndpoint
+	if r.WebIdentityTokenFile, err = expandOptional(rc.WebIdentityTokenFile); err != nil {
+		return nil, err
+	}
+
+	if v := rc.MaxSegmentSize; v > 0 {
+		r.MaxSegmentSize = v
+	}
+	if v := rc.UploadBufferSize; v > 0 {
+		r.UploadBufferSize = v
+	}
+	if v := rc.ManifestFlushInterval; v > 0 {
+		r.ManifestFlushInterval = v
+	}
+
+	if rc.SSECustomerKey != "" {
+		if r.SSECustomerKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(rc.SSECustomerKey)); err != nil {
+			return nil, fmt.Errorf("cannot decode sse-customer-key: %w", err)
+		}
+	}
+	if err := s3.ValidateServerSideEncryption(rc.SSE, rc.SSEKMSKeyID, r.SSECustomerKey); err != nil {
+		return nil, err
+	}
+	r.SSE, r.SSEKMSKeyID = rc.SSE, rc.SSEKMSKeyID
+	r.SnapshotStorageClass, r.WALStorageClass = rc.SnapshotStorageClass, rc.WALStorageClass
+	r.Tags = rc.Tags
+
+	if r.Codec, err = litestream.NewCodec(rc.Compression, rc.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if r.Encryptor, err = newEncryptorFromConfig(rc); err != nil {
+		return nil, err
+	}
 
 	if v := rc.Retention; v > 0 {
 		r.Retention = v
 	}
+	if r.RetentionPolicy, err = newRetentionPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
 	if v := rc.RetentionCheckInterval; v > 0 {
 		r.RetentionCheckInterval = v
 	}
 	if v := rc.SyncInterval; v > 0 {
 		r.SyncInterval = v
 	}
+	if v := rc.SnapshotInterval; v > 0 {
+		r.SnapshotInterval = v
+	}
+	if err := litestream.ValidateSnapshotMode(rc.SnapshotMode); err != nil {
+		return nil, err
+	}
+	r.SnapshotMode = rc.SnapshotMode
 	if v := rc.ValidationInterval; v > 0 {
 		r.ValidationInterval = v
 	}
+	if r.RetryPolicy, err = newRetryPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	r.CircuitBreaker = newCircuitBreakerFromConfig(rc)
 	return r, nil
 }
 
+// newGCSReplicaFromConfig returns a new instance of gcs.Replica built from config.
+func newGCSReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *ReplicaConfig) (_ *gcs.Replica, err error) {
+	bucket, path := rc.Bucket, rc.Path
+	if rc.URL != "" {
+		_, bucket, path, err = ParseReplicaURL(rc.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Ensure required settings are set.
+	if bucket == "" {
+		return nil, fmt.Errorf("%s: gcs bucket required", db.Path())
+	}
+
+	// Build replica.
+	r := gcs.NewReplica(db, rc.Name)
+	r.Bucket = bucket
+	r.Path = path
+	r.Endpoint = rc.Endpoint
+
+	if r.CredentialsPath, err = expandOptional(rc.CredentialsPath); err != nil {
+		return nil, err
+	}
+
+	if r.Codec, err = litestream.NewCodec(rc.Compression, rc.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if r.Encryptor, err = newEncryptorFromConfig(rc); err != nil {
+		return nil, err
+	}
+
+	if v := rc.Retention; v > 0 {
+		r.Retention = v
+	}
+	if r.RetentionPolicy, err = newRetentionPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	if v := rc.RetentionCheckInterval; v > 0 {
+		r.RetentionCheckInterval = v
+	}
+	if v := rc.SyncInterval; v > 0 {
+		r.SyncInterval = v
+	}
+	if v := rc.ValidationInterval; v > 0 {
+		r.ValidationInterval = v
+	}
+	if r.RetryPolicy, err = newRetryPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	r.CircuitBreaker = newCircuitBreakerFromConfig(rc)
+	return r, nil
+}
+
+// newABSReplicaFromConfig returns a new instance of abs.Replica built from config.
+func newABSReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *ReplicaConfig) (_ *abs.Replica, err error) {
+	accountName, container, path := rc.AccountName, rc.Bucket, rc.Path
+	if rc.URL != "" {
+		var urlpath string
+		if _, accountName, urlpath, err = ParseReplicaURL(rc.URL); err != nil {
+			return nil, err
+		}
+		container, path = splitABSPath(urlpath)
+	}
+
+	// Ensure required settings are set.
+	if accountName == "" {
+		return nil, fmt.Errorf("%s: abs account name required", db.Path())
+	} else if container == "" {
+		return nil, fmt.Errorf("%s: abs container required", db.Path())
+	}
+
+	// Build replica.
+	r := abs.NewReplica(db, rc.Name)
+	r.AccountName = accountName
+	r.AccountKey = rc.AccountKey
+	r.SASToken = rc.SASToken
+	r.Bucket = container
+	r.Path = path
+	r.Endpoint = rc.Endpoint
+
+	if r.Codec, err = litestream.NewCodec(rc.Compression, rc.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if r.Encryptor, err = newEncryptorFromConfig(rc); err != nil {
+		return nil, err
+	}
+
+	if v := rc.Retention; v > 0 {
+		r.Retention = v
+	}
+	if r.RetentionPolicy, err = newRetentionPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	if v := rc.RetentionCheckInterval; v > 0 {
+		r.RetentionCheckInterval = v
+	}
+	if v := rc.SyncInterval; v > 0 {
+		r.SyncInterval = v
+	}
+	if v := rc.ValidationInterval; v > 0 {
+		r.ValidationInterval = v
+	}
+	if r.RetryPolicy, err = newRetryPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	r.CircuitBreaker = newCircuitBreakerFromConfig(rc)
+	return r, nil
+}
+
+// newSFTPReplicaFromConfig returns a new instance of sftp.Replica built from config.
+func newSFTPReplicaFromConfig(db *litestream.DB, c *Config, dbc *DBConfig, rc *ReplicaConfig) (_ *sftp.Replica, err error) {
+	host, user, password, path := rc.Host, rc.User, rc.Password, rc.Path
+	if rc.URL != "" {
+		_, host, path, err = ParseReplicaURL(rc.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only override credentials if they are specified in the URL.
+		if u, p := parseReplicaURLUser(rc.URL); u != "" {
+			user, password = u, p
+		}
+	}
+
+	// Ensure required settings are set.
+	if host == "" {
+		return nil, fmt.Errorf("%s: sftp host required", db.Path())
+	} else if path == "" {
+		return nil, fmt.Errorf("%s: sftp path required", db.Path())
+	}
+
+	// Build replica.
+	r := sftp.NewReplica(db, rc.Name)
+	r.Host = host
+	r.User = user
+	r.Password = password
+	r.Path = path
+
+	if r.KeyPath, err = expandOptional(rc.KeyPath); err != nil {
+		return nil, err
+	}
+	if r.KnownHostsPath, err = expandOptional(rc.KnownHostsPath); err != nil {
+		return nil, err
+	}
+	r.InsecureIgnoreHostKey = rc.InsecureIgnoreHostKey
+
+	if r.Codec, err = litestream.NewCodec(rc.Compression, rc.CompressionLevel); err != nil {
+		return nil, err
+	}
+	if r.Encryptor, err = newEncryptorFromConfig(rc); err != nil {
+		return nil, err
+	}
+
+	if v := rc.Retention; v > 0 {
+		r.Retention = v
+	}
+	if r.RetentionPolicy, err = newRetentionPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	if v := rc.RetentionCheckInterval; v > 0 {
+		r.RetentionCheckInterval = v
+	}
+	if v := rc.SyncInterval; v > 0 {
+		r.SyncInterval = v
+	}
+	if v := rc.ValidationInterval; v > 0 {
+		r.ValidationInterval = v
+	}
+	if r.RetryPolicy, err = newRetryPolicyFromConfig(rc); err != nil {
+		return nil, err
+	}
+	r.CircuitBreaker = newCircuitBreakerFromConfig(rc)
+	return r, nil
+}
+
+// newEncryptorFromConfig returns an encryptor built from the replica's key
+// files. Returns nil if no keys are configured.
+func newEncryptorFromConfig(rc *ReplicaConfig) (*litestream.Encryptor, error) {
+	if rc.EncryptionKeyPath == "" && len(rc.DecryptionKeyPaths) == 0 {
+		return nil, nil
+	}
+
+	var key []byte
+	if rc.EncryptionKeyPath != "" {
+		filename, err := expand(rc.EncryptionKeyPath)
+		if err != nil {
+			return nil, err
+		} else if key, err = litestream.ReadEncryptionKeyFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	var decryptionKeys [][]byte
+	for _, path := range rc.DecryptionKeyPaths {
+		filename, err := expand(path)
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := litestream.ReadEncryptionKeyFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		decryptionKeys = append(decryptionKeys, k)
+	}
+
+	enc, err := litestream.NewEncryptor(key, decryptionKeys...)
+	if err != nil {
+		return nil, err
+	}
+	enc.AllowPlaintext = rc.AllowPlaintext
+	return enc, nil
+}
+
+// expandOptional returns an absolute path for s, if s is not blank.
+func expandOptional(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	return expand(s)
+}
+
 // expand returns an absolute path for s.
 func expand(s string) (string, error) {
 	// Just expand to absolute path if there is no home directory prefix.
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+	"github.com/benbjohnson/litestream/s3"
+)
+
+func TestParseS3ReplicaURLQuery(t *testing.T) {
+	for _, tt := range []struct {
+		url            string
+		endpoint       string
+		forcePathStyle bool
+		skipVerify     bool
+		err            bool
+	}{
+		{url: "s3://bkt/db"},
+		{url: "s3://bkt/db?endpoint=localhost:9000", endpoint: "localhost:9000"},
+		{url: "s3://bkt/db?endpoint=http://localhost:9000&force-path-style=true", endpoint: "http://localhost:9000", forcePathStyle: true},
+		{url: "s3://bkt/db?skip-verify=1", skipVerify: true},
+		{url: "s3://bkt/db?force-path-style=false&skip-verify=false"},
+		{url: "s3://bkt/db?force-path-style=yes", err: true},
+		{url: "s3://bkt/db?skip-verify=maybe", err: true},
+	} {
+		t.Run(tt.url, func(t *testing.T) {
+			endpoint, forcePathStyle, skipVerify, err := parseS3ReplicaURLQuery(tt.url)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := endpoint, tt.endpoint; got != want {
+				t.Fatalf("endpoint=%q, want %q", got, want)
+			} else if got, want := forcePathStyle, tt.forcePathStyle; got != want {
+				t.Fatalf("forcePathStyle=%v, want %v", got, want)
+			} else if got, want := skipVerify, tt.skipVerify; got != want {
+				t.Fatalf("skipVerify=%v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewReplicaFromURL_S3(t *testing.T) {
+	r, err := NewReplicaFromURL("s3://bkt/path/db?endpoint=https://minio.local:9000&force-path-style=true&skip-verify=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := r.(*s3.Replica)
+	if got, want := sr.Bucket, "bkt"; got != want {
+		t.Fatalf("Bucket=%q, want %q", got, want)
+	} else if got, want := sr.Path, "path/db"; got != want {
+		t.Fatalf("Path=%q, want %q", got, want)
+	} else if got, want := sr.Endpoint, "https://minio.local:9000"; got != want {
+		t.Fatalf("Endpoint=%q, want %q", got, want)
+	} else if !sr.ForcePathStyle {
+		t.Fatal("expected ForcePathStyle")
+	} else if !sr.SkipVerify {
+		t.Fatal("expected SkipVerify")
+	}
+
+	// Ensure invalid query values are rejected.
+	if _, err := NewReplicaFromURL("s3://bkt/db?force-path-style=x"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNewS3ReplicaFromConfig(t *testing.T) {
+	// Ensure endpoint settings are read from the replica configuration.
+	t.Run("Config", func(t *testing.T) {
+		r, err := newS3ReplicaFromConfig(nil, &Config{}, &DBConfig{}, &ReplicaConfig{
+			Bucket:         "bkt",
+			Path:           "db",
+			Endpoint:       "http://localhost:9000",
+			ForcePathStyle: true,
+			SkipVerify:     true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Endpoint, "http://localhost:9000"; got != want {
+			t.Fatalf("Endpoint=%q, want %q", got, want)
+		} else if !r.ForcePathStyle || !r.SkipVerify {
+			t.Fatalf("ForcePathStyle=%v, SkipVerify=%v, want true", r.ForcePathStyle, r.SkipVerify)
+		}
+	})
+
+	// Ensure URL query parameters override the configured endpoint.
+	t.Run("URL", func(t *testing.T) {
+		r, err := newS3ReplicaFromConfig(nil, &Config{}, &DBConfig{}, &ReplicaConfig{
+			URL:      "s3://bkt/db?endpoint=http://other:9000&force-path-style=true",
+			Endpoint: "http://localhost:9000",
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := r.Bucket, "bkt"; got != want {
+			t.Fatalf("Bucket=%q, want %q", got, want)
+		} else if got, want := r.Endpoint, "http://other:9000"; got != want {
+			t.Fatalf("Endpoint=%q, want %q", got, want)
+		} else if !r.ForcePathStyle {
+			t.Fatal("expected ForcePathStyle")
+		} else if r.SkipVerify {
+			t.Fatal("unexpected SkipVerify")
+		}
+	})
+}
+
+func TestDBConfig_IsPattern(t *testing.T) {
+	dir := t.TempDir()
+	MustCreateDB(t, filepath.Join(dir, "a.db"))
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{path: filepath.Join(dir, "*.db"), want: true},
+		{path: filepath.Join(dir, "db?.sqlite"), want: true},
+		{path: filepath.Join(dir, "[ab].db"), want: true},
+		{path: dir, want: true},
+		{path: filepath.Join(dir, "a.db"), want: false},
+		{path: filepath.Join(dir, "missing.db"), want: false},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := (&DBConfig{Path: tt.path}).IsPattern(); got != tt.want {
+				t.Fatalf("IsPattern()=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBConfig_Match(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/data/*.db", path: "/data/a.db", want: true},
+		{pattern: "/data/*.db", path: "/data/a.sqlite", want: false},
+		{pattern: "/data/*.db", path: "/data/sub/a.db", want: false},
+		{pattern: "/data/db?", path: "/data/db1", want: true},
+		{pattern: "/data", path: "/data/a.db", want: true},
+		{pattern: "/data/", path: "/data/a.sqlite", want: true},
+		{pattern: "/data", path: "/data/sub/a.db", want: false},
+		{pattern: "/data", path: "/other/a.db", want: false},
+	} {
+		t.Run(tt.pattern+"|"+tt.path, func(t *testing.T) {
+			if got := (&DBConfig{Path: tt.pattern}).Match(tt.path); got != tt.want {
+				t.Fatalf("Match()=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBConfig_Expand(t *testing.T) {
+	dir := t.TempDir()
+	MustCreateDB(t, filepath.Join(dir, "a.db"))
+	MustCreateDB(t, filepath.Join(dir, "b.sqlite"))
+	MustCreateDB(t, filepath.Join(dir, "sub", "c.db"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.db"), []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "empty.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		path  string
+		paths []string
+	}{
+		{name: "Directory", path: dir, paths: []string{filepath.Join(dir, "a.db"), filepath.Join(dir, "b.sqlite")}},
+		{name: "Glob", path: filepath.Join(dir, "*.db"), paths: []string{filepath.Join(dir, "a.db")}},
+		{name: "NestedGlob", path: filepath.Join(dir, "*", "*.db"), paths: []string{filepath.Join(dir, "sub", "c.db")}},
+		{name: "NoMatch", path: filepath.Join(dir, "*.txt")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dbConfigs, err := (&DBConfig{Path: tt.path}).Expand()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+			for _, dbConfig := range dbConfigs {
+				paths = append(paths, dbConfig.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.paths) {
+				t.Fatalf("paths=%v, want %v", paths, tt.paths)
+			}
+		})
+	}
+
+	// Ensure databases with the same name are skipped instead of failing.
+	t.Run("Collision", func(t *testing.T) {
+		dir := t.TempDir()
+		MustCreateDB(t, filepath.Join(dir, "a.db"))
+		MustCreateDB(t, filepath.Join(dir, "a.sqlite"))
+		MustCreateDB(t, filepath.Join(dir, "b.db"))
+
+		dbConfig := &DBConfig{Path: dir, Replicas: []*ReplicaConfig{{Path: "/backup/{{name}}"}}}
+		for i := 0; i < 2; i++ {
+			dbConfigs, err := dbConfig.Expand()
+			if err != nil {
+				t.Fatal(err)
+			} else if got, want := len(dbConfigs), 2; got != want {
+				t.Fatalf("len=%d, want %d", got, want)
+			} else if got, want := dbConfigs[0].Path, filepath.Join(dir, "a.db"); got != want {
+				t.Fatalf("Path=%q, want %q", got, want)
+			} else if got, want := dbConfigs[1].Path, filepath.Join(dir, "b.db"); got != want {
+				t.Fatalf("Path=%q, want %q", got, want)
+			}
+		}
+	})
+
+	// Ensure invalid patterns return an error.
+	t.Run("ErrInvalidPattern", func(t *testing.T) {
+		if _, err := (&DBConfig{Path: "/data/[.db"}).Expand(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestDBConfig_ForPath(t *testing.T) {
+	for _, tt := range []struct {
+		path    string
+		replica ReplicaConfig
+		want    ReplicaConfig
+	}{
+		{path: "/data/a.db", replica: ReplicaConfig{Path: "/backup/{{name}}"}, want: ReplicaConfig{Path: "/backup/a"}},
+		{path: "/data/a.b.sqlite", replica: ReplicaConfig{Path: "/backup/{{name}}"}, want: ReplicaConfig{Path: "/backup/a.b"}},
+		{path: "/data/db", replica: ReplicaConfig{URL: "s3://bkt/{{name}}/{{name}}"}, want: ReplicaConfig{URL: "s3://bkt/db/db"}},
+		{path: "/data/a.db", replica: ReplicaConfig{Path: "/backup/static"}, want: ReplicaConfig{Path: "/backup/static"}},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			pageN := 100
+			c := &DBConfig{Path: "/data", MinCheckpointPageN: &pageN, Replicas: []*ReplicaConfig{&tt.replica}}
+			other := c.ForPath(tt.path)
+			if got, want := other.Path, tt.path; got != want {
+				t.Fatalf("Path=%q, want %q", got, want)
+			} else if other.MinCheckpointPageN != &pageN {
+				t.Fatal("expected settings to be copied")
+			} else if got, want := *other.Replicas[0], tt.want; !reflect.DeepEqual(got, want) {
+				t.Fatalf("replica=%#v, want %#v", got, want)
+			} else if other.Replicas[0] == c.Replicas[0] {
+				t.Fatal("expected replica config to be copied")
+			}
+		})
+	}
+}
+
+func TestDBConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name     string
+		path     string
+		replicas []*ReplicaConfig
+		err      bool
+	}{
+		{name: "Database", path: filepath.Join(dir, "db"), replicas: []*ReplicaConfig{{Path: "/backup"}}},
+		{name: "GlobPath", path: filepath.Join(dir, "*.db"), replicas: []*ReplicaConfig{{Path: "/backup/{{name}}"}}},
+		{name: "GlobURL", path: filepath.Join(dir, "*.db"), replicas: []*ReplicaConfig{{URL: "s3://bkt/{{name}}"}}},
+		{name: "Directory", path: dir, replicas: []*ReplicaConfig{{Path: "/backup/{{name}}"}}},
+		{name: "ErrGlobNoPlaceholder", path: filepath.Join(dir, "*.db"), replicas: []*ReplicaConfig{{Path: "/backup"}}, err: true},
+		{name: "ErrDirectoryNoPlaceholder", path: dir, replicas: []*ReplicaConfig{{Path: "/backup/{{name}}"}, {URL: "s3://bkt/db"}}, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&DBConfig{Path: tt.path, Replicas: tt.replicas}).Validate()
+			if tt.err && err == nil {
+				t.Fatal("expected error")
+			} else if !tt.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretPath, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "db")
+
+	MustSetenv(t, "LITESTREAM_TEST_BUCKET", "bkt")
+	MustSetenv(t, "LITESTREAM_TEST_NEWLINE", "bkt\naddr: :9999")
+	os.Unsetenv("LITESTREAM_TEST_UNSET")
+
+	bucket := func(c *Config) string { return c.Bucket }
+	secretAccessKey := func(c *Config) string { return c.SecretAccessKey }
+	replicaAccessKeyID := func(c *Config) string { return c.DBs[0].Replicas[0].AccessKeyID }
+
+	for _, tt := range []struct {
+		name   string
+		config string
+		args   []string
+		got    func(*Config) string
+		want   string
+		err    string
+	}{
+		{name: "ExpandEnv", config: "bucket: ${LITESTREAM_TEST_BUCKET}", got: bucket, want: "bkt"},
+		{name: "ExpandEnvUnset", config: "bucket: ${LITESTREAM_TEST_UNSET}", got: bucket, want: ""},
+		{name: "NoExpandEnv", config: "bucket: ${LITESTREAM_TEST_BUCKET}", args: []string{"-no-expand-env"}, got: bucket, want: "${LITESTREAM_TEST_BUCKET}"},
+		{name: "SecretFile", config: "secret-access-key-file: " + secretPath, got: secretAccessKey, want: "secret"},
+		{name: "ReplicaSecretFile", config: fmt.Sprintf("dbs:\n  - path: %s\n    replicas:\n      - url: s3://bkt/db\n        access-key-id-file: %s", dbPath, secretPath), got: replicaAccessKeyID, want: "secret"},
+		{name: "ErrSecretFileConflict", config: "secret-access-key: xyz\nsecret-access-key-file: " + secretPath, err: "cannot specify both secret-access-key and secret-access-key-file"},
+		{name: "ErrReplicaSecretFileConflict", config: fmt.Sprintf("dbs:\n  - path: %s\n    replicas:\n      - url: s3://bkt/db\n        access-key-id: xyz\n        access-key-id-file: %s", dbPath, secretPath), err: "cannot specify both access-key-id and access-key-id-file"},
+		{name: "ErrSecretFileNotFound", config: "secret-access-key-file: " + filepath.Join(dir, "missing"), err: "cannot read secret-access-key-file"},
+
+		// Expansion occurs before parsing so a newline in a value adds a key.
+		{name: "ExpandEnvNewline", config: "bucket: ${LITESTREAM_TEST_NEWLINE}", got: func(c *Config) string { return c.Bucket + " " + c.Addr }, want: "bkt :9999"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "litestream.yml")
+			if err := ioutil.WriteFile(filename, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var configPath string
+			var noExpandEnv bool
+			fs := flag.NewFlagSet("litestream", flag.ContinueOnError)
+			registerConfigFlag(fs, &configPath, &noExpandEnv)
+			if err := fs.Parse(append([]string{"-config", filename}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := ReadConfigFile(configPath, !noExpandEnv)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got, want := tt.got(&config), tt.want; got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile_DBSettings(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	defaults := dbSettings{
+		MinCheckpointPageN: litestream.DefaultMinCheckpointPageN,
+		MaxCheckpointPageN: litestream.DefaultMaxCheckpointPageN,
+		CheckpointInterval: litestream.DefaultCheckpointInterval,
+		MonitorInterval:    litestream.DefaultMonitorInterval,
+	}
+
+	for _, tt := range []struct {
+		name   string
+		global string
+		db     string
+		want   dbSettings
+		err    string
+	}{
+		{name: "Defaults", want: defaults},
+		{
+			name:   "Global",
+			global: "min-checkpoint-page-count: 10\nmax-checkpoint-page-count: 20\ncheckpoint-interval: 2m\nmonitor-interval: 2s",
+			want:   dbSettings{MinCheckpointPageN: 10, MaxCheckpointPageN: 20, CheckpointInterval: 2 * time.Minute, MonitorInterval: 2 * time.Second},
+		},
+		{
+			name:   "Override",
+			global: "min-checkpoint-page-count: 10\nmax-checkpoint-page-count: 20\ncheckpoint-interval: 2m\nmonitor-interval: 2s",
+			db:     "min-checkpoint-page-count: 30\nmax-checkpoint-page-count: 40\ncheckpoint-interval: 3m\nmonitor-interval: 3s",
+			want:   dbSettings{MinCheckpointPageN: 30, MaxCheckpointPageN: 40, CheckpointInterval: 3 * time.Minute, MonitorInterval: 3 * time.Second},
+		},
+		{
+			name:   "Fallback",
+			global: "max-checkpoint-page-count: 20\nmonitor-interval: 2s",
+			db:     "min-checkpoint-page-count: 5\ncheckpoint-interval: 3m",
+			want:   dbSettings{MinCheckpointPageN: 5, MaxCheckpointPageN: 20, CheckpointInterval: 3 * time.Minute, MonitorInterval: 2 * time.Second},
+		},
+		{
+			name: "Disabled",
+			db:   "max-checkpoint-page-count: 0\ncheckpoint-interval: 0s",
+			want: dbSettings{MinCheckpointPageN: defaults.MinCheckpointPageN, MonitorInterval: defaults.MonitorInterval},
+		},
+		{name: "ErrMinGreaterThanMax", global: "max-checkpoint-page-count: 20", db: "min-checkpoint-page-count: 30", err: "max-checkpoint-page-count must be greater than or equal to min-checkpoint-page-count"},
+		{name: "ErrMinZero", db: "min-checkpoint-page-count: 0", err: "min-checkpoint-page-count must be greater than zero"},
+		{name: "ErrMaxNegative", global: "max-checkpoint-page-count: -1", err: "max-checkpoint-page-count cannot be negative"},
+		{name: "ErrCheckpointIntervalNegative", db: "checkpoint-interval: -1s", err: "checkpoint-interval cannot be negative"},
+		{name: "ErrMonitorIntervalZero", global: "monitor-interval: 0s", err: "monitor-interval must be greater than zero"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.global + "\ndbs:\n  - path: " + dbPath + "\n"
+			if tt.db != "" {
+				config += "    " + strings.ReplaceAll(tt.db, "\n", "\n    ") + "\n"
+			}
+
+			filename := filepath.Join(t.TempDir(), "litestream.yml")
+			if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := ReadConfigFile(filename, false)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// Ensure the resolved settings are applied to the database.
+			db, err := newDBFromConfig(&c, c.DBs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := dbSettings{
+				MinCheckpointPageN: db.MinCheckpointPageN,
+				MaxCheckpointPageN: db.MaxCheckpointPageN,
+				CheckpointInterval: db.CheckpointInterval,
+				MonitorInterval:    db.MonitorInterval,
+			}
+			if got != tt.want {
+				t.Fatalf("settings=%#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestS3Replica_Endpoint replicates to & restores from a real S3-compatible
+// store, such as MinIO. It is skipped unless LITESTREAM_S3_ENDPOINT and
+// LITESTREAM_S3_BUCKET are set. Credentials are read from the standard AWS
+// environment variables.
+func TestS3Replica_Endpoint(t *testing.T) {
+	endpoint, bucket := os.Getenv("LITESTREAM_S3_ENDPOINT"), os.Getenv("LITESTREAM_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("LITESTREAM_S3_ENDPOINT & LITESTREAM_S3_BUCKET not set, skipping")
+	}
+
+	db, sqldb := testingutil.MustOpenDBs(t)
+	defer testingutil.MustCloseDBs(t, db, sqldb)
+
+	// The region is not set so this also ensures that region discovery is
+	// skipped when an endpoint is set.
+	u := fmt.Sprintf("s3://%s/integration/%d?endpoint=%s&force-path-style=true", bucket, time.Now().UnixNano(), endpoint)
+	r, err := newS3ReplicaFromConfig(db, &Config{}, &DBConfig{}, &ReplicaConfig{URL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT); INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore from the replica & verify data.
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), r.LastPos().Generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testingutil.MustOpenSQLDB(t, opt.OutputPath)
+	defer testingutil.MustCloseSQLDB(t, other)
+
+	var bar string
+	if err := other.QueryRow(`SELECT bar FROM foo`).Scan(&bar); err != nil {
+		t.Fatal(err)
+	} else if got, want := bar, "baz"; got != want {
+		t.Fatalf("bar=%q, want %q", got, want)
+	}
+}
+
+// MustCreateDB creates a SQLite database at path, creating parent directories.
+func MustCreateDB(tb testing.TB, path string) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		tb.Fatal(err)
+	}
+	d := testingutil.MustOpenSQLDB(tb, path)
+	defer testingutil.MustCloseSQLDB(tb, d)
+	if _, err := d.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+}
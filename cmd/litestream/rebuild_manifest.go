@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/s3"
+)
+
+// RebuildManifestCommand represents a command to rebuild the manifests of S3 replicas.
+type RebuildManifestCommand struct{}
+
+// Run executes the command.
+func (c *RebuildManifestCommand) Run(ctx context.Context, args []string) (err error) {
+	var configPath string
+	var noExpandEnv bool
+	fs := flag.NewFlagSet("litestream-rebuild-manifest", flag.ContinueOnError)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
+	replicaName := fs.String("replica", "", "replica name")
+	generationName := fs.String("generation", "", "generation name")
+	fs.Usage = c.Usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() == 0 || fs.Arg(0) == "" {
+		return fmt.Errorf("database path or replica URL required")
+	} else if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	var db *litestream.DB
+	var r litestream.Replica
+	if isURL(fs.Arg(0)) {
+		if r, err = NewReplicaFromURL(fs.Arg(0)); err != nil {
+			return err
+		}
+	} else if configPath != "" {
+		// Load configuration.
+		config, err := ReadConfigFile(configPath, !noExpandEnv)
+		if err != nil {
+			return err
+		}
+
+		// Lookup database from configuration file by path.
+		if path, err := expand(fs.Arg(0)); err != nil {
+			return err
+		} else if dbc := config.DBConfig(path); dbc == nil {
+			return fmt.Errorf("database not found in config: %s", path)
+		} else if db, err = newDBFromConfig(&config, dbc); err != nil {
+			return err
+		}
+
+		// Filter by replica, if specified.
+		if *replicaName != "" {
+			if r = db.Replica(*replicaName); r == nil {
+				return fmt.Errorf("replica %q not found for database %q", *replicaName, db.Path())
+			}
+		}
+	} else {
+		return errors.New("config path or replica URL required")
+	}
+
+	// Only S3 replicas maintain manifests.
+	var replicas []*s3.Replica
+	if r != nil {
+		sr, ok := r.(*s3.Replica)
+		if !ok {
+			return fmt.Errorf("replica %q does not support manifests", r.Name())
+		}
+		replicas = []*s3.Replica{sr}
+	} else {
+		for _, r := range db.Replicas {
+			if sr, ok := r.(*s3.Replica); ok {
+				replicas = append(replicas, sr)
+			}
+		}
+		if len(replicas) == 0 {
+			return fmt.Errorf("no s3 replicas found for database %q", db.Path())
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "replica\tgeneration\tsnapshots\twal")
+	for _, r := range replicas {
+		generations := []string{*generationName}
+		if *generationName == "" {
+			if generations, err = r.Generations(ctx); err != nil {
+				return fmt.Errorf("%s: cannot list generations: %w", r.Name(), err)
+			}
+		}
+
+		for _, generation := range generations {
+			m, err := r.RebuildManifest(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("%s: cannot rebuild manifest for generation %q: %w", r.Name(), generation, err)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", r.Name(), generation, len(m.Snapshots), len(m.WAL))
+		}
+	}
+
+	return nil
+}
+
+// Usage prints the help message to STDOUT.
+func (c *RebuildManifestCommand) Usage() {
+	fmt.Printf(`
+The rebuild-manifest command lists the snapshots & WAL files of each generation
+in an S3 replica and overwrites the generation's manifest. Use it when a
+manifest is missing or no longer matches the objects in the replica.
+
+Usage:
+
+	litestream rebuild-manifest [arguments] DB_PATH
+
+	litestream rebuild-manifest [arguments] REPLICA_URL
+
+Arguments:
+
+	-config PATH
+	    Specifies the configuration file.
+	    Defaults to %s
+
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
+	-replica NAME
+	    Optional, filters by replica.
+
+	-generation NAME
+	    Optional, rebuilds a single generation.
+	    Defaults to all generations.
+
+`[1:],
+		DefaultConfigPath(),
+	)
+}
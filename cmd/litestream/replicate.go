@@ -10,28 +10,48 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
 	"time"
 
 	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/abs"
+	"github.com/benbjohnson/litestream/gcs"
 	"github.com/benbjohnson/litestream/s3"
+	"github.com/benbjohnson/litestream/sftp"
+	"github.com/mattn/go-shellwords"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // ReplicateCommand represents a command that continuously replicates SQLite databases.
 type ReplicateCommand struct {
-	ConfigPath string
-	Config     Config
+	ConfigPath  string
+	NoExpandEnv bool
+	Config      Config
 
 	// List of managed databases specified in the config.
 	DBs []*litestream.DB
+
+	// Configuration of each managed database, with patterns expanded.
+	dbConfigs []*DBConfig
+
+	// Subcommand executed & supervised by the program, if specified.
+	cmd *exec.Cmd
+
+	// HTTP handlers, if serving over HTTP. Updated on reload.
+	adminHandler  *litestream.AdminHandler
+	healthHandler *litestream.HealthHandler
 }
 
 // Run loads all databases specified in the configuration.
 func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	fs := flag.NewFlagSet("litestream-replicate", flag.ContinueOnError)
 	tracePath := fs.String("trace", "", "trace path")
-	registerConfigFlag(fs, &c.ConfigPath)
+	execFlag := fs.String("exec", "", "execute subcommand")
+	registerConfigFlag(fs, &c.ConfigPath, &c.NoExpandEnv)
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -42,16 +62,25 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	if fs.NArg() == 1 {
 		return fmt.Errorf("must specify at least one replica URL for %s", fs.Arg(0))
 	} else if fs.NArg() > 1 {
-		dbConfig := &DBConfig{Path: fs.Arg(0)}
+		path, err := expand(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		dbConfig := &DBConfig{Path: path}
 		for _, u := range fs.Args()[1:] {
 			dbConfig.Replicas = append(dbConfig.Replicas, &ReplicaConfig{
 				URL:          u,
 				SyncInterval: 1 * time.Second,
 			})
 		}
+		if err := dbConfig.Validate(); err != nil {
+			return err
+		}
 		config.DBs = []*DBConfig{dbConfig}
+		c.ConfigPath = "" // arguments cannot be reloaded
 	} else if c.ConfigPath != "" {
-		config, err = ReadConfigFile(c.ConfigPath)
+		config, err = ReadConfigFile(c.ConfigPath, !c.NoExpandEnv)
 		if err != nil {
 			return err
 		}
@@ -59,6 +88,8 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 		return errors.New("-config flag or database/replica arguments required")
 	}
 
+	c.Config = config
+
 	// Enable trace logging.
 	if *tracePath != "" {
 		f, err := os.Create(*tracePath)
@@ -69,11 +100,14 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 		litestream.Tracef = log.New(f, "", log.LstdFlags|log.LUTC|log.Lshortfile).Printf
 	}
 
-	// Setup signal handler.
-	ctx, cancel := context.WithCancel(ctx)
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	go func() { <-ch; cancel() }()
+	// Setup signal handler. Signals are forwarded to the subcommand, if one
+	// is executed, instead of stopping the program.
+	signalCh := make(chan os.Signal, 1)
+	if *execFlag != "" {
+		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	} else {
+		signal.Notify(signalCh, os.Interrupt)
+	}
 
 	// Display version information.
 	fmt.Printf("litestream %s\n", Version)
@@ -82,7 +116,12 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 		fmt.Println("no databases specified in configuration")
 	}
 
-	for _, dbConfig := range config.DBs {
+	// Expand directories & glob patterns to the databases they match.
+	if c.dbConfigs, err = config.ExpandDBs(); err != nil {
+		return err
+	}
+
+	for _, dbConfig := range c.dbConfigs {
 		db, err := newDBFromConfig(&config, dbConfig)
 		if err != nil {
 			return err
@@ -98,43 +137,372 @@ func (c *ReplicateCommand) Run(ctx context.Context, args []string) (err error) {
 	// Notify user that initialization is done.
 	for _, db := range c.DBs {
 		fmt.Printf("initialized db: %s\n", db.Path())
-		for _, r := range db.Replicas {
+		for _, r := range db.ReplicasSnapshot() {
 			switch r := r.(type) {
 			case *litestream.FileReplica:
 				fmt.Printf("replicating to: name=%q type=%q path=%q\n", r.Name(), r.Type(), r.Path())
 			case *s3.Replica:
 				fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q region=%q\n", r.Name(), r.Type(), r.Bucket, r.Path, r.Region)
+			case *gcs.Replica:
+				fmt.Printf("replicating to: name=%q type=%q bucket=%q path=%q\n", r.Name(), r.Type(), r.Bucket, r.Path)
+			case *abs.Replica:
+				fmt.Printf("replicating to: name=%q type=%q account=%q container=%q path=%q\n", r.Name(), r.Type(), r.AccountName, r.Bucket, r.Path)
+			case *sftp.Replica:
+				fmt.Printf("replicating to: name=%q type=%q host=%q user=%q path=%q\n", r.Name(), r.Type(), r.Host, r.User, r.Path)
 			default:
 				fmt.Printf("replicating to: name=%q type=%q\n", r.Name(), r.Type())
 			}
 		}
 	}
 
-	// Serve metrics over HTTP if enabled.
+	// Serve metrics, admin API & health checks over HTTP if enabled.
 	if config.Addr != "" {
 		_, port, _ := net.SplitHostPort(config.Addr)
 		fmt.Printf("serving metrics on http://localhost:%s/metrics\n", port)
+		fmt.Printf("serving admin api on http://localhost:%s/dbs\n", port)
+		fmt.Printf("serving health checks on http://localhost:%s/healthz & /readyz\n", port)
+
+		c.adminHandler = litestream.NewAdminHandler(c.DBs)
+		c.adminHandler.Writable = config.AdminAPI
+
+		c.healthHandler = litestream.NewHealthHandler(c.DBs)
+		c.healthHandler.MaxLag = config.MaxLag
+		c.healthHandler.MaxLagBytes = config.MaxLagBytes
+		c.healthHandler.MaxSyncErrorN = config.MaxSyncErrors
+		if config.MonitorTimeout > 0 {
+			c.healthHandler.MonitorTimeout = config.MonitorTimeout
+		}
+
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/dbs", c.adminHandler)
+			http.Handle("/dbs/", c.adminHandler)
+			http.Handle("/healthz", c.healthHandler)
+			http.Handle("/readyz", c.healthHandler)
 			if err := http.ListenAndServe(config.Addr, nil); err != nil {
 				log.Printf("cannot start metrics server: %s", err)
 			}
 		}()
 	}
 
-	// Wait for signal to stop program.
-	<-ctx.Done()
+	// Execute subcommand, if specified. The program exits with the
+	// subcommand's status once it exits.
+	var execCh chan error
+	if *execFlag != "" {
+		args, err := shellwords.Parse(*execFlag)
+		if err != nil {
+			return fmt.Errorf("cannot parse exec command: %w", err)
+		} else if len(args) == 0 {
+			return fmt.Errorf("exec command required")
+		}
+
+		// The subcommand runs in its own process group so that signals sent
+		// by the terminal are only delivered once, when forwarded below.
+		c.cmd = exec.Command(args[0], args[1:]...)
+		c.cmd.Stdout, c.cmd.Stderr = os.Stdout, os.Stderr
+		setExecProcAttr(c.cmd)
+		if err := c.cmd.Start(); err != nil {
+			return fmt.Errorf("cannot start exec command: %w", err)
+		}
+
+		execCh = make(chan error, 1)
+		go func() { execCh <- c.cmd.Wait() }()
+	}
+
+	// Wait for signal to stop program. Reload configuration on SIGHUP and
+	// periodically check patterns for added & removed databases.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	watchInterval := config.WatchInterval
+	if watchInterval <= 0 {
+		watchInterval = DefaultWatchInterval
+	}
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var exitCode int
+LOOP:
+	for {
+		select {
+		case <-ctx.Done():
+			break LOOP
+		case sig := <-signalCh:
+			if c.cmd == nil {
+				break LOOP
+			} else if err := c.cmd.Process.Signal(sig); err != nil {
+				log.Printf("cannot forward signal to exec command: %s", err)
+			}
+		case err := <-execCh:
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+				log.Printf("exec command exited: %s", exitErr)
+			} else if err != nil {
+				exitCode = 1
+				log.Printf("exec command failed: %s", err)
+			}
+			if exitCode < 0 {
+				exitCode = 1 // terminated by signal
+			}
+			break LOOP
+		case <-hup:
+			if err := c.Reload(); err != nil {
+				log.Printf("cannot reload config: %s", err)
+			}
+		case <-ticker.C:
+			if err := c.Watch(); err != nil {
+				log.Printf("cannot watch databases: %s", err)
+			}
+		}
+	}
 	signal.Reset()
 
+	// Ensure the latest writes are replicated after the subcommand exits.
+	if c.cmd != nil {
+		if err := c.Sync(context.Background()); err != nil {
+			log.Printf("cannot perform final sync: %s", err)
+			if exitCode == 0 {
+				exitCode = 1
+			}
+		}
+	}
+
 	// Gracefully close
 	if err := c.Close(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	if exitCode != 0 {
+		return &ExitError{Code: exitCode}
+	}
 	return nil
 }
 
+// Sync stops background replication and performs a final sync of each
+// database & its replicas so that the latest writes are replicated.
+func (c *ReplicateCommand) Sync(ctx context.Context) (err error) {
+	for _, db := range c.DBs {
+		if e := db.Sync(); e != nil {
+			log.Printf("%s: final sync error: %s", db.Path(), e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+
+		// Stop replicas after the database sync as replication is started
+		// when the database is first initialized during a sync. Replicas
+		// which cannot be synced on demand are only stopped.
+		for _, r := range db.ReplicasSnapshot() {
+			r.Stop()
+
+			syncer, ok := r.(litestream.ReplicaSyncer)
+			if !ok {
+				continue
+			}
+			if e := syncer.Sync(ctx); e != nil {
+				log.Printf("%s(%s): final sync error: %s", db.Path(), r.Name(), e)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+	}
+	return err
+}
+
+// Reload re-reads the configuration file and applies changes to the running
+// databases. Newly added databases are opened & removed databases are closed.
+// Replicas are only rebuilt if their configuration has changed so that other
+// replicas retain their position.
+func (c *ReplicateCommand) Reload() error {
+	if c.ConfigPath == "" {
+		return fmt.Errorf("no config file specified")
+	}
+
+	config, err := ReadConfigFile(c.ConfigPath, !c.NoExpandEnv)
+	if err != nil {
+		return err
+	}
+
+	diff, err := c.apply(config)
+	if err != nil {
+		return err
+	}
+	log.Printf("config reloaded: %s", diff)
+	return nil
+}
+
+// Watch checks directories & glob patterns in the configuration for added or
+// removed databases and starts or stops replicating them.
+func (c *ReplicateCommand) Watch() error {
+	var ok bool
+	for _, dbConfig := range c.Config.DBs {
+		ok = ok || dbConfig.IsPattern()
+	}
+	if !ok {
+		return nil
+	}
+
+	diff, err := c.apply(c.Config)
+	if err != nil {
+		return err
+	} else if !diff.IsZero() {
+		log.Printf("databases changed: %s", diff)
+	}
+	return nil
+}
+
+// apply updates the running databases & replicas to match config.
+func (c *ReplicateCommand) apply(config Config) (diff configDiff, err error) {
+	dbConfigs, err := config.ExpandDBs()
+	if err != nil {
+		return diff, err
+	}
+
+	// Replicas can only be reused if global settings are unchanged. All
+	// settings other than the database list are compared so that no setting
+	// read when building a replica is missed.
+	prevGlobal, global := c.Config, config
+	prevGlobal.DBs, global.DBs = nil, nil
+	reuse := reflect.DeepEqual(prevGlobal, global)
+
+	prev := make(map[string]*litestream.DB)
+	for _, db := range c.DBs {
+		prev[db.Path()] = db
+	}
+	prevDBConfigs := make(map[string]*DBConfig)
+	for _, dbc := range c.dbConfigs {
+		prevDBConfigs[dbc.Path] = dbc
+	}
+
+	// Build new databases & replicas before changing any running state so
+	// that an invalid configuration has no effect.
+	type replicaUpdate struct {
+		db       *litestream.DB
+		replicas []litestream.Replica
+	}
+	var dbs, newDBs []*litestream.DB
+	var updates []replicaUpdate
+	for _, dbConfig := range dbConfigs {
+		db := prev[dbConfig.Path]
+		if db == nil {
+			if db, err = newDBFromConfig(&config, dbConfig); err != nil {
+				return diff, err
+			}
+			dbs, newDBs = append(dbs, db), append(newDBs, db)
+			diff.added = append(diff.added, db.Path())
+			continue
+		}
+		delete(prev, db.Path())
+		dbs = append(dbs, db)
+
+		// Settings are read by the running monitor so changes are not applied
+		// to databases that are already open.
+		if dbc := prevDBConfigs[db.Path()]; dbc != nil && c.Config.dbSettings(dbc) != config.dbSettings(dbConfig) {
+			log.Printf("%s: checkpoint & monitor settings changed, restart to apply", db.Path())
+		}
+
+		// Reuse replicas whose configuration is unchanged. Replicas are built
+		// in the same order as their configuration.
+		prevReplicas := db.ReplicasSnapshot()
+		var prevReplicaConfigs []*ReplicaConfig
+		if dbc := prevDBConfigs[db.Path()]; reuse && dbc != nil && len(dbc.Replicas) == len(prevReplicas) {
+			prevReplicaConfigs = dbc.Replicas
+		}
+		var changed bool
+		names := make(map[string]struct{})
+		reused := make([]bool, len(prevReplicas))
+		replicas := make([]litestream.Replica, 0, len(dbConfig.Replicas))
+		for _, rc := range dbConfig.Replicas {
+			var r litestream.Replica
+			for i := range prevReplicaConfigs {
+				if !reused[i] && reflect.DeepEqual(prevReplicaConfigs[i], rc) {
+					r, reused[i] = prevReplicas[i], true
+					break
+				}
+			}
+
+			if r == nil {
+				if r, err = newReplicaFromConfig(db, &config, dbConfig, rc); err != nil {
+					return diff, err
+				}
+				diff.started = append(diff.started, fmt.Sprintf("%s(%s)", db.Path(), r.Name()))
+				changed = true
+			}
+
+			if _, ok := names[r.Name()]; ok {
+				return diff, fmt.Errorf("%s: duplicate replica name: %q", db.Path(), r.Name())
+			}
+			names[r.Name()] = struct{}{}
+			replicas = append(replicas, r)
+		}
+
+		for i, r := range prevReplicas {
+			if !reused[i] {
+				diff.stopped = append(diff.stopped, fmt.Sprintf("%s(%s)", db.Path(), r.Name()))
+				changed = true
+			}
+		}
+		if changed {
+			updates = append(updates, replicaUpdate{db: db, replicas: replicas})
+		}
+	}
+	for path := range prev {
+		diff.removed = append(diff.removed, path)
+	}
+	sort.Strings(diff.removed)
+
+	// Open new databases. Close any that were opened if one fails.
+	for i, db := range newDBs {
+		if err := db.Open(); err != nil {
+			for _, db := range newDBs[:i] {
+				_ = db.Close()
+			}
+			return diff, fmt.Errorf("open %s: %w", db.Path(), err)
+		}
+	}
+
+	// Swap replicas on existing databases & close removed databases.
+	for _, u := range updates {
+		if err := u.db.SetReplicas(u.replicas); err != nil {
+			log.Printf("%s: cannot update replicas: %s", u.db.Path(), err)
+		}
+	}
+	for _, path := range diff.removed {
+		if err := prev[path].Close(); err != nil {
+			log.Printf("%s: cannot close db: %s", path, err)
+		}
+	}
+
+	c.Config, c.DBs, c.dbConfigs = config, dbs, dbConfigs
+	if c.adminHandler != nil {
+		c.adminHandler.SetDBs(dbs)
+	}
+	if c.healthHandler != nil {
+		c.healthHandler.SetDBs(dbs)
+	}
+
+	return diff, nil
+}
+
+// configDiff summarizes the changes made when applying a configuration.
+type configDiff struct {
+	added, removed   []string // database paths
+	started, stopped []string // replicas, as "path(name)"
+}
+
+// IsZero returns true if no changes were made.
+func (d configDiff) IsZero() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.started) == 0 && len(d.stopped) == 0
+}
+
+// String returns a single line summary of the changes.
+func (d configDiff) String() string {
+	return fmt.Sprintf("dbs added=%v removed=%v, replicas started=%v stopped=%v", d.added, d.removed, d.started, d.stopped)
+}
+
 // Close closes all open databases.
 func (c *ReplicateCommand) Close() (err error) {
 	for _, db := range c.DBs {
@@ -156,6 +524,16 @@ You can specify your database & replicas in a configuration file or you can
 replicate a single database file by specifying its path and its replicas in the
 command line arguments.
 
+Sending SIGHUP to the process reloads the configuration file. Added databases
+are opened, removed databases are closed, and replicas are only rebuilt if
+their configuration has changed.
+
+A database path may be a directory or a glob pattern (e.g. /data/*.db) to
+replicate every SQLite database it contains. Replica paths must then include
+{{name}} which is replaced by each database's file name without extension.
+Databases are started & stopped as they are added & removed. A database with
+the same name as another (e.g. a.db & a.sqlite) is skipped with a warning.
+
 Usage:
 
 	litestream replicate [arguments]
@@ -168,6 +546,15 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
+	-exec CMD
+	    Executes a subcommand. Litestream forwards SIGINT & SIGTERM to the
+	    subcommand and exits with its status code once it exits, after
+	    performing a final sync of all databases & replicas. The subcommand
+	    runs in its own process group and does not read from stdin.
+
 	-trace PATH
 	    Write verbose trace logging to PATH.
 
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+)
+
+// Ensure replicas can be replaced by a reload while status is being served.
+// Run with -race to detect unsynchronized access to the replica list.
+func TestReplicateCommand_Reload(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, configPath := filepath.Join(dir, "db"), filepath.Join(dir, "litestream.yml")
+	writeConfig := func(replicaPath string) {
+		t.Helper()
+		buf := fmt.Sprintf("dbs:\n  - path: %s\n    replicas:\n      - path: %s\n", dbPath, replicaPath)
+		if err := ioutil.WriteFile(configPath, []byte(buf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &ReplicateCommand{
+		ConfigPath:    configPath,
+		adminHandler:  litestream.NewAdminHandler(nil),
+		healthHandler: litestream.NewHealthHandler(nil),
+	}
+	writeConfig(filepath.Join(dir, "replica0"))
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			c.adminHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dbs", nil))
+			c.healthHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/readyz", nil))
+		}
+	}()
+
+	const n = 20
+	for i := 1; i <= n; i++ {
+		writeConfig(filepath.Join(dir, fmt.Sprintf("replica%d", i)))
+		if err := c.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	// Ensure the last configured replica is running & is served.
+	replicas := c.DBs[0].ReplicasSnapshot()
+	if got, want := len(replicas), 1; got != want {
+		t.Fatalf("len=%d, want %d", got, want)
+	} else if got, want := replicas[0].(*litestream.FileReplica).Path(), filepath.Join(dir, fmt.Sprintf("replica%d", n)); got != want {
+		t.Fatalf("Path=%q, want %q", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	c.adminHandler.ServeHTTP(w, httptest.NewRequest("GET", "/dbs", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("code=%d, want %d", got, want)
+	}
+}
+
+// Ensure databases matching a directory pattern are opened & closed as they
+// are added & removed, and that databases with colliding names are skipped.
+func TestReplicateCommand_Watch(t *testing.T) {
+	dir, backupDir := t.TempDir(), t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "litestream.yml")
+	buf := fmt.Sprintf("dbs:\n  - path: %s\n    replicas:\n      - path: %s\n", dir, filepath.Join(backupDir, "{{name}}"))
+	if err := ioutil.WriteFile(configPath, []byte(buf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ReplicateCommand{
+		ConfigPath:    configPath,
+		adminHandler:  litestream.NewAdminHandler(nil),
+		healthHandler: litestream.NewHealthHandler(nil),
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	assertPaths := func(want ...string) {
+		t.Helper()
+		if err := c.Watch(); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, db := range c.DBs {
+			paths = append(paths, db.Path())
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Fatalf("paths=%v, want %v", paths, want)
+		}
+	}
+	assertPaths()
+
+	MustCreateDB(t, filepath.Join(dir, "a.db"))
+	assertPaths(filepath.Join(dir, "a.db"))
+
+	MustCreateDB(t, filepath.Join(dir, "a.sqlite"))
+	MustCreateDB(t, filepath.Join(dir, "b.db"))
+	assertPaths(filepath.Join(dir, "a.db"), filepath.Join(dir, "b.db"))
+
+	if err := os.Remove(filepath.Join(dir, "b.db")); err != nil {
+		t.Fatal(err)
+	}
+	assertPaths(filepath.Join(dir, "a.db"))
+}
+
+// Ensure the program exits with the status of the executed subcommand and
+// that writes made by the subcommand are replicated by the final sync.
+func TestReplicateCommand_Exec(t *testing.T) {
+	for _, code := range []int{0, 3} {
+		t.Run(fmt.Sprintf("ExitCode%d", code), func(t *testing.T) {
+			dir := t.TempDir()
+			dbPath, replicaPath := filepath.Join(dir, "db"), filepath.Join(dir, "replica")
+
+			MustSetenv(t, "LITESTREAM_TEST_EXEC_DB", dbPath)
+			MustSetenv(t, "LITESTREAM_TEST_EXEC_CODE", fmt.Sprint(code))
+
+			execCmd := fmt.Sprintf("%s -test.run=^TestReplicateCommand_ExecHelper$", os.Args[0])
+			err := (&ReplicateCommand{}).Run(context.Background(), []string{"-exec", execCmd, dbPath, "file://" + replicaPath})
+			if code == 0 && err != nil {
+				t.Fatal(err)
+			} else if exitErr, ok := err.(*ExitError); code != 0 && (!ok || exitErr.Code != code) {
+				t.Fatalf("unexpected error: %#v", err)
+			}
+
+			// Restore from the replica to verify the subcommand's writes.
+			r := litestream.NewFileReplica(nil, "", replicaPath)
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath = filepath.Join(dir, "restored")
+			if opt.Generation, _, err = litestream.CalcReplicaRestoreTarget(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			} else if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			}
+
+			d := testingutil.MustOpenSQLDB(t, opt.OutputPath)
+			defer testingutil.MustCloseSQLDB(t, d)
+			var n int
+			if err := d.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n); err != nil {
+				t.Fatal(err)
+			} else if got, want := n, 10; got != want {
+				t.Fatalf("n=%d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestReplicateCommand_ExecHelper is executed as the subcommand by
+// TestReplicateCommand_Exec. It writes to the database & exits immediately
+// without checkpointing so that only a final sync can replicate the writes.
+func TestReplicateCommand_ExecHelper(t *testing.T) {
+	dbPath := os.Getenv("LITESTREAM_TEST_EXEC_DB")
+	if dbPath == "" {
+		t.Skip("only executed as a subcommand")
+	}
+	code, err := strconv.Atoi(os.Getenv("LITESTREAM_TEST_EXEC_CODE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := testingutil.MustOpenSQLDB(t, dbPath)
+	if _, err := d.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := d.Exec(`INSERT INTO t (id) VALUES (?)`, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Exit(code)
+}
+
+// MustSetenv sets an environment variable until the end of the test.
+func MustSetenv(tb testing.TB, key, value string) {
+	tb.Helper()
+	prev, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
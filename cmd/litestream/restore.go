@@ -7,29 +7,45 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 
 	"github.com/benbjohnson/litestream"
 )
 
+// Restore exit codes. These are returned when a restore is skipped because the
+// database already exists or no backups are found and the matching -if-* flag
+// is specified.
+const (
+	RestoreExitCodeDBExists  = 2
+	RestoreExitCodeNoBackups = 3
+)
+
 // RestoreCommand represents a command to restore a database from a backup.
 type RestoreCommand struct{}
 
 // Run executes the command.
 func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
+	var noExpandEnv bool
 	opt := litestream.NewRestoreOptions()
 	opt.Verbose = true
 
 	fs := flag.NewFlagSet("litestream-restore", flag.ContinueOnError)
-	registerConfigFlag(fs, &configPath)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
 	fs.StringVar(&opt.OutputPath, "o", "", "output path")
 	fs.StringVar(&opt.ReplicaName, "replica", "", "replica name")
 	fs.StringVar(&opt.Generation, "generation", "", "generation name")
 	fs.IntVar(&opt.Index, "index", opt.Index, "wal index")
 	fs.BoolVar(&opt.DryRun, "dry-run", false, "dry run")
+	fs.BoolVar(&opt.Follow, "follow", false, "follow replica")
+	fs.DurationVar(&opt.FollowInterval, "follow-interval", opt.FollowInterval, "follow poll interval")
+	fs.IntVar(&opt.Parallelism, "parallelism", opt.Parallelism, "concurrent wal downloads")
 	timestampStr := fs.String("timestamp", "", "timestamp")
+	posStr := fs.String("pos", "", "position")
 	verbose := fs.Bool("v", false, "verbose output")
+	ifDBNotExists := fs.Bool("if-db-not-exists", false, "skip if database exists")
+	ifReplicaExists := fs.Bool("if-replica-exists", false, "skip if no backups exist")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -46,6 +62,15 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	}
 
+	// Parse position, if specified. Restrict to the position's generation.
+	if *posStr != "" {
+		if opt.Pos, err = litestream.ParsePos(*posStr); err != nil {
+			return errors.New("invalid -pos, must specify as GENERATION/INDEX:OFFSET (e.g. 0123456789abcdef/00000001:4152)")
+		} else if opt.Generation == "" {
+			opt.Generation = opt.Pos.Generation
+		}
+	}
+
 	// Verbose output is automatically enabled if dry run is specified.
 	if opt.DryRun {
 		*verbose = true
@@ -56,6 +81,29 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 		opt.Logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
+	// Skip restore if the database already exists, if specified. The output
+	// path defaults to the database path when restoring from a config file.
+	// The database is not opened or modified.
+	if *ifDBNotExists {
+		outputPath := opt.OutputPath
+		if outputPath == "" && !isURL(fs.Arg(0)) {
+			if outputPath, err = expand(fs.Arg(0)); err != nil {
+				return err
+			}
+		}
+
+		if outputPath != "" {
+			if _, err := os.Stat(outputPath); err == nil {
+				if opt.Logger != nil {
+					opt.Logger.Printf("database already exists, skipping: %s", outputPath)
+				}
+				return &ExitError{Code: RestoreExitCodeDBExists}
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
 	// Determine replica & generation to restore from.
 	var r litestream.Replica
 	if isURL(fs.Arg(0)) {
@@ -63,18 +111,44 @@ func (c *RestoreCommand) Run(ctx context.Context, args []string) (err error) {
 			return err
 		}
 	} else if configPath != "" {
-		if r, err = c.loadFromConfig(ctx, fs.Arg(0), configPath, &opt); err != nil {
+		if r, err = c.loadFromConfig(ctx, fs.Arg(0), configPath, !noExpandEnv, &opt); err != nil {
 			return err
 		}
 	} else {
 		return errors.New("config path or replica URL required")
 	}
 
-	// Return an error if no matching targets found.
+	// Return an error if no matching targets found. Exit quietly with a
+	// distinct status instead if the replica is only restored when backups exist.
 	if opt.Generation == "" {
+		if *ifReplicaExists {
+			if opt.Logger != nil {
+				opt.Logger.Printf("no matching backups found, skipping")
+			}
+			return &ExitError{Code: RestoreExitCodeNoBackups}
+		}
 		return fmt.Errorf("no matching backups found")
 	}
 
+	// Follow replica until interrupted, if specified.
+	if opt.Follow {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		defer signal.Reset()
+
+		go func() {
+			select {
+			case <-ch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
 	return litestream.RestoreReplica(ctx, r, opt)
 }
 
@@ -89,9 +163,9 @@ func (c *RestoreCommand) loadFromURL(ctx context.Context, replicaURL string, opt
 }
 
 // loadFromConfig returns a replica & updates the restore options from a DB reference.
-func (c *RestoreCommand) loadFromConfig(ctx context.Context, dbPath, configPath string, opt *litestream.RestoreOptions) (litestream.Replica, error) {
+func (c *RestoreCommand) loadFromConfig(ctx context.Context, dbPath, configPath string, expandEnv bool, opt *litestream.RestoreOptions) (litestream.Replica, error) {
 	// Load configuration.
-	config, err := ReadConfigFile(configPath)
+	config, err := ReadConfigFile(configPath, expandEnv)
 	if err != nil {
 		return nil, err
 	}
@@ -141,6 +215,9 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
 	-replica NAME
 	    Restore from a specific replica.
 	    Defaults to replica with latest data.
@@ -154,13 +231,44 @@ Arguments:
 	    Defaults to use the highest available index.
 
 	-timestamp TIMESTAMP
-	    Restore to a specific point-in-time.
+	    Restore to a specific point-in-time. Only transactions
+	    replicated at or before the timestamp are restored.
 	    Defaults to use the latest available backup.
 
+	-pos GENERATION/INDEX:OFFSET
+	    Restore up to the last transaction ending at or before
+	    a specific WAL position. Cannot be used with -index
+	    or -timestamp.
+
 	-o PATH
 	    Output path of the restored database.
 	    Defaults to original DB path.
 
+	-follow
+	    Continuously applies new WAL data from the replica after
+	    the initial restore until interrupted. The database is
+	    restored again if the replica starts a new generation.
+	    Changes are copied into the output database in a single
+	    transaction so it may be read while following. Each copy
+	    rewrites the whole database.
+
+	-follow-interval DURATION
+	    Time between polls of the replica when following.
+	    Defaults to 1s.
+
+	-parallelism NUM
+	    Number of WAL files downloaded concurrently while
+	    earlier WAL files are applied. Defaults to 8.
+
+	-if-db-not-exists
+	    Skips the restore & exits with status %d if the output
+	    database already exists. The existing database is not
+	    modified.
+
+	-if-replica-exists
+	    Skips the restore & exits quietly with status %d if no
+	    matching backups are found.
+
 	-dry-run
 	    Prints all log output as if it were running but does
 	    not perform actual restore.
@@ -177,6 +285,12 @@ Examples:
 	# Restore replica for database to a given point in time.
 	$ litestream restore -timestamp 2020-01-01T00:00:00Z /path/to/db
 
+	# Restore replica for database up to a given WAL position.
+	$ litestream restore -pos 0123456789abcdef/00000001:4152 /path/to/db
+
+	# Continuously restore replica for database to a read-only copy.
+	$ litestream restore -follow -o /tmp/db /path/to/db
+
 	# Restore latest replica for database to new /tmp directory
 	$ litestream restore -o /tmp/db /path/to/db
 
@@ -186,7 +300,15 @@ Examples:
 	# Restore database from specific generation on S3.
 	$ litestream restore -replica s3 -generation xxxxxxxx /path/to/db
 
+	# Restore database on first boot, if a backup exists. Exit
+	# statuses %d & %d indicate that the restore was skipped.
+	$ litestream restore -if-db-not-exists -if-replica-exists /path/to/db
+
 `[1:],
 		DefaultConfigPath(),
+		RestoreExitCodeDBExists,
+		RestoreExitCodeNoBackups,
+		RestoreExitCodeDBExists,
+		RestoreExitCodeNoBackups,
 	)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+)
+
+func TestRestoreCommand_IfDBNotExists(t *testing.T) {
+	// Ensure an existing database is left untouched & a distinct status is returned.
+	t.Run("Exists", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath, replicaPath := filepath.Join(dir, "db"), filepath.Join(dir, "replica")
+		MustReplicateDB(t, replicaPath)
+		configPath := MustWriteRestoreConfig(t, dbPath, replicaPath)
+
+		if err := ioutil.WriteFile(dbPath, []byte("existing"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := (&RestoreCommand{}).Run(context.Background(), []string{"-config", configPath, "-if-db-not-exists", dbPath})
+		if e, ok := err.(*ExitError); !ok || e.Code != RestoreExitCodeDBExists {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+
+		if buf, err := ioutil.ReadFile(dbPath); err != nil {
+			t.Fatal(err)
+		} else if got, want := string(buf), "existing"; got != want {
+			t.Fatalf("data=%q, want %q", got, want)
+		}
+	})
+
+	// Ensure a missing database is restored normally.
+	t.Run("NotExists", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath, replicaPath := filepath.Join(dir, "db"), filepath.Join(dir, "replica")
+		MustReplicateDB(t, replicaPath)
+		configPath := MustWriteRestoreConfig(t, dbPath, replicaPath)
+
+		if err := (&RestoreCommand{}).Run(context.Background(), []string{"-config", configPath, "-if-db-not-exists", dbPath}); err != nil {
+			t.Fatal(err)
+		}
+
+		d := testingutil.MustOpenSQLDB(t, dbPath)
+		defer testingutil.MustCloseSQLDB(t, d)
+		var bar string
+		if err := d.QueryRow(`SELECT bar FROM foo`).Scan(&bar); err != nil {
+			t.Fatal(err)
+		} else if got, want := bar, "baz"; got != want {
+			t.Fatalf("bar=%q, want %q", got, want)
+		}
+	})
+}
+
+func TestRestoreCommand_IfReplicaExists(t *testing.T) {
+	// Ensure an empty replica is skipped with a distinct status.
+	t.Run("NoBackups", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath := filepath.Join(dir, "db")
+		configPath := MustWriteRestoreConfig(t, dbPath, filepath.Join(dir, "replica"))
+
+		err := (&RestoreCommand{}).Run(context.Background(), []string{"-config", configPath, "-if-replica-exists", dbPath})
+		if e, ok := err.(*ExitError); !ok || e.Code != RestoreExitCodeNoBackups {
+			t.Fatalf("unexpected error: %#v", err)
+		} else if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+			t.Fatalf("expected database to not exist: %v", err)
+		}
+	})
+
+	// Ensure an empty replica returns an error if the flag is not specified.
+	t.Run("ErrNoBackups", func(t *testing.T) {
+		dir := t.TempDir()
+		dbPath := filepath.Join(dir, "db")
+		configPath := MustWriteRestoreConfig(t, dbPath, filepath.Join(dir, "replica"))
+
+		err := (&RestoreCommand{}).Run(context.Background(), []string{"-config", configPath, dbPath})
+		if _, ok := err.(*ExitError); ok || err == nil || err.Error() != "no matching backups found" {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+}
+
+// MustReplicateDB writes a row to a new database & replicates it to a file
+// replica at replicaPath.
+func MustReplicateDB(tb testing.TB, replicaPath string) {
+	tb.Helper()
+	db, sqldb := testingutil.MustOpenDBs(tb)
+	defer testingutil.MustCloseDBs(tb, db, sqldb)
+
+	r := litestream.NewFileReplica(db, "", replicaPath)
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT); INSERT INTO foo (bar) VALUES ('baz');`); err != nil {
+		tb.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		tb.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// MustWriteRestoreConfig writes a config file for a database with a single
+// file replica & returns its path.
+func MustWriteRestoreConfig(tb testing.TB, dbPath, replicaPath string) string {
+	tb.Helper()
+	configPath := filepath.Join(tb.TempDir(), "litestream.yml")
+	buf := fmt.Sprintf("dbs:\n  - path: %s\n    replicas:\n      - path: %s\n", dbPath, replicaPath)
+	if err := ioutil.WriteFile(configPath, []byte(buf), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return configPath
+}
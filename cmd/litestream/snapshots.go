@@ -18,8 +18,9 @@ type SnapshotsCommand struct{}
 // Run executes the command.
 func (c *SnapshotsCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
+	var noExpandEnv bool
 	fs := flag.NewFlagSet("litestream-snapshots", flag.ContinueOnError)
-	registerConfigFlag(fs, &configPath)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
 	replicaName := fs.String("replica", "", "replica name")
 	fs.Usage = c.Usage
 	if err := fs.Parse(args); err != nil {
@@ -38,7 +39,7 @@ func (c *SnapshotsCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	} else if configPath != "" {
 		// Load configuration.
-		config, err := ReadConfigFile(configPath)
+		config, err := ReadConfigFile(configPath, !noExpandEnv)
 		if err != nil {
 			return err
 		}
@@ -109,6 +110,9 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
 	-replica NAME
 	    Optional, filter by a specific replica.
 
@@ -18,8 +18,9 @@ type WALCommand struct{}
 // Run executes the command.
 func (c *WALCommand) Run(ctx context.Context, args []string) (err error) {
 	var configPath string
+	var noExpandEnv bool
 	fs := flag.NewFlagSet("litestream-wal", flag.ContinueOnError)
-	registerConfigFlag(fs, &configPath)
+	registerConfigFlag(fs, &configPath, &noExpandEnv)
 	replicaName := fs.String("replica", "", "replica name")
 	generation := fs.String("generation", "", "generation name")
 	fs.Usage = c.Usage
@@ -39,7 +40,7 @@ func (c *WALCommand) Run(ctx context.Context, args []string) (err error) {
 		}
 	} else if configPath != "" {
 		// Load configuration.
-		config, err := ReadConfigFile(configPath)
+		config, err := ReadConfigFile(configPath, !noExpandEnv)
 		if err != nil {
 			return err
 		}
@@ -115,6 +116,9 @@ Arguments:
 	    Specifies the configuration file.
 	    Defaults to %s
 
+	-no-expand-env
+	    Disables environment variable expansion in configuration file.
+
 	-replica NAME
 	    Optional, filter by a specific replica.
 
@@ -0,0 +1,177 @@
+package litestream
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression codec names.
+const (
+	CodecLZ4  = "lz4"
+	CodecZstd = "zstd"
+	CodecGzip = "gzip"
+)
+
+// DefaultCodec is the codec used to compress snapshots & WAL files if a
+// replica does not specify one.
+const DefaultCodec = CodecLZ4
+
+// Codec represents a compression format used for snapshots & WAL files.
+type Codec interface {
+	// Name of the codec (e.g. "lz4").
+	Name() string
+
+	// File extension appended to compressed files, including the dot.
+	Ext() string
+
+	// NewWriter returns a writer that compresses data to w. Closing the writer
+	// flushes remaining data but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader that decompresses data from r. Closing the
+	// reader releases codec resources but does not close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// NewCodec returns a codec by name with the given compression level.
+// A level of zero uses the codec's default level.
+func NewCodec(name string, level int) (Codec, error) {
+	switch name {
+	case "", CodecLZ4:
+		if level < 0 || level > 9 {
+			return nil, fmt.Errorf("invalid lz4 compression level: %d", level)
+		}
+		return &LZ4Codec{Level: level}, nil
+	case CodecZstd:
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("invalid zstd compression level: %d", level)
+		}
+		return &ZstdCodec{Level: level}, nil
+	case CodecGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid gzip compression level: %d", level)
+		}
+		return &GzipCodec{Level: level}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %q", name)
+	}
+}
+
+// CodecByPath returns the codec used to compress the snapshot or WAL file
+// at path s. Returns nil if the file is not compressed.
+func CodecByPath(s string) (Codec, error) {
+	switch ext := filepath.Ext(s); ext {
+	case SnapshotExt, WALExt:
+		return nil, nil
+	case ".lz4":
+		return &LZ4Codec{}, nil
+	case ".zst":
+		return &ZstdCodec{}, nil
+	case ".gz":
+		return &GzipCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression extension: %q", ext)
+	}
+}
+
+// NewCodecReader returns a reader that decompresses data from r based on the
+// extension of path s. Returns r as-is if the file is not compressed.
+func NewCodecReader(r io.Reader, s string) (io.ReadCloser, error) {
+	codec, err := CodecByPath(s)
+	if err != nil {
+		return nil, err
+	} else if codec == nil {
+		return ioutil.NopCloser(r), nil
+	}
+	return codec.NewReader(r)
+}
+
+// LZ4Codec compresses data using the lz4 frame format.
+type LZ4Codec struct {
+	// Compression level, 1-9. Zero uses the fastest compression.
+	Level int
+}
+
+// Name returns "lz4".
+func (c *LZ4Codec) Name() string { return CodecLZ4 }
+
+// Ext returns ".lz4".
+func (c *LZ4Codec) Ext() string { return ".lz4" }
+
+// NewWriter returns an lz4 writer.
+func (c *LZ4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw := lz4.NewWriter(w)
+	if c.Level > 0 {
+		if err := zw.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + c.Level)))); err != nil {
+			return nil, err
+		}
+	}
+	return zw, nil
+}
+
+// NewReader returns an lz4 reader.
+func (c *LZ4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+// ZstdCodec compresses data using zstd.
+type ZstdCodec struct {
+	// Compression level, 1-22. Zero uses the default level.
+	Level int
+}
+
+// Name returns "zstd".
+func (c *ZstdCodec) Name() string { return CodecZstd }
+
+// Ext returns ".zst".
+func (c *ZstdCodec) Ext() string { return ".zst" }
+
+// NewWriter returns a zstd writer.
+func (c *ZstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	var opts []zstd.EOption
+	if c.Level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+// NewReader returns a zstd reader.
+func (c *ZstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// GzipCodec compresses data using gzip.
+type GzipCodec struct {
+	// Compression level, 1-9. Zero uses the default level.
+	Level int
+}
+
+// Name returns "gzip".
+func (c *GzipCodec) Name() string { return CodecGzip }
+
+// Ext returns ".gz".
+func (c *GzipCodec) Ext() string { return ".gz" }
+
+// NewWriter returns a gzip writer.
+func (c *GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// NewReader returns a gzip reader.
+func (c *GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
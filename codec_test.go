@@ -0,0 +1,174 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestNewCodec(t *testing.T) {
+	// Ensure each codec can round trip data at its default & maximum level.
+	t.Run("OK", func(t *testing.T) {
+		for _, tt := range []struct {
+			name  string
+			level int
+			ext   string
+		}{
+			{"", 0, ".lz4"},
+			{"lz4", 9, ".lz4"},
+			{"zstd", 0, ".zst"},
+			{"zstd", 22, ".zst"},
+			{"gzip", 0, ".gz"},
+			{"gzip", 9, ".gz"},
+		} {
+			codec, err := litestream.NewCodec(tt.name, tt.level)
+			if err != nil {
+				t.Fatal(err)
+			} else if got, want := codec.Ext(), tt.ext; got != want {
+				t.Fatalf("Ext()=%q, want %q", got, want)
+			}
+
+			data := bytes.Repeat([]byte("foobar"), 10000)
+
+			var buf bytes.Buffer
+			w, err := codec.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			} else if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			} else if err := w.Close(); err != nil {
+				t.Fatal(err)
+			} else if buf.Len() >= len(data) {
+				t.Fatalf("%s: data not compressed: %d bytes", codec.Name(), buf.Len())
+			}
+
+			// Ensure data can be read using only the file extension.
+			r, err := litestream.NewCodecReader(&buf, "00000000.snapshot"+codec.Ext())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			if got, err := ioutil.ReadAll(r); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, data) {
+				t.Fatalf("%s: data mismatch", codec.Name())
+			}
+		}
+	})
+
+	t.Run("ErrUnknownCodec", func(t *testing.T) {
+		if _, err := litestream.NewCodec("snappy", 0); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("ErrInvalidLevel", func(t *testing.T) {
+		if _, err := litestream.NewCodec("lz4", 10); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := litestream.NewCodec("zstd", 23); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := litestream.NewCodec("gzip", -1); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestParseWALPath(t *testing.T) {
+	for _, ext := range []string{".wal", ".wal.lz4", ".wal.zst", ".wal.gz"} {
+		if index, offset, got, err := litestream.ParseWALPath("0000000a_00001000" + ext); err != nil {
+			t.Fatal(err)
+		} else if index != 10 || offset != 4096 || got != ext {
+			t.Fatalf("unexpected result: index=%d offset=%d ext=%q", index, offset, got)
+		}
+	}
+
+	if _, _, _, err := litestream.ParseWALPath("0000000a.wal.bz2"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseSnapshotPath(t *testing.T) {
+	for _, ext := range []string{".snapshot", ".snapshot.lz4", ".snapshot.zst", ".snapshot.gz"} {
+		if index, got, err := litestream.ParseSnapshotPath("0000000a" + ext); err != nil {
+			t.Fatal(err)
+		} else if index != 10 || got != ext {
+			t.Fatalf("unexpected result: index=%d ext=%q", index, got)
+		}
+	}
+}
+
+func TestFileReplica_Codec(t *testing.T) {
+	// Ensure a replica can be restored after its codec is changed.
+	t.Run("Mixed", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Switch from lz4 to zstd to gzip partway through the writes.
+		n := db.MinCheckpointPageN * 3
+		for i := 0; i < n; i++ {
+			switch i {
+			case n / 3:
+				r.Codec = &litestream.ZstdCodec{Level: 3}
+			case 2 * n / 3:
+				r.Codec = &litestream.GzipCodec{}
+			}
+
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure multiple codecs were used for the WAL files.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exts := make(map[string]bool)
+		if fis, err := ioutil.ReadDir(r.WALDir(pos.Generation)); err != nil {
+			t.Fatal(err)
+		} else {
+			for _, fi := range fis {
+				exts[filepath.Ext(fi.Name())] = true
+			}
+		}
+		if !exts[".zst"] || !exts[".gz"] {
+			t.Fatalf("expected mixed wal codecs: %v", exts)
+		}
+
+		// Restore & verify data.
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := MustOpenSQLDB(t, outputPath)
+		defer MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -33,6 +34,14 @@ const (
 	DefaultMaxCheckpointPageN = 10000
 )
 
+// DefaultFollowInterval is the default time between polls of a replica when
+// restoring in follow mode.
+const DefaultFollowInterval = 1 * time.Second
+
+// DefaultRestoreParallelism is the default number of WAL indexes downloaded
+// concurrently during a restore.
+const DefaultRestoreParallelism = 8
+
 // MaxIndex is the maximum possible WAL index.
 // If this index is reached then a new generation will be started.
 const MaxIndex = 0x7FFFFFFF
@@ -58,6 +67,17 @@ type DB struct {
 	cancel func()
 	wg     sync.WaitGroup
 
+	// Guards Replicas once the database is open. Separate from mu as
+	// replicas are read while mu is held during syncs.
+	replicasMu sync.RWMutex
+
+	// Health status, used to determine liveness & replica lag.
+	healthMu   sync.Mutex
+	syncErrorN int       // consecutive sync errors
+	monitorAt  time.Time // last monitor tick
+	healthPos  Pos       // last recorded position
+	posHistory []posTime // times at which positions were reached
+
 	// Metrics
 	dbSizeGauge                 prometheus.Gauge
 	walSizeGauge                prometheus.Gauge
@@ -93,7 +113,8 @@ type DB struct {
 	MonitorInterval time.Duration
 
 	// List of replicas for the database.
-	// Must be set before calling Open().
+	// Must be set before calling Open(). Once open, use ReplicasSnapshot()
+	// to read & SetReplicas() to replace the list.
 	Replicas []Replica
 }
 
@@ -208,9 +229,17 @@ func (db *DB) CurrentShadowWALIndex(generation string) (index int, size int64, e
 	return index, size, nil
 }
 
+// ReplicasSnapshot returns a copy of the list of replicas. It is safe to call
+// while SetReplicas() replaces the list.
+func (db *DB) ReplicasSnapshot() []Replica {
+	db.replicasMu.RLock()
+	defer db.replicasMu.RUnlock()
+	return append([]Replica(nil), db.Replicas...)
+}
+
 // Replica returns a replica by name.
 func (db *DB) Replica(name string) Replica {
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		if r.Name() == name {
 			return r
 		}
@@ -261,7 +290,7 @@ func (db *DB) PageSize() int {
 func (db *DB) Open() (err error) {
 	// Validate that all replica names are unique.
 	m := make(map[string]struct{})
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		if _, ok := m[r.Name()]; ok {
 			return fmt.Errorf("duplicate replica name: %q", r.Name())
 		}
@@ -320,7 +349,7 @@ func (db *DB) UpdatedAt() (time.Time, error) {
 // Snapshots returns a list of all snapshots across all replicas.
 func (db *DB) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
 	var infos []*SnapshotInfo
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		a, err := r.Snapshots(ctx)
 		if err != nil {
 			return nil, err
@@ -338,7 +367,7 @@ func (db *DB) Snapshots(ctx context.Context) ([]*SnapshotInfo, error) {
 // WALs returns a list of all WAL files across all replicas.
 func (db *DB) WALs(ctx context.Context) ([]*WALInfo, error) {
 	var infos []*WALInfo
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		a, err := r.WALs(ctx)
 		if err != nil {
 			return nil, err
@@ -437,13 +466,53 @@ func (db *DB) init() (err error) {
 	}
 
 	// Start replication.
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		r.Start(db.ctx)
 	}
 
 	return nil
 }
 
+// SetReplicas replaces the replicas of an open database. Replicas that are
+// not in the new list are stopped and replicas that were not previously
+// attached are started. Replicas in both lists continue running as-is.
+func (db *DB) SetReplicas(replicas []Replica) error {
+	m := make(map[string]struct{})
+	for _, r := range replicas {
+		if _, ok := m[r.Name()]; ok {
+			return fmt.Errorf("duplicate replica name: %q", r.Name())
+		}
+		m[r.Name()] = struct{}{}
+	}
+
+	db.replicasMu.Lock()
+	prev := db.Replicas
+	db.Replicas = replicas
+	db.replicasMu.Unlock()
+
+	for _, r := range prev {
+		if !containsReplica(replicas, r) {
+			r.Stop()
+		}
+	}
+	for _, r := range replicas {
+		if !containsReplica(prev, r) {
+			r.Start(db.ctx)
+		}
+	}
+	return nil
+}
+
+// containsReplica returns true if r is in a.
+func containsReplica(a []Replica, r Replica) bool {
+	for i := range a {
+		if a[i] == r {
+			return true
+		}
+	}
+	return false
+}
+
 // verifyHeadersMatch returns true if the primary WAL and last shadow WAL header match.
 func (db *DB) verifyHeadersMatch() error {
 	// Determine current generation.
@@ -525,7 +594,7 @@ func (db *DB) cleanWAL() error {
 
 	// Determine lowest index that's been replicated to all replicas.
 	min := -1
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		pos := r.LastPos()
 		if pos.Generation != generation {
 			pos = Pos{} // different generation, reset index to zero
@@ -568,7 +637,7 @@ func (db *DB) SoftClose() (err error) {
 	db.wg.Wait()
 
 	// Ensure replicas all stop replicating.
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		r.Stop()
 	}
 
@@ -678,6 +747,9 @@ func (db *DB) Sync() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// Track consecutive errors & position changes for health checks.
+	defer func() { db.recordSync(err) }()
+
 	// Initialize database, if necessary. Exit if no DB exists.
 	if err := db.init(); err != nil {
 		return err
@@ -1346,6 +1418,8 @@ func (db *DB) monitor() {
 	ticker := time.NewTicker(db.MonitorInterval)
 	defer ticker.Stop()
 
+	db.tickMonitor()
+
 	for {
 		// Wait for ticker or context close.
 		select {
@@ -1353,6 +1427,7 @@ func (db *DB) monitor() {
 			return
 		case <-ticker.C:
 		}
+		db.tickMonitor()
 
 		// Sync the database to the shadow WAL.
 		if err := db.Sync(); err != nil && !errors.Is(err, context.Canceled) {
@@ -1361,13 +1436,134 @@ func (db *DB) monitor() {
 	}
 }
 
+// tickMonitor records that the monitor goroutine is still running.
+func (db *DB) tickMonitor() {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	db.monitorAt = time.Now()
+}
+
+// LastMonitorAt returns the time the monitor goroutine last ticked. Returns
+// the zero time if the monitor has not started.
+func (db *DB) LastMonitorAt() time.Time {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	return db.monitorAt
+}
+
+// SyncErrorN returns the number of consecutive failed syncs.
+func (db *DB) SyncErrorN() int {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+	return db.syncErrorN
+}
+
+// LaggingSince returns the time at which the database first advanced beyond
+// pos. Returns the zero time if pos is current or the time is unknown.
+func (db *DB) LaggingSince(pos Pos) time.Time {
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+
+	for _, e := range db.posHistory {
+		if pos.Generation != e.pos.Generation || posLess(pos, e.pos) {
+			return e.t
+		}
+	}
+	return time.Time{}
+}
+
+// recordSync updates the health status after a sync. The time of each new
+// position is recorded until all replicas have replicated past it.
+func (db *DB) recordSync(syncErr error) {
+	pos, err := db.Pos()
+
+	db.healthMu.Lock()
+	defer db.healthMu.Unlock()
+
+	if syncErr != nil {
+		db.syncErrorN++
+		return
+	}
+	db.syncErrorN = 0
+
+	if err != nil || pos.IsZero() || pos == db.healthPos {
+		return
+	}
+
+	// Reset history on a new generation so entries are always comparable.
+	if pos.Generation != db.healthPos.Generation {
+		db.posHistory = db.posHistory[:0]
+	}
+	db.healthPos = pos
+	db.posHistory = append(db.posHistory, posTime{pos: pos, t: time.Now()})
+
+	// Remove positions that every replica has passed. Replicas without a
+	// position in the current generation keep all history.
+	var min Pos
+	for i, r := range db.ReplicasSnapshot() {
+		rpos := r.LastPos()
+		if rpos.Generation != pos.Generation {
+			min = Pos{}
+			break
+		} else if i == 0 || posLess(rpos, min) {
+			min = rpos
+		}
+	}
+	if !min.IsZero() {
+		n := 0
+		for n < len(db.posHistory) && !posLess(min, db.posHistory[n].pos) {
+			n++
+		}
+		db.posHistory = db.posHistory[n:]
+	}
+
+	// Limit history size by removing the second entry so that the earliest
+	// time is retained for replicas which have stopped progressing.
+	if len(db.posHistory) > maxPosHistoryN {
+		db.posHistory = append(db.posHistory[:1], db.posHistory[2:]...)
+	}
+}
+
+// maxPosHistoryN is the maximum number of positions retained for
+// calculating replica lag.
+const maxPosHistoryN = 10000
+
+// posTime is the time at which the database reached a position.
+type posTime struct {
+	pos Pos
+	t   time.Time
+}
+
+// posLess returns true if a is before b. Both must be in the same generation.
+func posLess(a, b Pos) bool {
+	if a.Index != b.Index {
+		return a.Index < b.Index
+	}
+	return a.Offset < b.Offset
+}
+
 // RestoreReplica restores the database from a replica based on the options given.
 // This method will restore into opt.OutputPath, if specified, or into the
 // DB's original database path. It can optionally restore from a specific
 // replica or generation or it will automatically choose the best one. Finally,
-// a timestamp can be specified to restore the database to a specific
-// point-in-time.
+// a timestamp or position can be specified to restore the database to a
+// specific point-in-time. Only whole transactions are restored so the database
+// is restored to the last commit at or before the given timestamp or position.
+//
+// If opt.Follow is set, the replica is polled for new WAL data after the
+// initial restore and it is applied to the database. This blocks until ctx
+// is canceled.
 func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
+	// Restoring to a position implies its generation & index.
+	if !opt.Pos.IsZero() {
+		if opt.Index != math.MaxInt64 || !opt.Timestamp.IsZero() {
+			return fmt.Errorf("cannot specify position with index or timestamp to restore")
+		} else if opt.Generation != "" && opt.Generation != opt.Pos.Generation {
+			return fmt.Errorf("generation %q does not match position generation %q", opt.Generation, opt.Pos.Generation)
+		}
+		opt.Generation, opt.Index = opt.Pos.Generation, opt.Pos.Index
+	}
+
 	// Validate options.
 	if opt.OutputPath == "" {
 		return fmt.Errorf("output path required")
@@ -1375,6 +1571,10 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 		return fmt.Errorf("must specify generation when restoring to index")
 	} else if opt.Index != math.MaxInt64 && !opt.Timestamp.IsZero() {
 		return fmt.Errorf("cannot specify index & timestamp to restore")
+	} else if opt.Follow && (opt.Index != math.MaxInt64 || !opt.Timestamp.IsZero()) {
+		return fmt.Errorf("cannot follow replica when restoring to a point-in-time")
+	} else if opt.Follow && opt.FollowInterval <= 0 {
+		return fmt.Errorf("follow interval required")
 	}
 
 	// Ensure logger exists.
@@ -1391,24 +1591,57 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 	// Ensure output path does not already exist (unless this is a dry run).
 	if !opt.DryRun {
 		if _, err := os.Stat(opt.OutputPath); err == nil {
-			return fmt.Errorf("cannot restore, output path already exists: %s", opt.OutputPath)
+			return fmt.Errorf("cannot restore, %w: %s", ErrOutputPathExists, opt.OutputPath)
 		} else if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 
-	// Find lastest snapshot that occurs before timestamp.
-	minWALIndex, err := SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp)
+	pos, err := restoreReplica(ctx, r, opt, logger, logPrefix)
+	if err != nil {
+		return err
+	} else if !opt.Follow || opt.DryRun {
+		return nil
+	}
+	return followReplica(ctx, r, opt, pos, logger, logPrefix)
+}
+
+// restoreReplica restores a snapshot & WAL files into a temporary path and
+// then moves it over the output path. Returns the last restored position.
+func restoreReplica(ctx context.Context, r Replica, opt RestoreOptions, logger *log.Logger, logPrefix string) (Pos, error) {
+	// Find lastest snapshot that occurs before timestamp or index.
+	var minWALIndex int
+	var err error
+	if opt.Index != math.MaxInt64 {
+		minWALIndex, err = SnapshotIndexByIndex(ctx, r, opt.Generation, opt.Index)
+	} else {
+		minWALIndex, err = SnapshotIndexAt(ctx, r, opt.Generation, opt.Timestamp)
+	}
 	if err != nil {
-		return fmt.Errorf("cannot find snapshot index for restore: %w", err)
+		return Pos{}, fmt.Errorf("cannot find snapshot index for restore: %w", err)
 	}
 
 	// Find the maximum WAL index that occurs before timestamp.
 	maxWALIndex, err := WALIndexAt(ctx, r, opt.Generation, opt.Index, opt.Timestamp)
 	if err != nil {
-		return fmt.Errorf("cannot find max wal index for restore: %w", err)
+		return Pos{}, fmt.Errorf("cannot find max wal index for restore: %w", err)
+	}
+
+	// Find the offset within the maximum WAL index to stop restoring at.
+	maxWALOffset := int64(math.MaxInt64)
+	if !opt.Pos.IsZero() {
+		maxWALOffset = opt.Pos.Offset
+	} else if !opt.Timestamp.IsZero() {
+		if maxWALOffset, err = WALOffsetAt(ctx, r, opt.Generation, maxWALIndex, opt.Timestamp); err != nil {
+			return Pos{}, fmt.Errorf("cannot find max wal offset for restore: %w", err)
+		}
+	}
+
+	if maxWALOffset != math.MaxInt64 {
+		logger.Printf("%s: starting restore: generation %s, index %08x-%08x, offset %d", logPrefix, opt.Generation, minWALIndex, maxWALIndex, maxWALOffset)
+	} else {
+		logger.Printf("%s: starting restore: generation %s, index %08x-%08x", logPrefix, opt.Generation, minWALIndex, maxWALIndex)
 	}
-	logger.Printf("%s: starting restore: generation %s, index %08x-%08x", logPrefix, opt.Generation, minWALIndex, maxWALIndex)
 
 	// Initialize starting position.
 	pos := Pos{Generation: opt.Generation, Index: minWALIndex}
@@ -1418,19 +1651,41 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 	logger.Printf("%s: restoring snapshot %s/%08x to %s", logPrefix, opt.Generation, minWALIndex, tmpPath)
 	if !opt.DryRun {
 		if err := restoreSnapshot(ctx, r, pos.Generation, pos.Index, tmpPath); err != nil {
-			return fmt.Errorf("cannot restore snapshot: %w", err)
+			return Pos{}, fmt.Errorf("cannot restore snapshot: %w", err)
+		}
+	}
+
+	// Download upcoming WAL files in the background while earlier ones are applied.
+	var p *walPrefetcher
+	if !opt.DryRun && opt.Parallelism > 1 && maxWALIndex > minWALIndex {
+		if p, err = newWALPrefetcher(ctx, r, opt.Generation, minWALIndex, maxWALIndex, opt.Parallelism, tmpPath); err != nil {
+			return Pos{}, fmt.Errorf("cannot prefetch wal: %w", err)
 		}
+		defer p.Close()
 	}
 
 	// Restore each WAL file until we reach our maximum index.
 	for index := minWALIndex; index <= maxWALIndex; index++ {
+		maxOffset := int64(math.MaxInt64)
+		if index == maxWALIndex {
+			maxOffset = maxWALOffset
+		}
+
 		if !opt.DryRun {
-			if err = restoreWAL(ctx, r, opt.Generation, index, tmpPath); os.IsNotExist(err) && index == minWALIndex && index == maxWALIndex {
+			var n int64
+			var err error
+			if p != nil {
+				n, err = p.restoreWAL(index, maxOffset, tmpPath)
+			} else {
+				n, err = restoreWAL(ctx, r, opt.Generation, index, maxOffset, tmpPath)
+			}
+			if os.IsNotExist(err) && index == minWALIndex && index == maxWALIndex {
 				logger.Printf("%s: no wal available, snapshot only", logPrefix)
 				break // snapshot file only, ignore error
 			} else if err != nil {
-				return fmt.Errorf("cannot restore wal: %w", err)
+				return Pos{}, fmt.Errorf("cannot restore wal: %w", err)
 			}
+			pos.Index, pos.Offset = index, n
 		}
 
 		if opt.Verbose {
@@ -1442,11 +1697,116 @@ func RestoreReplica(ctx context.Context, r Replica, opt RestoreOptions) error {
 	logger.Printf("%s: renaming database from temporary location", logPrefix)
 	if !opt.DryRun {
 		if err := os.Rename(tmpPath, opt.OutputPath); err != nil {
-			return err
+			return Pos{}, err
 		}
 	}
 
-	return nil
+	return pos, nil
+}
+
+// followReplica polls the replica for new WAL data in the restored generation
+// and applies it to the output database until ctx is canceled. If the replica
+// moves to a new generation then the database is restored from it again.
+//
+// WAL data is applied to a private staging copy of the database and then
+// copied into the output database with the SQLite backup API so that readers
+// of the output database always see whole transactions and never have the
+// database file replaced underneath them. This copies the entire database on
+// each poll that applies new data.
+func followReplica(ctx context.Context, r Replica, opt RestoreOptions, pos Pos, logger *log.Logger, logPrefix string) error {
+	logger.Printf("%s: following replica from %s", logPrefix, pos)
+
+	stagingPath := opt.OutputPath + ".follow"
+	defer removeDBFiles(stagingPath)
+	if err := removeDBFiles(stagingPath); err != nil {
+		return err
+	} else if err := backupDBFile(ctx, stagingPath, opt.OutputPath); err != nil {
+		return fmt.Errorf("cannot create staging database: %w", err)
+	}
+
+	ticker := time.NewTicker(opt.FollowInterval)
+	defer ticker.Stop()
+
+	var dirty bool // staging database has data not yet in output database
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// Errors are logged & retried on the next poll as they may be transient.
+		prev := pos
+		var err error
+		if pos, err = followReplicaOnce(ctx, r, opt, stagingPath, pos, logger, logPrefix); err != nil && ctx.Err() == nil {
+			logger.Printf("%s: follow error: %s", logPrefix, err)
+		}
+
+		// Copy applied data to the output database. The copy is retried on the
+		// next poll if it fails.
+		if pos == prev && !dirty {
+			continue
+		} else if err := backupDBFile(ctx, opt.OutputPath, stagingPath); err != nil {
+			dirty = true
+			if ctx.Err() == nil {
+				logger.Printf("%s: cannot copy to output database: %s", logPrefix, err)
+			}
+			continue
+		}
+		dirty = false
+	}
+}
+
+// followReplicaOnce applies new WAL data after pos to the staging database.
+// If no new data exists, it checks for a newer generation to restore from.
+// Returns the last applied position.
+func followReplicaOnce(ctx context.Context, r Replica, opt RestoreOptions, stagingPath string, pos Pos, logger *log.Logger, logPrefix string) (Pos, error) {
+	// Apply new data for the current WAL index & any subsequent indexes.
+	var applied bool
+	for index := pos.Index; ; index++ {
+		offset := int64(0)
+		if index == pos.Index {
+			offset = pos.Offset
+		}
+
+		n, err := followWAL(ctx, r, pos.Generation, index, offset, stagingPath)
+		if os.IsNotExist(err) && index > pos.Index {
+			break // no more wal files
+		} else if os.IsNotExist(err) {
+			continue // current wal file not written yet, check next index
+		} else if err != nil {
+			return pos, fmt.Errorf("cannot apply wal %s/%08x: %w", pos.Generation, index, err)
+		}
+
+		// Ignore if no new data is available.
+		if n == offset {
+			continue
+		}
+
+		pos.Index, pos.Offset, applied = index, n, true
+		if opt.Verbose {
+			logger.Printf("%s: applied wal %s", logPrefix, pos)
+		}
+	}
+	if applied {
+		return pos, nil
+	}
+
+	// Restore from a newer generation if the replica has moved on.
+	generation, _, err := CalcReplicaRestoreTarget(ctx, r, RestoreOptions{})
+	if err != nil {
+		return pos, err
+	} else if generation == "" || generation == pos.Generation {
+		return pos, nil
+	}
+
+	logger.Printf("%s: new generation found, restoring: %s", logPrefix, generation)
+	opt.Generation, opt.OutputPath = generation, stagingPath
+	newPos, err := restoreReplica(ctx, r, opt, logger, logPrefix)
+	if err != nil {
+		return pos, err
+	}
+	return newPos, nil
 }
 
 func checksumFile(filename string) (uint64, error) {
@@ -1471,7 +1831,7 @@ func (db *DB) CalcRestoreTarget(ctx context.Context, opt RestoreOptions) (Replic
 		stats      GenerationStats
 	}
 
-	for _, r := range db.Replicas {
+	for _, r := range db.ReplicasSnapshot() {
 		// Skip replica if it does not match filter.
 		if opt.ReplicaName != "" && r.Name() != opt.ReplicaName {
 			continue
@@ -1573,49 +1933,370 @@ func restoreSnapshot(ctx context.Context, r Replica, generation string, index in
 }
 
 // restoreWAL copies a WAL file from the replica to the local WAL and forces checkpoint.
-func restoreWAL(ctx context.Context, r Replica, generation string, index int, dbPath string) error {
-	// Determine the user/group & mode based on the DB, if available.
-	uid, gid, mode := -1, -1, os.FileMode(0600)
-	if db := r.DB(); db != nil {
-		uid, gid, mode = db.uid, db.gid, db.mode
-	}
-
+// Only transactions which end at or before maxOffset are copied. Returns the
+// number of bytes of WAL data applied.
+func restoreWAL(ctx context.Context, r Replica, generation string, index int, maxOffset int64, dbPath string) (int64, error) {
 	// Open WAL file from replica.
 	rd, err := r.WALReader(ctx, generation, index)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	return applyWAL(r, rd, maxOffset, dbPath)
+}
+
+// walPrefetcher downloads a range of WAL indexes from a replica into temporary
+// files using concurrent downloads. At most n indexes are downloaded or waiting
+// to be applied at once. Indexes must be restored in order.
+type walPrefetcher struct {
+	r          Replica
+	generation string
+	minIndex   int
+	dir        string
+
+	results []chan error
+	sem     chan struct{}
+
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// newWALPrefetcher returns a prefetcher which begins downloading WAL indexes
+// from minIndex to maxIndex into a temporary directory next to dbPath.
+func newWALPrefetcher(ctx context.Context, r Replica, generation string, minIndex, maxIndex, n int, dbPath string) (*walPrefetcher, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(dbPath), filepath.Base(dbPath)+"-wal-*")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &walPrefetcher{
+		r:          r,
+		generation: generation,
+		minIndex:   minIndex,
+		dir:        dir,
+		results:    make([]chan error, maxIndex-minIndex+1),
+		sem:        make(chan struct{}, n),
+	}
+	for i := range p.results {
+		p.results[i] = make(chan error, 1)
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+
+	p.wg.Add(1)
+	go func() { defer p.wg.Done(); p.dispatch(ctx) }()
+
+	return p, nil
+}
+
+// Close stops all downloads & removes the temporary directory.
+func (p *walPrefetcher) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	return os.RemoveAll(p.dir)
+}
+
+// dispatch starts a download for each index once a slot is available.
+func (p *walPrefetcher) dispatch(ctx context.Context) {
+	for i := range p.results {
+		select {
+		case <-ctx.Done():
+			return
+		case p.sem <- struct{}{}:
+		}
+
+		p.wg.Add(1)
+		go func(index int, ch chan error) {
+			defer p.wg.Done()
+			ch <- p.download(ctx, index)
+		}(p.minIndex+i, p.results[i])
+	}
+}
+
+// download copies the WAL data at index to a temporary file.
+func (p *walPrefetcher) download(ctx context.Context, index int) error {
+	rd, err := p.r.WALReader(ctx, p.generation, index)
 	if err != nil {
 		return err
 	}
 	defer rd.Close()
 
-	// Open handle to destination WAL path.
-	f, err := createFile(dbPath+"-wal", mode, uid, gid)
+	f, err := os.Create(p.path(index))
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	// Copy WAL to target path.
 	if _, err := io.Copy(f, rd); err != nil {
 		return err
-	} else if err := f.Close(); err != nil {
+	}
+	return f.Close()
+}
+
+// restoreWAL waits for the download of index to complete & then applies it to
+// the database at dbPath. Frees a download slot once applied.
+func (p *walPrefetcher) restoreWAL(index int, maxOffset int64, dbPath string) (int64, error) {
+	defer func() { <-p.sem }()
+	if err := <-p.results[index-p.minIndex]; err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(p.path(index))
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	return applyWAL(p.r, f, maxOffset, dbPath)
+}
+
+// path returns the temporary path for the WAL data at index.
+func (p *walPrefetcher) path(index int) string {
+	return filepath.Join(p.dir, FormatWALPath(index))
+}
+
+// followWAL applies WAL data from the replica after offset to the database
+// at dbPath. Only segments after offset are read. Frame checksums depend on
+// all previous frames so committed frames are rewritten into a new WAL file
+// with their own salt & checksums before being checkpointed. Returns the
+// offset after the last applied commit frame.
+func followWAL(ctx context.Context, r Replica, generation string, index int, offset int64, dbPath string) (int64, error) {
+	pageSize, err := readPageSize(dbPath)
+	if err != nil {
+		return offset, err
+	}
+
+	rd, err := walReaderFrom(ctx, r, generation, index, offset)
+	if err != nil {
+		return offset, err
+	}
+	defer rd.Close()
+
+	// Skip over the header if this is the start of the WAL file.
+	n := offset
+	if n == 0 {
+		if _, err := io.CopyN(ioutil.Discard, rd, WALHeaderSize); err == io.EOF {
+			return offset, nil // no data yet
+		} else if err != nil {
+			return offset, err
+		}
+		n += WALHeaderSize
+	}
+
+	// Write a new WAL header with a random salt.
+	var buf bytes.Buffer
+	hdr := make([]byte, WALHeaderSize)
+	binary.BigEndian.PutUint32(hdr[0:], 0x377f0683) // big endian checksums
+	binary.BigEndian.PutUint32(hdr[4:], 3007000)    // wal format version
+	binary.BigEndian.PutUint32(hdr[8:], uint32(pageSize))
+	binary.BigEndian.PutUint32(hdr[16:], rand.Uint32())
+	binary.BigEndian.PutUint32(hdr[20:], rand.Uint32())
+	s0, s1 := Checksum(binary.BigEndian, 0, 0, hdr[:24])
+	binary.BigEndian.PutUint32(hdr[24:], s0)
+	binary.BigEndian.PutUint32(hdr[28:], s1)
+	buf.Write(hdr)
+
+	// Copy frames with the new salt & checksums. Frames after the last commit
+	// frame are discarded as they are not part of a whole transaction yet.
+	commitOffset, commitLen := offset, 0
+	frame := make([]byte, WALFrameHeaderSize+pageSize)
+	for {
+		if _, err := io.ReadFull(rd, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return offset, err
+		}
+		n += int64(len(frame))
+
+		copy(frame[8:16], hdr[16:24])
+		s0, s1 = Checksum(binary.BigEndian, s0, s1, frame[:8])
+		s0, s1 = Checksum(binary.BigEndian, s0, s1, frame[WALFrameHeaderSize:])
+		binary.BigEndian.PutUint32(frame[16:], s0)
+		binary.BigEndian.PutUint32(frame[20:], s1)
+		buf.Write(frame)
+
+		// Commit frames store the database size after the commit.
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			commitOffset, commitLen = n, buf.Len()
+		}
+	}
+	if commitLen == 0 {
+		return offset, nil // no new transactions
+	}
+	buf.Truncate(commitLen)
+
+	if _, err := applyWAL(r, &buf, math.MaxInt64, dbPath); err != nil {
+		return offset, err
+	}
+	return commitOffset, nil
+}
+
+// readPageSize returns the page size from the header of the database file.
+func readPageSize(dbPath string) (int, error) {
+	b, err := readFileAt(dbPath, 16, 2)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read page size: %w", err)
+	}
+
+	// A page size of 65536 is stored as 1 as it does not fit in two bytes.
+	if pageSize := int(binary.BigEndian.Uint16(b)); pageSize != 1 {
+		return pageSize, nil
+	}
+	return 65536, nil
+}
+
+// backupDBFile copies the database at src to the database at dst using the
+// SQLite online backup API. Readers of dst see either the previous or the new
+// contents as the copy is written in a single transaction.
+func backupDBFile(ctx context.Context, dst, src string) error {
+	s, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if _, err := d.ExecContext(ctx, `PRAGMA journal_mode = wal;`); err != nil {
+		return err
+	} else if err := backupDB(ctx, d, s); err != nil {
+		return err
+	} else if err := d.Close(); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// backupDB copies all pages of the src database to dst in a single step using
+// the SQLite online backup API.
+func backupDB(ctx context.Context, dst, src *sql.DB) error {
+	dconn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dconn.Close()
+
+	sconn, err := src.Conn(ctx)
+	if err != nil {
 		return err
 	}
+	defer sconn.Close()
+
+	return dconn.Raw(func(dc interface{}) error {
+		return sconn.Raw(func(sc interface{}) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// Copy all pages in a single step so the copy is consistent.
+			if done, err := b.Step(-1); err != nil {
+				_ = b.Finish()
+				return err
+			} else if !done {
+				_ = b.Finish()
+				return fmt.Errorf("database busy")
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// removeDBFiles removes a database file & its WAL & shared memory files.
+func removeDBFiles(dbPath string) error {
+	for _, filename := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWAL writes WAL data to the database's WAL file and forces a checkpoint.
+// Only transactions which end at or before maxOffset are copied.
+func applyWAL(r Replica, rd io.Reader, maxOffset int64, dbPath string) (int64, error) {
+	// Determine the user/group & mode based on the DB, if available.
+	uid, gid, mode := -1, -1, os.FileMode(0600)
+	if db := r.DB(); db != nil {
+		uid, gid, mode = db.uid, db.gid, db.mode
+	}
+
+	// Open handle to destination WAL path.
+	f, err := createFile(dbPath+"-wal", mode, uid, gid)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Copy WAL to target path.
+	var n int64
+	if maxOffset == math.MaxInt64 {
+		if n, err = io.Copy(f, rd); err != nil {
+			return n, err
+		}
+	} else if n, err = copyWALUntil(f, rd, maxOffset); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
 
 	// Open SQLite database and force a truncating checkpoint.
 	d, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		return err
+		return n, err
 	}
 	defer d.Close()
 
 	var row [3]int
 	if err := d.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE);`).Scan(&row[0], &row[1], &row[2]); err != nil {
-		return err
+		return n, err
 	} else if row[0] != 0 {
-		return fmt.Errorf("truncation checkpoint failed during restore (%d,%d,%d)", row[0], row[1], row[2])
+		return n, fmt.Errorf("truncation checkpoint failed during restore (%d,%d,%d)", row[0], row[1], row[2])
 	}
 
-	return d.Close()
+	return n, d.Close()
+}
+
+// copyWALUntil copies WAL data from src to dst but stops at the last commit
+// frame that ends at or before maxOffset so that only whole transactions are
+// copied.
+func copyWALUntil(dst io.Writer, src io.Reader, maxOffset int64) (n int64, err error) {
+	hdr := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(src, hdr); err != nil {
+		return 0, fmt.Errorf("cannot read wal header: %w", err)
+	} else if _, err := dst.Write(hdr); err != nil {
+		return 0, err
+	}
+	n = int64(len(hdr))
+
+	// Buffer frames until a commit frame is read and then write the
+	// whole transaction to the destination.
+	var txn bytes.Buffer
+	frame := make([]byte, WALFrameHeaderSize+int(binary.BigEndian.Uint32(hdr[8:])))
+	for offset := int64(WALHeaderSize); offset+int64(len(frame)) <= maxOffset; offset += int64(len(frame)) {
+		if _, err := io.ReadFull(src, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		txn.Write(frame)
+
+		// Commit frames store the database size after the commit.
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			nn, err := txn.WriteTo(dst)
+			if n += nn; err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
 }
 
 // CRC64 returns a CRC-64 ISO checksum of the database and its current position.
@@ -1684,10 +2365,26 @@ type RestoreOptions struct {
 	// If zero, database restore to most recent state available.
 	Timestamp time.Time
 
+	// Specific position to restore to. Restores up to the last transaction
+	// that ends at or before the offset within the position's WAL index.
+	// If zero, database restore to most recent state available.
+	Pos Pos
+
 	// If true, no actual restore is performed.
 	// Only equivalent log output for a regular restore.
 	DryRun bool
 
+	// If true, the replica is continuously polled for new WAL data after the
+	// initial restore which is then applied to the output database.
+	Follow bool
+
+	// Time between polls of the replica when following.
+	FollowInterval time.Duration
+
+	// Number of WAL indexes downloaded concurrently ahead of the index being
+	// applied. WAL indexes are downloaded sequentially if less than two.
+	Parallelism int
+
 	// Logging settings.
 	Logger  *log.Logger
 	Verbose bool
@@ -1696,7 +2393,9 @@ type RestoreOptions struct {
 // NewRestoreOptions returns a new instance of RestoreOptions with defaults.
 func NewRestoreOptions() RestoreOptions {
 	return RestoreOptions{
-		Index: math.MaxInt64,
+		Index:          math.MaxInt64,
+		FollowInterval: DefaultFollowInterval,
+		Parallelism:    DefaultRestoreParallelism,
 	}
 }
 
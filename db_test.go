@@ -1,10 +1,14 @@
 package litestream_test
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -158,6 +162,53 @@ func TestDB_CRC64(t *testing.T) {
 	})
 }
 
+func TestDB_SetReplicas(t *testing.T) {
+	// Ensure replicas can be swapped on an open database.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r0 := NewTestFileReplica(t, db)
+
+		r1 := litestream.NewFileReplica(db, "other", t.TempDir())
+		r1.MonitorEnabled = false
+		if err := db.SetReplicas([]litestream.Replica{r0, r1}); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(db.Replicas), 2; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+
+		// Ensure new replica can sync.
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r1.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.SetReplicas([]litestream.Replica{r1}); err != nil {
+			t.Fatal(err)
+		} else if got, want := db.Replica("other"), litestream.Replica(r1); got != want {
+			t.Fatalf("Replica()=%v, want %v", got, want)
+		} else if db.Replica("file") != nil {
+			t.Fatal("expected replica to be removed")
+		}
+	})
+
+	// Ensure replica names must be unique.
+	t.Run("ErrDuplicateName", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		r := NewTestFileReplica(t, db)
+
+		if err := db.SetReplicas([]litestream.Replica{r, litestream.NewFileReplica(db, "", t.TempDir())}); err == nil || err.Error() != `duplicate replica name: "file"` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := len(db.Replicas), 1; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+	})
+}
+
 // Ensure we can sync the real WAL to the shadow WAL.
 func TestDB_Sync(t *testing.T) {
 	// Ensure sync is skipped if no database exists.
@@ -587,6 +638,371 @@ func TestDB_Sync(t *testing.T) {
 	})
 }
 
+func TestRestoreReplica(t *testing.T) {
+	// Ensure database can be restored to the last transaction before a position.
+	t.Run("Pos", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Insert rows in separate transactions & record the position after each.
+		var positions []litestream.Pos
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			pos, err := db.Pos()
+			if err != nil {
+				t.Fatal(err)
+			}
+			positions = append(positions, pos)
+		}
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Restore exactly at the fifth commit & within the sixth transaction.
+		for _, pos := range []litestream.Pos{positions[4], {Generation: positions[4].Generation, Index: positions[4].Index, Offset: positions[5].Offset - 1}} {
+			opt := litestream.NewRestoreOptions()
+			opt.OutputPath, opt.Pos = filepath.Join(t.TempDir(), "db"), pos
+			if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+				t.Fatal(err)
+			} else if got, want := MustCountRows(t, opt.OutputPath), 5; got != want {
+				t.Fatalf("pos=%s: n=%d, want %d", pos, got, want)
+			}
+		}
+	})
+
+	// Ensure database can be restored to the last segment before a timestamp.
+	t.Run("Timestamp", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Encrypted replicas write each sync to a separate WAL segment.
+		key := make([]byte, litestream.EncryptionKeySize)
+		enc, err := litestream.NewEncryptor(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Encryptor = enc
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Space out snapshot & segment times by a minute, in offset order.
+		base := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(r.SnapshotPath(pos.Generation, 0), base, base); err != nil {
+			t.Fatal(err)
+		}
+
+		wals, err := r.WALs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(wals, func(i, j int) bool { return wals[i].Offset < wals[j].Offset })
+		for i, wal := range wals {
+			tm := base.Add(time.Duration(i) * time.Minute)
+			if err := os.Chtimes(filepath.Join(r.WALDir(pos.Generation), wal.Name), tm, tm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Restore between the creation of the sixth & seventh segments.
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), pos.Generation
+		opt.Timestamp = base.Add(5*time.Minute + 30*time.Second)
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath), 5; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure WAL indexes downloaded concurrently are applied in order.
+	t.Run("Parallelism", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Checkpoint on every sync so each write moves to a new WAL index.
+		db.MinCheckpointPageN = 1
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Index < 10 {
+			t.Fatalf("expected multiple wal indexes: %s", pos)
+		}
+
+		dir := t.TempDir()
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation, opt.Parallelism = filepath.Join(dir, "db"), pos.Generation, 3
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		} else if got, want := MustCountRows(t, opt.OutputPath), 10; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Ensure temporary WAL files are removed.
+		if matches, err := filepath.Glob(filepath.Join(dir, "db.tmp-wal-*")); err != nil {
+			t.Fatal(err)
+		} else if len(matches) != 0 {
+			t.Fatalf("unexpected temporary files: %v", matches)
+		}
+
+		// Ensure a missing WAL index stops the restore.
+		if err := os.Remove(filepath.Join(r.WALDir(pos.Generation), litestream.FormatWALPath(pos.Index/2)+".lz4")); err != nil {
+			t.Fatal(err)
+		}
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err == nil || !strings.Contains(err.Error(), "cannot restore wal") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure new WAL data & generations are applied in follow mode.
+	t.Run("Follow", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		// Insert a row & sync to replica.
+		insert := func(sqldb *sql.DB, db *litestream.DB, r *litestream.FileReplica) {
+			t.Helper()
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		insert(sqldb, db, r)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Follow, opt.FollowInterval = filepath.Join(t.TempDir(), "db"), true, 10*time.Millisecond
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt.Generation = pos.Generation
+
+		done := make(chan error)
+		go func() { done <- litestream.RestoreReplica(ctx, r, opt) }()
+		WaitForRowCount(t, opt.OutputPath, 1)
+
+		// Ensure new data in the current WAL index is applied.
+		insert(sqldb, db, r)
+		insert(sqldb, db, r)
+		WaitForRowCount(t, opt.OutputPath, 3)
+
+		// Ensure data in the next WAL index is applied after a checkpoint.
+		if err := db.Checkpoint(litestream.CheckpointModeTruncate); err != nil {
+			t.Fatal(err)
+		}
+		insert(sqldb, db, r)
+		WaitForRowCount(t, opt.OutputPath, 4)
+
+		// Start a new generation in the same replica from a different database.
+		db2, sqldb2 := MustOpenDBs(t)
+		defer MustCloseDBs(t, db2, sqldb2)
+		r2 := litestream.NewFileReplica(db2, "", r.Path())
+		r2.MonitorEnabled = false
+		db2.Replicas = []litestream.Replica{r2}
+
+		if _, err := sqldb2.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		insert(sqldb2, db2, r2)
+		WaitForRowCount(t, opt.OutputPath, 1)
+
+		// Ensure follow mode stops once canceled.
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure new data is applied while a reader holds a read transaction on
+	// the output database & that the reader keeps its view of the database.
+	t.Run("FollowWithReader", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		insert := func() {
+			t.Helper()
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		insert()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Follow, opt.FollowInterval = filepath.Join(t.TempDir(), "db"), true, 10*time.Millisecond
+		opt.Generation = r.LastPos().Generation
+
+		done := make(chan error)
+		go func() { done <- litestream.RestoreReplica(ctx, r, opt) }()
+		WaitForRowCount(t, opt.OutputPath, 1)
+
+		// Hold a read transaction open on the output database.
+		reader := MustOpenSQLDB(t, opt.OutputPath)
+		defer MustCloseSQLDB(t, reader)
+		tx, err := reader.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		}
+
+		insert()
+		insert()
+		WaitForRowCount(t, opt.OutputPath, 3)
+
+		// Ensure the open transaction still sees its original snapshot.
+		if err := tx.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("n=%d, want 1", n)
+		} else if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		} else if _, err := os.Stat(opt.OutputPath + ".follow"); !os.IsNotExist(err) {
+			t.Fatalf("expected staging database to be removed: %v", err)
+		}
+	})
+
+	t.Run("ErrOutputPathExists", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), "0000000000000000"
+		if err := ioutil.WriteFile(opt.OutputPath, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := litestream.RestoreReplica(context.Background(), litestream.NewFileReplica(nil, "", t.TempDir()), opt); !errors.Is(err, litestream.ErrOutputPathExists) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrPosWithTimestamp", func(t *testing.T) {
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Timestamp = filepath.Join(t.TempDir(), "db"), time.Now()
+		opt.Pos = litestream.Pos{Generation: "0000000000000000", Index: 1, Offset: 4152}
+		if err := litestream.RestoreReplica(context.Background(), litestream.NewFileReplica(nil, "", t.TempDir()), opt); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestParsePos(t *testing.T) {
+	pos := litestream.Pos{Generation: "0123456789abcdef", Index: 10, Offset: 4152}
+	if got, err := litestream.ParsePos(pos.String()); err != nil {
+		t.Fatal(err)
+	} else if got != pos {
+		t.Fatalf("ParsePos()=%#v, want %#v", got, pos)
+	}
+
+	if _, err := litestream.ParsePos("0123456789abcdef/0000000a"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// WaitForRowCount waits until the "foo" table of a database has n rows.
+func WaitForRowCount(tb testing.TB, path string, n int) {
+	tb.Helper()
+
+	var got int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		} else if got = MustCountRows(tb, path); got == n {
+			return
+		}
+	}
+	tb.Fatalf("timeout waiting for row count: n=%d, want %d", got, n)
+}
+
+// MustCountRows returns the number of rows in the "foo" table of a database.
+func MustCountRows(tb testing.TB, path string) int {
+	tb.Helper()
+	d := MustOpenSQLDB(tb, path)
+	defer MustCloseSQLDB(tb, d)
+
+	var n int
+	if err := d.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
 // MustOpenDBs returns a new instance of a DB & associated SQL DB.
 func MustOpenDBs(tb testing.TB) (*litestream.DB, *sql.DB) {
 	db := MustOpenDB(tb)
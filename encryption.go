@@ -0,0 +1,364 @@
+package litestream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Encryption format settings.
+const (
+	// EncryptionKeySize is the size of an AES-256 key, in bytes.
+	EncryptionKeySize = 32
+
+	// EncryptionChunkSize is the maximum size of plaintext sealed in a single chunk.
+	EncryptionChunkSize = 64 * 1024
+
+	encryptionKeyIDSize       = 8
+	encryptionNoncePrefixSize = 8
+	encryptionHeaderSize      = len(encryptionMagic) + encryptionKeyIDSize + encryptionNoncePrefixSize
+
+	// High bit of a chunk's length prefix marks the final chunk.
+	encryptionFinalFlag = 1 << 31
+)
+
+// encryptionMagic is the header prefix for encrypted data.
+const encryptionMagic = "LSE\x01"
+
+// Encryption errors.
+var (
+	ErrEncryptionKeyRequired = errors.New("data is encrypted but no decryption key is configured")
+	ErrDecryptionKeyNotFound = errors.New("no decryption key matches encrypted data")
+	ErrUnencryptedData       = errors.New("data is not encrypted but an encryption key is configured")
+)
+
+// Encryptor encrypts replica data with AES-256-GCM before it is written and
+// decrypts it when read.
+//
+// Data is split into chunks which are each sealed separately so that data can
+// be streamed. Encrypted data begins with a header containing an identifier of
+// the key used so that older keys can be retained for decryption after the
+// encryption key is rotated.
+type Encryptor struct {
+	key  []byte            // encryption key, optional
+	keys map[string][]byte // decryption keys by key id
+
+	// If true, data without an encryption header is read as-is so that
+	// replicas written before encryption was enabled can still be restored.
+	// Otherwise unencrypted data is rejected so it cannot be substituted for
+	// encrypted data. Decryption-only encryptors always allow unencrypted
+	// data as they write it themselves.
+	AllowPlaintext bool
+}
+
+// NewEncryptor returns a new instance of Encryptor. The key is used to
+// encrypt new data and may be nil if only decryption is required. Any
+// additional keys are only used for decrypting existing data.
+func NewEncryptor(key []byte, decryptionKeys ...[]byte) (*Encryptor, error) {
+	e := &Encryptor{keys: make(map[string][]byte)}
+
+	if key != nil {
+		if len(key) != EncryptionKeySize {
+			return nil, fmt.Errorf("invalid encryption key size: %d", len(key))
+		}
+		e.key = key
+		e.keys[string(encryptionKeyID(key))] = key
+	}
+
+	for _, k := range decryptionKeys {
+		if len(k) != EncryptionKeySize {
+			return nil, fmt.Errorf("invalid decryption key size: %d", len(k))
+		}
+		e.keys[string(encryptionKeyID(k))] = k
+	}
+
+	if len(e.keys) == 0 {
+		return nil, fmt.Errorf("at least one encryption or decryption key required")
+	}
+	return e, nil
+}
+
+// HasEncryptionKey returns true if new data is encrypted. Returns false if e
+// is nil or only has decryption keys.
+func (e *Encryptor) HasEncryptionKey() bool {
+	return e != nil && e.key != nil
+}
+
+// ReadEncryptionKeyFile reads a 256-bit key from a file. The key must be
+// encoded as hex or base64.
+func ReadEncryptionKeyFile(filename string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	buf = bytes.TrimSpace(buf)
+
+	var key []byte
+	if len(buf) == hex.EncodedLen(EncryptionKeySize) {
+		key, err = hex.DecodeString(string(buf))
+	} else {
+		key, err = base64.StdEncoding.DecodeString(string(buf))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode encryption key %s: %w", filename, err)
+	} else if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("invalid encryption key size in %s: %d bytes, expected %d", filename, len(key), EncryptionKeySize)
+	}
+	return key, nil
+}
+
+// NewEncryptWriter returns a writer that encrypts data to w. Data is written
+// unencrypted if enc is nil or has no encryption key. Closing the writer
+// flushes the final chunk but does not close w.
+func NewEncryptWriter(w io.Writer, enc *Encryptor) (io.WriteCloser, error) {
+	if !enc.HasEncryptionKey() {
+		return &nopWriteCloser{w}, nil
+	}
+
+	aead, err := newEncryptionAEAD(enc.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build header from magic, key id, and a random nonce prefix.
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionKeyID(enc.key)...)
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	header = append(header, prefix...)
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, EncryptionChunkSize),
+	}, nil
+}
+
+// NewDecryptReader returns a reader that decrypts data from r. Data that does
+// not begin with an encryption header is returned as-is if enc is nil or
+// allows plaintext. Otherwise ErrUnencryptedData is returned.
+func NewDecryptReader(r io.Reader, enc *Encryptor) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	// Pass through data that has not been encrypted, if allowed.
+	if magic, err := br.Peek(len(encryptionMagic)); err != nil && err != io.EOF {
+		return nil, err
+	} else if string(magic) != encryptionMagic {
+		if enc.HasEncryptionKey() && !enc.AllowPlaintext {
+			return nil, ErrUnencryptedData
+		}
+		return br, nil
+	}
+
+	if enc == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("cannot read encryption header: %w", err)
+	}
+
+	key := enc.keys[string(header[len(encryptionMagic):len(encryptionMagic)+encryptionKeyIDSize])]
+	if key == nil {
+		return nil, ErrDecryptionKeyNotFound
+	}
+
+	aead, err := newEncryptionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, header: header}, nil
+}
+
+// encryptWriter seals data written to it in chunks.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte // pending plaintext
+	counter uint32 // chunk counter, used for nonce
+	started bool   // true if header written
+	closed  bool
+}
+
+// Write buffers p and writes sealed chunks as the buffer fills. A full chunk
+// is only written once more data arrives so the final chunk can be marked.
+func (w *encryptWriter) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, errors.New("encrypt writer closed")
+	}
+
+	for len(p) > 0 {
+		if len(w.buf) == EncryptionChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		sz := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+sz]
+		p, n = p[sz:], n+sz
+	}
+	return n, nil
+}
+
+// Close writes the final chunk. Does not close the underlying writer.
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// flush seals the pending plaintext & writes it as a single chunk.
+func (w *encryptWriter) flush(final bool) error {
+	if !w.started {
+		if _, err := w.w.Write(w.header); err != nil {
+			return err
+		}
+		w.started = true
+	}
+
+	if w.counter == math.MaxUint32 {
+		return errors.New("encrypted data too large")
+	}
+
+	ciphertext := w.aead.Seal(nil, encryptionNonce(w.header, w.counter), w.buf, encryptionAdditionalData(w.header, final))
+	w.counter++
+	w.buf = w.buf[:0]
+
+	length := uint32(len(ciphertext))
+	if final {
+		length |= encryptionFinalFlag
+	}
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	if _, err := w.w.Write(prefix[:]); err != nil {
+		return err
+	} else if _, err := w.w.Write(ciphertext); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decryptReader opens sealed chunks read from the underlying reader.
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte // pending plaintext
+	counter uint32 // chunk counter, used for nonce
+	final   bool   // true if final chunk read
+}
+
+// Read returns decrypted data. Returns an error if the data has been
+// truncated or modified.
+func (r *decryptReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		} else if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads & decrypts the next chunk.
+func (r *decryptReader) next() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r.r, prefix[:]); err == io.EOF {
+		return fmt.Errorf("encrypted data truncated: %w", io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	final := length&encryptionFinalFlag != 0
+	length &^= encryptionFinalFlag
+	if length > EncryptionChunkSize+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("invalid encrypted chunk size: %d", length)
+	}
+
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(r.r, ciphertext); err != nil {
+		return fmt.Errorf("cannot read encrypted chunk: %w", err)
+	}
+
+	plaintext, err := r.aead.Open(ciphertext[:0], encryptionNonce(r.header, r.counter), ciphertext, encryptionAdditionalData(r.header, final))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt chunk: %w", err)
+	}
+	r.counter++
+	r.buf, r.final = plaintext, final
+
+	// Ensure no data exists after the final chunk.
+	if final {
+		var b [1]byte
+		if n, _ := r.r.Read(b[:]); n != 0 {
+			return fmt.Errorf("unexpected data after final encrypted chunk")
+		}
+	}
+	return nil
+}
+
+// newEncryptionAEAD returns an AES-GCM cipher for key.
+func newEncryptionAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionKeyID returns a short identifier for key that is stored in the header.
+func encryptionKeyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:encryptionKeyIDSize]
+}
+
+// encryptionNonce returns the nonce for the chunk at the given counter.
+func encryptionNonce(header []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(header)-encryptionNoncePrefixSize:])
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	return nonce
+}
+
+// encryptionAdditionalData binds the header & final flag to each chunk.
+func encryptionAdditionalData(header []byte, final bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if final {
+		ad[len(header)] = 1
+	}
+	return ad
+}
+
+// nopWriteCloser wraps a writer with a no-op Close().
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (*nopWriteCloser) Close() error { return nil }
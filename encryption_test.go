@@ -0,0 +1,328 @@
+package litestream_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestEncryptor(t *testing.T) {
+	// Ensure data of various sizes can be encrypted & decrypted.
+	t.Run("OK", func(t *testing.T) {
+		enc := MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+
+		for _, n := range []int{0, 1, litestream.EncryptionChunkSize - 1, litestream.EncryptionChunkSize, litestream.EncryptionChunkSize + 1, 3 * litestream.EncryptionChunkSize} {
+			plaintext := MustRandomBytes(t, n)
+			ciphertext := MustEncrypt(t, enc, plaintext)
+			if n >= 16 && bytes.Contains(ciphertext, plaintext) {
+				t.Fatalf("n=%d: plaintext found in ciphertext", n)
+			}
+
+			if got, err := Decrypt(enc, ciphertext); err != nil {
+				t.Fatalf("n=%d: %s", n, err)
+			} else if !bytes.Equal(got, plaintext) {
+				t.Fatalf("n=%d: decrypted data mismatch", n)
+			}
+		}
+	})
+
+	// Ensure data encrypted with an older key can be read after rotation.
+	t.Run("Rotation", func(t *testing.T) {
+		oldKey, newKey := MustGenerateEncryptionKey(t), MustGenerateEncryptionKey(t)
+		ciphertext := MustEncrypt(t, MustNewEncryptor(t, oldKey), []byte("foo"))
+
+		enc := MustNewEncryptor(t, newKey, oldKey)
+		if got, err := Decrypt(enc, ciphertext); err != nil {
+			t.Fatal(err)
+		} else if string(got) != "foo" {
+			t.Fatalf("unexpected data: %q", got)
+		}
+	})
+
+	// Ensure a decryption-only encryptor writes unencrypted data.
+	t.Run("DecryptOnly", func(t *testing.T) {
+		key := MustGenerateEncryptionKey(t)
+		enc, err := litestream.NewEncryptor(nil, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := MustEncrypt(t, enc, []byte("foo")); string(got) != "foo" {
+			t.Fatalf("unexpected data: %q", got)
+		} else if got, err := Decrypt(enc, MustEncrypt(t, MustNewEncryptor(t, key), []byte("bar"))); err != nil {
+			t.Fatal(err)
+		} else if string(got) != "bar" {
+			t.Fatalf("unexpected data: %q", got)
+		}
+	})
+
+	// Ensure unencrypted data is passed through as-is, if allowed.
+	t.Run("Unencrypted", func(t *testing.T) {
+		enc := MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+		enc.AllowPlaintext = true
+		for _, s := range []string{"", "L", "foo bar baz"} {
+			if got, err := Decrypt(enc, []byte(s)); err != nil {
+				t.Fatal(err)
+			} else if string(got) != s {
+				t.Fatalf("unexpected data: %q", got)
+			}
+		}
+	})
+
+	// Ensure unencrypted data is rejected when an encryption key is set.
+	t.Run("ErrUnencryptedData", func(t *testing.T) {
+		enc := MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+		for _, s := range []string{"", "L", "foo bar baz"} {
+			if _, err := Decrypt(enc, []byte(s)); err != litestream.ErrUnencryptedData {
+				t.Fatalf("%q: unexpected error: %#v", s, err)
+			}
+		}
+	})
+
+	// Ensure encrypted data cannot be read without a key.
+	t.Run("ErrEncryptionKeyRequired", func(t *testing.T) {
+		ciphertext := MustEncrypt(t, MustNewEncryptor(t, MustGenerateEncryptionKey(t)), []byte("foo"))
+		if _, err := Decrypt(nil, ciphertext); err != litestream.ErrEncryptionKeyRequired {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+
+	// Ensure encrypted data cannot be read with the wrong key.
+	t.Run("ErrDecryptionKeyNotFound", func(t *testing.T) {
+		ciphertext := MustEncrypt(t, MustNewEncryptor(t, MustGenerateEncryptionKey(t)), []byte("foo"))
+		if _, err := Decrypt(MustNewEncryptor(t, MustGenerateEncryptionKey(t)), ciphertext); err != litestream.ErrDecryptionKeyNotFound {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+
+	// Ensure modified data is detected.
+	t.Run("ErrModified", func(t *testing.T) {
+		enc := MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+		ciphertext := MustEncrypt(t, enc, []byte("foo"))
+		ciphertext[len(ciphertext)-1] ^= 0xFF
+		if _, err := Decrypt(enc, ciphertext); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure truncated data is detected, even on a chunk boundary.
+	t.Run("ErrTruncated", func(t *testing.T) {
+		enc := MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+		ciphertext := MustEncrypt(t, enc, MustRandomBytes(t, 2*litestream.EncryptionChunkSize))
+
+		// Header is 20 bytes, first chunk is prefixed by length & includes a 16-byte tag.
+		if _, err := Decrypt(enc, ciphertext[:20+4+litestream.EncryptionChunkSize+16]); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := Decrypt(enc, ciphertext[:len(ciphertext)-1]); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure invalid key sizes are rejected.
+	t.Run("ErrInvalidKeySize", func(t *testing.T) {
+		if _, err := litestream.NewEncryptor(make([]byte, 16)); err == nil {
+			t.Fatal("expected error")
+		} else if _, err := litestream.NewEncryptor(nil); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestReadEncryptionKeyFile(t *testing.T) {
+	key := MustGenerateEncryptionKey(t)
+
+	// Ensure hex & base64 encoded keys can be read.
+	t.Run("OK", func(t *testing.T) {
+		for _, s := range []string{hex.EncodeToString(key), base64.StdEncoding.EncodeToString(key) + "\n"} {
+			filename := filepath.Join(t.TempDir(), "key")
+			if err := ioutil.WriteFile(filename, []byte(s), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := litestream.ReadEncryptionKeyFile(filename); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, key) {
+				t.Fatalf("key mismatch: %x", got)
+			}
+		}
+	})
+
+	// Ensure keys of the wrong size are rejected.
+	t.Run("ErrInvalidKeySize", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "key")
+		if err := ioutil.WriteFile(filename, []byte(hex.EncodeToString(key[:16])), 0600); err != nil {
+			t.Fatal(err)
+		} else if _, err := litestream.ReadEncryptionKeyFile(filename); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestFileReplica_Encryption(t *testing.T) {
+	// Ensure an encrypted replica can be restored & does not contain plaintext.
+	t.Run("OK", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Encryptor = MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write enough data to create multiple WAL indexes & segments.
+		n := db.MinCheckpointPageN * 2
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('plaintextvalue')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure no replica file contains plaintext data.
+		if err := filepath.Walk(r.Path(), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			} else if buf, err := ioutil.ReadFile(path); err != nil {
+				return err
+			} else if bytes.Contains(buf, []byte("plaintextvalue")) {
+				t.Fatalf("plaintext found in %s", path)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ensure calculated position matches the last replicated position.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		} else if calcPos, err := r.CalcPos(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if calcPos.Index != pos.Index || calcPos.Offset > pos.Offset {
+			t.Fatalf("CalcPos()=%v, want <= %v", calcPos, pos)
+		}
+
+		// Restore & verify data.
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := MustOpenSQLDB(t, outputPath)
+		defer MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure an unencrypted snapshot substituted in the replica is rejected.
+	t.Run("ErrUnencryptedData", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.Encryptor = MustNewEncryptor(t, MustGenerateEncryptionKey(t))
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos := r.LastPos()
+		filenames, err := filepath.Glob(filepath.Join(r.SnapshotDir(pos.Generation), "*"))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(filenames) == 0 {
+			t.Fatal("expected snapshot")
+		}
+		for _, filename := range filenames {
+			if err := ioutil.WriteFile(filename, []byte("plaintextvalue"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); !errors.Is(err, litestream.ErrUnencryptedData) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// MustNewEncryptor returns a new encryptor for key & decryption keys.
+func MustNewEncryptor(tb testing.TB, key []byte, decryptionKeys ...[]byte) *litestream.Encryptor {
+	tb.Helper()
+	enc, err := litestream.NewEncryptor(key, decryptionKeys...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return enc
+}
+
+// MustGenerateEncryptionKey returns a random 256-bit key.
+func MustGenerateEncryptionKey(tb testing.TB) []byte {
+	tb.Helper()
+	return MustRandomBytes(tb, litestream.EncryptionKeySize)
+}
+
+// MustRandomBytes returns n random bytes.
+func MustRandomBytes(tb testing.TB, n int) []byte {
+	tb.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// MustEncrypt returns data encrypted by enc.
+func MustEncrypt(tb testing.TB, enc *litestream.Encryptor, data []byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	w, err := litestream.NewEncryptWriter(&buf, enc)
+	if err != nil {
+		tb.Fatal(err)
+	} else if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	} else if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Decrypt returns data decrypted by enc.
+func Decrypt(enc *litestream.Encryptor, data []byte) ([]byte, error) {
+	r, err := litestream.NewDecryptReader(bytes.NewReader(data), enc)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
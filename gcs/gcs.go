@@ -0,0 +1,1296 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCS replica default settings.
+const (
+	DefaultSyncInterval = 10 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+)
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.WALSegmentLister = (*Replica)(nil)
+var _ litestream.WALSegmentReader = (*Replica)(nil)
+var _ litestream.ReplicaStatusReporter = (*Replica)(nil)
+var _ litestream.ReplicaMaintainer = (*Replica)(nil)
+var _ litestream.ReplicaSyncer = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to a Google Cloud Storage bucket.
+type Replica struct {
+	db     *litestream.DB // source database
+	name   string         // replica name, optional
+	client *storage.Client
+	bkt    *storage.BucketHandle
+
+	mu         sync.RWMutex
+	snapshotMu sync.Mutex
+	pos        litestream.Pos // last position
+	syncErr    error          // error from last sync, if any
+	snapshotAt time.Time      // time of most recent snapshot, if known
+	monitorAt  time.Time      // start of current monitor sync, if any
+
+	wg     sync.WaitGroup
+	cancel func()
+
+	snapshotTotalGauge          prometheus.Gauge
+	walBytesCounter             prometheus.Counter
+	walIndexGauge               prometheus.Gauge
+	walOffsetGauge              prometheus.Gauge
+	putOperationTotalCounter    prometheus.Counter
+	putOperationBytesCounter    prometheus.Counter
+	getOperationTotalCounter    prometheus.Counter
+	getOperationBytesCounter    prometheus.Counter
+	listOperationTotalCounter   prometheus.Counter
+	deleteOperationTotalCounter prometheus.Counter
+	retryCounter                prometheus.Counter
+	circuitOpenGauge            prometheus.Gauge
+	circuitOpenCounter          prometheus.Counter
+
+	// Path to a service account JSON key file. If blank, the application
+	// default credentials are used.
+	CredentialsPath string
+
+	// GCS bucket information
+	Bucket string
+	Path   string
+
+	// Overrides the GCS API endpoint (e.g. "http://localhost:4443"). Used for
+	// connecting to an emulator. Authentication is disabled when set.
+	Endpoint string
+
+	// Time between syncs with the shadow WAL.
+	SyncInterval time.Duration
+
+	// Time to keep snapshots and related WAL files.
+	// Database is snapshotted after interval and older WAL files are discarded.
+	Retention time.Duration
+
+	// Tiered retention policy. Overrides Retention, if set.
+	RetentionPolicy litestream.RetentionPolicy
+
+	// Time between retention checks.
+	RetentionCheckInterval time.Duration
+
+	// Time between validation checks.
+	ValidationInterval time.Duration
+
+	// Codec used to compress snapshots & WAL files. Defaults to lz4.
+	Codec litestream.Codec
+
+	// If set, snapshots & WAL files are encrypted before being uploaded.
+	Encryptor *litestream.Encryptor
+
+	// Policy used to retry failed uploads, lists & deletes.
+	RetryPolicy litestream.RetryPolicy
+
+	// Rejects operations after repeated transient failures so the replica
+	// backs off while GCS is unavailable. Disabled if nil.
+	CircuitBreaker *litestream.CircuitBreaker
+
+	// If true, replica monitors database for changes automatically.
+	// Set to false if replica is being used synchronously (such as in tests).
+	MonitorEnabled bool
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		db:     db,
+		name:   name,
+		cancel: func() {},
+
+		SyncInterval:           DefaultSyncInterval,
+		Codec:                  &litestream.LZ4Codec{},
+		Retention:              DefaultRetention,
+		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		RetryPolicy:            litestream.NewRetryPolicy(),
+		CircuitBreaker:         litestream.NewCircuitBreaker(),
+
+		MonitorEnabled: true,
+	}
+
+	var dbPath string
+	if db != nil {
+		dbPath = db.Path()
+	}
+	r.snapshotTotalGauge = internal.ReplicaSnapshotTotalGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
+	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.putOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.putOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.getOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.getOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.listOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "LIST")
+	r.deleteOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "DELETE")
+	r.retryCounter = internal.ReplicaRetryTotalCounterVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenGauge = internal.ReplicaCircuitOpenGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenCounter = internal.ReplicaCircuitOpenTotalCounterVec.WithLabelValues(dbPath, r.Name())
+
+	return r
+}
+
+// Name returns the name of the replica. Returns the type if no name set.
+func (r *Replica) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.Type()
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "gcs"
+}
+
+// DB returns the parent database reference.
+func (r *Replica) DB() *litestream.DB {
+	return r.db
+}
+
+// LastPos returns the last successfully replicated position.
+func (r *Replica) LastPos() litestream.Pos {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pos
+}
+
+// LastSyncError returns the error from the most recent sync, if any.
+func (r *Replica) LastSyncError() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.syncErr
+}
+
+// LastSnapshotAt returns the time of the most recent snapshot created or
+// listed by the replica. Returns a zero time if no snapshot has been seen.
+func (r *Replica) LastSnapshotAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotAt
+}
+
+// setLastSnapshotAt updates the time of the most recent snapshot if t is later.
+func (r *Replica) setLastSnapshotAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.snapshotAt) {
+		r.snapshotAt = t
+	}
+}
+
+// MonitorBusySince returns the time the monitor began syncing the current
+// change. Returns a zero time if the monitor is waiting for changes.
+func (r *Replica) MonitorBusySince() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.monitorAt
+}
+
+// setMonitorBusySince sets the start time of the current monitor sync.
+func (r *Replica) setMonitorBusySince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitorAt = t
+}
+
+// GenerationDir returns the path to a generation's root directory.
+func (r *Replica) GenerationDir(generation string) string {
+	return path.Join(r.Path, "generations", generation)
+}
+
+// SnapshotDir returns the path to a generation's snapshot directory.
+func (r *Replica) SnapshotDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "snapshots")
+}
+
+// SnapshotPath returns the path to a snapshot file.
+func (r *Replica) SnapshotPath(generation string, index int) string {
+	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, litestream.SnapshotExt, r.Codec.Ext()))
+}
+
+// MaxSnapshotIndex returns the highest index for the snapshots.
+func (r *Replica) MaxSnapshotIndex(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	index := -1
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation {
+			continue
+		} else if index == -1 || snapshot.Index > index {
+			index = snapshot.Index
+		}
+	}
+	if index == -1 {
+		return 0, fmt.Errorf("no snapshots found")
+	}
+	return index, nil
+}
+
+// WALDir returns the path to a generation's WAL directory
+func (r *Replica) WALDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "wal")
+}
+
+// Generations returns a list of available generation names.
+func (r *Replica) Generations(ctx context.Context) ([]string, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix:    path.Join(r.Path, "generations") + "/",
+		Delimiter: "/",
+	}, func(attrs *storage.ObjectAttrs) error {
+		// Prefixes are only set for "directories" when using a delimiter.
+		if attrs.Prefix == "" {
+			return nil
+		}
+
+		name := path.Base(attrs.Prefix)
+		if !litestream.IsGenerationName(name) {
+			return nil
+		}
+		generations = append(generations, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return generations, nil
+}
+
+// GenerationStats returns stats for a generation.
+func (r *Replica) GenerationStats(ctx context.Context, generation string) (stats litestream.GenerationStats, err error) {
+	if err := r.Init(ctx); err != nil {
+		return stats, err
+	}
+
+	// Determine stats for all snapshots.
+	n, min, max, err := r.objectStats(ctx, r.SnapshotDir(generation), litestream.IsSnapshotPath)
+	if err != nil {
+		return stats, err
+	}
+	stats.SnapshotN = n
+	stats.CreatedAt, stats.UpdatedAt = min, max
+
+	// Update stats if we have WAL files.
+	n, min, max, err = r.objectStats(ctx, r.WALDir(generation), litestream.IsWALPath)
+	if err != nil {
+		return stats, err
+	} else if n == 0 {
+		return stats, nil
+	}
+
+	stats.WALN = n
+	if stats.CreatedAt.IsZero() || min.Before(stats.CreatedAt) {
+		stats.CreatedAt = min
+	}
+	if stats.UpdatedAt.IsZero() || max.After(stats.UpdatedAt) {
+		stats.UpdatedAt = max
+	}
+	return stats, nil
+}
+
+// objectStats returns the count & time range of objects under dir that match fn.
+func (r *Replica) objectStats(ctx context.Context, dir string, fn func(string) bool) (n int, min, max time.Time, err error) {
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix: dir + "/",
+	}, func(attrs *storage.ObjectAttrs) error {
+		if !fn(path.Base(attrs.Name)) {
+			return nil
+		}
+		modTime := attrs.Updated.UTC()
+
+		n++
+		if min.IsZero() || modTime.Before(min) {
+			min = modTime
+		}
+		if max.IsZero() || modTime.After(max) {
+			max = modTime
+		}
+		return nil
+	}); err != nil {
+		return n, min, max, err
+	}
+	return n, min, max, nil
+}
+
+// Snapshots returns a list of available snapshots in the replica.
+func (r *Replica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.SnapshotInfo
+	for _, generation := range generations {
+		if err := r.eachObject(ctx, &storage.Query{
+			Prefix:    r.SnapshotDir(generation) + "/",
+			Delimiter: "/",
+		}, func(attrs *storage.ObjectAttrs) error {
+			key := path.Base(attrs.Name)
+			index, _, err := litestream.ParseSnapshotPath(key)
+			if err != nil {
+				return nil
+			}
+
+			infos = append(infos, &litestream.SnapshotInfo{
+				Name:       key,
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Size:       attrs.Size,
+				CreatedAt:  attrs.Created.UTC(),
+			})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return infos, nil
+}
+
+// WALs returns a list of available WAL files in the replica.
+func (r *Replica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.WALInfo
+	for _, generation := range generations {
+		segments, err := r.WALSegments(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+
+		var prev *litestream.WALInfo
+		for _, info := range segments {
+			// Update previous record if generation & index match.
+			if prev != nil && prev.Index == info.Index {
+				prev.Size += info.Size
+				prev.CreatedAt = info.CreatedAt
+				continue
+			}
+
+			// Append new WAL record and keep reference to append additional
+			// size for segmented WAL files.
+			prev = info
+			infos = append(infos, prev)
+		}
+	}
+
+	return infos, nil
+}
+
+// WALSegments returns a list of WAL segments in a generation, in order.
+func (r *Replica) WALSegments(ctx context.Context, generation string) ([]*litestream.WALInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.WALInfo
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix:    r.WALDir(generation) + "/",
+		Delimiter: "/",
+	}, func(attrs *storage.ObjectAttrs) error {
+		key := path.Base(attrs.Name)
+
+		index, offset, _, err := litestream.ParseWALPath(key)
+		if err != nil {
+			return nil
+		}
+
+		infos = append(infos, &litestream.WALInfo{
+			Name:       key,
+			Replica:    r.Name(),
+			Generation: generation,
+			Index:      index,
+			Offset:     offset,
+			Size:       attrs.Size,
+			CreatedAt:  attrs.Created.UTC(),
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// eachObject iterates over all objects matching the query and calls fn for each.
+// The listing is restarted if it fails so all objects are read before fn is called.
+func (r *Replica) eachObject(ctx context.Context, q *storage.Query, fn func(*storage.ObjectAttrs) error) error {
+	var a []*storage.ObjectAttrs
+	if err := r.retry(ctx, func() error {
+		a = a[:0]
+		it := r.bkt.Objects(ctx, q)
+		r.listOperationTotalCounter.Inc()
+
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			a = append(a, attrs)
+		}
+	}); err != nil {
+		return err
+	}
+
+	for _, attrs := range a {
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts replication for a given generation.
+func (r *Replica) Start(ctx context.Context) {
+	// Ignore if replica is being used sychronously.
+	if !r.MonitorEnabled {
+		return
+	}
+
+	// Stop previous replication.
+	r.Stop()
+
+	// Wrap context with cancelation.
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	// Start goroutines to manage replica data.
+	r.wg.Add(3)
+	go func() { defer r.wg.Done(); r.monitor(ctx) }()
+	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.validator(ctx) }()
+}
+
+// Stop cancels any outstanding replication and blocks until finished.
+func (r *Replica) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// monitor runs in a separate goroutine and continuously replicates the DB.
+func (r *Replica) monitor(ctx context.Context) {
+	ticker := time.NewTicker(r.SyncInterval)
+	defer ticker.Stop()
+
+	// Continuously check for new data to replicate.
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+
+	for initial := true; ; initial = false {
+		// Enforce a minimum time between synchronization.
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		// Wait for changes to the database.
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		}
+
+		// Fetch new notify channel before replicating data.
+		notify = r.db.Notify()
+
+		// Synchronize the shadow wal into the replication directory. The start
+		// time is tracked so a stalled sync can be detected by health checks.
+		r.setMonitorBusySince(time.Now())
+		err := r.Sync(ctx)
+		r.setMonitorBusySince(time.Time{})
+		if err != nil {
+			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
+			continue
+		}
+	}
+}
+
+// retainer runs in a separate goroutine and handles retention.
+func (r *Replica) retainer(ctx context.Context) {
+	ticker := time.NewTicker(r.RetentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.EnforceRetention(ctx); err != nil {
+				log.Printf("%s(%s): retain error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// validator runs in a separate goroutine and handles periodic validation.
+func (r *Replica) validator(ctx context.Context) {
+	// Initialize counters since validation occurs infrequently.
+	for _, status := range []string{"ok", "error"} {
+		internal.ReplicaValidationTotalCounterVec.WithLabelValues(r.db.Path(), r.Name(), status).Add(0)
+	}
+
+	if r.ValidationInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ValidationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := litestream.ValidateReplica(ctx, r); err != nil {
+				log.Printf("%s(%s): validation error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// CalcPos returns the position for the replica for the current generation.
+// Returns a zero value if there is no active generation.
+func (r *Replica) CalcPos(ctx context.Context, generation string) (pos litestream.Pos, err error) {
+	if err := r.Init(ctx); err != nil {
+		return pos, err
+	}
+
+	pos.Generation = generation
+
+	// Find maximum snapshot index.
+	if pos.Index, err = r.MaxSnapshotIndex(generation); err != nil {
+		return litestream.Pos{}, err
+	}
+
+	index := -1
+	var offset int64
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix:    r.WALDir(generation) + "/",
+		Delimiter: "/",
+	}, func(attrs *storage.ObjectAttrs) error {
+		idx, off, _, err := litestream.ParseWALPath(path.Base(attrs.Name))
+		if err != nil {
+			return nil // invalid wal filename
+		}
+
+		if index == -1 || idx > index {
+			index, offset = idx, 0 // start tracking new wal
+		} else if idx == index && off > offset {
+			offset = off // update offset
+		}
+		return nil
+	}); err != nil {
+		return litestream.Pos{}, err
+	}
+	if index == -1 {
+		return pos, nil // no wal files
+	}
+	pos.Index = index
+	pos.Offset = offset
+
+	return pos, nil
+}
+
+// snapshot copies the entire database to the replica path.
+func (r *Replica) snapshot(ctx context.Context, generation string, index int) (err error) {
+	// Acquire a read lock on the database during snapshot to prevent checkpoints.
+	tx, err := r.db.SQLDB().Begin()
+	if err != nil {
+		return err
+	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Open database file handle.
+	f, err := os.Open(r.db.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshotPath := r.SnapshotPath(generation, index)
+	startTime := time.Now()
+
+	var n int64
+	if err := r.retry(ctx, func() (err error) {
+		// Rewind in case a previous attempt read part of the database.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		n, err = r.writeObject(ctx, snapshotPath, func(w io.Writer) error {
+			ew, err := litestream.NewEncryptWriter(w, r.Encryptor)
+			if err != nil {
+				return err
+			}
+
+			zw, err := r.Codec.NewWriter(ew)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(zw, f); err != nil {
+				return err
+			} else if err := zw.Close(); err != nil {
+				return err
+			}
+			return ew.Close()
+		})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n)) // compressed bytes
+
+	r.setLastSnapshotAt(time.Now())
+	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+
+	return nil
+}
+
+// snapshotN returns the number of snapshots for a generation.
+func (r *Replica) snapshotN(generation string) (int, error) {
+	snapshots, err := r.Snapshots(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, snapshot := range snapshots {
+		if snapshot.Generation == generation {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Init initializes the connection to GCS. No-op if already initialized.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil {
+		return nil
+	}
+
+	var opts []option.ClientOption
+	if r.Endpoint != "" {
+		u, err := url.Parse(r.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid gcs endpoint: %w", err)
+		} else if u.Path == "" || u.Path == "/" {
+			u.Path = "/storage/v1/"
+		}
+
+		// Emulators do not require authentication so a plain HTTP client is
+		// used which also ensures object reads use the endpoint's scheme.
+		opts = append(opts,
+			option.WithEndpoint(u.String()),
+			option.WithHTTPClient(&http.Client{Transport: &endpointTransport{scheme: u.Scheme}}),
+		)
+	} else if r.CredentialsPath != "" {
+		opts = append(opts, option.WithCredentialsFile(r.CredentialsPath))
+	}
+
+	if r.client, err = storage.NewClient(ctx, opts...); err != nil {
+		return fmt.Errorf("cannot create gcs client: %w", err)
+	}
+	r.bkt = r.client.Bucket(r.Bucket)
+
+	return nil
+}
+
+// writeObject uploads the data written by fn to key & returns the number of
+// bytes uploaded. The upload is discarded if fn or the upload fails so a
+// partial object is never committed.
+func (r *Replica) writeObject(ctx context.Context, key string, fn func(w io.Writer) error) (_ int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := r.bkt.Object(key).NewWriter(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+			_ = w.Close()
+		}
+	}()
+
+	cw := &countWriter{w: w}
+	if err := fn(cw); err != nil {
+		return 0, err
+	} else if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// retry calls fn using the replica's retry policy. Returns
+// litestream.ErrCircuitOpen without calling fn if the circuit breaker is open.
+func (r *Replica) retry(ctx context.Context, fn func() error) error {
+	if err := r.CircuitBreaker.Allow(); err != nil {
+		r.circuitOpenCounter.Inc()
+		return err
+	}
+
+	var attempt int
+	err := r.RetryPolicy.Do(ctx, isRetryable, func() error {
+		if attempt++; attempt > 1 {
+			r.retryCounter.Inc()
+		}
+		return fn()
+	})
+
+	// Only transient errors indicate that GCS is unavailable. A canceled
+	// operation says nothing about GCS so its outcome is not recorded.
+	if err != nil && ctx.Err() == context.Canceled {
+		r.CircuitBreaker.Release()
+	} else {
+		r.CircuitBreaker.Record(err != nil && (isRetryable(err) || ctx.Err() != nil))
+	}
+	if r.CircuitBreaker.IsOpen() {
+		r.circuitOpenGauge.Set(1)
+	} else {
+		r.circuitOpenGauge.Set(0)
+	}
+	return err
+}
+
+// isRetryable returns true if err is a transient GCS or network error. The
+// GCS client already retries requests that fail with these status codes until
+// its context is done so dropped connections are typically what is seen here.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code >= http.StatusInternalServerError || gerr.Code == http.StatusTooManyRequests
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTransient returns true if err is a transient error or the operation was
+// rejected by an open circuit breaker.
+func isTransient(err error) bool {
+	return errors.Is(err, litestream.ErrCircuitOpen) || isRetryable(err)
+}
+
+// Sync replays data from the shadow WAL and uploads it to GCS.
+func (r *Replica) Sync(ctx context.Context) (err error) {
+	// Track the sync error & clear last position if an error occurs. The
+	// position is kept after a transient error as GCS is unchanged.
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.syncErr = err
+		if err != nil && !isTransient(err) {
+			r.pos = litestream.Pos{}
+		}
+	}()
+
+	// Connect to GCS, if necessary.
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Find current position of database.
+	dpos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if dpos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	generation := dpos.Generation
+
+	// Calculate position if we don't have a previous position or if the generation changes.
+	// Ensure sync & retainer do not snapshot at the same time.
+	if lastPos := r.LastPos(); lastPos.IsZero() || lastPos.Generation != generation {
+		if err := func() error {
+			r.snapshotMu.Lock()
+			defer r.snapshotMu.Unlock()
+
+			// Create snapshot if no snapshots exist for generation.
+			if n, err := r.snapshotN(generation); err != nil {
+				return err
+			} else if n == 0 {
+				if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+					return err
+				}
+				r.snapshotTotalGauge.Set(1.0)
+			} else {
+				r.snapshotTotalGauge.Set(float64(n))
+			}
+
+			// Determine position, if necessary.
+			pos, err := r.CalcPos(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("cannot determine replica position: %w", err)
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.pos = pos
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Read all WAL files since the last position.
+	for {
+		if err = r.syncWAL(ctx); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Replica) syncWAL(ctx context.Context) (err error) {
+	rd, err := r.db.ShadowWALReader(r.LastPos())
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+	defer rd.Close()
+
+	// Read to intermediate buffer to determine size.
+	pos := rd.Pos()
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	ew, err := litestream.NewEncryptWriter(&buf, r.Encryptor)
+	if err != nil {
+		return err
+	}
+
+	zw, err := r.Codec.NewWriter(ew)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return err
+	} else if err := zw.Close(); err != nil {
+		return err
+	} else if err := ew.Close(); err != nil {
+		return err
+	}
+	n := buf.Len()
+
+	// Build a WAL path with the index/offset as well as size so we can ensure
+	// that files are contiguous without having to decompress.
+	walPath := path.Join(
+		r.WALDir(rd.Pos().Generation),
+		litestream.FormatWALPathWithOffset(pos.Index, pos.Offset)+r.Codec.Ext(),
+	)
+
+	if err := r.retry(ctx, func() error {
+		_, err := r.writeObject(ctx, walPath, func(w io.Writer) error {
+			_, err := w.Write(buf.Bytes())
+			return err
+		})
+		return err
+	}); err != nil {
+		return err
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n)) // compressed bytes
+
+	// Save last replicated position.
+	r.mu.Lock()
+	r.pos = rd.Pos()
+	r.mu.Unlock()
+
+	// Track raw bytes processed & current position.
+	r.walBytesCounter.Add(float64(len(b))) // raw bytes
+	r.walIndexGauge.Set(float64(rd.Pos().Index))
+	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
+
+	return nil
+}
+
+// SnapshotReader returns a reader for snapshot data at the given generation/index.
+func (r *Replica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Find snapshot key as the compression extension may vary.
+	key, err := r.snapshotKey(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pipe download to return an io.Reader.
+	rd, err := r.bkt.Object(key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	r.getOperationTotalCounter.Inc()
+	r.getOperationBytesCounter.Add(float64(rd.Attrs.Size))
+
+	// Decrypt, if necessary, and decompress the snapshot file.
+	dr, err := litestream.NewDecryptReader(rd, r.Encryptor)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+
+	zr, err := litestream.NewCodecReader(dr, key)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	return internal.NewReadCloser(zr, rd), nil
+}
+
+// snapshotKey returns the key of the snapshot at the given generation/index.
+// Returns os.ErrNotExist if no matching snapshot is found.
+func (r *Replica) snapshotKey(ctx context.Context, generation string, index int) (string, error) {
+	var key string
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix: path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x", index)),
+	}, func(attrs *storage.ObjectAttrs) error {
+		if idx, _, err := litestream.ParseSnapshotPath(path.Base(attrs.Name)); err == nil && idx == index && key == "" {
+			key = attrs.Name
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	} else if key == "" {
+		return "", os.ErrNotExist
+	}
+	return key, nil
+}
+
+// WALReader returns a reader for WAL data at the given index.
+// Returns os.ErrNotExist if no matching index is found.
+func (r *Replica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.WALReaderFrom(ctx, generation, index, 0)
+}
+
+// WALReaderFrom returns a reader for WAL data in index starting at offset.
+// Segments which end before offset are not downloaded.
+func (r *Replica) WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	// Collect all files for the index.
+	var keys []string
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix: path.Join(r.WALDir(generation), fmt.Sprintf("%08x_", index)),
+	}, func(attrs *storage.ObjectAttrs) error {
+		if _, _, _, err := litestream.ParseWALPath(path.Base(attrs.Name)); err != nil {
+			return nil
+		}
+		keys = append(keys, attrs.Name)
+		return nil
+	}); err != nil {
+		return nil, err
+	} else if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Skip segments which end before offset.
+	var start int64
+	for i := len(keys) - 1; i >= 0; i-- {
+		if _, off, _, _ := litestream.ParseWALPath(path.Base(keys[i])); off <= offset {
+			keys, start = keys[i:], off
+			break
+		}
+	}
+
+	// Open each file and concatenate into a multi-reader.
+	var buf bytes.Buffer
+	pos := start
+	for _, key := range keys {
+		// Ensure offset is correct as we copy segments into buffer.
+		_, off, _, _ := litestream.ParseWALPath(path.Base(key))
+		if off != pos {
+			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at remote offset %d, expected offset %d", generation, index, off, pos)
+		}
+
+		// Pipe download to return an io.Reader.
+		rd, err := r.bkt.Object(key).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer rd.Close()
+
+		r.getOperationTotalCounter.Inc()
+		r.getOperationBytesCounter.Add(float64(rd.Attrs.Size))
+
+		dr, err := litestream.NewDecryptReader(rd, r.Encryptor)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := litestream.NewCodecReader(dr, key)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := io.Copy(&buf, zr)
+		if err != nil {
+			return nil, err
+		} else if err := zr.Close(); err != nil {
+			return nil, err
+		}
+		pos += n
+	}
+
+	return internal.Discard(ioutil.NopCloser(&buf), offset-start)
+}
+
+// Snapshot creates a snapshot of the database at its current position.
+// No snapshot is created if one already exists for the current WAL index.
+func (r *Replica) Snapshot(ctx context.Context) error {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Ensure sync & retainer do not snapshot at the same time.
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	pos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if pos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	return r.snapshot(ctx, pos.Generation, pos.Index)
+}
+
+// EnforceRetention forces a new snapshot once the retention interval has passed.
+// Older snapshots and WAL files are then removed.
+func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
+	if err := r.Init(ctx); err != nil {
+		return err
+	}
+
+	// Ensure sync & retainer do not snapshot at the same time.
+	var all, snapshots, walSnapshots []*litestream.SnapshotInfo
+	if err := func() error {
+		r.snapshotMu.Lock()
+		defer r.snapshotMu.Unlock()
+
+		// Find current position of database.
+		pos, err := r.db.Pos()
+		if err != nil {
+			return fmt.Errorf("cannot determine current generation: %w", err)
+		} else if pos.IsZero() {
+			return fmt.Errorf("no generation, waiting for data")
+		}
+
+		// Obtain list of snapshots that are within the retention period.
+		if all, err = r.Snapshots(ctx); err != nil {
+			return fmt.Errorf("cannot obtain snapshot list: %w", err)
+		}
+		r.setLastSnapshotAt(litestream.LatestSnapshotTime(all))
+		now := time.Now()
+		snapshots, walSnapshots = litestream.RetainSnapshots(all, r.Retention, r.RetentionPolicy, now)
+
+		// If no retained snapshots with WAL exist or the retention policy has
+		// no snapshot for its finest interval, create a new snapshot.
+		if litestream.FindMinSnapshotByGeneration(walSnapshots, pos.Generation) == nil ||
+			(r.RetentionPolicy.SnapshotDue(all, pos.Generation, now) && !litestream.ContainsSnapshot(all, pos.Generation, pos.Index)) {
+			if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+				return fmt.Errorf("cannot snapshot: %w", err)
+			}
+			info := &litestream.SnapshotInfo{Generation: pos.Generation, Index: pos.Index}
+			snapshots, walSnapshots = append(snapshots, info), append(walSnapshots, info)
+		}
+
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// Loop over generations and delete unretained snapshots & WAL files.
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot obtain generations: %w", err)
+	}
+	for _, generation := range generations {
+		// Find earliest retained snapshot for this generation.
+		snapshot := litestream.FindMinSnapshotByGeneration(snapshots, generation)
+
+		// Delete generations if it has no snapshots being retained.
+		if snapshot == nil {
+			if err := r.deleteGenerationBefore(ctx, generation, -1, nil, nil); err != nil {
+				return fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
+			}
+			continue
+		}
+
+		// Otherwise delete unretained snapshots & all WAL files before the
+		// lowest index that retains WAL. Generations retained only by coarser
+		// policy tiers keep no WAL files.
+		walIndex := math.MaxInt32
+		if snapshot := litestream.FindMinSnapshotByGeneration(walSnapshots, generation); snapshot != nil {
+			walIndex = snapshot.Index
+		}
+		if err := r.deleteGenerationBefore(ctx, generation, walIndex, all, snapshots); err != nil {
+			return fmt.Errorf("cannot delete generation %q files before index %d: %w", generation, walIndex, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteGenerationBefore deletes WAL files before index & listed snapshots
+// that are not retained. All files are deleted if index is -1.
+func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string, index int, snapshots, retained []*litestream.SnapshotInfo) (err error) {
+	// Collect all files for the generation.
+	var keys []string
+	if err := r.eachObject(ctx, &storage.Query{
+		Prefix: r.GenerationDir(generation) + "/",
+	}, func(attrs *storage.ObjectAttrs) error {
+		// Skip retained snapshots, snapshots created since listing & WALs
+		// that are after the search index unless -1.
+		if index != -1 {
+			if idx, _, err := litestream.ParseSnapshotPath(path.Base(attrs.Name)); err == nil {
+				if !litestream.ContainsSnapshot(snapshots, generation, idx) || litestream.ContainsSnapshot(retained, generation, idx) {
+					return nil
+				}
+			} else if idx, _, _, err := litestream.ParseWALPath(path.Base(attrs.Name)); err == nil && idx >= index {
+				return nil
+			}
+		}
+
+		keys = append(keys, attrs.Name)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// GCS does not support batch deletes so delete each object individually.
+	for _, key := range keys {
+		if err := r.retry(ctx, func() error {
+			if err := r.bkt.Object(key).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+	}
+
+	log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, len(keys))
+
+	return nil
+}
+
+// endpointTransport rewrites the scheme of outgoing requests. The GCS client
+// always reads objects over HTTPS unless STORAGE_EMULATOR_HOST is set.
+type endpointTransport struct {
+	scheme string
+}
+
+// RoundTrip executes req against the default transport using t's scheme.
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.scheme
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// GCS metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "gcs",
+		Name:      "operation_total",
+		Help:      "The number of GCS operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "gcs",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by GCS operations",
+	}, []string{"db", "name", "type"})
+)
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
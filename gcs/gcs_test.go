@@ -0,0 +1,662 @@
+package gcs_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/gcs"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	// Ensure replica can sync to an emulator and be restored from it.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write to the database multiple times and sync periodically so that
+		// multiple WAL indexes & segments are uploaded.
+		n := db.MinCheckpointPageN * 2
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure positions match.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Index == 0 {
+			t.Fatal("expected multiple wal indexes")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		// Calculated position points to the start of the last WAL segment.
+		if calcPos, err := r.CalcPos(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if calcPos.Generation != pos.Generation || calcPos.Index != pos.Index || calcPos.Offset > pos.Offset {
+			t.Fatalf("CalcPos()=%v, want <= %v", calcPos, pos)
+		}
+
+		// Ensure generation is listed along with its snapshot.
+		if generations, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := generations, []string{pos.Generation}; len(got) != 1 || got[0] != want[0] {
+			t.Fatalf("Generations()=%v, want %v", got, want)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len(Snapshots())=%d, want %d", got, want)
+		}
+
+		// Restore from the replica & verify data.
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := testingutil.MustOpenSQLDB(t, outputPath)
+		defer testingutil.MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure replica data is encrypted & can only be restored with the key.
+	t.Run("Encrypted", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		key := make([]byte, litestream.EncryptionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		} else if r.Encryptor, err = litestream.NewEncryptor(key); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('plaintextvalue')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Ensure no uploaded object contains plaintext data.
+		for _, key := range s.keys() {
+			if bytes.Contains(s.objects[key].data, []byte("plaintextvalue")) {
+				t.Fatalf("plaintext found in %s", key)
+			}
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Restoring without a key should fail.
+		unkeyed := gcs.NewReplica(db, "")
+		unkeyed.Bucket, unkeyed.Path, unkeyed.Endpoint = r.Bucket, r.Path, r.Endpoint
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), unkeyed, opt); !errors.Is(err, litestream.ErrEncryptionKeyRequired) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Restore with key & verify data.
+		opt.OutputPath = filepath.Join(t.TempDir(), "db")
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := testingutil.MustOpenSQLDB(t, opt.OutputPath)
+		defer testingutil.MustCloseSQLDB(t, other)
+
+		var bar string
+		if err := other.QueryRow(`SELECT bar FROM foo`).Scan(&bar); err != nil {
+			t.Fatal(err)
+		} else if got, want := bar, "plaintextvalue"; got != want {
+			t.Fatalf("bar=%q, want %q", got, want)
+		}
+	})
+}
+
+func TestReplica_Snapshot(t *testing.T) {
+	// Ensure a failed snapshot upload is discarded instead of being committed.
+	t.Run("WriteError", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Codec = &errorCodec{Codec: r.Codec, err: errors.New("marker")}
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := r.Snapshot(context.Background()); err == nil || err.Error() != "marker" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, key := range s.keys() {
+			if strings.Contains(key, "/snapshots/") {
+				t.Fatalf("unexpected snapshot object: %s", key)
+			}
+		}
+	})
+}
+
+func TestReplica_SnapshotReader(t *testing.T) {
+	// Ensure a missing snapshot returns a "not exist" error.
+	t.Run("ErrNotExist", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		r := gcs.NewReplica(nil, "")
+		r.Bucket, r.Path, r.Endpoint = "bkt", "db", s.URL
+
+		if _, err := r.SnapshotReader(context.Background(), "0000000000000000", 0); !os.IsNotExist(err) {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+}
+
+func TestReplica_EnforceRetention(t *testing.T) {
+	// Ensure older generations are removed once a new snapshot is retained.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Retention = 0
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Upload an unrelated generation which should be removed.
+		s.PutObject("bkt", "db/generations/0000000000000000/snapshots/00000000.snapshot.lz4", nil)
+
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if generations, err := r.Generations(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if len(generations) != 1 || generations[0] != pos.Generation {
+			t.Fatalf("unexpected generations: %v", generations)
+		}
+	})
+}
+
+func TestReplica_Retry(t *testing.T) {
+	// Ensure failed uploads are retried.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+
+		s.FailNext(2)
+		MustSyncRows(t, db, sqldb, r, 1)
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure the replica position is kept after a transient failure so the
+	// next sync does not recalculate it from the replica.
+	t.Run("KeepPos", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		requestN := s.RequestN()
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := s.RequestN()-requestN, 1; got != want {
+			t.Fatalf("requests=%d, want %d", got, want) // wal upload only, no listing
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure requests are rejected without contacting GCS while the circuit
+	// breaker is open & that a successful trial closes it.
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		now := time.Now()
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		r.CircuitBreaker = &litestream.CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Now: func() time.Time { return now }}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if !r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected open circuit")
+		}
+
+		requestN := s.RequestN()
+		if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrCircuitOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := s.RequestN(); got != requestN {
+			t.Fatalf("unexpected requests while circuit open: n=%d", got-requestN)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		now = now.Add(time.Hour)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected closed circuit")
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+}
+
+// MustSyncRows inserts n rows into the "foo" table, syncing the database &
+// replica after each one. Returns the current generation.
+func MustSyncRows(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *gcs.Replica, n int) string {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE IF NOT EXISTS foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pos.Generation
+}
+
+// MustRestoreRowCount restores the generation from r & verifies the number of
+// rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r *gcs.Replica, generation string, n int) {
+	tb.Helper()
+
+	outputPath := filepath.Join(tb.TempDir(), "db")
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath, opt.Generation = outputPath, generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	other := testingutil.MustOpenSQLDB(tb, outputPath)
+	defer testingutil.MustCloseSQLDB(tb, other)
+
+	var count int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+		tb.Fatal(err)
+	} else if got, want := count, n; got != want {
+		tb.Fatalf("n=%d, want %d", got, want)
+	}
+}
+
+// errorCodec wraps a codec & returns err when a compressed writer is closed.
+type errorCodec struct {
+	litestream.Codec
+	err error
+}
+
+func (c *errorCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw, err := c.Codec.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &errorWriteCloser{WriteCloser: zw, err: c.err}, nil
+}
+
+type errorWriteCloser struct {
+	io.WriteCloser
+	err error
+}
+
+func (w *errorWriteCloser) Close() error {
+	_ = w.WriteCloser.Close()
+	return w.err
+}
+
+// Server is a minimal, in-memory implementation of the GCS JSON API.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]*object // keyed by "bucket/name"
+	requestN int                // number of requests received
+	failN    int                // number of subsequent requests to drop
+	failing  bool               // if true, all requests are dropped
+}
+
+type object struct {
+	bucket    string
+	name      string
+	data      []byte
+	createdAt time.Time
+}
+
+// MustOpenServer returns a new, running emulator on a random local port.
+func MustOpenServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := &Server{objects: make(map[string]*object)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewReplica returns a new replica connected to the server.
+func (s *Server) NewReplica(tb testing.TB, db *litestream.DB) *gcs.Replica {
+	r := gcs.NewReplica(db, "")
+	r.Bucket, r.Path, r.Endpoint = "bkt", "db", s.URL
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+	return r
+}
+
+// PutObject writes an object directly to the server's storage.
+func (s *Server) PutObject(bucket, name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+name] = &object{bucket: bucket, name: name, data: data, createdAt: time.Now()}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requestN++
+	fail := s.failing || s.failN > 0
+	if s.failN > 0 {
+		s.failN--
+	}
+	s.mu.Unlock()
+
+	// Drop the connection so the request fails with a network error. The GCS
+	// client retries 5xx responses itself until its context is done.
+	if fail {
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		s.handleUpload(w, r)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		s.handleList(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/"):
+		s.handleDelete(w, r)
+	case r.Method == "GET":
+		s.handleRead(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/")[0]
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	// First part contains the object metadata, second part contains the data.
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	if part, err := mr.NextPart(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := json.NewDecoder(part).Decode(&attrs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	part, err := mr.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.PutObject(bucket, attrs.Name, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, s.objects[bucket+"/"+attrs.Name].resource())
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o")
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]map[string]interface{}, 0)
+	var prefixes []string
+	seen := make(map[string]bool)
+
+	for _, key := range s.keys() {
+		obj := s.objects[key]
+		if obj.bucket != bucket || !strings.HasPrefix(obj.name, prefix) {
+			continue
+		}
+
+		// Collapse objects below the delimiter into a single prefix.
+		if delimiter != "" {
+			if i := strings.Index(obj.name[len(prefix):], delimiter); i >= 0 {
+				if p := obj.name[:len(prefix)+i+len(delimiter)]; !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		items = append(items, obj.resource())
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"kind":     "storage#objects",
+		"items":    items,
+		"prefixes": prefixes,
+	})
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	a := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/b/"), "/o/", 2)
+	if len(a) != 2 {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	name, err := url.PathUnescape(a[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := a[0] + "/" + name
+	if _, ok := s.objects[key]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	delete(s.objects, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRead(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	obj := s.objects[strings.TrimPrefix(r.URL.Path, "/")]
+	s.mu.Unlock()
+
+	if obj == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	_, _ = w.Write(obj.data)
+}
+
+// SetFailing sets whether all subsequent requests fail by dropping the connection.
+func (s *Server) SetFailing(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = v
+}
+
+// FailNext fails the next n requests by dropping the connection.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failN = n
+}
+
+// RequestN returns the number of requests received.
+func (s *Server) RequestN() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestN
+}
+
+// keys returns a sorted list of object keys. Must be called under lock.
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resource returns the JSON API representation of the object.
+func (o *object) resource() map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      o.bucket,
+		"name":        o.name,
+		"size":        strconv.Itoa(len(o.data)),
+		"timeCreated": o.createdAt.UTC().Format(time.RFC3339Nano),
+		"updated":     o.createdAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
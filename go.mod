@@ -3,10 +3,18 @@ module github.com/benbjohnson/litestream
 go 1.15
 
 require (
+	cloud.google.com/go/storage v1.15.0
+	github.com/Azure/azure-storage-blob-go v0.13.0
 	github.com/aws/aws-sdk-go v1.27.0
 	github.com/davecgh/go-spew v1.1.1
+	github.com/google/uuid v1.2.0 // indirect
+	github.com/klauspost/compress v1.11.7
+	github.com/mattn/go-shellwords v1.0.12
 	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/pierrec/lz4/v4 v4.1.3
+	github.com/pkg/sftp v1.13.5
 	github.com/prometheus/client_golang v1.9.0
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	google.golang.org/api v0.45.0
 	gopkg.in/yaml.v2 v2.4.0
 )
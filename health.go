@@ -0,0 +1,189 @@
+package litestream
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMonitorTimeout is the default time since a database monitor last
+// ticked before the process is no longer considered live.
+const DefaultMonitorTimeout = 1 * time.Minute
+
+// HealthHandler serves liveness & readiness checks for managed databases.
+//
+//	GET /healthz   fails if a database monitor has stopped ticking or a
+//	               replica monitor is stuck in a sync
+//	GET /readyz    fails if replicas are lagging or database syncs are failing
+//
+// Healthy checks return a 200 status code. Failed checks return a 503 status
+// code along with a list of the reasons for failure.
+type HealthHandler struct {
+	mu  sync.RWMutex
+	dbs []*DB
+
+	// Maximum time a replica can lag behind its database before the process
+	// is no longer ready. Disabled if zero.
+	MaxLag time.Duration
+
+	// Maximum number of WAL bytes a replica can lag behind its database
+	// before the process is no longer ready. Disabled if zero.
+	MaxLagBytes int64
+
+	// Number of consecutive failed database syncs before the process is no
+	// longer ready. Disabled if zero.
+	MaxSyncErrorN int
+
+	// Maximum time since a database monitor last ticked, or that a replica
+	// monitor can spend in a single sync, before the process is no longer
+	// live. Replica syncs include uploading snapshots so this should be
+	// longer than the time to upload the largest database.
+	MonitorTimeout time.Duration
+}
+
+// NewHealthHandler returns a new instance of HealthHandler for dbs.
+func NewHealthHandler(dbs []*DB) *HealthHandler {
+	return &HealthHandler{
+		dbs:            dbs,
+		MonitorTimeout: DefaultMonitorTimeout,
+	}
+}
+
+// SetDBs replaces the list of databases served by the handler.
+func (h *HealthHandler) SetDBs(dbs []*DB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dbs = dbs
+}
+
+// DBs returns the list of databases served by the handler.
+func (h *HealthHandler) DBs() []*DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dbs
+}
+
+// ServeHTTP routes requests to the appropriate check.
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	var errs []string
+	switch r.URL.Path {
+	case "/healthz":
+		errs = h.checkLive()
+	case "/readyz":
+		errs = h.checkReady()
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	if len(errs) > 0 {
+		writeAdminJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Errors: errs})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// checkLive returns a list of reasons the process is not live.
+func (h *HealthHandler) checkLive() (errs []string) {
+	for _, db := range h.DBs() {
+		if db.MonitorInterval <= 0 {
+			continue // monitoring disabled
+		}
+
+		if t := db.LastMonitorAt(); t.IsZero() {
+			errs = append(errs, fmt.Sprintf("%s: monitor not running", db.Path()))
+		} else if d := time.Since(t); d > h.MonitorTimeout {
+			errs = append(errs, fmt.Sprintf("%s: monitor last ticked %s ago", db.Path(), d.Round(time.Millisecond)))
+		}
+
+		// Replica monitors only run when there are changes to replicate so
+		// they fail if a single sync has been running for too long.
+		for _, r := range db.ReplicasSnapshot() {
+			rr, ok := r.(ReplicaStatusReporter)
+			if !ok {
+				continue
+			}
+			if t := rr.MonitorBusySince(); !t.IsZero() {
+				if d := time.Since(t); d > h.MonitorTimeout {
+					errs = append(errs, fmt.Sprintf("%s(%s): replica monitor syncing for %s", db.Path(), r.Name(), d.Round(time.Millisecond)))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkReady returns a list of reasons the process is not ready.
+func (h *HealthHandler) checkReady() (errs []string) {
+	for _, db := range h.DBs() {
+		if h.MaxSyncErrorN > 0 {
+			if n := db.SyncErrorN(); n >= h.MaxSyncErrorN {
+				errs = append(errs, fmt.Sprintf("%s: %d consecutive sync errors", db.Path(), n))
+			}
+		}
+
+		dpos, err := db.Pos()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: cannot determine position: %s", db.Path(), err))
+			continue
+		} else if dpos.IsZero() {
+			continue // no data to replicate
+		}
+
+		for _, r := range db.ReplicasSnapshot() {
+			rpos := r.LastPos()
+			if rpos.Generation == dpos.Generation && !posLess(rpos, dpos) {
+				continue // caught up
+			}
+
+			if h.MaxLag > 0 {
+				if t := db.LaggingSince(rpos); !t.IsZero() {
+					if d := time.Since(t); d > h.MaxLag {
+						errs = append(errs, fmt.Sprintf("%s(%s): replica lagging by %s", db.Path(), r.Name(), d.Round(time.Millisecond)))
+					}
+				}
+			}
+
+			if h.MaxLagBytes > 0 {
+				if n, ok := replicaLagBytes(db, dpos, rpos); !ok {
+					errs = append(errs, fmt.Sprintf("%s(%s): replica position unknown", db.Path(), r.Name()))
+				} else if n > h.MaxLagBytes {
+					errs = append(errs, fmt.Sprintf("%s(%s): replica lagging by %d bytes", db.Path(), r.Name(), n))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// replicaLagBytes returns the number of shadow WAL bytes between the replica
+// position rpos & the database position dpos. Returns false if the replica is
+// not in the current generation or the shadow WAL files no longer exist.
+func replicaLagBytes(db *DB, dpos, rpos Pos) (int64, bool) {
+	if rpos.Generation != dpos.Generation {
+		return 0, false
+	}
+
+	n := dpos.Offset - rpos.Offset
+	for index := rpos.Index; index < dpos.Index; index++ {
+		fi, err := os.Stat(db.ShadowWALPath(dpos.Generation, index))
+		if err != nil {
+			return 0, false
+		}
+		n += fi.Size()
+	}
+	return n, true
+}
+
+// healthStatus is the JSON representation of a health check result.
+type healthStatus struct {
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+}
@@ -0,0 +1,201 @@
+package litestream_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestHealthHandler_Live(t *testing.T) {
+	// Ensure liveness fails once the monitor stops ticking.
+	t.Run("OK", func(t *testing.T) {
+		db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+		db.MonitorInterval = 10 * time.Millisecond
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewHealthHandler([]*litestream.DB{db})
+		h.MonitorTimeout = 100 * time.Millisecond
+		WaitForHealthStatus(t, h, "/healthz", http.StatusOK)
+
+		MustCloseDB(t, db)
+		WaitForHealthStatus(t, h, "/healthz", http.StatusServiceUnavailable)
+	})
+
+	// Ensure liveness fails if a replica monitor is stuck in a sync.
+	t.Run("ReplicaMonitor", func(t *testing.T) {
+		db := litestream.NewDB(filepath.Join(t.TempDir(), "db"))
+		db.MonitorInterval = 10 * time.Millisecond
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer MustCloseDB(t, db)
+
+		r := &stalledReplica{FileReplica: litestream.NewFileReplica(db, "", t.TempDir())}
+		r.MonitorEnabled = false
+		db.Replicas = []litestream.Replica{r}
+
+		h := litestream.NewHealthHandler([]*litestream.DB{db})
+		h.MonitorTimeout = 100 * time.Millisecond
+		WaitForHealthStatus(t, h, "/healthz", http.StatusOK)
+
+		r.busySince = time.Now().Add(-time.Second)
+		WaitForHealthStatus(t, h, "/healthz", http.StatusServiceUnavailable)
+	})
+
+	// Ensure databases without a monitor are ignored.
+	t.Run("MonitorDisabled", func(t *testing.T) {
+		db := MustOpenDB(t)
+		defer MustCloseDB(t, db)
+		MustServeJSON(t, litestream.NewHealthHandler([]*litestream.DB{db}), "GET", "/healthz", http.StatusOK, nil)
+	})
+}
+
+func TestHealthHandler_Ready(t *testing.T) {
+	// Ensure readiness fails when a replica lags by too many bytes.
+	t.Run("MaxLagBytes", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		h := litestream.NewHealthHandler([]*litestream.DB{db})
+		h.MaxLagBytes = 1024
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusOK, nil)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusServiceUnavailable, nil)
+
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusOK, nil)
+
+		// A small write should be within the threshold.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		h.MaxLagBytes = 1 << 20
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusOK, nil)
+	})
+
+	// Ensure readiness fails when a replica lags for too long.
+	t.Run("MaxLag", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait before writing so lag is measured from the write, not the
+		// last replica sync.
+		h := litestream.NewHealthHandler([]*litestream.DB{db})
+		h.MaxLag = 100 * time.Millisecond
+		time.Sleep(h.MaxLag)
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusOK, nil)
+
+		time.Sleep(h.MaxLag)
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusServiceUnavailable, nil)
+
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusOK, nil)
+	})
+
+	// Ensure readiness fails after consecutive sync errors.
+	t.Run("MaxSyncErrorN", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		h := litestream.NewHealthHandler([]*litestream.DB{db})
+		h.MaxSyncErrorN = 2
+
+		// Replace generation file with a directory so syncs fail.
+		if err := os.Remove(db.GenerationNamePath()); err != nil {
+			t.Fatal(err)
+		} else if err := os.Mkdir(db.GenerationNamePath(), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Sync(); err == nil {
+			t.Fatal("expected error")
+		} else if err := db.Sync(); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := db.SyncErrorN(), 2; got != want {
+			t.Fatalf("SyncErrorN()=%d, want %d", got, want)
+		}
+
+		var status struct{ Errors []string }
+		MustServeJSON(t, h, "GET", "/readyz", http.StatusServiceUnavailable, &status)
+		if got, want := status.Errors[0], db.Path()+": 2 consecutive sync errors"; got != want {
+			t.Fatalf("error=%q, want %q", got, want)
+		}
+
+		// Ensure a successful sync resets the error count.
+		if err := os.Remove(db.GenerationNamePath()); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if got, want := db.SyncErrorN(), 0; got != want {
+			t.Fatalf("SyncErrorN()=%d, want %d", got, want)
+		}
+	})
+}
+
+// stalledReplica is a file replica which reports its monitor as syncing since
+// busySince, if set.
+type stalledReplica struct {
+	*litestream.FileReplica
+	busySince time.Time
+}
+
+func (r *stalledReplica) MonitorBusySince() time.Time { return r.busySince }
+
+// WaitForHealthStatus waits for a health check to return the given status code.
+func WaitForHealthStatus(tb testing.TB, h http.Handler, path string, code int) {
+	tb.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code == code {
+			return
+		}
+
+		select {
+		case <-timeout:
+			tb.Fatalf("timeout waiting for %s status %d: %d %s", path, code, w.Code, w.Body.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
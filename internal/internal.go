@@ -2,6 +2,7 @@ package internal
 
 import (
 	"io"
+	"io/ioutil"
 )
 
 // ReadCloser wraps a reader to also attach a separate closer.
@@ -30,3 +31,13 @@ func (r *ReadCloser) Close() error {
 	}
 	return r.c.Close()
 }
+
+// Discard reads & discards the first n bytes of rc & returns rc. If rc has
+// fewer than n bytes then rc is returned at EOF. Closes rc on error.
+func Discard(rc io.ReadCloser, n int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(ioutil.Discard, rc, n); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
@@ -41,4 +41,41 @@ var (
 		Name:      "validation_total",
 		Help:      "The number of validations performed",
 	}, []string{"db", "name", "status"})
+
+	ReplicaSnapshotSecondsHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_seconds",
+		Help:      "Time spent creating snapshots, in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"db", "name"})
+
+	ReplicaSnapshotLockSecondsHistogramVec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "snapshot_lock_seconds",
+		Help:      "Time the database read lock was held while creating snapshots, in seconds",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"db", "name"})
+
+	ReplicaRetryTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "retry_total",
+		Help:      "The number of retried replica operations",
+	}, []string{"db", "name"})
+
+	ReplicaCircuitOpenGaugeVec = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "circuit_open",
+		Help:      "Set to 1 while the replica's circuit breaker is open",
+	}, []string{"db", "name"})
+
+	ReplicaCircuitOpenTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "replica",
+		Name:      "circuit_open_total",
+		Help:      "The number of operations rejected by an open circuit breaker",
+	}, []string{"db", "name"})
 )
@@ -38,6 +38,7 @@ const (
 var (
 	ErrNoSnapshots      = errors.New("no snapshots available")
 	ErrChecksumMismatch = errors.New("invalid replica, checksum mismatch")
+	ErrOutputPathExists = errors.New("output path already exists")
 )
 
 // SnapshotInfo represents file information about a snapshot.
@@ -74,6 +75,18 @@ func FindMinSnapshotByGeneration(a []*SnapshotInfo, generation string) *Snapshot
 	return min
 }
 
+// LatestSnapshotTime returns the creation time of the most recent snapshot.
+// Returns a zero time if a is empty.
+func LatestSnapshotTime(a []*SnapshotInfo) time.Time {
+	var t time.Time
+	for _, snapshot := range a {
+		if snapshot.CreatedAt.After(t) {
+			t = snapshot.CreatedAt
+		}
+	}
+	return t
+}
+
 // WALInfo represents file information about a WAL file.
 type WALInfo struct {
 	Name       string
@@ -105,6 +118,24 @@ func (p Pos) IsZero() bool {
 	return p == (Pos{})
 }
 
+// ParsePos parses a position in the format returned by Pos.String()
+// (e.g. "0123456789abcdef/00000001:4152").
+func ParsePos(s string) (Pos, error) {
+	a := posRegex.FindStringSubmatch(s)
+	if a == nil {
+		return Pos{}, fmt.Errorf("invalid position: %q", s)
+	}
+
+	index, _ := strconv.ParseUint(a[2], 16, 64)
+	offset, err := strconv.ParseInt(a[3], 10, 64)
+	if err != nil {
+		return Pos{}, fmt.Errorf("invalid position offset: %q", s)
+	}
+	return Pos{Generation: a[1], Index: int(index), Offset: offset}, nil
+}
+
+var posRegex = regexp.MustCompile(`^([0-9a-f]{16})/([0-9a-f]{8}):([0-9]+)$`)
+
 // Checksum computes a running SQLite checksum over a byte slice.
 func Checksum(bo binary.ByteOrder, s0, s1 uint32, b []byte) (uint32, uint32) {
 	assert(len(b)%8 == 0, "misaligned checksum byte slice")
@@ -214,7 +245,7 @@ func ParseSnapshotPath(s string) (index int, ext string, err error) {
 	return int(i64), a[2], nil
 }
 
-var snapshotPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(.snapshot(?:.lz4)?)$`)
+var snapshotPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(.snapshot(?:.lz4|.zst|.gz)?)$`)
 
 // IsWALPath returns true if s is a path to a WAL file.
 func IsWALPath(s string) bool {
@@ -249,7 +280,7 @@ func FormatWALPathWithOffset(index int, offset int64) string {
 	return fmt.Sprintf("%08x_%08x%s", index, offset, WALExt)
 }
 
-var walPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(?:_([0-9a-f]{8}))?(.wal(?:.lz4)?)$`)
+var walPathRegex = regexp.MustCompile(`^([0-9a-f]{8})(?:_([0-9a-f]{8}))?(.wal(?:.lz4|.zst|.gz)?)$`)
 
 // isHexChar returns true if ch is a lowercase hex character.
 func isHexChar(ch rune) bool {
@@ -1,6 +1,7 @@
 package litestream
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
@@ -11,11 +12,11 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/litestream/internal"
-	"github.com/pierrec/lz4/v4"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -62,6 +63,53 @@ type Replica interface {
 	WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error)
 }
 
+// WALSegmentLister is implemented by replicas whose WALs() merges the segments
+// of each WAL index into a single WALInfo. WALSegments returns one WALInfo per
+// segment in a generation so that WAL data can be located by timestamp.
+type WALSegmentLister interface {
+	WALSegments(ctx context.Context, generation string) ([]*WALInfo, error)
+}
+
+// WALSegmentReader is implemented by replicas that can read WAL data from the
+// middle of an index. WALReaderFrom returns WAL data in index starting at
+// offset. Segments which end before offset are not read.
+type WALSegmentReader interface {
+	WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error)
+}
+
+// ReplicaStatusReporter is implemented by replicas that track the results of
+// recent syncs & snapshots and the state of their monitor so their status can
+// be reported without reading from the replica's storage.
+type ReplicaStatusReporter interface {
+	// Returns the error from the most recent sync, if any.
+	LastSyncError() error
+
+	// Returns the time of the most recent snapshot, if known.
+	LastSnapshotAt() time.Time
+
+	// Returns the time the background monitor began syncing the current
+	// change or a zero time if it is waiting for changes.
+	MonitorBusySince() time.Time
+}
+
+// ReplicaSyncer is implemented by replicas that can be synced on demand, such
+// as for a final sync before the program exits.
+type ReplicaSyncer interface {
+	// Copies any new shadow WAL data from the database to the replica.
+	Sync(ctx context.Context) error
+}
+
+// ReplicaMaintainer is implemented by replicas that support on-demand
+// snapshots & retention enforcement.
+type ReplicaMaintainer interface {
+	// Creates a snapshot of the database at its current position.
+	Snapshot(ctx context.Context) error
+
+	// Forces a snapshot once the retention period has passed and removes
+	// snapshots & WAL files outside of the retention period.
+	EnforceRetention(ctx context.Context) error
+}
+
 // GenerationStats represents high level stats for a single generation.
 type GenerationStats struct {
 	// Count of snapshot & WAL files.
@@ -80,6 +128,10 @@ const (
 )
 
 var _ Replica = (*FileReplica)(nil)
+var _ WALSegmentReader = (*FileReplica)(nil)
+var _ ReplicaStatusReporter = (*FileReplica)(nil)
+var _ ReplicaMaintainer = (*FileReplica)(nil)
+var _ ReplicaSyncer = (*FileReplica)(nil)
 
 // FileReplica is a replica that replicates a DB to a local file path.
 type FileReplica struct {
@@ -87,8 +139,11 @@ type FileReplica struct {
 	name string // replica name, optional
 	dst  string // destination path
 
-	mu  sync.RWMutex
-	pos Pos // last position
+	mu         sync.RWMutex
+	pos        Pos       // last position
+	syncErr    error     // error from last sync, if any
+	snapshotAt time.Time // time of most recent snapshot, if known
+	monitorAt  time.Time // start of current monitor sync, if any
 
 	wg     sync.WaitGroup
 	cancel func()
@@ -98,16 +153,38 @@ type FileReplica struct {
 	walIndexGauge      prometheus.Gauge
 	walOffsetGauge     prometheus.Gauge
 
+	snapshotSecondsHistogram     prometheus.Observer
+	snapshotLockSecondsHistogram prometheus.Observer
+
 	// Time to keep snapshots and related WAL files.
 	// Database is snapshotted after interval and older WAL files are discarded.
 	Retention time.Duration
 
+	// Tiered retention policy. Overrides Retention, if set.
+	RetentionPolicy RetentionPolicy
+
 	// Time between checks for retention.
 	RetentionCheckInterval time.Duration
 
+	// Time between snapshots, independent of retention. Reduces the amount
+	// of WAL replayed during a restore. Disabled if zero.
+	SnapshotInterval time.Duration
+
+	// Method used to read the database during a snapshot. Defaults to
+	// SnapshotModeDirect.
+	SnapshotMode string
+
 	// Time between validation checks.
 	ValidationInterval time.Duration
 
+	// Codec used to compress snapshots & WAL files. Defaults to lz4.
+	Codec Codec
+
+	// If set, snapshots & compressed WAL files are encrypted. WAL data is
+	// written as encrypted segments instead of being appended to a plaintext
+	// WAL file if an encryption key is set.
+	Encryptor *Encryptor
+
 	// If true, replica monitors database for changes automatically.
 	// Set to false if replica is being used synchronously (such as in tests).
 	MonitorEnabled bool
@@ -121,6 +198,7 @@ func NewFileReplica(db *DB, name, dst string) *FileReplica {
 		dst:    dst,
 		cancel: func() {},
 
+		Codec:                  &LZ4Codec{},
 		Retention:              DefaultRetention,
 		RetentionCheckInterval: DefaultRetentionCheckInterval,
 		MonitorEnabled:         true,
@@ -134,6 +212,8 @@ func NewFileReplica(db *DB, name, dst string) *FileReplica {
 	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
 	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
 	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.snapshotSecondsHistogram = internal.ReplicaSnapshotSecondsHistogramVec.WithLabelValues(dbPath, r.Name())
+	r.snapshotLockSecondsHistogram = internal.ReplicaSnapshotLockSecondsHistogramVec.WithLabelValues(dbPath, r.Name())
 
 	return r
 }
@@ -168,6 +248,45 @@ func (r *FileReplica) LastPos() Pos {
 	return r.pos
 }
 
+// LastSyncError returns the error from the most recent sync, if any.
+func (r *FileReplica) LastSyncError() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.syncErr
+}
+
+// LastSnapshotAt returns the time of the most recent snapshot created or
+// listed by the replica. Returns a zero time if no snapshot has been seen.
+func (r *FileReplica) LastSnapshotAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotAt
+}
+
+// setLastSnapshotAt updates the time of the most recent snapshot if t is later.
+func (r *FileReplica) setLastSnapshotAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.snapshotAt) {
+		r.snapshotAt = t
+	}
+}
+
+// MonitorBusySince returns the time the monitor began syncing the current
+// change. Returns a zero time if the monitor is waiting for changes.
+func (r *FileReplica) MonitorBusySince() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.monitorAt
+}
+
+// setMonitorBusySince sets the start time of the current monitor sync.
+func (r *FileReplica) setMonitorBusySince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitorAt = t
+}
+
 // GenerationDir returns the path to a generation's root directory.
 func (r *FileReplica) GenerationDir(generation string) string {
 	return filepath.Join(r.dst, "generations", generation)
@@ -180,7 +299,7 @@ func (r *FileReplica) SnapshotDir(generation string) string {
 
 // SnapshotPath returns the path to a snapshot file.
 func (r *FileReplica) SnapshotPath(generation string, index int) string {
-	return filepath.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x.snapshot.lz4", index))
+	return filepath.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, SnapshotExt, r.Codec.Ext()))
 }
 
 // MaxSnapshotIndex returns the highest index for the snapshots.
@@ -402,9 +521,10 @@ func (r *FileReplica) Start(ctx context.Context) {
 	ctx, r.cancel = context.WithCancel(ctx)
 
 	// Start goroutine to replicate data.
-	r.wg.Add(3)
+	r.wg.Add(4)
 	go func() { defer r.wg.Done(); r.monitor(ctx) }()
 	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.snapshotter(ctx) }()
 	go func() { defer r.wg.Done(); r.validator(ctx) }()
 }
 
@@ -436,8 +556,12 @@ func (r *FileReplica) monitor(ctx context.Context) {
 		// Fetch new notify channel before replicating data.
 		notify = r.db.Notify()
 
-		// Synchronize the shadow wal into the replication directory.
-		if err := r.Sync(ctx); err != nil {
+		// Synchronize the shadow wal into the replication directory. The start
+		// time is tracked so a stalled sync can be detected by health checks.
+		r.setMonitorBusySince(time.Now())
+		err := r.Sync(ctx)
+		r.setMonitorBusySince(time.Time{})
+		if err != nil {
 			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
 			continue
 		}
@@ -462,6 +586,28 @@ func (r *FileReplica) retainer(ctx context.Context) {
 	}
 }
 
+// snapshotter runs in a separate goroutine and creates periodic snapshots.
+func (r *FileReplica) snapshotter(ctx context.Context) {
+	if r.SnapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Snapshot(ctx); err != nil {
+				log.Printf("%s(%s): snapshotter error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
 // validator runs in a separate goroutine and handles periodic validation.
 func (r *FileReplica) validator(ctx context.Context) {
 	// Initialize counters since validation occurs infrequently.
@@ -508,12 +654,18 @@ func (r *FileReplica) CalcPos(ctx context.Context, generation string) (pos Pos,
 		return Pos{}, err
 	}
 
-	index := -1
+	index, segmentOffset := -1, int64(-1)
 	for _, fi := range fis {
-		if idx, _, _, err := ParseWALPath(fi.Name()); err != nil {
+		idx, off, _, err := ParseWALPath(fi.Name())
+		if err != nil {
 			continue // invalid wal filename
 		} else if index == -1 || idx > index {
-			index = idx
+			index, segmentOffset = idx, -1
+		}
+
+		// Track the offset of the latest segment for the current index.
+		if idx == index && isWALSegmentPath(fi.Name()) && off > segmentOffset {
+			segmentOffset = off
 		}
 	}
 	if index == -1 {
@@ -521,28 +673,36 @@ func (r *FileReplica) CalcPos(ctx context.Context, generation string) (pos Pos,
 	}
 	pos.Index = index
 
-	// Determine current offset.
-	fi, err := os.Stat(r.WALPath(pos.Generation, pos.Index))
+	// Determine current offset from the uncompressed WAL file, if available.
+	if fi, err := os.Stat(r.WALPath(pos.Generation, pos.Index)); err == nil {
+		pos.Offset = fi.Size()
+		return pos, nil
+	} else if !os.IsNotExist(err) {
+		return Pos{}, err
+	}
+
+	// Otherwise restart from the beginning of the last segment so it is
+	// rewritten by the next sync. If there are no segments then the WAL
+	// file has been compressed so read it to determine its size.
+	if segmentOffset != -1 {
+		pos.Offset = segmentOffset
+		return pos, nil
+	}
+
+	rd, err := r.WALReader(ctx, pos.Generation, pos.Index)
 	if err != nil {
 		return Pos{}, err
 	}
-	pos.Offset = fi.Size()
+	defer rd.Close()
 
+	if pos.Offset, err = io.Copy(ioutil.Discard, rd); err != nil {
+		return Pos{}, err
+	}
 	return pos, nil
 }
 
 // snapshot copies the entire database to the replica path.
 func (r *FileReplica) snapshot(ctx context.Context, generation string, index int) error {
-	// Acquire a read lock on the database during snapshot to prevent checkpoints.
-	tx, err := r.db.db.Begin()
-	if err != nil {
-		return err
-	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer func() { _ = tx.Rollback() }()
-
 	// Ignore if we already have a snapshot for the given WAL index.
 	snapshotPath := r.SnapshotPath(generation, index)
 	if _, err := os.Stat(snapshotPath); err == nil {
@@ -551,12 +711,26 @@ func (r *FileReplica) snapshot(ctx context.Context, generation string, index int
 
 	startTime := time.Now()
 
+	// Obtain a consistent view of the database. Checkpoints are blocked until
+	// the reader is closed or, in backup mode, until the local copy completes.
+	rd, err := r.db.OpenSnapshot(ctx, r.SnapshotMode)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
 	if err := mkdirAll(filepath.Dir(snapshotPath), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
 		return err
-	} else if err := compressFile(r.db.Path(), snapshotPath, r.db.uid, r.db.gid); err != nil {
+	} else if _, err := compressReader(rd, snapshotPath, r.db.mode, r.Codec, r.Encryptor, r.db.uid, r.db.gid); err != nil {
+		return err
+	} else if err := rd.Close(); err != nil {
 		return err
 	}
 
+	r.snapshotSecondsHistogram.Observe(time.Since(startTime).Seconds())
+	r.snapshotLockSecondsHistogram.Observe(rd.LockDuration().Seconds())
+
+	r.setLastSnapshotAt(time.Now())
 	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
 	return nil
 }
@@ -581,12 +755,13 @@ func (r *FileReplica) snapshotN(generation string) (int, error) {
 
 // Sync replays data from the shadow WAL into the file replica.
 func (r *FileReplica) Sync(ctx context.Context) (err error) {
-	// Clear last position if if an error occurs during sync.
+	// Track the sync error & clear last position if an error occurs.
 	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.syncErr = err
 		if err != nil {
-			r.mu.Lock()
 			r.pos = Pos{}
-			r.mu.Unlock()
 		}
 	}()
 
@@ -628,7 +803,13 @@ func (r *FileReplica) Sync(ctx context.Context) (err error) {
 
 	// Read all WAL files since the last position.
 	for {
-		if err = r.syncWAL(ctx); err == io.EOF {
+		if r.Encryptor.HasEncryptionKey() {
+			err = r.syncWALSegment(ctx)
+		} else {
+			err = r.syncWAL(ctx)
+		}
+
+		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
@@ -734,18 +915,59 @@ func (r *FileReplica) syncWAL(ctx context.Context) (err error) {
 	return nil
 }
 
-// compress compresses all WAL files before the current one.
+// syncWALSegment writes WAL data since the last position to a new compressed
+// & encrypted segment file. Used instead of syncWAL() when encrypting as
+// encrypted data cannot be appended to.
+func (r *FileReplica) syncWALSegment(ctx context.Context) (err error) {
+	rd, err := r.db.ShadowWALReader(r.LastPos())
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+	defer rd.Close()
+
+	// Segment filename includes the starting offset of the WAL data.
+	pos := rd.Pos()
+	filename := filepath.Join(r.WALDir(pos.Generation), FormatWALPathWithOffset(pos.Index, pos.Offset)+r.Codec.Ext())
+	if err := mkdirAll(filepath.Dir(filename), r.db.dirmode, r.db.diruid, r.db.dirgid); err != nil {
+		return err
+	}
+
+	n, err := compressReader(rd, filename, r.db.mode, r.Codec, r.Encryptor, r.db.uid, r.db.gid)
+	if err != nil {
+		return err
+	}
+	r.walBytesCounter.Add(float64(n))
+
+	// Save last replicated position.
+	r.mu.Lock()
+	r.pos = rd.Pos()
+	r.mu.Unlock()
+
+	// Track current position
+	r.walIndexGauge.Set(float64(rd.Pos().Index))
+	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
+
+	return nil
+}
+
+// compress compresses all WAL files before the current one. If encrypting,
+// the current WAL file is also compressed as WAL data is written to segments.
 func (r *FileReplica) compress(ctx context.Context, generation string) error {
 	filenames, err := filepath.Glob(filepath.Join(r.WALDir(generation), "*.wal"))
 	if err != nil {
 		return err
-	} else if len(filenames) <= 1 {
-		return nil // no uncompressed wal files or only one active file
 	}
 
 	// Ensure filenames are sorted & remove the last (active) WAL.
 	sort.Strings(filenames)
-	filenames = filenames[:len(filenames)-1]
+	if !r.Encryptor.HasEncryptionKey() {
+		if len(filenames) <= 1 {
+			return nil // no uncompressed wal files or only one active file
+		}
+		filenames = filenames[:len(filenames)-1]
+	}
 
 	// Compress each file from oldest to newest.
 	for _, filename := range filenames {
@@ -755,8 +977,8 @@ func (r *FileReplica) compress(ctx context.Context, generation string) error {
 		default:
 		}
 
-		dst := filename + ".lz4"
-		if err := compressFile(filename, dst, r.db.uid, r.db.gid); err != nil {
+		dst := filename + r.Codec.Ext()
+		if err := compressFile(filename, dst, r.Codec, r.Encryptor, r.db.uid, r.db.gid); err != nil {
 			return err
 		} else if err := os.Remove(filename); err != nil {
 			return err
@@ -786,14 +1008,24 @@ func (r *FileReplica) SnapshotReader(ctx context.Context, generation string, ind
 		f, err := os.Open(filepath.Join(dir, fi.Name()))
 		if err != nil {
 			return nil, err
-		} else if ext == ".snapshot" {
+		} else if ext == SnapshotExt {
 			return f, nil // not compressed, return as-is.
 		}
-		assert(ext == ".snapshot.lz4", "invalid snapshot extension")
 
-		// If compressed, wrap in an lz4 reader and return with wrapper to
-		// ensure that the underlying file is closed.
-		return internal.NewReadCloser(lz4.NewReader(f), f), nil
+		// If compressed, decrypt if necessary & wrap in a decompressing reader.
+		// Return with wrapper to ensure that the underlying file is closed.
+		dr, err := NewDecryptReader(f, r.Encryptor)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		zr, err := NewCodecReader(dr, fi.Name())
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return internal.NewReadCloser(zr, f), nil
 	}
 	return nil, os.ErrNotExist
 }
@@ -801,25 +1033,122 @@ func (r *FileReplica) SnapshotReader(ctx context.Context, generation string, ind
 // WALReader returns a reader for WAL data at the given index.
 // Returns os.ErrNotExist if no matching index is found.
 func (r *FileReplica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
-	filename := r.WALPath(generation, index)
+	return r.WALReaderFrom(ctx, generation, index, 0)
+}
+
+// WALReaderFrom returns a reader for WAL data in index starting at offset.
+// Segments which end before offset are not read.
+func (r *FileReplica) WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error) {
+	filenames, err := r.walFilenames(generation, index)
+	if err != nil {
+		return nil, err
+	} else if len(filenames) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// Skip segments which end before offset.
+	for len(filenames) > 1 {
+		if _, off, _, _ := ParseWALPath(filenames[1]); off > offset {
+			break
+		}
+		filenames = filenames[1:]
+	}
+	_, start, _, _ := ParseWALPath(filenames[0])
+
+	// Stream the file directly if the WAL is stored in a single file.
+	if len(filenames) == 1 {
+		f, err := r.openWALFile(filenames[0])
+		if err != nil {
+			return nil, err
+		}
+		return internal.Discard(f, offset-start)
+	}
+
+	// Otherwise concatenate segments into a buffer & ensure they are contiguous.
+	var buf bytes.Buffer
+	for _, filename := range filenames {
+		if _, off, _, _ := ParseWALPath(filename); off != start+int64(buf.Len()) {
+			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at offset %d, expected offset %d", generation, index, off, start+int64(buf.Len()))
+		}
+
+		if err := func() error {
+			f, err := r.openWALFile(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(&buf, f)
+			return err
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return internal.Discard(ioutil.NopCloser(&buf), offset-start)
+}
+
+// walFilenames returns the paths to all WAL files & segments for an index,
+// sorted by offset.
+func (r *FileReplica) walFilenames(generation string, index int) ([]string, error) {
+	fis, err := ioutil.ReadDir(r.WALDir(generation))
+	if os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	for _, fi := range fis {
+		if idx, _, _, err := ParseWALPath(fi.Name()); err != nil || idx != index {
+			continue
+		}
+		filenames = append(filenames, filepath.Join(r.WALDir(generation), fi.Name()))
+	}
+
+	sort.Slice(filenames, func(i, j int) bool {
+		_, oi, _, _ := ParseWALPath(filenames[i])
+		_, oj, _, _ := ParseWALPath(filenames[j])
+		return oi < oj
+	})
+	return filenames, nil
+}
 
-	// Attempt to read uncompressed file first.
+// openWALFile opens a WAL file or segment. Compressed files are decrypted,
+// if necessary, and decompressed.
+func (r *FileReplica) openWALFile(filename string) (io.ReadCloser, error) {
 	f, err := os.Open(filename)
-	if err == nil {
-		return f, nil // file exist, return
-	} else if err != nil && !os.IsNotExist(err) {
+	if err != nil {
+		return nil, err
+	} else if filepath.Ext(filename) == WALExt {
+		return f, nil // not compressed, return as-is.
+	}
+
+	// If compressed, wrap in a decompressing reader and return with wrapper
+	// to ensure that the underlying file is closed.
+	dr, err := NewDecryptReader(f, r.Encryptor)
+	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
 
-	// Otherwise read the compressed file. Return error if file doesn't exist.
-	f, err = os.Open(filename + ".lz4")
+	zr, err := NewCodecReader(dr, filename)
 	if err != nil {
+		_ = f.Close()
 		return nil, err
 	}
+	return internal.NewReadCloser(zr, f), nil
+}
 
-	// If compressed, wrap in an lz4 reader and return with wrapper to
-	// ensure that the underlying file is closed.
-	return internal.NewReadCloser(lz4.NewReader(f), f), nil
+// Snapshot creates a snapshot of the database at its current position.
+// No snapshot is created if one already exists for the current WAL index.
+func (r *FileReplica) Snapshot(ctx context.Context) error {
+	pos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if pos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	return r.snapshot(ctx, pos.Generation, pos.Index)
 }
 
 // EnforceRetention forces a new snapshot once the retention interval has passed.
@@ -834,18 +1163,23 @@ func (r *FileReplica) EnforceRetention(ctx context.Context) (err error) {
 	}
 
 	// Obtain list of snapshots that are within the retention period.
-	snapshots, err := r.Snapshots(ctx)
+	all, err := r.Snapshots(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot obtain snapshot list: %w", err)
 	}
-	snapshots = FilterSnapshotsAfter(snapshots, time.Now().Add(-r.Retention))
+	r.setLastSnapshotAt(LatestSnapshotTime(all))
+	now := time.Now()
+	snapshots, walSnapshots := RetainSnapshots(all, r.Retention, r.RetentionPolicy, now)
 
-	// If no retained snapshots exist, create a new snapshot.
-	if len(snapshots) == 0 {
+	// If no retained snapshots with WAL exist or the retention policy has no
+	// snapshot for its finest interval, create a new snapshot.
+	if FindMinSnapshotByGeneration(walSnapshots, pos.Generation) == nil ||
+		(r.RetentionPolicy.SnapshotDue(all, pos.Generation, now) && !ContainsSnapshot(all, pos.Generation, pos.Index)) {
 		if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
 			return fmt.Errorf("cannot snapshot: %w", err)
 		}
-		snapshots = append(snapshots, &SnapshotInfo{Generation: pos.Generation, Index: pos.Index})
+		info := &SnapshotInfo{Generation: pos.Generation, Index: pos.Index}
+		snapshots, walSnapshots = append(snapshots, info), append(walSnapshots, info)
 	}
 
 	// Loop over generations and delete unretained snapshots & WAL files.
@@ -866,44 +1200,39 @@ func (r *FileReplica) EnforceRetention(ctx context.Context) (err error) {
 			continue
 		}
 
-		// Otherwise delete all snapshots & WAL files before a lowest retained index.
-		if err := r.deleteGenerationSnapshotsBefore(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("cannot delete generation %q snapshots before index %d: %w", generation, snapshot.Index, err)
-		} else if err := r.deleteGenerationWALBefore(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("cannot delete generation %q wal before index %d: %w", generation, snapshot.Index, err)
+		// Otherwise delete unretained snapshots & all WAL files before the
+		// lowest index that retains WAL. Generations retained only by coarser
+		// policy tiers keep no WAL files.
+		walIndex := math.MaxInt32
+		if snapshot := FindMinSnapshotByGeneration(walSnapshots, generation); snapshot != nil {
+			walIndex = snapshot.Index
+		}
+		if err := r.deleteGenerationSnapshots(ctx, generation, all, snapshots); err != nil {
+			return fmt.Errorf("cannot delete generation %q snapshots: %w", generation, err)
+		} else if err := r.deleteGenerationWALBefore(ctx, generation, walIndex); err != nil {
+			return fmt.Errorf("cannot delete generation %q wal before index %d: %w", generation, walIndex, err)
 		}
 	}
 
 	return nil
 }
 
-// deleteGenerationSnapshotsBefore deletes snapshot before a given index.
-func (r *FileReplica) deleteGenerationSnapshotsBefore(ctx context.Context, generation string, index int) (err error) {
-	dir := r.SnapshotDir(generation)
-
-	fis, err := ioutil.ReadDir(dir)
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return err
-	}
-
+// deleteGenerationSnapshots deletes listed snapshots in a generation that are
+// not retained. Snapshots created since listing are left as-is.
+func (r *FileReplica) deleteGenerationSnapshots(ctx context.Context, generation string, snapshots, retained []*SnapshotInfo) (err error) {
 	var n int
-	for _, fi := range fis {
-		idx, _, err := ParseSnapshotPath(fi.Name())
-		if err != nil {
-			continue
-		} else if idx >= index {
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation || ContainsSnapshot(retained, generation, snapshot.Index) {
 			continue
 		}
 
-		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+		if err := os.Remove(filepath.Join(r.SnapshotDir(generation), snapshot.Name)); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 		n++
 	}
 	if n > 0 {
-		log.Printf("%s(%s): retainer: deleting snapshots before %s/%08x; n=%d", r.db.Path(), r.Name(), generation, index, n)
+		log.Printf("%s(%s): retainer: deleting unretained snapshots in %s; n=%d", r.db.Path(), r.Name(), generation, n)
 	}
 
 	return nil
@@ -970,20 +1299,44 @@ func SnapshotIndexAt(ctx context.Context, r Replica, generation string, timestam
 	return index, nil
 }
 
+// SnapshotIndexByIndex returns the highest index for a snapshot within a
+// generation that occurs at or before the given WAL index.
+func SnapshotIndexByIndex(ctx context.Context, r Replica, generation string, index int) (int, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshotIndex := -1
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation {
+			continue // different generation, skip
+		} else if snapshot.Index > index {
+			continue // after index, skip
+		}
+
+		if snapshot.Index > snapshotIndex {
+			snapshotIndex = snapshot.Index
+		}
+	}
+
+	if snapshotIndex == -1 {
+		return 0, ErrNoSnapshots
+	}
+	return snapshotIndex, nil
+}
+
 // WALIndexAt returns the highest index for a WAL file that occurs before maxIndex & timestamp.
-// If timestamp is zero, returns the highest WAL index.
+// If timestamp is zero, returns the highest WAL index. An index is included if
+// any of its segments were created before timestamp.
 func WALIndexAt(ctx context.Context, r Replica, generation string, maxIndex int, timestamp time.Time) (int, error) {
-	wals, err := r.WALs(ctx)
+	wals, err := walSegments(ctx, r, generation)
 	if err != nil {
 		return 0, err
 	}
 
 	var index int
 	for _, wal := range wals {
-		if wal.Generation != generation {
-			continue
-		}
-
 		if !timestamp.IsZero() && wal.CreatedAt.After(timestamp) {
 			continue // after timestamp, skip
 		} else if wal.Index > maxIndex {
@@ -1002,8 +1355,65 @@ func WALIndexAt(ctx context.Context, r Replica, generation string, maxIndex int,
 	return index, nil
 }
 
-// compressFile compresses a file and replaces it with a new file with a .lz4 extension.
-func compressFile(src, dst string, uid, gid int) error {
+// WALOffsetAt returns the offset of the earliest WAL segment within index that
+// was created after timestamp. WAL data from that offset onward should not be
+// restored. Returns math.MaxInt64 if all segments occur before timestamp.
+func WALOffsetAt(ctx context.Context, r Replica, generation string, index int, timestamp time.Time) (int64, error) {
+	wals, err := walSegments(ctx, r, generation)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := int64(math.MaxInt64)
+	for _, wal := range wals {
+		if wal.Index != index {
+			continue
+		} else if wal.CreatedAt.After(timestamp) && wal.Offset < offset {
+			offset = wal.Offset
+		}
+	}
+	return offset, nil
+}
+
+// walSegments returns the WAL segments in a generation. Uses WALSegments, if
+// implemented by r. Otherwise, WAL files are filtered from WALs().
+func walSegments(ctx context.Context, r Replica, generation string) ([]*WALInfo, error) {
+	if r, ok := r.(WALSegmentLister); ok {
+		return r.WALSegments(ctx, generation)
+	}
+
+	wals, err := r.WALs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a := wals[:0]
+	for _, wal := range wals {
+		if wal.Generation == generation {
+			a = append(a, wal)
+		}
+	}
+	return a, nil
+}
+
+// walReaderFrom returns a reader for WAL data in index starting at offset.
+// Uses WALReaderFrom, if implemented by r. Otherwise, the data before offset
+// is read from WALReader() & discarded.
+func walReaderFrom(ctx context.Context, r Replica, generation string, index int, offset int64) (io.ReadCloser, error) {
+	if r, ok := r.(WALSegmentReader); ok {
+		return r.WALReaderFrom(ctx, generation, index, offset)
+	}
+
+	rd, err := r.WALReader(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+	return internal.Discard(rd, offset)
+}
+
+// compressFile compresses a file with codec and writes it to dst. The
+// compressed data is encrypted if enc has an encryption key.
+func compressFile(src, dst string, codec Codec, enc *Encryptor, uid, gid int) error {
 	r, err := os.Open(src)
 	if err != nil {
 		return err
@@ -1015,28 +1425,54 @@ func compressFile(src, dst string, uid, gid int) error {
 		return err
 	}
 
-	w, err := createFile(dst+".tmp", fi.Mode(), uid, gid)
+	_, err = compressReader(r, dst, fi.Mode(), codec, enc, uid, gid)
+	return err
+}
+
+// compressReader compresses the contents of r to a new file at dst. Returns
+// the number of uncompressed bytes written.
+func compressReader(r io.Reader, dst string, mode os.FileMode, codec Codec, enc *Encryptor, uid, gid int) (int64, error) {
+	w, err := createFile(dst+".tmp", mode, uid, gid)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer w.Close()
 
-	zr := lz4.NewWriter(w)
+	ew, err := NewEncryptWriter(w, enc)
+	if err != nil {
+		return 0, err
+	}
+	defer ew.Close()
+
+	zr, err := codec.NewWriter(ew)
+	if err != nil {
+		return 0, err
+	}
 	defer zr.Close()
 
 	// Copy & compress file contents to temporary file.
-	if _, err := io.Copy(zr, r); err != nil {
-		return err
+	n, err := io.Copy(zr, r)
+	if err != nil {
+		return n, err
 	} else if err := zr.Close(); err != nil {
-		return err
+		return n, err
+	} else if err := ew.Close(); err != nil {
+		return n, err
 	} else if err := w.Sync(); err != nil {
-		return err
+		return n, err
 	} else if err := w.Close(); err != nil {
-		return err
+		return n, err
 	}
 
 	// Move compressed file to final location.
-	return os.Rename(dst+".tmp", dst)
+	return n, os.Rename(dst+".tmp", dst)
+}
+
+// isWALSegmentPath returns true if s is the path to a WAL segment which
+// includes the starting offset in its name.
+func isWALSegmentPath(s string) bool {
+	index, offset, ext, err := ParseWALPath(s)
+	return err == nil && filepath.Base(s) == FormatWALPathWithOffset(index, offset)+strings.TrimPrefix(ext, WALExt)
 }
 
 // ValidateReplica restores the most recent data from a replica and validates
@@ -1093,9 +1529,9 @@ func ValidateReplica(ctx context.Context, r Replica) error {
 		internal.ReplicaValidationTotalCounterVec.WithLabelValues(db.Path(), r.Name(), "error").Inc()
 
 		// Compress mismatched databases and report temporary path for investigation.
-		if err := compressFile(primaryPath, primaryPath+".lz4", db.uid, db.gid); err != nil {
+		if err := compressFile(primaryPath, primaryPath+".lz4", &LZ4Codec{}, nil, db.uid, db.gid); err != nil {
 			return fmt.Errorf("cannot compress primary db: %w", err)
-		} else if err := compressFile(restorePath, restorePath+".lz4", db.uid, db.gid); err != nil {
+		} else if err := compressFile(restorePath, restorePath+".lz4", &LZ4Codec{}, nil, db.uid, db.gid); err != nil {
 			return fmt.Errorf("cannot compress replica db: %w", err)
 		}
 		log.Printf("%s(%s): validator: mismatch files @ %s", db.Path(), r.Name(), tmpdir)
@@ -1,8 +1,13 @@
 package litestream_test
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/litestream"
 )
@@ -81,6 +86,364 @@ func TestFileReplica_Sync(t *testing.T) {
 	})
 }
 
+func TestFileReplica_WALReaderFrom(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	// Write & sync several times so the WAL index is stored in multiple segments.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos := r.LastPos()
+	rd, err := r.WALReader(context.Background(), pos.Generation, pos.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure reading from an offset returns the same data as the full WAL.
+	for _, offset := range []int64{0, litestream.WALHeaderSize, int64(len(full) / 2), int64(len(full) - 1), int64(len(full))} {
+		rd, err := r.WALReaderFrom(context.Background(), pos.Generation, pos.Index, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, full[offset:]) {
+			t.Fatalf("WALReaderFrom(%d): len=%d, want %d", offset, len(buf), len(full[offset:]))
+		}
+	}
+}
+
+func TestFileReplica_SnapshotInterval(t *testing.T) {
+	db, sqldb := MustOpenDBs(t)
+	defer MustCloseDBs(t, db, sqldb)
+	r := NewTestFileReplica(t, db)
+
+	// Create initial snapshot at the first WAL index.
+	if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+		t.Fatal(err)
+	} else if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write until the database checkpoints & moves to the next WAL index.
+	for i, n := 0, db.MinCheckpointPageN*2; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if i%100 == 0 || i == n-1 {
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pos, err := db.Pos()
+	if err != nil {
+		t.Fatal(err)
+	} else if pos.Index == 0 {
+		t.Fatal("expected new WAL index")
+	}
+
+	// Ensure a snapshot is created at the current index without retention.
+	r.MonitorEnabled = true
+	r.SnapshotInterval = 10 * time.Millisecond
+	r.Start(context.Background())
+	defer r.Stop()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if index, err := r.MaxSnapshotIndex(pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if index == pos.Index {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for snapshot: index=%d, want %d", index, pos.Index)
+		}
+	}
+}
+
+func TestFileReplica_Snapshot(t *testing.T) {
+	// Ensure a snapshot copied locally in backup mode can be restored with the
+	// WAL written before & after the copy.
+	t.Run("Backup", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SnapshotMode = litestream.SnapshotModeBackup
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('bat')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Restore & verify data.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := MustOpenSQLDB(t, outputPath)
+		defer MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, 2; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+
+		// Ensure the temporary copy is removed from the meta directory.
+		if matches, err := filepath.Glob(filepath.Join(db.MetaPath(), "snapshot-*")); err != nil {
+			t.Fatal(err)
+		} else if len(matches) != 0 {
+			t.Fatalf("unexpected temporary files: %v", matches)
+		}
+	})
+
+	// Ensure a backup snapshot does not include writes which have not been
+	// synced to the shadow WAL so it can be restored to the replica position.
+	t.Run("BackupPendingWrite", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SnapshotMode = litestream.SnapshotModeBackup
+
+		// Checkpoint on every sync so the snapshot is taken at a new index.
+		db.MinCheckpointPageN = 1
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write without syncing & snapshot at the synced position.
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('bat')`); err != nil {
+			t.Fatal(err)
+		} else if err := r.Snapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos := r.LastPos()
+		if index, err := r.MaxSnapshotIndex(pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if index != pos.Index {
+			t.Fatalf("MaxSnapshotIndex()=%d, want %d", index, pos.Index)
+		}
+
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Pos = outputPath, pos
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := MustOpenSQLDB(t, outputPath)
+		defer MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure an invalid snapshot mode returns an error.
+	t.Run("ErrInvalidMode", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.SnapshotMode = "vacuum"
+
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil || err.Error() != `invalid snapshot mode: "vacuum"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestFileReplica_EnforceRetention(t *testing.T) {
+	// Ensure coarse policy tiers retain snapshots without their WAL files.
+	t.Run("Policy", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.RetentionPolicy = litestream.RetentionPolicy{
+			{Interval: time.Hour, Duration: 2 * time.Hour},
+			{Interval: 24 * time.Hour, Duration: 30 * 24 * time.Hour},
+		}
+
+		// Checkpoint on every sync so each write moves to a new WAL index.
+		db.MinCheckpointPageN = 1
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Snapshot at three indexes & age the earlier snapshots so they fall
+		// outside all tiers & within the daily tier only, respectively.
+		var pos litestream.Pos
+		var indexes []int
+		for i, age := range []time.Duration{60 * 24 * time.Hour, 7 * 24 * time.Hour, 0} {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			} else if err := r.Snapshot(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			if pos, err = db.Pos(); err != nil {
+				t.Fatal(err)
+			} else if i > 0 && pos.Index <= indexes[i-1] {
+				t.Fatalf("Index=%d, expected index to advance", pos.Index)
+			}
+			indexes = append(indexes, pos.Index)
+
+			tm := time.Now().Add(-age)
+			if err := os.Chtimes(r.SnapshotPath(pos.Generation, pos.Index), tm, tm); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		snapshots, err := r.Snapshots(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		} else if got, want := snapshots[0].Index, indexes[1]; got != want {
+			t.Fatalf("snapshots[0].Index=%d, want %d", got, want)
+		}
+
+		// Only WAL after the most recent snapshot should be retained.
+		wals, err := r.WALs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, wal := range wals {
+			if wal.Index < pos.Index {
+				t.Fatalf("unexpected wal: %s", wal.Name)
+			}
+		}
+	})
+
+	// Ensure a snapshot is taken once the finest policy tier has no snapshot
+	// for its current interval, even if older snapshots retain WAL.
+	t.Run("PolicySnapshotDue", func(t *testing.T) {
+		db, sqldb := MustOpenDBs(t)
+		defer MustCloseDBs(t, db, sqldb)
+		r := NewTestFileReplica(t, db)
+		r.RetentionPolicy = litestream.RetentionPolicy{{Interval: time.Hour, Duration: 48 * time.Hour}}
+
+		db.MinCheckpointPageN = 1
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos0, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(r.SnapshotPath(pos0.Generation, pos0.Index), tm, tm); err != nil {
+			t.Fatal(err)
+		}
+
+		// No snapshot is taken if the database has not moved to a new index.
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if snapshots, err := r.Snapshots(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		pos1, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos1.Index <= pos0.Index {
+			t.Fatalf("Index=%d, expected index to advance", pos1.Index)
+		}
+
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		snapshots, err := r.Snapshots(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 2; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		} else if !litestream.ContainsSnapshot(snapshots, pos1.Generation, pos1.Index) {
+			t.Fatalf("expected snapshot at index %d", pos1.Index)
+		}
+	})
+}
+
 // NewTestFileReplica returns a new replica using a temp directory & with monitoring disabled.
 func NewTestFileReplica(tb testing.TB, db *litestream.DB) *litestream.FileReplica {
 	r := litestream.NewFileReplica(db, "", tb.TempDir())
@@ -0,0 +1,141 @@
+package litestream
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionTier retains the earliest snapshot of each generation created
+// within each Interval for snapshots created within the last Duration.
+type RetentionTier struct {
+	Interval time.Duration
+	Duration time.Duration
+}
+
+// RetentionPolicy represents a grandfather-father-son retention policy, such
+// as hourly snapshots for two days, daily snapshots for 30 days & monthly
+// snapshots for a year. A snapshot is retained if any tier retains it.
+//
+// WAL files are only retained for the finest tier (the tier with the smallest
+// interval) so point-in-time restores are only available within its duration.
+// Snapshots retained by coarser tiers can only be restored as-is.
+//
+// A snapshot is taken during retention enforcement whenever the finest tier
+// has no snapshot for its current interval, so the retention check interval
+// should not exceed the finest tier's interval.
+type RetentionPolicy []RetentionTier
+
+// Validate returns an error if a tier has an invalid interval or duration.
+func (p RetentionPolicy) Validate() error {
+	for _, tier := range p {
+		if tier.Interval <= 0 {
+			return fmt.Errorf("retention tier interval must be greater than zero")
+		} else if tier.Duration < tier.Interval {
+			return fmt.Errorf("retention tier duration must be greater than or equal to its interval")
+		}
+	}
+	return nil
+}
+
+// Retain returns the snapshots retained by the policy at time now. The WAL
+// snapshots are the subset of retained snapshots within the finest tier whose
+// subsequent WAL files are retained.
+func (p RetentionPolicy) Retain(snapshots []*SnapshotInfo, now time.Time) (retained, walSnapshots []*SnapshotInfo) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	// Evaluate snapshots in creation order so the earliest in each interval wins.
+	a := make([]*SnapshotInfo, len(snapshots))
+	copy(a, snapshots)
+	sort.SliceStable(a, func(i, j int) bool { return a[i].CreatedAt.Before(a[j].CreatedAt) })
+
+	finest := p.finest()
+
+	type bucket struct {
+		generation string
+		t          time.Time
+	}
+
+	m := make(map[*SnapshotInfo]struct{})
+	for _, tier := range p {
+		cutoff := now.Add(-tier.Duration)
+		buckets := make(map[bucket]struct{})
+		for _, snapshot := range a {
+			if snapshot.CreatedAt.Before(cutoff) {
+				continue
+			}
+
+			key := bucket{snapshot.Generation, snapshot.CreatedAt.Truncate(tier.Interval)}
+			if _, ok := buckets[key]; ok {
+				continue
+			}
+			buckets[key] = struct{}{}
+			m[snapshot] = struct{}{}
+		}
+	}
+
+	// Retain in original order. WAL is retained within the finest tier only.
+	cutoff := now.Add(-finest.Duration)
+	for _, snapshot := range snapshots {
+		if _, ok := m[snapshot]; !ok {
+			continue
+		}
+		retained = append(retained, snapshot)
+		if !snapshot.CreatedAt.Before(cutoff) {
+			walSnapshots = append(walSnapshots, snapshot)
+		}
+	}
+	return retained, walSnapshots
+}
+
+// SnapshotDue returns true if generation has no snapshot created within the
+// current interval of the finest tier at time now. Always returns false if the
+// policy has no tiers.
+func (p RetentionPolicy) SnapshotDue(snapshots []*SnapshotInfo, generation string, now time.Time) bool {
+	if len(p) == 0 {
+		return false
+	}
+
+	start := now.Truncate(p.finest().Interval)
+	for _, snapshot := range snapshots {
+		if snapshot.Generation == generation && !snapshot.CreatedAt.Before(start) {
+			return false
+		}
+	}
+	return true
+}
+
+// finest returns the tier with the smallest interval.
+func (p RetentionPolicy) finest() RetentionTier {
+	finest := p[0]
+	for _, tier := range p[1:] {
+		if tier.Interval < finest.Interval {
+			finest = tier
+		}
+	}
+	return finest
+}
+
+// RetainSnapshots returns the snapshots retained at time now by policy or, if
+// no policy is set, the snapshots created within the retention period. The WAL
+// snapshots are the retained snapshots whose subsequent WAL files are retained.
+func RetainSnapshots(snapshots []*SnapshotInfo, retention time.Duration, policy RetentionPolicy, now time.Time) (retained, walSnapshots []*SnapshotInfo) {
+	if len(policy) > 0 {
+		return policy.Retain(snapshots, now)
+	}
+	retained = FilterSnapshotsAfter(snapshots, now.Add(-retention))
+	return retained, retained
+}
+
+// ContainsSnapshot returns true if a contains a snapshot at the given
+// generation & index.
+func ContainsSnapshot(a []*SnapshotInfo, generation string, index int) bool {
+	for _, snapshot := range a {
+		if snapshot.Generation == generation && snapshot.Index == index {
+			return true
+		}
+	}
+	return false
+}
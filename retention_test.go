@@ -0,0 +1,113 @@
+package litestream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRetentionPolicy_Retain(t *testing.T) {
+	now := time.Date(2000, time.March, 1, 12, 30, 0, 0, time.UTC)
+	policy := litestream.RetentionPolicy{
+		{Interval: time.Hour, Duration: 2 * time.Hour},
+		{Interval: 24 * time.Hour, Duration: 3 * 24 * time.Hour},
+	}
+
+	// Snapshots every 30m over the last four days.
+	var snapshots []*litestream.SnapshotInfo
+	for i := 0; i < 4*48; i++ {
+		snapshots = append(snapshots, &litestream.SnapshotInfo{
+			Generation: "0000000000000000",
+			Index:      i,
+			CreatedAt:  now.Add(time.Duration(i-4*48+1) * 30 * time.Minute),
+		})
+	}
+
+	retained, walSnapshots := policy.Retain(snapshots, now)
+
+	// Expect hourly snapshots within two hours & the first snapshot of each
+	// day within three days.
+	var got []time.Time
+	for _, snapshot := range retained {
+		got = append(got, snapshot.CreatedAt)
+	}
+	want := []time.Time{
+		time.Date(2000, time.February, 27, 12, 30, 0, 0, time.UTC), // cutoff, partial day
+		time.Date(2000, time.February, 28, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, time.February, 29, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, time.March, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2000, time.March, 1, 10, 30, 0, 0, time.UTC), // cutoff, partial hour
+		time.Date(2000, time.March, 1, 11, 0, 0, 0, time.UTC),
+		time.Date(2000, time.March, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("retained=%v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Fatalf("retained[%d]=%s, want %s", i, got[i], want[i])
+		}
+	}
+
+	// WAL is only retained for snapshots within the finest tier.
+	if got, want := len(walSnapshots), 3; got != want {
+		t.Fatalf("len(walSnapshots)=%d, want %d", got, want)
+	} else if got, want := walSnapshots[0].CreatedAt, now.Add(-2*time.Hour); !got.Equal(want) {
+		t.Fatalf("walSnapshots[0]=%s, want %s", got, want)
+	}
+
+	// Ensure each generation is retained separately.
+	t.Run("Generations", func(t *testing.T) {
+		retained, _ := policy.Retain([]*litestream.SnapshotInfo{
+			{Generation: "0000000000000000", CreatedAt: now.Add(-10 * time.Minute)},
+			{Generation: "0000000000000001", CreatedAt: now.Add(-5 * time.Minute)},
+		}, now)
+		if got, want := len(retained), 2; got != want {
+			t.Fatalf("len=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestRetentionPolicy_Validate(t *testing.T) {
+	if err := (litestream.RetentionPolicy{{Interval: time.Hour, Duration: 48 * time.Hour}}).Validate(); err != nil {
+		t.Fatal(err)
+	} else if err := (litestream.RetentionPolicy{{Interval: 0, Duration: time.Hour}}).Validate(); err == nil {
+		t.Fatal("expected error")
+	} else if err := (litestream.RetentionPolicy{{Interval: time.Hour, Duration: time.Minute}}).Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRetentionPolicy_SnapshotDue(t *testing.T) {
+	now := time.Date(2000, time.March, 1, 12, 30, 0, 0, time.UTC)
+	policy := litestream.RetentionPolicy{
+		{Interval: 24 * time.Hour, Duration: 30 * 24 * time.Hour},
+		{Interval: time.Hour, Duration: 48 * time.Hour},
+	}
+
+	for _, tt := range []struct {
+		name      string
+		policy    litestream.RetentionPolicy
+		snapshots []*litestream.SnapshotInfo
+		want      bool
+	}{
+		{name: "NoSnapshots", policy: policy, want: true},
+		{name: "CurrentInterval", policy: policy, snapshots: []*litestream.SnapshotInfo{
+			{Generation: "0000000000000000", CreatedAt: time.Date(2000, time.March, 1, 12, 0, 0, 0, time.UTC)},
+		}},
+		{name: "PreviousInterval", policy: policy, want: true, snapshots: []*litestream.SnapshotInfo{
+			{Generation: "0000000000000000", CreatedAt: time.Date(2000, time.March, 1, 11, 59, 0, 0, time.UTC)},
+		}},
+		{name: "OtherGeneration", policy: policy, want: true, snapshots: []*litestream.SnapshotInfo{
+			{Generation: "0000000000000001", CreatedAt: time.Date(2000, time.March, 1, 12, 15, 0, 0, time.UTC)},
+		}},
+		{name: "NoPolicy"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.SnapshotDue(tt.snapshots, "0000000000000000", now); got != tt.want {
+				t.Fatalf("SnapshotDue()=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
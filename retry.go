@@ -0,0 +1,203 @@
+package litestream
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Default retry & circuit breaker settings.
+const (
+	DefaultRetryMaxAttempts = 5
+	DefaultRetryMinBackoff  = 100 * time.Millisecond
+	DefaultRetryMaxBackoff  = 10 * time.Second
+	DefaultRetryJitter      = 0.5
+
+	DefaultCircuitBreakerThreshold   = 5
+	DefaultCircuitBreakerCooldown    = 10 * time.Second
+	DefaultCircuitBreakerMaxCooldown = 5 * time.Minute
+)
+
+// ErrCircuitOpen is returned when an operation is rejected because the
+// circuit breaker for its destination is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// RetryPolicy retries failed replica operations with exponential backoff.
+// Retries are applied on top of any retries performed by a client library
+// for individual requests. File replicas do not use a retry policy.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first. Retries are disabled
+	// if less than or equal to one.
+	MaxAttempts int
+
+	// Delay before the first retry. Doubles with each subsequent attempt
+	// up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Fraction of each delay that is randomized, between 0 and 1.
+	Jitter float64
+}
+
+// NewRetryPolicy returns a retry policy with the default settings.
+func NewRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DefaultRetryMaxAttempts,
+		MinBackoff:  DefaultRetryMinBackoff,
+		MaxBackoff:  DefaultRetryMaxBackoff,
+		Jitter:      DefaultRetryJitter,
+	}
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable, the
+// maximum attempts are reached or ctx is done. Returns the last error.
+func (p RetryPolicy) Do(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Backoff returns the delay after the given failed attempt, starting from one.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	// Randomize the delay downward so it never exceeds the maximum.
+	if jitter := p.Jitter; jitter > 0 && d > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
+
+// CircuitBreaker rejects operations against a destination after repeated
+// failures so that a replica backs off while the destination is down. Once
+// the cooldown has passed, a single trial operation is allowed through. The
+// cooldown doubles each time a trial fails, up to MaxCooldown. File replicas
+// do not use a circuit breaker.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	failureN int       // consecutive failures
+	openedAt time.Time // zero if closed
+	cooldown time.Duration
+	trial    bool // true if a trial operation is in progress
+
+	// Number of consecutive failures before the circuit opens.
+	// The circuit breaker is disabled if zero.
+	Threshold int
+
+	// Time the circuit stays open before allowing a trial operation.
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+
+	// Returns the current time. Defaults to time.Now. Used for testing.
+	Now func() time.Time
+}
+
+// NewCircuitBreaker returns a circuit breaker with the default settings.
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold:   DefaultCircuitBreakerThreshold,
+		Cooldown:    DefaultCircuitBreakerCooldown,
+		MaxCooldown: DefaultCircuitBreakerMaxCooldown,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the circuit is open. Otherwise the caller
+// may perform the operation & must report its outcome with Record.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return nil
+	} else if b.trial || b.now().Before(b.openedAt.Add(b.cooldown)) {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// Record reports the outcome of an operation permitted by Allow. Failures
+// should only be reported for errors that indicate the destination is
+// unavailable.
+func (b *CircuitBreaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failureN, b.openedAt, b.cooldown, b.trial = 0, time.Time{}, 0, false
+		return
+	}
+
+	b.failureN++
+	if b.trial {
+		// Trial failed so reopen with a longer cooldown.
+		b.trial = false
+		b.openedAt, b.cooldown = b.now(), b.cooldown*2
+		if b.MaxCooldown > 0 && b.cooldown > b.MaxCooldown {
+			b.cooldown = b.MaxCooldown
+		}
+	} else if b.openedAt.IsZero() && b.Threshold > 0 && b.failureN >= b.Threshold {
+		b.openedAt, b.cooldown = b.now(), b.Cooldown
+	}
+}
+
+// Release reports that an operation permitted by Allow ended without an
+// outcome, such as when its context was canceled. Nothing is recorded about
+// the destination so another trial operation may be attempted.
+func (b *CircuitBreaker) Release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// IsOpen returns true if the circuit is open or a trial is in progress.
+func (b *CircuitBreaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
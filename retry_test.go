@@ -0,0 +1,158 @@
+package litestream_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+)
+
+func TestRetryPolicy_Do(t *testing.T) {
+	errTransient, errPermanent := errors.New("transient"), errors.New("permanent")
+	retryable := func(err error) bool { return err == errTransient }
+	policy := litestream.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	// Ensure transient errors are retried until the operation succeeds.
+	t.Run("OK", func(t *testing.T) {
+		var n int
+		if err := policy.Do(context.Background(), retryable, func() error {
+			if n++; n < 3 {
+				return errTransient
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 3; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure the last error is returned once attempts are exhausted.
+	t.Run("MaxAttempts", func(t *testing.T) {
+		var n int
+		if err := policy.Do(context.Background(), retryable, func() error {
+			n++
+			return errTransient
+		}); err != errTransient {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := n, 3; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure errors that are not retryable are returned immediately.
+	t.Run("ErrNotRetryable", func(t *testing.T) {
+		var n int
+		if err := policy.Do(context.Background(), retryable, func() error {
+			n++
+			return errPermanent
+		}); err != errPermanent {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure retries stop once the context is canceled.
+	t.Run("ContextCanceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		policy := litestream.RetryPolicy{MaxAttempts: 10, MinBackoff: time.Hour}
+
+		var n int
+		if err := policy.Do(ctx, retryable, func() error {
+			n++
+			cancel()
+			return errTransient
+		}); err != errTransient {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got, want := n, 1; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := litestream.RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5}
+	for _, tt := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		if d := policy.Backoff(tt.attempt); d > tt.max || d < tt.max/2 {
+			t.Fatalf("Backoff(%d)=%s, want between %s and %s", tt.attempt, d, tt.max/2, tt.max)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	b := &litestream.CircuitBreaker{
+		Threshold:   2,
+		Cooldown:    time.Minute,
+		MaxCooldown: 3 * time.Minute,
+		Now:         func() time.Time { return now },
+	}
+
+	// Ensure the circuit opens after consecutive failures.
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.Record(true)
+	}
+	if !b.IsOpen() {
+		t.Fatal("expected open circuit")
+	} else if err := b.Allow(); err != litestream.ErrCircuitOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ensure a single trial is allowed after the cooldown & that a failed
+	// trial doubles the cooldown.
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	} else if err := b.Allow(); err != litestream.ErrCircuitOpen {
+		t.Fatalf("expected single trial, got %v", err)
+	}
+	b.Record(true)
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != litestream.ErrCircuitOpen {
+		t.Fatalf("expected longer cooldown, got %v", err)
+	}
+
+	// Ensure a released trial records nothing & allows another trial.
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if !b.IsOpen() {
+		t.Fatal("expected open circuit")
+	}
+
+	// Ensure a successful trial closes the circuit.
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Record(false)
+	if b.IsOpen() {
+		t.Fatal("expected closed circuit")
+	} else if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure a nil circuit breaker always allows operations.
+	var nilBreaker *litestream.CircuitBreaker
+	nilBreaker.Record(true)
+	if err := nilBreaker.Allow(); err != nil {
+		t.Fatal(err)
+	}
+}
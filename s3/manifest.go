@@ -0,0 +1,434 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/benbjohnson/litestream"
+)
+
+// ManifestName is the name of the manifest object in a generation directory.
+const ManifestName = "manifest.json"
+
+// Manifest describes the snapshots & WAL segments in a generation. It is
+// stored in the generation directory & updated by the replica after each
+// upload & retention check so that reads do not require listing objects.
+type Manifest struct {
+	Generation string           `json:"generation"`
+	Snapshots  []*ManifestEntry `json:"snapshots"`
+	WAL        []*ManifestEntry `json:"wal"`
+	UpdatedAt  time.Time        `json:"updated_at"`
+}
+
+// ManifestEntry describes a single snapshot or WAL segment object.
+type ManifestEntry struct {
+	Name      string    `json:"name"`
+	Index     int       `json:"index"`
+	Offset    int64     `json:"offset,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// clone returns a copy of the manifest. Entries are shared as they are never
+// modified once added to a manifest.
+func (m *Manifest) clone() *Manifest {
+	other := *m
+	other.Snapshots = append([]*ManifestEntry(nil), m.Snapshots...)
+	other.WAL = append([]*ManifestEntry(nil), m.WAL...)
+	return &other
+}
+
+// putSnapshot adds a snapshot entry or replaces an entry with the same name.
+func (m *Manifest) putSnapshot(e *ManifestEntry) {
+	m.Snapshots = putManifestEntry(m.Snapshots, e)
+}
+
+// putWAL adds a WAL segment entry or replaces an entry with the same name.
+func (m *Manifest) putWAL(e *ManifestEntry) {
+	m.WAL = putManifestEntry(m.WAL, e)
+}
+
+// remove removes all entries whose names are in the set.
+func (m *Manifest) remove(names map[string]struct{}) {
+	m.Snapshots = removeManifestEntries(m.Snapshots, names)
+	m.WAL = removeManifestEntries(m.WAL, names)
+}
+
+func putManifestEntry(a []*ManifestEntry, e *ManifestEntry) []*ManifestEntry {
+	for i := range a {
+		if a[i].Name == e.Name {
+			a[i] = e
+			return a
+		}
+	}
+
+	// Keep entries in the same order as a listing: by index, then offset.
+	a = append(a, e)
+	sort.SliceStable(a, func(i, j int) bool {
+		if a[i].Index != a[j].Index {
+			return a[i].Index < a[j].Index
+		}
+		return a[i].Offset < a[j].Offset
+	})
+	return a
+}
+
+func removeManifestEntries(a []*ManifestEntry, names map[string]struct{}) []*ManifestEntry {
+	other := a[:0]
+	for _, e := range a {
+		if _, ok := names[e.Name]; !ok {
+			other = append(other, e)
+		}
+	}
+	return other
+}
+
+// cachedManifest is the last manifest read or written by the replica along
+// with its ETag so it can be revalidated with a conditional request.
+type cachedManifest struct {
+	m    *Manifest
+	etag string
+}
+
+// ManifestPath returns the path to a generation's manifest object.
+func (r *Replica) ManifestPath(generation string) string {
+	return path.Join(r.GenerationDir(generation), ManifestName)
+}
+
+// RebuildManifest lists the snapshots & WAL segments in a generation and
+// overwrites its manifest. Used when the manifest is missing or stale.
+func (r *Replica) RebuildManifest(ctx context.Context, generation string) (*Manifest, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+
+	m, err := r.buildManifest(ctx, generation)
+	if err != nil {
+		return nil, err
+	} else if err := r.writeManifest(ctx, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// buildManifest returns a new manifest by listing a generation's objects.
+func (r *Replica) buildManifest(ctx context.Context, generation string) (_ *Manifest, err error) {
+	m := &Manifest{Generation: generation}
+	if m.Snapshots, err = r.listSnapshotEntries(ctx, generation); err != nil {
+		return nil, err
+	} else if m.WAL, err = r.listWALEntries(ctx, generation, ""); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readManifest returns the manifest for a generation. A cached manifest is
+// revalidated by its ETag so it is only downloaded again if it has changed.
+// Returns nil if no manifest exists.
+func (r *Replica) readManifest(ctx context.Context, generation string) (*Manifest, error) {
+	r.mu.RLock()
+	cached := r.manifests[generation]
+	r.mu.RUnlock()
+
+	input := r.getObjectInput(r.ManifestPath(generation))
+	if cached != nil {
+		input.IfNoneMatch = aws.String(cached.etag)
+	}
+
+	var out *s3.GetObjectOutput
+	err := r.retry(ctx, func() (err error) {
+		out, err = r.s3.GetObjectWithContext(ctx, input)
+		return err
+	})
+	if isStatusCode(err, http.StatusNotModified) && cached != nil {
+		r.getOperationTotalCounter.Inc()
+		return cached.m, nil
+	} else if isNotExists(err) {
+		r.setManifest(generation, nil, "")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	r.getOperationTotalCounter.Inc()
+	r.getOperationBytesCounter.Add(float64(aws.Int64Value(out.ContentLength)))
+
+	var m Manifest
+	if err := json.NewDecoder(out.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("cannot decode manifest %s: %w", *input.Key, err)
+	} else if m.Generation != generation {
+		return nil, fmt.Errorf("manifest generation mismatch: %s, expected %s", m.Generation, generation)
+	}
+
+	r.setManifest(generation, &m, aws.StringValue(out.ETag))
+	return &m, nil
+}
+
+// writeManifest uploads m & caches it for subsequent reads.
+func (r *Replica) writeManifest(ctx context.Context, m *Manifest) error {
+	m.UpdatedAt = time.Now().UTC()
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	// Apply the same encryption & tagging settings as other uploads. The
+	// manifest uses the bucket's default storage class as it is read often.
+	upload := r.uploadInput(r.ManifestPath(m.Generation), "", nil)
+	var out *s3.PutObjectOutput
+	if err := r.retry(ctx, func() (err error) {
+		out, err = r.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:               upload.Bucket,
+			Key:                  upload.Key,
+			Body:                 bytes.NewReader(buf),
+			ContentType:          aws.String("application/json"),
+			ServerSideEncryption: upload.ServerSideEncryption,
+			SSEKMSKeyId:          upload.SSEKMSKeyId,
+			SSECustomerAlgorithm: upload.SSECustomerAlgorithm,
+			SSECustomerKey:       upload.SSECustomerKey,
+			Tagging:              upload.Tagging,
+		})
+		return err
+	}); err != nil {
+		return fmt.Errorf("cannot write manifest: %w", err)
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(len(buf)))
+
+	r.setManifest(m.Generation, m, aws.StringValue(out.ETag))
+	return nil
+}
+
+// updateManifest applies fn to a copy of the generation's manifest & uploads
+// it. If no manifest exists then one is built from a listing first so that
+// objects uploaded before the manifest was created are included.
+func (r *Replica) updateManifest(ctx context.Context, generation string, fn func(m *Manifest)) error {
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+	return r.updateManifestLocked(ctx, generation, fn)
+}
+
+// updateManifestLocked is the implementation of updateManifest. Must be
+// called while holding manifestMu.
+func (r *Replica) updateManifestLocked(ctx context.Context, generation string, fn func(m *Manifest)) error {
+	m, err := r.readManifest(ctx, generation)
+	if err != nil {
+		return err
+	} else if m != nil {
+		m = m.clone()
+	} else if m, err = r.buildManifest(ctx, generation); err != nil {
+		return err
+	}
+
+	fn(m)
+
+	// Include segments uploaded since the manifest was last updated.
+	for _, e := range r.pendingWAL[generation] {
+		m.putWAL(e)
+	}
+	if err := r.writeManifest(ctx, m); err != nil {
+		return err
+	}
+	delete(r.pendingWAL, generation)
+	return nil
+}
+
+// addPendingWAL records an uploaded WAL segment to be added to the manifest
+// on the next flush.
+func (r *Replica) addPendingWAL(generation string, e *ManifestEntry) {
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+
+	if r.pendingWAL == nil {
+		r.pendingWAL = make(map[string][]*ManifestEntry)
+	}
+	r.pendingWAL[generation] = append(r.pendingWAL[generation], e)
+}
+
+// removePendingWAL discards pending WAL segments for a deleted generation.
+func (r *Replica) removePendingWAL(generation string) {
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+	delete(r.pendingWAL, generation)
+}
+
+// flushManifest adds pending WAL segments to their generations' manifests.
+// Manifests are only updated once ManifestFlushInterval has passed since the
+// last flush unless force is true. Segments remain pending if a manifest
+// cannot be updated.
+func (r *Replica) flushManifest(ctx context.Context, force bool) error {
+	r.manifestMu.Lock()
+	defer r.manifestMu.Unlock()
+
+	if len(r.pendingWAL) == 0 {
+		return nil
+	} else if !force && time.Since(r.flushedAt) < r.ManifestFlushInterval {
+		return nil
+	}
+
+	for generation := range r.pendingWAL {
+		if err := r.updateManifestLocked(ctx, generation, func(m *Manifest) {}); err != nil {
+			return err
+		}
+	}
+	r.flushedAt = time.Now()
+	return nil
+}
+
+// setManifest caches the manifest for a generation. Clears the cache if m is nil.
+func (r *Replica) setManifest(generation string, m *Manifest, etag string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m == nil || etag == "" {
+		delete(r.manifests, generation)
+		return
+	}
+
+	if r.manifests == nil {
+		r.manifests = make(map[string]*cachedManifest)
+	}
+	r.manifests[generation] = &cachedManifest{m: m, etag: etag}
+}
+
+// snapshotEntries returns the snapshots in a generation from its manifest or,
+// if no manifest exists, by listing the snapshot directory.
+func (r *Replica) snapshotEntries(ctx context.Context, generation string) ([]*ManifestEntry, error) {
+	if m, err := r.readManifest(ctx, generation); err != nil {
+		return nil, err
+	} else if m != nil {
+		return m.Snapshots, nil
+	}
+	return r.listSnapshotEntries(ctx, generation)
+}
+
+// walEntries returns the WAL segments in a generation from its manifest or,
+// if no manifest exists, by listing the WAL directory. As the manifest may lag
+// behind uploads, segments after its last segment are found with a listing
+// that starts after that segment.
+func (r *Replica) walEntries(ctx context.Context, generation string) ([]*ManifestEntry, error) {
+	m, err := r.readManifest(ctx, generation)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return r.listWALEntries(ctx, generation, "")
+	}
+
+	var after string
+	if len(m.WAL) > 0 {
+		after = m.WAL[len(m.WAL)-1].Name
+	}
+	entries, err := r.listWALEntries(ctx, generation, after)
+	if err != nil {
+		return nil, err
+	}
+	return append(m.WAL[:len(m.WAL):len(m.WAL)], entries...), nil
+}
+
+// listSnapshotEntries returns the snapshots in a generation by listing objects.
+func (r *Replica) listSnapshotEntries(ctx context.Context, generation string) ([]*ManifestEntry, error) {
+	objs, _, err := r.listObjects(ctx, &s3.ListObjectsInput{
+		Bucket:    aws.String(r.Bucket),
+		Prefix:    aws.String(r.SnapshotDir(generation) + "/"),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var a []*ManifestEntry
+	for _, obj := range objs {
+		key := path.Base(*obj.Key)
+		index, _, err := litestream.ParseSnapshotPath(key)
+		if err != nil {
+			continue
+		}
+
+		a = append(a, &ManifestEntry{
+			Name:      key,
+			Index:     index,
+			Size:      *obj.Size,
+			CreatedAt: obj.LastModified.UTC(),
+		})
+	}
+	return a, nil
+}
+
+// listWALEntries returns the WAL segments in a generation by listing objects.
+// If after is set, only segments named after it are listed. Segment names sort
+// by index & offset.
+func (r *Replica) listWALEntries(ctx context.Context, generation, after string) ([]*ManifestEntry, error) {
+	input := &s3.ListObjectsInput{
+		Bucket:    aws.String(r.Bucket),
+		Prefix:    aws.String(r.WALDir(generation) + "/"),
+		Delimiter: aws.String("/"),
+	}
+	if after != "" {
+		input.Marker = aws.String(path.Join(r.WALDir(generation), after))
+	}
+
+	objs, _, err := r.listObjects(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	var a []*ManifestEntry
+	for _, obj := range objs {
+		key := path.Base(*obj.Key)
+		index, offset, _, err := litestream.ParseWALPath(key)
+		if err != nil {
+			continue
+		}
+
+		a = append(a, &ManifestEntry{
+			Name:      key,
+			Index:     index,
+			Offset:    offset,
+			Size:      *obj.Size,
+			CreatedAt: obj.LastModified.UTC(),
+		})
+	}
+	return a, nil
+}
+
+// isNotExists returns true if err is an S3 "not found" error.
+func isNotExists(err error) bool {
+	if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	return isStatusCode(err, http.StatusNotFound)
+}
+
+// isStatusCode returns true if err is an S3 request failure with the given
+// HTTP status code.
+func isStatusCode(err error, code int) bool {
+	e, ok := err.(awserr.RequestFailure)
+	return ok && e.StatusCode() == code
+}
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
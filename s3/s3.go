@@ -1,43 +1,68 @@
 package s3
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/benbjohnson/litestream"
 	"github.com/benbjohnson/litestream/internal"
-	"github.com/pierrec/lz4/v4"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // S3 replica default settings.
 const (
+	DefaultRegion = "us-east-1"
+
 	DefaultSyncInterval = 10 * time.Second
 
 	DefaultRetention = 24 * time.Hour
 
 	DefaultRetentionCheckInterval = 1 * time.Hour
+
+	DefaultMaxSegmentSize = 64 * 1024 * 1024
+
+	DefaultManifestFlushInterval = 1 * time.Minute
+
+	DefaultUploadBufferSize = s3manager.DefaultUploadPartSize * s3manager.DefaultUploadConcurrency
+
+	DefaultRoleSessionName = "litestream"
+
+	// Assumed role credentials are refreshed this long before they expire.
+	DefaultCredentialExpiryWindow = 1 * time.Minute
 )
 
 // MaxKeys is the number of keys S3 can operate on per batch.
 const MaxKeys = 1000
 
 var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.WALSegmentLister = (*Replica)(nil)
+var _ litestream.WALSegmentReader = (*Replica)(nil)
+var _ litestream.ReplicaStatusReporter = (*Replica)(nil)
+var _ litestream.ReplicaMaintainer = (*Replica)(nil)
+var _ litestream.ReplicaSyncer = (*Replica)(nil)
 
 // Replica is a replica that replicates a DB to an S3 bucket.
 type Replica struct {
@@ -45,10 +70,19 @@ type Replica struct {
 	name     string         // replica name, optional
 	s3       *s3.S3         // s3 service
 	uploader *s3manager.Uploader
+	creds    *credentials.Credentials // assumed role credentials, if any
 
 	mu         sync.RWMutex
 	snapshotMu sync.Mutex
 	pos        litestream.Pos // last position
+	syncErr    error          // error from last sync, if any
+	snapshotAt time.Time      // time of most recent snapshot, if known
+	monitorAt  time.Time      // start of current monitor sync, if any
+
+	manifestMu sync.Mutex                  // serializes manifest updates
+	manifests  map[string]*cachedManifest  // last known manifests, by generation
+	pendingWAL map[string][]*ManifestEntry // uploaded segments not yet in manifest
+	flushedAt  time.Time                   // last manifest update by sync
 
 	wg     sync.WaitGroup
 	cancel func()
@@ -64,28 +98,115 @@ type Replica struct {
 	listOperationTotalCounter   prometheus.Counter
 	deleteOperationTotalCounter prometheus.Counter
 
+	snapshotSecondsHistogram     prometheus.Observer
+	snapshotLockSecondsHistogram prometheus.Observer
+	retryCounter                 prometheus.Counter
+	circuitOpenGauge             prometheus.Gauge
+	circuitOpenCounter           prometheus.Counter
+
 	// AWS authentication keys.
 	AccessKeyID     string
 	SecretAccessKey string
 
+	// IAM role to assume with sts:AssumeRole. The role is assumed using the
+	// authentication keys, if set, or the default credential chain.
+	RoleARN         string
+	RoleExternalID  string
+	RoleSessionName string
+
+	// Path to an OIDC token file, such as the service account token mounted
+	// for EKS (IRSA). If set, RoleARN is assumed with
+	// sts:AssumeRoleWithWebIdentity instead. The file is re-read on refresh.
+	WebIdentityTokenFile string
+
+	// Overrides the STS API endpoint used to assume roles.
+	STSEndpoint string
+
 	// S3 bucket information
 	Region string
 	Bucket string
 	Path   string
 
+	// Overrides the S3 API endpoint. Used for S3-compatible stores such as
+	// MinIO. Region discovery is skipped when set.
+	Endpoint string
+
+	// If true, the bucket is addressed in the path instead of the hostname.
+	ForcePathStyle bool
+
+	// If true, TLS certificates are not verified. Used for self-signed stores.
+	SkipVerify bool
+
 	// Time between syncs with the shadow WAL.
 	SyncInterval time.Duration
 
+	// Maximum number of uncompressed WAL bytes uploaded in a single WAL
+	// segment. Larger ranges of the shadow WAL are split into multiple
+	// segments on frame boundaries.
+	MaxSegmentSize int64
+
+	// Time between manifest updates for WAL segments uploaded by the
+	// background monitor. Segments uploaded since the last update are found by
+	// listing objects after the manifest's last segment. Syncs outside of the
+	// monitor, snapshots & retention checks always update the manifest.
+	ManifestFlushInterval time.Duration
+
+	// Maximum memory used to buffer a single upload. Uploads are streamed in
+	// parts of at least s3manager.MinUploadPartSize so the buffer size also
+	// limits the number of parts uploaded concurrently.
+	UploadBufferSize int64
+
 	// Time to keep snapshots and related WAL files.
 	// Database is snapshotted after interval and older WAL files are discarded.
 	Retention time.Duration
 
+	// Tiered retention policy. Overrides Retention, if set.
+	RetentionPolicy litestream.RetentionPolicy
+
 	// Time between retention checks.
 	RetentionCheckInterval time.Duration
 
+	// Time between snapshots, independent of retention. Reduces the amount
+	// of WAL replayed during a restore. Disabled if zero.
+	SnapshotInterval time.Duration
+
+	// Method used to read the database during a snapshot. Defaults to
+	// litestream.SnapshotModeDirect which holds a read lock during upload.
+	SnapshotMode string
+
 	// Time between validation checks.
 	ValidationInterval time.Duration
 
+	// Codec used to compress snapshots & WAL files. Defaults to lz4.
+	Codec litestream.Codec
+
+	// If set, snapshots & WAL files are encrypted before being uploaded.
+	Encryptor *litestream.Encryptor
+
+	// Server-side encryption for uploaded objects, either "AES256" or
+	// "aws:kms". SSEKMSKeyID optionally sets the KMS key used by "aws:kms".
+	SSE         string
+	SSEKMSKeyID string
+
+	// Customer-provided 256-bit key (SSE-C) used to encrypt objects on upload.
+	// The same key must be provided to read objects. Cannot be used with SSE.
+	SSECustomerKey []byte
+
+	// Storage classes of snapshot & WAL objects, such as "STANDARD_IA".
+	// Defaults to the bucket's default storage class.
+	SnapshotStorageClass string
+	WALStorageClass      string
+
+	// Tags applied to all uploaded objects.
+	Tags map[string]string
+
+	// Policy used to retry failed uploads, lists & deletes.
+	RetryPolicy litestream.RetryPolicy
+
+	// Rejects operations after repeated transient failures so the replica
+	// backs off while S3 is unavailable. Disabled if nil.
+	CircuitBreaker *litestream.CircuitBreaker
+
 	// If true, replica monitors database for changes automatically.
 	// Set to false if replica is being used synchronously (such as in tests).
 	MonitorEnabled bool
@@ -99,8 +220,14 @@ func NewReplica(db *litestream.DB, name string) *Replica {
 		cancel: func() {},
 
 		SyncInterval:           DefaultSyncInterval,
+		MaxSegmentSize:         DefaultMaxSegmentSize,
+		UploadBufferSize:       DefaultUploadBufferSize,
+		ManifestFlushInterval:  DefaultManifestFlushInterval,
+		Codec:                  &litestream.LZ4Codec{},
 		Retention:              DefaultRetention,
 		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		RetryPolicy:            litestream.NewRetryPolicy(),
+		CircuitBreaker:         litestream.NewCircuitBreaker(),
 
 		MonitorEnabled: true,
 	}
@@ -119,6 +246,11 @@ func NewReplica(db *litestream.DB, name string) *Replica {
 	r.getOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
 	r.listOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "LIST")
 	r.deleteOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "DELETE")
+	r.snapshotSecondsHistogram = internal.ReplicaSnapshotSecondsHistogramVec.WithLabelValues(dbPath, r.Name())
+	r.snapshotLockSecondsHistogram = internal.ReplicaSnapshotLockSecondsHistogramVec.WithLabelValues(dbPath, r.Name())
+	r.retryCounter = internal.ReplicaRetryTotalCounterVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenGauge = internal.ReplicaCircuitOpenGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenCounter = internal.ReplicaCircuitOpenTotalCounterVec.WithLabelValues(dbPath, r.Name())
 
 	return r
 }
@@ -148,6 +280,45 @@ func (r *Replica) LastPos() litestream.Pos {
 	return r.pos
 }
 
+// LastSyncError returns the error from the most recent sync, if any.
+func (r *Replica) LastSyncError() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.syncErr
+}
+
+// LastSnapshotAt returns the time of the most recent snapshot created or
+// listed by the replica. Returns a zero time if no snapshot has been seen.
+func (r *Replica) LastSnapshotAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotAt
+}
+
+// setLastSnapshotAt updates the time of the most recent snapshot if t is later.
+func (r *Replica) setLastSnapshotAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.snapshotAt) {
+		r.snapshotAt = t
+	}
+}
+
+// MonitorBusySince returns the time the monitor began syncing the current
+// change. Returns a zero time if the monitor is waiting for changes.
+func (r *Replica) MonitorBusySince() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.monitorAt
+}
+
+// setMonitorBusySince sets the start time of the current monitor sync.
+func (r *Replica) setMonitorBusySince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitorAt = t
+}
+
 // GenerationDir returns the path to a generation's root directory.
 func (r *Replica) GenerationDir(generation string) string {
 	return path.Join(r.Path, "generations", generation)
@@ -160,7 +331,7 @@ func (r *Replica) SnapshotDir(generation string) string {
 
 // SnapshotPath returns the path to a snapshot file.
 func (r *Replica) SnapshotPath(generation string, index int) string {
-	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x.snapshot.lz4", index))
+	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, litestream.SnapshotExt, r.Codec.Ext()))
 }
 
 // MaxSnapshotIndex returns the highest index for the snapshots.
@@ -195,24 +366,22 @@ func (r *Replica) Generations(ctx context.Context) ([]string, error) {
 		return nil, err
 	}
 
-	var generations []string
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
+	_, prefixes, err := r.listObjects(ctx, &s3.ListObjectsInput{
 		Bucket:    aws.String(r.Bucket),
 		Prefix:    aws.String(path.Join(r.Path, "generations") + "/"),
 		Delimiter: aws.String("/"),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		for _, prefix := range page.CommonPrefixes {
-			name := path.Base(*prefix.Prefix)
-			if !litestream.IsGenerationName(name) {
-				continue
-			}
-			generations = append(generations, name)
+	var generations []string
+	for _, prefix := range prefixes {
+		name := path.Base(*prefix.Prefix)
+		if !litestream.IsGenerationName(name) {
+			continue
 		}
-		return true
-	}); err != nil {
-		return nil, err
+		generations = append(generations, name)
 	}
 
 	return generations, nil
@@ -251,61 +420,37 @@ func (r *Replica) GenerationStats(ctx context.Context, generation string) (stats
 }
 
 func (r *Replica) snapshotStats(ctx context.Context, generation string) (n int, min, max time.Time, err error) {
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-		Bucket: aws.String(r.Bucket),
-		Prefix: aws.String(r.SnapshotDir(generation) + "/"),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
-
-		for _, obj := range page.Contents {
-			if !litestream.IsSnapshotPath(path.Base(*obj.Key)) {
-				continue
-			}
-			modTime := obj.LastModified.UTC()
-
-			n++
-			if min.IsZero() || modTime.Before(min) {
-				min = modTime
-			}
-			if max.IsZero() || modTime.After(max) {
-				max = modTime
-			}
-		}
-		return true
-	}); err != nil {
+	entries, err := r.snapshotEntries(ctx, generation)
+	if err != nil {
 		return n, min, max, err
 	}
+	n, min, max = manifestEntryStats(entries)
 	return n, min, max, nil
 }
 
 func (r *Replica) walStats(ctx context.Context, generation string) (n int, min, max time.Time, err error) {
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-		Bucket: aws.String(r.Bucket),
-		Prefix: aws.String(r.WALDir(generation) + "/"),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
-
-		for _, obj := range page.Contents {
-			if !litestream.IsWALPath(path.Base(*obj.Key)) {
-				continue
-			}
-			modTime := obj.LastModified.UTC()
-
-			n++
-			if min.IsZero() || modTime.Before(min) {
-				min = modTime
-			}
-			if max.IsZero() || modTime.After(max) {
-				max = modTime
-			}
-		}
-		return true
-	}); err != nil {
+	entries, err := r.walEntries(ctx, generation)
+	if err != nil {
 		return n, min, max, err
 	}
+	n, min, max = manifestEntryStats(entries)
 	return n, min, max, nil
 }
 
+// manifestEntryStats returns the number of entries & their creation time range.
+func manifestEntryStats(entries []*ManifestEntry) (n int, min, max time.Time) {
+	for _, e := range entries {
+		n++
+		if min.IsZero() || e.CreatedAt.Before(min) {
+			min = e.CreatedAt
+		}
+		if max.IsZero() || e.CreatedAt.After(max) {
+			max = e.CreatedAt
+		}
+	}
+	return n, min, max
+}
+
 // Snapshots returns a list of available snapshots in the replica.
 func (r *Replica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, error) {
 	if err := r.Init(ctx); err != nil {
@@ -319,33 +464,21 @@ func (r *Replica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, er
 
 	var infos []*litestream.SnapshotInfo
 	for _, generation := range generations {
-		if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-			Bucket:    aws.String(r.Bucket),
-			Prefix:    aws.String(r.SnapshotDir(generation) + "/"),
-			Delimiter: aws.String("/"),
-		}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-			r.listOperationTotalCounter.Inc()
-
-			for _, obj := range page.Contents {
-				key := path.Base(*obj.Key)
-				index, _, err := litestream.ParseSnapshotPath(key)
-				if err != nil {
-					continue
-				}
-
-				infos = append(infos, &litestream.SnapshotInfo{
-					Name:       key,
-					Replica:    r.Name(),
-					Generation: generation,
-					Index:      index,
-					Size:       *obj.Size,
-					CreatedAt:  obj.LastModified.UTC(),
-				})
-			}
-			return true
-		}); err != nil {
+		entries, err := r.snapshotEntries(ctx, generation)
+		if err != nil {
 			return nil, err
 		}
+
+		for _, e := range entries {
+			infos = append(infos, &litestream.SnapshotInfo{
+				Name:       e.Name,
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      e.Index,
+				Size:       e.Size,
+				CreatedAt:  e.CreatedAt,
+			})
+		}
 	}
 
 	return infos, nil
@@ -364,48 +497,53 @@ func (r *Replica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
 
 	var infos []*litestream.WALInfo
 	for _, generation := range generations {
+		segments, err := r.WALSegments(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+
 		var prev *litestream.WALInfo
-		if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-			Bucket:    aws.String(r.Bucket),
-			Prefix:    aws.String(r.WALDir(generation) + "/"),
-			Delimiter: aws.String("/"),
-		}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-			r.listOperationTotalCounter.Inc()
+		for _, info := range segments {
+			// Update previous record if generation & index match.
+			if prev != nil && prev.Index == info.Index {
+				prev.Size += info.Size
+				prev.CreatedAt = info.CreatedAt
+				continue
+			}
 
-			for _, obj := range page.Contents {
-				key := path.Base(*obj.Key)
+			// Append new WAL record and keep reference to append additional
+			// size for segmented WAL files.
+			prev = info
+			infos = append(infos, prev)
+		}
+	}
 
-				index, offset, _, err := litestream.ParseWALPath(key)
-				if err != nil {
-					continue
-				}
+	return infos, nil
+}
 
-				// Update previous record if generation & index match.
-				if prev != nil && prev.Index == index {
-					prev.Size += *obj.Size
-					prev.CreatedAt = obj.LastModified.UTC()
-					continue
-				}
+// WALSegments returns a list of WAL segments in a generation, in order.
+func (r *Replica) WALSegments(ctx context.Context, generation string) ([]*litestream.WALInfo, error) {
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
 
-				// Append new WAL record and keep reference to append additional
-				// size for segmented WAL files.
-				prev = &litestream.WALInfo{
-					Name:       key,
-					Replica:    r.Name(),
-					Generation: generation,
-					Index:      index,
-					Offset:     offset,
-					Size:       *obj.Size,
-					CreatedAt:  obj.LastModified.UTC(),
-				}
-				infos = append(infos, prev)
-			}
-			return true
-		}); err != nil {
-			return nil, err
-		}
+	entries, err := r.walEntries(ctx, generation)
+	if err != nil {
+		return nil, err
 	}
 
+	infos := make([]*litestream.WALInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, &litestream.WALInfo{
+			Name:       e.Name,
+			Replica:    r.Name(),
+			Generation: generation,
+			Index:      e.Index,
+			Offset:     e.Offset,
+			Size:       e.Size,
+			CreatedAt:  e.CreatedAt,
+		})
+	}
 	return infos, nil
 }
 
@@ -423,9 +561,10 @@ func (r *Replica) Start(ctx context.Context) {
 	ctx, r.cancel = context.WithCancel(ctx)
 
 	// Start goroutines to manage replica data.
-	r.wg.Add(3)
+	r.wg.Add(4)
 	go func() { defer r.wg.Done(); r.monitor(ctx) }()
 	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.snapshotter(ctx) }()
 	go func() { defer r.wg.Done(); r.validator(ctx) }()
 }
 
@@ -465,8 +604,12 @@ func (r *Replica) monitor(ctx context.Context) {
 		// Fetch new notify channel before replicating data.
 		notify = r.db.Notify()
 
-		// Synchronize the shadow wal into the replication directory.
-		if err := r.Sync(ctx); err != nil {
+		// Synchronize the shadow wal into the replication directory. The start
+		// time is tracked so a stalled sync can be detected by health checks.
+		r.setMonitorBusySince(time.Now())
+		err := r.sync(ctx, false)
+		r.setMonitorBusySince(time.Time{})
+		if err != nil {
 			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
 			continue
 		}
@@ -491,6 +634,28 @@ func (r *Replica) retainer(ctx context.Context) {
 	}
 }
 
+// snapshotter runs in a separate goroutine and creates periodic snapshots.
+func (r *Replica) snapshotter(ctx context.Context) {
+	if r.SnapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Snapshot(ctx); err != nil {
+				log.Printf("%s(%s): snapshot error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
 // validator runs in a separate goroutine and handles periodic validation.
 func (r *Replica) validator(ctx context.Context) {
 	// Initialize counters since validation occurs infrequently.
@@ -532,32 +697,19 @@ func (r *Replica) CalcPos(ctx context.Context, generation string) (pos litestrea
 		return litestream.Pos{}, err
 	}
 
+	entries, err := r.walEntries(ctx, generation)
+	if err != nil {
+		return litestream.Pos{}, err
+	}
+
 	index := -1
 	var offset int64
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-		Bucket:    aws.String(r.Bucket),
-		Prefix:    aws.String(r.WALDir(generation) + "/"),
-		Delimiter: aws.String("/"),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
-
-		for _, obj := range page.Contents {
-			key := path.Base(*obj.Key)
-
-			idx, off, _, err := litestream.ParseWALPath(key)
-			if err != nil {
-				continue // invalid wal filename
-			}
-
-			if index == -1 || idx > index {
-				index, offset = idx, 0 // start tracking new wal
-			} else if idx == index && off > offset {
-				offset = off // update offset
-			}
+	for _, e := range entries {
+		if index == -1 || e.Index > index {
+			index, offset = e.Index, 0 // start tracking new wal
+		} else if e.Index == index && e.Offset > offset {
+			offset = e.Offset // update offset
 		}
-		return true
-	}); err != nil {
-		return litestream.Pos{}, err
 	}
 	if index == -1 {
 		return pos, nil // no wal files
@@ -570,55 +722,95 @@ func (r *Replica) CalcPos(ctx context.Context, generation string) (pos litestrea
 
 // snapshot copies the entire database to the replica path.
 func (r *Replica) snapshot(ctx context.Context, generation string, index int) error {
-	// Acquire a read lock on the database during snapshot to prevent checkpoints.
-	tx, err := r.db.SQLDB().Begin()
-	if err != nil {
-		return err
-	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
-		_ = tx.Rollback()
+	// Ignore if we already have a snapshot for the given WAL index.
+	if _, err := r.snapshotKey(ctx, generation, index); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
 		return err
 	}
-	defer func() { _ = tx.Rollback() }()
 
-	// Open database file handle.
-	f, err := os.Open(r.db.Path())
-	if err != nil {
+	startTime := time.Now()
+
+	snapshotPath := r.SnapshotPath(generation, index)
+	var size int64
+	if err := r.retry(ctx, func() (err error) {
+		size, err = r.uploadSnapshot(ctx, snapshotPath)
+		return err
+	}); err != nil {
+		return err
+	}
+	r.snapshotSecondsHistogram.Observe(time.Since(startTime).Seconds())
+
+	// Record the snapshot in the generation's manifest.
+	entry := &ManifestEntry{
+		Name:      path.Base(snapshotPath),
+		Index:     index,
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := r.updateManifest(ctx, generation, func(m *Manifest) { m.putSnapshot(entry) }); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	fi, err := f.Stat()
+	r.setLastSnapshotAt(time.Now())
+	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+
+	return nil
+}
+
+// uploadSnapshot uploads the database to key & returns the uploaded size.
+func (r *Replica) uploadSnapshot(ctx context.Context, key string) (int64, error) {
+	// Obtain a consistent view of the database. Checkpoints are blocked until
+	// the reader is closed or, in backup mode, until the local copy completes.
+	rd, err := r.db.OpenSnapshot(ctx, r.SnapshotMode)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer rd.Close()
 
 	pr, pw := io.Pipe()
-	zw := lz4.NewWriter(pw)
+	defer pr.Close()
+
+	cw := &countWriter{w: pw}
+	ew, err := litestream.NewEncryptWriter(cw, r.Encryptor)
+	if err != nil {
+		return 0, err
+	}
+
+	zw, err := r.Codec.NewWriter(ew)
+	if err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
 	go func() {
-		if _, err := io.Copy(zw, f); err != nil {
+		defer close(done)
+		if _, err := io.Copy(zw, rd); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		} else if err := zw.Close(); err != nil {
 			_ = pw.CloseWithError(err)
 			return
 		}
-		_ = pw.CloseWithError(zw.Close())
+		_ = pw.CloseWithError(ew.Close())
 	}()
 
-	snapshotPath := r.SnapshotPath(generation, index)
-	startTime := time.Now()
+	// Wait for the copy to stop before the snapshot reader is closed. Closing
+	// the pipe unblocks the copy if the upload fails.
+	defer func() { _ = pr.Close(); <-done }()
 
-	if _, err := r.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(snapshotPath),
-		Body:   pr,
-	}); err != nil {
-		return err
+	if _, err := r.uploader.UploadWithContext(ctx, r.uploadInput(key, r.SnapshotStorageClass, pr)); err != nil {
+		return 0, err
+	}
+	<-done
+	if err := rd.Close(); err != nil {
+		return 0, err
 	}
 
 	r.putOperationTotalCounter.Inc()
-	r.putOperationBytesCounter.Add(float64(fi.Size()))
+	r.putOperationBytesCounter.Add(float64(cw.n)) // compressed bytes
+	r.snapshotLockSecondsHistogram.Observe(rd.LockDuration().Seconds())
 
-	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
-
-	return nil
+	return cw.n, nil
 }
 
 // snapshotN returns the number of snapshots for a generation.
@@ -646,40 +838,273 @@ func (r *Replica) Init(ctx context.Context) (err error) {
 		return nil
 	}
 
-	// Look up region if not specified.
+	// Look up region if not specified. S3-compatible stores may not support
+	// region discovery so use the default region if an endpoint is set.
 	region := r.Region
-	if region == "" {
+	if region == "" && r.Endpoint != "" {
+		region = DefaultRegion
+	} else if region == "" {
 		if region, err = r.findBucketRegion(ctx, r.Bucket); err != nil {
 			return fmt.Errorf("cannot lookup bucket region: %w", err)
 		}
 	}
 
 	// Create new AWS session.
-	config := r.config()
+	config, err := r.config()
+	if err != nil {
+		return err
+	}
 	config.Region = aws.String(region)
 	sess, err := session.NewSession(config)
 	if err != nil {
 		return fmt.Errorf("cannot create aws session: %w", err)
 	}
 	r.s3 = s3.New(sess)
-	r.uploader = s3manager.NewUploader(sess)
+	r.uploader = s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize, u.Concurrency = uploadPartSize(r.UploadBufferSize)
+	})
+	return nil
+}
+
+// ValidateServerSideEncryption returns an error if the server-side encryption
+// settings are invalid or conflict with each other.
+func ValidateServerSideEncryption(sse, kmsKeyID string, customerKey []byte) error {
+	switch sse {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("invalid server-side encryption: %q", sse)
+	}
+
+	if kmsKeyID != "" && sse != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("kms key id requires %q server-side encryption", s3.ServerSideEncryptionAwsKms)
+	} else if len(customerKey) > 0 && sse != "" {
+		return fmt.Errorf("customer key cannot be used with %q server-side encryption", sse)
+	} else if len(customerKey) > 0 && len(customerKey) != 32 {
+		return fmt.Errorf("customer key must be 32 bytes")
+	}
 	return nil
 }
 
+// retry calls fn using the replica's retry policy. Returns
+// litestream.ErrCircuitOpen without calling fn if the circuit breaker is open.
+func (r *Replica) retry(ctx context.Context, fn func() error) error {
+	if err := r.CircuitBreaker.Allow(); err != nil {
+		r.circuitOpenCounter.Inc()
+		return err
+	}
+
+	var attempt int
+	err := r.RetryPolicy.Do(ctx, isRetryable, func() error {
+		if attempt++; attempt > 1 {
+			r.retryCounter.Inc()
+		}
+		return fn()
+	})
+
+	// Only transient errors indicate that S3 is unavailable. A canceled
+	// operation says nothing about S3 so its outcome is not recorded.
+	if err != nil && ctx.Err() == context.Canceled {
+		r.CircuitBreaker.Release()
+	} else {
+		r.CircuitBreaker.Record(err != nil && (isRetryable(err) || ctx.Err() != nil))
+	}
+	if r.CircuitBreaker.IsOpen() {
+		r.circuitOpenGauge.Set(1)
+	} else {
+		r.circuitOpenGauge.Set(0)
+	}
+	return err
+}
+
+// isRetryable returns true if err is a transient S3 or network error.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		var nerr net.Error
+		return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	// Classify by the HTTP status of the innermost failed request, if any.
+	// Multipart upload failures wrap the error of the failed part.
+	for e := aerr; e != nil; {
+		if rf, ok := e.(awserr.RequestFailure); ok && rf.StatusCode() != 0 {
+			return rf.StatusCode() >= http.StatusInternalServerError || rf.StatusCode() == http.StatusTooManyRequests
+		} else if request.IsErrorThrottle(e) {
+			return true
+		}
+
+		next, ok := e.OrigErr().(awserr.Error)
+		if !ok {
+			break
+		}
+		e = next
+	}
+	return request.IsErrorRetryable(aerr)
+}
+
+// isTransient returns true if err is a transient error or the operation was
+// rejected by an open circuit breaker.
+func isTransient(err error) bool {
+	return errors.Is(err, litestream.ErrCircuitOpen) || isRetryable(err)
+}
+
+// uploadInput returns the input for uploading body to key with the replica's
+// encryption, storage class & tagging settings applied.
+func (r *Replica) uploadInput(key, storageClass string, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if r.SSE != "" {
+		input.ServerSideEncryption = aws.String(r.SSE)
+	}
+	if r.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(r.SSEKMSKeyID)
+	}
+	if len(r.SSECustomerKey) > 0 {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(r.SSECustomerKey))
+	}
+	if storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if len(r.Tags) > 0 {
+		input.Tagging = aws.String(r.tagging())
+	}
+	return input
+}
+
+// getObjectInput returns the input for downloading key. The customer key is
+// included if objects are encrypted with SSE-C.
+func (r *Replica) getObjectInput(key string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(key),
+	}
+	if len(r.SSECustomerKey) > 0 {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(string(r.SSECustomerKey))
+	}
+	return input
+}
+
+// tagging returns the replica's tags encoded as URL query parameters.
+func (r *Replica) tagging() string {
+	q := make(url.Values, len(r.Tags))
+	for k, v := range r.Tags {
+		q.Set(k, v)
+	}
+	return q.Encode()
+}
+
+// uploadPartSize returns the part size & concurrency for streaming uploads so
+// that no more than bufferSize bytes are buffered at once.
+func uploadPartSize(bufferSize int64) (partSize int64, concurrency int) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultUploadBufferSize
+	}
+
+	concurrency = int(bufferSize / s3manager.MinUploadPartSize)
+	if concurrency < 1 {
+		concurrency = 1
+	} else if concurrency > s3manager.DefaultUploadConcurrency {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+
+	partSize = bufferSize / int64(concurrency)
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+	return partSize, concurrency
+}
+
 // config returns the AWS configuration. Uses the default credential chain
-// unless a key/secret are explicitly set.
-func (r *Replica) config() *aws.Config {
+// unless a key/secret are explicitly set or a role is assumed.
+func (r *Replica) config() (*aws.Config, error) {
+	config := defaults.Get().Config
+	if r.RoleARN != "" {
+		if r.creds == nil {
+			creds, err := r.roleCredentials()
+			if err != nil {
+				return nil, err
+			}
+			r.creds = creds
+		}
+		config.Credentials = r.creds
+	} else if r.WebIdentityTokenFile != "" {
+		return nil, fmt.Errorf("role arn required for web identity token file")
+	} else if r.AccessKeyID != "" || r.SecretAccessKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(r.AccessKeyID, r.SecretAccessKey, "")
+	}
+	if r.Endpoint != "" {
+		config.Endpoint = aws.String(r.Endpoint)
+	}
+	if r.ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if r.SkipVerify {
+		config.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	return config, nil
+}
+
+// roleCredentials returns credentials for RoleARN. The credentials are
+// refreshed automatically before they expire.
+func (r *Replica) roleCredentials() (*credentials.Credentials, error) {
+	// STS is called with the authentication keys or the default chain.
 	config := defaults.Get().Config
 	if r.AccessKeyID != "" || r.SecretAccessKey != "" {
 		config.Credentials = credentials.NewStaticCredentials(r.AccessKeyID, r.SecretAccessKey, "")
 	}
-	return config
+	config.Region = aws.String(r.Region)
+	if r.Region == "" {
+		config.Region = aws.String(DefaultRegion)
+	}
+	if r.STSEndpoint != "" {
+		config.Endpoint = aws.String(r.STSEndpoint)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create sts session: %w", err)
+	}
+	svc := sts.New(sess)
+
+	sessionName := r.RoleSessionName
+	if sessionName == "" {
+		sessionName = DefaultRoleSessionName
+	}
+
+	if r.WebIdentityTokenFile != "" {
+		p := stscreds.NewWebIdentityRoleProvider(svc, r.RoleARN, sessionName, r.WebIdentityTokenFile)
+		p.ExpiryWindow = DefaultCredentialExpiryWindow
+		return credentials.NewCredentials(p), nil
+	}
+
+	return stscreds.NewCredentialsWithClient(svc, r.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		p.ExpiryWindow = DefaultCredentialExpiryWindow
+		if r.RoleExternalID != "" {
+			p.ExternalID = aws.String(r.RoleExternalID)
+		}
+	}), nil
 }
 
 func (r *Replica) findBucketRegion(ctx context.Context, bucket string) (string, error) {
 	// Connect to US standard region to fetch info.
-	config := r.config()
-	config.Region = aws.String("us-east-1")
+	config, err := r.config()
+	if err != nil {
+		return "", err
+	}
+	config.Region = aws.String(DefaultRegion)
 	sess, err := session.NewSession(config)
 	if err != nil {
 		return "", err
@@ -694,17 +1119,27 @@ func (r *Replica) findBucketRegion(ctx context.Context, bucket string) (string,
 	} else if out.LocationConstraint != nil {
 		return *out.LocationConstraint, nil
 	}
-	return "us-east-1", nil
+	return DefaultRegion, nil
 }
 
-// Sync replays data from the shadow WAL and uploads it to S3.
+// Sync replays data from the shadow WAL and uploads it to S3. Uploaded WAL
+// segments are recorded in the manifest before returning.
 func (r *Replica) Sync(ctx context.Context) (err error) {
-	// Clear last position if if an error occurs during sync.
+	return r.sync(ctx, true)
+}
+
+// sync uploads new data from the shadow WAL. The manifest is only updated once
+// ManifestFlushInterval has passed since its last update unless flush is true.
+func (r *Replica) sync(ctx context.Context, flush bool) (err error) {
+	// Track the sync error & clear last position if an error occurs. The
+	// position is kept on transient errors so the next sync can resume
+	// without recalculating it from the replica.
 	defer func() {
-		if err != nil {
-			r.mu.Lock()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.syncErr = err
+		if err != nil && !isTransient(err) {
 			r.pos = litestream.Pos{}
-			r.mu.Unlock()
 		}
 	}()
 
@@ -759,57 +1194,89 @@ func (r *Replica) Sync(ctx context.Context) (err error) {
 
 	// Read all WAL files since the last position.
 	for {
-		if err = r.syncWAL(ctx); err == io.EOF {
+		var entry *ManifestEntry
+		err := r.retry(ctx, func() (err error) {
+			entry, err = r.syncWAL(ctx)
+			return err
+		})
+		if err == io.EOF {
 			break
 		} else if err != nil {
+			// Record segments uploaded before the error in the manifest.
+			_ = r.flushManifest(ctx, flush)
 			return err
 		}
+		r.addPendingWAL(generation, entry)
 	}
 
-	return nil
+	// Record all uploaded segments in the manifest with a single update.
+	return r.flushManifest(ctx, flush)
 }
 
-func (r *Replica) syncWAL(ctx context.Context) (err error) {
+// syncWAL uploads the next WAL segment from the shadow WAL & returns its
+// manifest entry. Returns io.EOF if no WAL data is available.
+func (r *Replica) syncWAL(ctx context.Context) (_ *ManifestEntry, err error) {
 	rd, err := r.db.ShadowWALReader(r.LastPos())
 	if err == io.EOF {
-		return err
+		return nil, err
 	} else if err != nil {
-		return fmt.Errorf("wal reader: %w", err)
+		return nil, fmt.Errorf("wal reader: %w", err)
 	}
 	defer rd.Close()
 
-	// Read to intermediate buffer to determine size.
+	// Limit the segment size & stream the compressed segment to the uploader.
 	pos := rd.Pos()
-	b, err := ioutil.ReadAll(rd)
+	sz := r.segmentSize(pos, rd.N())
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	cw := &countWriter{w: pw}
+	ew, err := litestream.NewEncryptWriter(cw, r.Encryptor)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var buf bytes.Buffer
-	zw := lz4.NewWriter(&buf)
-	n, err := zw.Write(b)
+	zw, err := r.Codec.NewWriter(ew)
 	if err != nil {
-		return err
-	} else if err := zw.Close(); err != nil {
-		return err
+		return nil, err
 	}
 
+	var n int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		if n, err = io.Copy(zw, io.LimitReader(rd, sz)); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		} else if n != sz {
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+			return
+		} else if err := zw.Close(); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(ew.Close())
+	}()
+
+	// Wait for the copy to stop before the shadow WAL reader is closed.
+	// Closing the pipe unblocks the copy if the upload fails.
+	defer func() { _ = pr.Close(); <-done }()
+
 	// Build a WAL path with the index/offset as well as size so we can ensure
 	// that files are contiguous without having to decompress.
 	walPath := path.Join(
-		r.WALDir(rd.Pos().Generation),
-		litestream.FormatWALPathWithOffset(pos.Index, pos.Offset)+".lz4",
+		r.WALDir(pos.Generation),
+		litestream.FormatWALPathWithOffset(pos.Index, pos.Offset)+r.Codec.Ext(),
 	)
 
-	if _, err := r.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(walPath),
-		Body:   &buf,
-	}); err != nil {
-		return err
+	if _, err := r.uploader.UploadWithContext(ctx, r.uploadInput(walPath, r.WALStorageClass, pr)); err != nil {
+		return nil, err
 	}
+	<-done
 	r.putOperationTotalCounter.Inc()
-	r.putOperationBytesCounter.Add(float64(n)) // compressed bytes
+	r.putOperationBytesCounter.Add(float64(cw.n)) // compressed bytes
 
 	// Save last replicated position.
 	r.mu.Lock()
@@ -817,11 +1284,42 @@ func (r *Replica) syncWAL(ctx context.Context) (err error) {
 	r.mu.Unlock()
 
 	// Track raw bytes processed & current position.
-	r.walBytesCounter.Add(float64(len(b))) // raw bytes
+	r.walBytesCounter.Add(float64(n)) // raw bytes
 	r.walIndexGauge.Set(float64(rd.Pos().Index))
 	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
 
-	return nil
+	return &ManifestEntry{
+		Name:      path.Base(walPath),
+		Index:     pos.Index,
+		Offset:    pos.Offset,
+		Size:      cw.n,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// segmentSize returns the number of bytes to upload from the shadow WAL at pos
+// when n bytes are available. Segments larger than MaxSegmentSize are split
+// on frame boundaries, however, at least one frame is always included.
+func (r *Replica) segmentSize(pos litestream.Pos, n int64) int64 {
+	if r.MaxSegmentSize <= 0 || n <= r.MaxSegmentSize {
+		return n
+	}
+
+	var hdrSize int64
+	if pos.Offset == 0 {
+		hdrSize = litestream.WALHeaderSize
+	}
+
+	frameSize := int64(litestream.WALFrameHeaderSize + r.db.PageSize())
+	frameN := (r.MaxSegmentSize - hdrSize) / frameSize
+	if frameN < 1 {
+		frameN = 1
+	}
+
+	if sz := hdrSize + (frameN * frameSize); sz < n {
+		return sz
+	}
+	return n
 }
 
 // SnapshotReader returns a reader for snapshot data at the given generation/index.
@@ -830,83 +1328,176 @@ func (r *Replica) SnapshotReader(ctx context.Context, generation string, index i
 		return nil, err
 	}
 
+	// Find snapshot key as the compression extension may vary.
+	key, err := r.snapshotKey(ctx, generation, index)
+	if err != nil {
+		return nil, err
+	}
+
 	// Pipe download to return an io.Reader.
-	out, err := r.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(r.SnapshotPath(generation, index)),
-	})
+	out, err := r.s3.GetObjectWithContext(ctx, r.getObjectInput(key))
 	if err != nil {
 		return nil, err
 	}
 	r.getOperationTotalCounter.Inc()
 	r.getOperationBytesCounter.Add(float64(*out.ContentLength))
 
-	// Decompress the snapshot file.
-	return internal.NewReadCloser(lz4.NewReader(out.Body), out.Body), nil
+	// Decrypt, if necessary, and decompress the snapshot file.
+	dr, err := litestream.NewDecryptReader(out.Body, r.Encryptor)
+	if err != nil {
+		_ = out.Body.Close()
+		return nil, err
+	}
+
+	zr, err := litestream.NewCodecReader(dr, key)
+	if err != nil {
+		_ = out.Body.Close()
+		return nil, err
+	}
+	return internal.NewReadCloser(zr, out.Body), nil
+}
+
+// snapshotKey returns the key of the snapshot at the given generation/index.
+// Returns os.ErrNotExist if no matching snapshot is found.
+func (r *Replica) snapshotKey(ctx context.Context, generation string, index int) (string, error) {
+	entries, err := r.snapshotEntries(ctx, generation)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if e.Index == index {
+			return path.Join(r.SnapshotDir(generation), e.Name), nil
+		}
+	}
+	return "", os.ErrNotExist
 }
 
 // WALReader returns a reader for WAL data at the given index.
 // Returns os.ErrNotExist if no matching index is found.
 func (r *Replica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.WALReaderFrom(ctx, generation, index, 0)
+}
+
+// WALReaderFrom returns a reader for WAL data in index starting at offset.
+// Segments which end before offset are not downloaded.
+func (r *Replica) WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error) {
 	if err := r.Init(ctx); err != nil {
 		return nil, err
 	}
 
-	// Collect all files for the index.
-	var keys []string
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-		Bucket: aws.String(r.Bucket),
-		Prefix: aws.String(path.Join(r.WALDir(generation), fmt.Sprintf("%08x_", index))),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
+	// Collect all files for the index, skipping segments which end before offset.
+	entries, err := r.walEntries(ctx, generation)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, obj := range page.Contents {
-			_, _, _, err := litestream.ParseWALPath(path.Base(*obj.Key))
-			if err != nil {
-				continue
-			}
-			keys = append(keys, *obj.Key)
+	var keys []string
+	var start int64
+	for _, e := range entries {
+		if e.Index != index {
+			continue
+		} else if e.Offset <= offset {
+			keys, start = keys[:0], e.Offset
 		}
-		return true
-	}); err != nil {
-		return nil, err
-	} else if len(keys) == 0 {
+		keys = append(keys, path.Join(r.WALDir(generation), e.Name))
+	}
+	if len(keys) == 0 {
 		return nil, os.ErrNotExist
 	}
 
-	// Open each file and concatenate into a multi-reader.
-	var buf bytes.Buffer
-	var offset int64
+	// Download each segment in order & stream through a pipe so only a single
+	// segment is open at a time. Closing the reader stops the download.
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	rd := &walSegmentsReader{PipeReader: pr, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(rd.done)
+		_ = pw.CloseWithError(r.copyWALSegments(ctx, pw, generation, index, start, keys))
+	}()
+	return internal.Discard(rd, offset-start)
+}
+
+// walSegmentsReader reads WAL segments downloaded in a separate goroutine.
+type walSegmentsReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the download & waits for it to finish.
+func (r *walSegmentsReader) Close() error {
+	r.cancel()
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+// copyWALSegments downloads & decompresses the WAL segments at keys, starting
+// at offset, into w.
+func (r *Replica) copyWALSegments(ctx context.Context, w io.Writer, generation string, index int, offset int64, keys []string) error {
 	for _, key := range keys {
-		// Ensure offset is correct as we copy segments into buffer.
+		// Ensure offset is correct as we copy segments to the writer.
 		_, off, _, _ := litestream.ParseWALPath(path.Base(key))
 		if off != offset {
-			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at remote offset %d, expected offset %d", generation, index, off, offset)
+			return fmt.Errorf("out of sequence wal segments: %s/%08x at remote offset %d, expected offset %d", generation, index, off, offset)
 		}
 
-		// Pipe download to return an io.Reader.
-		out, err := r.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(r.Bucket),
-			Key:    aws.String(key),
-		})
+		n, err := r.copyWALSegment(ctx, w, key)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer out.Body.Close()
+		offset += n
+	}
+	return nil
+}
 
-		r.getOperationTotalCounter.Inc()
-		r.getOperationBytesCounter.Add(float64(*out.ContentLength))
+// copyWALSegment downloads & decompresses a single WAL segment into w.
+func (r *Replica) copyWALSegment(ctx context.Context, w io.Writer, key string) (int64, error) {
+	out, err := r.s3.GetObjectWithContext(ctx, r.getObjectInput(key))
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
 
-		zr := lz4.NewReader(out.Body)
+	r.getOperationTotalCounter.Inc()
+	r.getOperationBytesCounter.Add(float64(*out.ContentLength))
 
-		n, err := io.Copy(&buf, zr)
-		if err != nil {
-			return nil, err
-		}
-		offset += int64(n)
+	dr, err := litestream.NewDecryptReader(out.Body, r.Encryptor)
+	if err != nil {
+		return 0, err
+	}
+	zr, err := litestream.NewCodecReader(dr, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, zr)
+	if err != nil {
+		_ = zr.Close()
+		return n, err
+	}
+	return n, zr.Close()
+}
+
+// Snapshot creates a snapshot of the database at its current position.
+// No snapshot is created if one already exists for the current WAL index.
+func (r *Replica) Snapshot(ctx context.Context) error {
+	if err := r.Init(ctx); err != nil {
+		return err
 	}
 
-	return ioutil.NopCloser(&buf), nil
+	// Ensure sync & retainer do not snapshot at the same time.
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	pos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if pos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	return r.snapshot(ctx, pos.Generation, pos.Index)
 }
 
 // EnforceRetention forces a new snapshot once the retention interval has passed.
@@ -917,7 +1508,7 @@ func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
 	}
 
 	// Ensure sync & retainer do not snapshot at the same time.
-	var snapshots []*litestream.SnapshotInfo
+	var all, snapshots, walSnapshots []*litestream.SnapshotInfo
 	if err := func() error {
 		r.snapshotMu.Lock()
 		defer r.snapshotMu.Unlock()
@@ -931,17 +1522,22 @@ func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
 		}
 
 		// Obtain list of snapshots that are within the retention period.
-		if snapshots, err = r.Snapshots(ctx); err != nil {
+		if all, err = r.Snapshots(ctx); err != nil {
 			return fmt.Errorf("cannot obtain snapshot list: %w", err)
 		}
-		snapshots = litestream.FilterSnapshotsAfter(snapshots, time.Now().Add(-r.Retention))
-
-		// If no retained snapshots exist, create a new snapshot.
-		if len(snapshots) == 0 {
+		r.setLastSnapshotAt(litestream.LatestSnapshotTime(all))
+		now := time.Now()
+		snapshots, walSnapshots = litestream.RetainSnapshots(all, r.Retention, r.RetentionPolicy, now)
+
+		// If no retained snapshots with WAL exist or the retention policy has
+		// no snapshot for its finest interval, create a new snapshot.
+		if litestream.FindMinSnapshotByGeneration(walSnapshots, pos.Generation) == nil ||
+			(r.RetentionPolicy.SnapshotDue(all, pos.Generation, now) && !litestream.ContainsSnapshot(all, pos.Generation, pos.Index)) {
 			if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
 				return fmt.Errorf("cannot snapshot: %w", err)
 			}
-			snapshots = append(snapshots, &litestream.SnapshotInfo{Generation: pos.Generation, Index: pos.Index})
+			info := &litestream.SnapshotInfo{Generation: pos.Generation, Index: pos.Index}
+			snapshots, walSnapshots = append(snapshots, info), append(walSnapshots, info)
 		}
 
 		return nil
@@ -960,45 +1556,59 @@ func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
 
 		// Delete generations if it has no snapshots being retained.
 		if snapshot == nil {
-			if err := r.deleteGenerationBefore(ctx, generation, -1); err != nil {
+			if err := r.deleteGenerationBefore(ctx, generation, -1, nil, nil); err != nil {
 				return fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
 			}
 			continue
 		}
 
-		// Otherwise delete all snapshots & WAL files before a lowest retained index.
-		if err := r.deleteGenerationBefore(ctx, generation, snapshot.Index); err != nil {
-			return fmt.Errorf("cannot delete generation %q files before index %d: %w", generation, snapshot.Index, err)
+		// Otherwise delete unretained snapshots & all WAL files before the
+		// lowest index that retains WAL. Generations retained only by coarser
+		// policy tiers keep no WAL files.
+		walIndex := math.MaxInt32
+		if snapshot := litestream.FindMinSnapshotByGeneration(walSnapshots, generation); snapshot != nil {
+			walIndex = snapshot.Index
+		}
+		if err := r.deleteGenerationBefore(ctx, generation, walIndex, all, snapshots); err != nil {
+			return fmt.Errorf("cannot delete generation %q files before index %d: %w", generation, walIndex, err)
 		}
 	}
 
 	return nil
 }
 
-func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string, index int) (err error) {
-	// Collect all files for the generation.
+// deleteGenerationBefore deletes WAL files before index & listed snapshots
+// that are not retained. All files, including the manifest, are deleted if
+// index is -1.
+func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string, index int, snapshots, retained []*litestream.SnapshotInfo) (err error) {
 	var objIDs []*s3.ObjectIdentifier
-	if err := r.s3.ListObjectsPagesWithContext(ctx, &s3.ListObjectsInput{
-		Bucket: aws.String(r.Bucket),
-		Prefix: aws.String(r.GenerationDir(generation)),
-	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		r.listOperationTotalCounter.Inc()
-
-		for _, obj := range page.Contents {
-			// Skip snapshots or WALs that are after the search index unless -1.
-			if index != -1 {
-				if idx, _, err := litestream.ParseSnapshotPath(path.Base(*obj.Key)); err == nil && idx >= index {
-					continue
-				} else if idx, _, _, err := litestream.ParseWALPath(path.Base(*obj.Key)); err == nil && idx >= index {
-					continue
-				}
+	if index == -1 {
+		if objIDs, err = r.listGenerationObjects(ctx, generation); err != nil {
+			return err
+		}
+	} else {
+		// Skip retained snapshots, snapshots created since listing & WALs
+		// that are after the search index.
+		entries, err := r.snapshotEntries(ctx, generation)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !litestream.ContainsSnapshot(snapshots, generation, e.Index) || litestream.ContainsSnapshot(retained, generation, e.Index) {
+				continue
 			}
+			objIDs = append(objIDs, &s3.ObjectIdentifier{Key: aws.String(path.Join(r.SnapshotDir(generation), e.Name))})
+		}
 
-			objIDs = append(objIDs, &s3.ObjectIdentifier{Key: obj.Key})
+		if entries, err = r.walEntries(ctx, generation); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Index >= index {
+				continue
+			}
+			objIDs = append(objIDs, &s3.ObjectIdentifier{Key: aws.String(path.Join(r.WALDir(generation), e.Name))})
 		}
-		return true
-	}); err != nil {
-		return err
 	}
 
 	// Delete all files in batches.
@@ -1009,12 +1619,15 @@ func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string,
 			j = len(objIDs)
 		}
 
-		if _, err := r.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
-			Bucket: aws.String(r.Bucket),
-			Delete: &s3.Delete{
-				Objects: objIDs[i:j],
-				Quiet:   aws.Bool(true),
-			},
+		if err := r.retry(ctx, func() error {
+			_, err := r.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(r.Bucket),
+				Delete: &s3.Delete{
+					Objects: objIDs[i:j],
+					Quiet:   aws.Bool(true),
+				},
+			})
+			return err
 		}); err != nil {
 			return err
 		}
@@ -1022,11 +1635,59 @@ func (r *Replica) deleteGenerationBefore(ctx context.Context, generation string,
 		r.deleteOperationTotalCounter.Inc()
 	}
 
+	// Remove deleted objects from the manifest & add segments uploaded since
+	// its last update. Objects are deleted first so that an interrupted update
+	// is corrected by the next retention check.
+	if index == -1 {
+		r.setManifest(generation, nil, "")
+		r.removePendingWAL(generation)
+	} else {
+		names := make(map[string]struct{}, len(objIDs))
+		for _, objID := range objIDs {
+			names[path.Base(*objID.Key)] = struct{}{}
+		}
+		if err := r.updateManifest(ctx, generation, func(m *Manifest) { m.remove(names) }); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, n)
 
 	return nil
 }
 
+// listGenerationObjects returns identifiers for all objects in a generation.
+func (r *Replica) listGenerationObjects(ctx context.Context, generation string) ([]*s3.ObjectIdentifier, error) {
+	objs, _, err := r.listObjects(ctx, &s3.ListObjectsInput{
+		Bucket: aws.String(r.Bucket),
+		Prefix: aws.String(r.GenerationDir(generation) + "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objIDs := make([]*s3.ObjectIdentifier, 0, len(objs))
+	for _, obj := range objs {
+		objIDs = append(objIDs, &s3.ObjectIdentifier{Key: obj.Key})
+	}
+	return objIDs, nil
+}
+
+// listObjects returns all objects & common prefixes matching input. The
+// listing is restarted if a page fails to load.
+func (r *Replica) listObjects(ctx context.Context, input *s3.ListObjectsInput) (objs []*s3.Object, prefixes []*s3.CommonPrefix, err error) {
+	err = r.retry(ctx, func() error {
+		objs, prefixes = nil, nil
+		return r.s3.ListObjectsPagesWithContext(ctx, input, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+			r.listOperationTotalCounter.Inc()
+			objs = append(objs, page.Contents...)
+			prefixes = append(prefixes, page.CommonPrefixes...)
+			return true
+		})
+	})
+	return objs, prefixes, err
+}
+
 // S3 metrics.
 var (
 	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -0,0 +1,1460 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+	"github.com/benbjohnson/litestream/s3"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	// Ensure WAL ranges larger than the max segment size are split into
+	// multiple segments & can be restored from them.
+	t.Run("MaxSegmentSize", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.MaxSegmentSize = 16 * 1024
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write to the database multiple times and sync periodically so that
+		// multiple WAL indexes & segments are uploaded.
+		n := db.MinCheckpointPageN * 2
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure positions match.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Index == 0 {
+			t.Fatal("expected multiple wal indexes")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		// Ensure no uploaded segment exceeds the max segment size.
+		wals, err := r.WALs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var segmentN int
+		for _, key := range s.keys() {
+			if !strings.Contains(key, "/wal/") {
+				continue
+			} else if len(s.objects[key].data) > int(r.MaxSegmentSize) {
+				t.Fatalf("segment too large: %s (%d bytes)", key, len(s.objects[key].data))
+			}
+			segmentN++
+		}
+		if segmentN <= len(wals) {
+			t.Fatalf("expected wal indexes split into multiple segments: segments=%d wals=%d", segmentN, len(wals))
+		}
+
+		MustRestoreRowCount(t, r, pos.Generation, n)
+	})
+
+	// Ensure segments larger than the upload buffer are streamed as multipart
+	// uploads & streamed back in order during restore.
+	t.Run("Multipart", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Codec = &litestream.GzipCodec{} // lz4 cannot decode large incompressible frames
+		r.UploadBufferSize = s3manager.MinUploadPartSize
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar BLOB);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		const n = 8
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (randomblob(1048576))`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if s.multipartN == 0 {
+			t.Fatal("expected multipart upload")
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		MustRestoreRowCount(t, r, pos.Generation, n)
+	})
+	// Ensure the PUT bytes metric counts the compressed bytes uploaded.
+	t.Run("PutBytes", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES (?)`, strings.Repeat("x", 1000)); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			} else if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s.mu.Lock()
+		putBytes := s.putBytes
+		s.mu.Unlock()
+		if got, want := MustGatherOperationBytes(t, db.Path(), "PUT"), float64(putBytes); got != want {
+			t.Fatalf("operation_bytes=%v, want %v", got, want)
+		}
+	})
+}
+
+func TestReplica_Snapshot(t *testing.T) {
+	// Ensure a snapshot is not uploaded again if one already exists for the
+	// current WAL index.
+	t.Run("Exists", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := "bkt/" + r.SnapshotPath(pos.Generation, pos.Index)
+		s.mu.Lock()
+		obj := s.objects[key]
+		s.mu.Unlock()
+		if obj == nil {
+			t.Fatalf("expected snapshot: %s", key)
+		}
+
+		if err := r.Snapshot(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		other := s.objects[key]
+		s.mu.Unlock()
+		if other != obj {
+			t.Fatal("expected existing snapshot to be retained")
+		}
+
+		snapshots, err := r.Snapshots(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if got, want := len(snapshots), 1; got != want {
+			t.Fatalf("len(snapshots)=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_Init(t *testing.T) {
+	// Ensure the region is not looked up when a custom endpoint is set.
+	t.Run("EndpointWithoutRegion", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Region = ""
+
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		MustRestoreRowCount(t, r, generation, 1)
+	})
+}
+
+func TestReplica_Restore(t *testing.T) {
+	// Ensure the database can be restored to the last WAL segment before a
+	// timestamp when the timestamp falls within a WAL index.
+	t.Run("Timestamp", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		generation := MustSyncRows(t, db, sqldb, r, 3)
+		time.Sleep(10 * time.Millisecond)
+		timestamp := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		MustSyncRows(t, db, sqldb, r, 2)
+
+		if pos := r.LastPos(); pos.Index != 0 {
+			t.Fatalf("expected single wal index: %s", pos)
+		}
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), generation
+		opt.Timestamp = timestamp
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := testingutil.MustOpenSQLDB(t, opt.OutputPath)
+		defer testingutil.MustCloseSQLDB(t, other)
+
+		var n int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if got, want := n, 3; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+}
+
+func TestReplica_WALReaderFrom(t *testing.T) {
+	s := MustOpenServer(t)
+	defer s.Close()
+
+	db, sqldb := testingutil.MustOpenDBs(t)
+	defer testingutil.MustCloseDBs(t, db, sqldb)
+	r := s.NewReplica(t, db)
+
+	generation := MustSyncRows(t, db, sqldb, r, 5)
+	index := r.LastPos().Index
+
+	readAll := func(offset int64) (buf []byte, requestN int) {
+		t.Helper()
+		n := s.RequestN()
+		rd, err := r.WALReaderFrom(context.Background(), generation, index, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rd.Close()
+
+		if buf, err = ioutil.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		}
+		return buf, s.RequestN() - n
+	}
+
+	full, fullRequestN := readAll(0)
+	if len(full) == 0 {
+		t.Fatal("expected wal data")
+	}
+
+	segments, err := r.WALSegments(context.Background(), generation)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(segments) < 2 {
+		t.Fatalf("expected multiple wal segments, got %d", len(segments))
+	}
+
+	// Ensure data from the start of & within each segment matches & that
+	// earlier segments are not downloaded.
+	for _, seg := range segments {
+		for _, offset := range []int64{seg.Offset, seg.Offset + 1} {
+			buf, requestN := readAll(offset)
+			if !bytes.Equal(buf, full[offset:]) {
+				t.Fatalf("WALReaderFrom(%d): len=%d, want %d", offset, len(buf), len(full[offset:]))
+			} else if seg.Offset > 0 && requestN >= fullRequestN {
+				t.Fatalf("WALReaderFrom(%d): requests=%d, want fewer than %d", offset, requestN, fullRequestN)
+			}
+		}
+	}
+
+	// Ensure reading from the end of the WAL returns no data.
+	if buf, _ := readAll(int64(len(full))); len(buf) != 0 {
+		t.Fatalf("unexpected data: len=%d", len(buf))
+	}
+}
+
+func TestReplica_Manifest(t *testing.T) {
+	// Ensure the manifest is updated on upload & used for reads so that a
+	// restore only lists segments after the manifest's last segment.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		generation := MustSyncRows(t, db, sqldb, r, 3)
+
+		m := s.MustReadManifest(t, r, generation)
+		if got, want := len(m.Snapshots), 1; got != want {
+			t.Fatalf("len(Snapshots)=%d, want %d", got, want)
+		} else if got, want := len(m.WAL), len(s.keysUnder("bkt/"+r.WALDir(generation)+"/")); got != want {
+			t.Fatalf("len(WAL)=%d, want %d", got, want)
+		}
+
+		listN := s.listedUnder(r.GenerationDir(generation))
+		MustRestoreRowCount(t, s.NewReplica(t, db), generation, 3)
+		if got := s.listedUnder(r.GenerationDir(generation)); got != listN {
+			t.Fatalf("unexpected generation listing: n=%d", got-listN)
+		}
+	})
+
+	// Ensure reads fall back to listing objects if the manifest is missing.
+	t.Run("Missing", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		generation := MustSyncRows(t, db, sqldb, r, 3)
+		s.deleteObject("bkt/" + r.ManifestPath(generation))
+
+		listN := s.listedUnder(r.GenerationDir(generation))
+		MustRestoreRowCount(t, s.NewReplica(t, db), generation, 3)
+		if s.listedUnder(r.GenerationDir(generation)) == listN {
+			t.Fatal("expected generation listing")
+		}
+	})
+
+	// Ensure a stale manifest can be rebuilt from a listing.
+	t.Run("Rebuild", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		generation := MustSyncRows(t, db, sqldb, r, 2)
+
+		// Replace manifest with a copy from before the last rows were synced.
+		key := "bkt/" + r.ManifestPath(generation)
+		stale := s.objectData(key)
+		MustSyncRows(t, db, sqldb, r, 2)
+		s.putObject(key, stale)
+
+		other := s.NewReplica(t, db)
+		if m, err := other.RebuildManifest(context.Background(), generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := len(m.WAL), len(s.keysUnder("bkt/"+r.WALDir(generation)+"/")); got != want {
+			t.Fatalf("len(WAL)=%d, want %d", got, want)
+		}
+		MustRestoreRowCount(t, other, generation, 4)
+	})
+
+	// Ensure segments uploaded after the manifest's last segment are found by
+	// a listing that starts after it so reads of a stale manifest are current.
+	t.Run("Stale", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		generation := MustSyncRows(t, db, sqldb, r, 2)
+
+		key := "bkt/" + r.ManifestPath(generation)
+		stale := s.objectData(key)
+		MustSyncRows(t, db, sqldb, r, 2)
+		s.putObject(key, stale)
+
+		other := s.NewReplica(t, db)
+		if pos, err := other.CalcPos(context.Background(), generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := pos, s.MustLastWALPos(t, r, generation); got != want {
+			t.Fatalf("CalcPos()=%v, want %v", got, want)
+		}
+
+		listN := s.listedUnder(r.GenerationDir(generation))
+		MustRestoreRowCount(t, other, generation, 4)
+		if got := s.listedUnder(r.GenerationDir(generation)); got != listN {
+			t.Fatalf("unexpected generation listing: n=%d", got-listN)
+		}
+	})
+
+	// Ensure the background monitor batches manifest updates & that an
+	// on-demand sync records all pending segments.
+	t.Run("FlushInterval", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.ManifestFlushInterval = time.Hour
+		r.SyncInterval = 10 * time.Millisecond
+		r.MonitorEnabled = true
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		r.Start(context.Background())
+		defer r.Stop()
+
+		waitSynced := func() litestream.Pos {
+			t.Helper()
+			pos, err := db.Pos()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for deadline := time.Now().Add(5 * time.Second); r.LastPos() != pos; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout waiting for sync: LastPos()=%v, want %v", r.LastPos(), pos)
+				}
+			}
+			return pos
+		}
+		pos := waitSynced()
+		generation := pos.Generation
+		key := "bkt/" + r.ManifestPath(generation)
+		data := s.objectData(key)
+
+		for i := 0; i < 3; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			} else if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			waitSynced()
+		}
+		if !bytes.Equal(s.objectData(key), data) {
+			t.Fatal("expected manifest update to be deferred")
+		}
+
+		// Reads include segments missing from the manifest.
+		if got, err := s.NewReplica(t, db).CalcPos(context.Background(), generation); err != nil {
+			t.Fatal(err)
+		} else if want := s.MustLastWALPos(t, r, generation); got != want {
+			t.Fatalf("CalcPos()=%v, want %v", got, want)
+		}
+
+		r.Stop()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		m := s.MustReadManifest(t, r, generation)
+		if got, want := len(m.WAL), len(s.keysUnder("bkt/"+r.WALDir(generation)+"/")); got != want {
+			t.Fatalf("len(WAL)=%d, want %d", got, want)
+		}
+		MustRestoreRowCount(t, r, generation, 4)
+	})
+
+	// Ensure objects removed by retention are removed from the manifest.
+	t.Run("Retention", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		db.MinCheckpointPageN = 1
+		r := s.NewReplica(t, db)
+		r.Retention = time.Nanosecond
+		generation := MustSyncRows(t, db, sqldb, r, 3)
+
+		if err := r.EnforceRetention(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		m := s.MustReadManifest(t, r, generation)
+		for _, e := range m.Snapshots {
+			names = append(names, "bkt/"+r.SnapshotDir(generation)+"/"+e.Name)
+		}
+		for _, e := range m.WAL {
+			names = append(names, "bkt/"+r.WALDir(generation)+"/"+e.Name)
+		}
+		keys := append(s.keysUnder("bkt/"+r.SnapshotDir(generation)+"/"), s.keysUnder("bkt/"+r.WALDir(generation)+"/")...)
+		sort.Strings(names)
+		sort.Strings(keys)
+		if got, want := strings.Join(names, ","), strings.Join(keys, ","); got != want {
+			t.Fatalf("manifest=%s, want %s", got, want)
+		} else if len(m.Snapshots) != 1 {
+			t.Fatalf("len(Snapshots)=%d, want 1", len(m.Snapshots))
+		}
+		MustRestoreRowCount(t, s.NewReplica(t, db), generation, 3)
+	})
+}
+
+func TestReplica_ServerSideEncryption(t *testing.T) {
+	// Ensure encryption, storage class & tagging settings are applied to
+	// every uploaded object.
+	t.Run("KMS", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.SSE, r.SSEKMSKeyID = "aws:kms", "alias/litestream"
+		r.SnapshotStorageClass, r.WALStorageClass = "STANDARD_IA", "STANDARD"
+		r.Tags = map[string]string{"app": "litestream", "env": "test"}
+		generation := MustSyncRows(t, db, sqldb, r, 2)
+
+		keys := s.keysUnder("bkt/" + r.GenerationDir(generation) + "/")
+		if len(keys) == 0 {
+			t.Fatal("expected objects")
+		}
+		for _, key := range keys {
+			header := s.objectHeader(key)
+			if got, want := header.Get("X-Amz-Server-Side-Encryption"), "aws:kms"; got != want {
+				t.Fatalf("%s: sse=%q, want %q", key, got, want)
+			} else if got, want := header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), "alias/litestream"; got != want {
+				t.Fatalf("%s: kms key id=%q, want %q", key, got, want)
+			} else if got, want := header.Get("X-Amz-Tagging"), "app=litestream&env=test"; got != want {
+				t.Fatalf("%s: tagging=%q, want %q", key, got, want)
+			}
+
+			var storageClass string
+			if strings.Contains(key, "/snapshots/") {
+				storageClass = "STANDARD_IA"
+			} else if strings.Contains(key, "/wal/") {
+				storageClass = "STANDARD"
+			}
+			if got := header.Get("X-Amz-Storage-Class"); got != storageClass {
+				t.Fatalf("%s: storage class=%q, want %q", key, got, storageClass)
+			}
+		}
+	})
+
+	// Ensure objects are uploaded with a customer-provided key & that the same
+	// key is required to restore them.
+	t.Run("CustomerKey", func(t *testing.T) {
+		s := MustOpenTLSServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		key := []byte("0123456789abcdef0123456789abcdef")
+		r := s.NewReplica(t, db)
+		r.SSECustomerKey = key
+		generation := MustSyncRows(t, db, sqldb, r, 2)
+
+		for _, k := range s.keysUnder("bkt/" + r.GenerationDir(generation) + "/") {
+			if s.objectHeader(k).Get(sseCustomerKeyMD5Header) == "" {
+				t.Fatalf("%s: expected customer key", k)
+			}
+		}
+
+		other := s.NewReplica(t, db)
+		other.SSECustomerKey = key
+		MustRestoreRowCount(t, other, generation, 2)
+
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = filepath.Join(t.TempDir(), "db"), generation
+		if err := litestream.RestoreReplica(context.Background(), s.NewReplica(t, db), opt); err == nil {
+			t.Fatal("expected error without customer key")
+		}
+	})
+}
+
+func TestValidateServerSideEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	for _, tt := range []struct {
+		sse, kmsKeyID string
+		customerKey   []byte
+		err           string
+	}{
+		{sse: "AES256"},
+		{sse: "aws:kms", kmsKeyID: "alias/litestream"},
+		{customerKey: key},
+		{sse: "aws:kmx", err: `invalid server-side encryption: "aws:kmx"`},
+		{sse: "AES256", kmsKeyID: "alias/litestream", err: `kms key id requires "aws:kms" server-side encryption`},
+		{sse: "AES256", customerKey: key, err: `customer key cannot be used with "AES256" server-side encryption`},
+		{customerKey: key[:16], err: `customer key must be 32 bytes`},
+	} {
+		if err := s3.ValidateServerSideEncryption(tt.sse, tt.kmsKeyID, tt.customerKey); tt.err == "" && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Fatalf("error=%v, want %s", err, tt.err)
+		}
+	}
+}
+
+func TestReplica_AssumeRole(t *testing.T) {
+	// Ensure the role is assumed once using the authentication keys & its
+	// credentials are used for all S3 requests.
+	t.Run("OK", func(t *testing.T) {
+		s, sts := MustOpenServer(t), MustOpenSTSServer(t, time.Hour)
+		defer s.Close()
+		defer sts.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RoleARN = "arn:aws:iam::123456789012:role/litestream"
+		r.RoleExternalID, r.RoleSessionName = "EXTERNALID", "backup"
+		r.STSEndpoint = sts.URL
+		MustSyncRows(t, db, sqldb, r, 2)
+
+		if got, want := len(sts.requests), 1; got != want {
+			t.Fatalf("sts requests=%d, want %d", got, want)
+		} else if req := sts.requests[0]; req.Get("Action") != "AssumeRole" {
+			t.Fatalf("unexpected action: %s", req.Get("Action"))
+		} else if got, want := req.Get("RoleArn"), r.RoleARN; got != want {
+			t.Fatalf("RoleArn=%s, want %s", got, want)
+		} else if got, want := req.Get("ExternalId"), "EXTERNALID"; got != want {
+			t.Fatalf("ExternalId=%s, want %s", got, want)
+		} else if got, want := req.Get("RoleSessionName"), "backup"; got != want {
+			t.Fatalf("RoleSessionName=%s, want %s", got, want)
+		} else if got, want := sts.signers[0], "AKID"; got != want {
+			t.Fatalf("sts signer=%s, want %s", got, want)
+		}
+
+		if len(s.signers) != 1 || s.signers["ASIA1:TOKEN1"] == 0 {
+			t.Fatalf("unexpected s3 signers: %v", s.signers)
+		}
+	})
+
+	// Ensure a web identity token is exchanged for role credentials.
+	t.Run("WebIdentity", func(t *testing.T) {
+		s, sts := MustOpenServer(t), MustOpenSTSServer(t, time.Hour)
+		defer s.Close()
+		defer sts.Close()
+
+		tokenPath := filepath.Join(t.TempDir(), "token")
+		if err := ioutil.WriteFile(tokenPath, []byte("OIDCTOKEN"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.AccessKeyID, r.SecretAccessKey = "", ""
+		r.RoleARN, r.WebIdentityTokenFile = "arn:aws:iam::123456789012:role/litestream", tokenPath
+		r.STSEndpoint = sts.URL
+		MustSyncRows(t, db, sqldb, r, 2)
+
+		if got, want := len(sts.requests), 1; got != want {
+			t.Fatalf("sts requests=%d, want %d", got, want)
+		} else if req := sts.requests[0]; req.Get("Action") != "AssumeRoleWithWebIdentity" {
+			t.Fatalf("unexpected action: %s", req.Get("Action"))
+		} else if got, want := req.Get("WebIdentityToken"), "OIDCTOKEN"; got != want {
+			t.Fatalf("WebIdentityToken=%s, want %s", got, want)
+		} else if got, want := req.Get("RoleSessionName"), s3.DefaultRoleSessionName; got != want {
+			t.Fatalf("RoleSessionName=%s, want %s", got, want)
+		}
+
+		if len(s.signers) != 1 || s.signers["ASIA1:TOKEN1"] == 0 {
+			t.Fatalf("unexpected s3 signers: %v", s.signers)
+		}
+	})
+
+	// Ensure credentials are refreshed as they expire & the token file is
+	// re-read on each refresh.
+	t.Run("Refresh", func(t *testing.T) {
+		s, sts := MustOpenServer(t), MustOpenSTSServer(t, s3.DefaultCredentialExpiryWindow/2)
+		defer s.Close()
+		defer sts.Close()
+
+		tokenPath := filepath.Join(t.TempDir(), "token")
+		if err := ioutil.WriteFile(tokenPath, []byte("TOKEN1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RoleARN, r.WebIdentityTokenFile = "arn:aws:iam::123456789012:role/litestream", tokenPath
+		r.STSEndpoint = sts.URL
+		MustSyncRows(t, db, sqldb, r, 1)
+
+		if err := ioutil.WriteFile(tokenPath, []byte("TOKEN2"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		MustSyncRows(t, db, sqldb, r, 1)
+
+		if n := len(sts.requests); n < 2 {
+			t.Fatalf("expected refresh, sts requests=%d", n)
+		} else if got, want := sts.requests[n-1].Get("WebIdentityToken"), "TOKEN2"; got != want {
+			t.Fatalf("WebIdentityToken=%s, want %s", got, want)
+		} else if len(s.signers) < 2 {
+			t.Fatalf("expected refreshed credentials, s3 signers: %v", s.signers)
+		}
+	})
+}
+
+func TestReplica_Retry(t *testing.T) {
+	// Ensure failed uploads are retried once the SDK's own retries of the
+	// request are exhausted.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+
+		s.FailNext(5) // more than the SDK retries for a single request
+		MustSyncRows(t, db, sqldb, r, 1)
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure the replica position is kept after a transient failure so the
+	// next sync does not recalculate it from the replica.
+	t.Run("KeepPos", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		listN := s.listedUnder(r.GenerationDir(generation))
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if got := s.listedUnder(r.GenerationDir(generation)); got != listN {
+			t.Fatalf("unexpected generation listing: n=%d", got-listN)
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure requests are rejected without contacting S3 while the circuit
+	// breaker is open & that a successful trial closes it.
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		now := time.Now()
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		r.CircuitBreaker = &litestream.CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Now: func() time.Time { return now }}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if !r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected open circuit")
+		}
+
+		requestN := s.RequestN()
+		if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrCircuitOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := s.RequestN(); got != requestN {
+			t.Fatalf("unexpected requests while circuit open: n=%d", got-requestN)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(false)
+		now = now.Add(time.Hour)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected closed circuit")
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure operations canceled by their context are not recorded as
+	// failures by the circuit breaker.
+	t.Run("Canceled", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		r.CircuitBreaker = &litestream.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(ctx); err == nil {
+			t.Fatal("expected error")
+		} else if r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected closed circuit")
+		}
+
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+}
+
+// MustSyncRows inserts n rows into the "foo" table, creating it if needed, and
+// syncs db & r after each row. Returns the current generation.
+func MustSyncRows(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *s3.Replica, n int) string {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE IF NOT EXISTS foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pos.Generation
+}
+
+// MustRestoreRowCount restores the generation from r & verifies the number of
+// rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r *s3.Replica, generation string, n int) {
+	tb.Helper()
+
+	outputPath := filepath.Join(tb.TempDir(), "db")
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath, opt.Generation = outputPath, generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	other := testingutil.MustOpenSQLDB(tb, outputPath)
+	defer testingutil.MustCloseSQLDB(tb, other)
+
+	var count int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+		tb.Fatal(err)
+	} else if got, want := count, n; got != want {
+		tb.Fatalf("n=%d, want %d", got, want)
+	}
+}
+
+// MustLastWALPos returns the index & offset of the last WAL segment object in
+// a generation.
+func (s *Server) MustLastWALPos(tb testing.TB, r *s3.Replica, generation string) litestream.Pos {
+	tb.Helper()
+	keys := s.keysUnder("bkt/" + r.WALDir(generation) + "/")
+	if len(keys) == 0 {
+		tb.Fatal("no wal segments")
+	}
+	index, offset, _, err := litestream.ParseWALPath(path.Base(keys[len(keys)-1]))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return litestream.Pos{Generation: generation, Index: index, Offset: offset}
+}
+
+// MustGatherOperationBytes returns the S3 operation bytes metric for a
+// database & operation type.
+func MustGatherOperationBytes(tb testing.TB, dbPath, typ string) (v float64) {
+	tb.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "litestream_s3_operation_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["db"] == dbPath && labels["type"] == typ {
+				v += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return v
+}
+
+// Server is a minimal, in-memory implementation of the S3 REST API using
+// path-style addressing.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*object        // keyed by "bucket/key"
+	uploads    map[string]map[int][]byte // multipart parts, keyed by upload id
+	headers    map[string]http.Header    // multipart headers, keyed by upload id
+	multipartN int                       // number of completed multipart uploads
+	putBytes   int                       // number of bytes received by puts & parts
+	listed     []string                  // prefixes of list requests without a marker
+	signers    map[string]int            // request count by access key & session token
+	requestN   int                       // number of requests received
+	failN      int                       // number of subsequent requests to fail
+	failing    bool                      // if true, all requests fail
+}
+
+type object struct {
+	data      []byte
+	header    http.Header // request headers from upload
+	updatedAt time.Time
+}
+
+// MustOpenServer returns a new, running emulator on a random local port.
+func MustOpenServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := newServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// MustOpenTLSServer returns a new, running emulator using TLS. Required for
+// customer-provided encryption keys.
+func MustOpenTLSServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := newServer()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		objects: make(map[string]*object),
+		uploads: make(map[string]map[int][]byte),
+		headers: make(map[string]http.Header),
+		signers: make(map[string]int),
+	}
+}
+
+// NewReplica returns a new replica connected to the server.
+func (s *Server) NewReplica(tb testing.TB, db *litestream.DB) *s3.Replica {
+	r := s3.NewReplica(db, "")
+	r.AccessKeyID, r.SecretAccessKey = "AKID", "SECRET"
+	r.Region, r.Bucket, r.Path = "us-east-1", "bkt", "db"
+	r.Endpoint, r.ForcePathStyle = s.URL, true
+	r.SkipVerify = s.TLS != nil
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+	return r
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	a := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := a[0], ""
+	if len(a) == 2 {
+		key = a[1]
+	}
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	s.signers[signer(r)]++
+	s.requestN++
+	fail := s.failing || s.failN > 0
+	if s.failN > 0 {
+		s.failN--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		writeError(w, http.StatusServiceUnavailable, "ServiceUnavailable")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && key == "" && hasParam(q, "location"):
+		// Region discovery is not supported by many S3-compatible stores.
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	case r.Method == "GET" && key == "":
+		s.handleList(w, r, bucket)
+	case r.Method == "POST" && key == "" && hasParam(q, "delete"):
+		s.handleDeleteObjects(w, r, bucket)
+	case r.Method == "POST" && hasParam(q, "uploads"):
+		s.handleCreateMultipartUpload(w, r, bucket, key)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		s.handleUploadPart(w, r)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		s.handleCompleteMultipartUpload(w, r, bucket, key)
+	case r.Method == "PUT":
+		s.handlePut(w, r, bucket, key)
+	case r.Method == "GET":
+		s.handleGet(w, r, bucket, key)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	marker := r.URL.Query().Get("marker")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if marker == "" {
+		s.listed = append(s.listed, prefix)
+	}
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int    `xml:"Size"`
+	}
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	var result struct {
+		XMLName        xml.Name       `xml:"ListBucketResult"`
+		Name           string         `xml:"Name"`
+		Prefix         string         `xml:"Prefix"`
+		IsTruncated    bool           `xml:"IsTruncated"`
+		Contents       []content      `xml:"Contents"`
+		CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+	}
+	result.Name, result.Prefix = bucket, prefix
+
+	seen := make(map[string]bool)
+	for _, k := range s.keys() {
+		if !strings.HasPrefix(k, bucket+"/"+prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, bucket+"/")
+		if name <= marker {
+			continue
+		}
+
+		// Collapse objects below the delimiter into a single prefix.
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				if p := name[:len(prefix)+i+len(delimiter)]; !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+				}
+				continue
+			}
+		}
+
+		obj := s.objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          name,
+			LastModified: obj.updatedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         len(obj.data),
+		})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) handleDeleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	var input struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	var result struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}
+	for _, obj := range input.Objects {
+		delete(s.objects, bucket+"/"+obj.Key)
+		result.Deleted = append(result.Deleted, deleted{obj.Key})
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) handleCreateMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strconv.Itoa(len(s.uploads) + 1)
+	s.uploads[id] = make(map[int][]byte)
+	s.headers[id] = r.Header
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putBytes += len(data)
+
+	parts := s.uploads[r.URL.Query().Get("uploadId")]
+	if parts == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	parts[partNumber] = data
+
+	w.Header().Set("ETag", etag(data))
+}
+
+func (s *Server) handleCompleteMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.URL.Query().Get("uploadId")
+	parts := s.uploads[id]
+	if parts == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	header := s.headers[id]
+	delete(s.uploads, id)
+	delete(s.headers, id)
+
+	// Concatenate parts in order.
+	numbers := make([]int, 0, len(parts))
+	for number := range parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	var data []byte
+	for _, number := range numbers {
+		data = append(data, parts[number]...)
+	}
+	s.objects[bucket+"/"+key] = &object{data: data, header: header, updatedAt: time.Now()}
+	s.multipartN++
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: bucket, Key: key, ETag: etag(data)})
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putBytes += len(data)
+	s.objects[bucket+"/"+key] = &object{data: data, header: r.Header, updatedAt: time.Now()}
+
+	w.Header().Set("ETag", etag(data))
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	obj := s.objects[bucket+"/"+key]
+	s.mu.Unlock()
+
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	} else if md5 := obj.header.Get(sseCustomerKeyMD5Header); r.Header.Get(sseCustomerKeyMD5Header) != md5 {
+		writeError(w, http.StatusBadRequest, "InvalidRequest") // SSE-C key must match upload
+		return
+	} else if tag := etag(obj.data); r.Header.Get("If-None-Match") == tag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag(obj.data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+	_, _ = w.Write(obj.data)
+}
+
+// MustReadManifest decodes the manifest stored for a generation.
+func (s *Server) MustReadManifest(tb testing.TB, r *s3.Replica, generation string) *s3.Manifest {
+	tb.Helper()
+
+	data := s.objectData("bkt/" + r.ManifestPath(generation))
+	if data == nil {
+		tb.Fatal("manifest not found")
+	}
+
+	var m s3.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		tb.Fatal(err)
+	}
+	return &m
+}
+
+// objectData returns the contents of an object. Returns nil if not found.
+func (s *Server) objectData(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj := s.objects[key]; obj != nil {
+		return obj.data
+	}
+	return nil
+}
+
+// putObject writes the contents of an object.
+func (s *Server) putObject(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = &object{data: data, updatedAt: time.Now()}
+}
+
+// deleteObject removes an object.
+func (s *Server) deleteObject(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+}
+
+// keysUnder returns a sorted list of object keys beginning with prefix.
+func (s *Server) keysUnder(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var a []string
+	for _, key := range s.keys() {
+		if strings.HasPrefix(key, prefix) {
+			a = append(a, key)
+		}
+	}
+	return a
+}
+
+// listedUnder returns the number of list requests without a marker for
+// prefixes beginning with prefix.
+func (s *Server) listedUnder(prefix string) (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.listed {
+		if strings.HasPrefix(p, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetFailing sets whether all requests fail with a 503 error.
+func (s *Server) SetFailing(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = v
+}
+
+// FailNext fails the next n requests with a 503 error.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failN = n
+}
+
+// RequestN returns the number of requests received.
+func (s *Server) RequestN() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestN
+}
+
+// objectHeader returns the upload request headers of an object.
+func (s *Server) objectHeader(key string) http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj := s.objects[key]; obj != nil {
+		return obj.header
+	}
+	return nil
+}
+
+// keys returns a sorted list of object keys. Must be called under lock.
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// signer returns the access key ID & session token used to sign r, separated
+// by a colon.
+func signer(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		auth = auth[i+len("Credential="):]
+	}
+	if i := strings.Index(auth, "/"); i >= 0 {
+		auth = auth[:i]
+	}
+	return auth + ":" + r.Header.Get("X-Amz-Security-Token")
+}
+
+const sseCustomerKeyMD5Header = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+
+func hasParam(q map[string][]string, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+	}{Code: code})
+}
+
+// STSServer is a minimal, in-memory implementation of the STS assume role
+// APIs. Each request issues new credentials with a fixed lifetime.
+type STSServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	expiry   time.Duration // lifetime of issued credentials
+	requests []url.Values  // form values of each request
+	signers  []string      // access key ID that signed each request
+}
+
+// MustOpenSTSServer returns a new, running STS emulator on a random local port.
+func MustOpenSTSServer(tb testing.TB, expiry time.Duration) *STSServer {
+	tb.Helper()
+	s := &STSServer{expiry: expiry}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *STSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedInput")
+		return
+	}
+
+	action := r.PostForm.Get("Action")
+	switch action {
+	case "AssumeRole", "AssumeRoleWithWebIdentity":
+	default:
+		writeError(w, http.StatusBadRequest, "InvalidAction")
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.PostForm)
+	s.signers = append(s.signers, strings.TrimSuffix(signer(r), ":"))
+	n := len(s.requests)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<%sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <%sResult>
+    <Credentials>
+      <AccessKeyId>ASIA%d</AccessKeyId>
+      <SecretAccessKey>SECRET%d</SecretAccessKey>
+      <SessionToken>TOKEN%d</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </%sResult>
+</%sResponse>`, action, action, n, n, n, time.Now().Add(s.expiry).UTC().Format(time.RFC3339), action, action)
+}
@@ -0,0 +1,1621 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP replica default settings.
+const (
+	DefaultPort = 22
+
+	DefaultDialTimeout = 30 * time.Second
+
+	DefaultSyncInterval = 1 * time.Second
+
+	DefaultRetention = 24 * time.Hour
+
+	DefaultRetentionCheckInterval = 1 * time.Hour
+)
+
+var _ litestream.Replica = (*Replica)(nil)
+var _ litestream.WALSegmentReader = (*Replica)(nil)
+var _ litestream.ReplicaStatusReporter = (*Replica)(nil)
+var _ litestream.ReplicaMaintainer = (*Replica)(nil)
+var _ litestream.ReplicaSyncer = (*Replica)(nil)
+
+// Replica is a replica that replicates a DB to a remote path over SFTP.
+// It uses the same generation, snapshot & WAL layout as litestream.FileReplica.
+type Replica struct {
+	db   *litestream.DB // source database
+	name string         // replica name, optional
+
+	mu         sync.RWMutex
+	snapshotMu sync.Mutex
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+	pos        litestream.Pos // last position
+	syncErr    error          // error from last sync, if any
+	snapshotAt time.Time      // time of most recent snapshot, if known
+	monitorAt  time.Time      // start of current monitor sync, if any
+
+	wg     sync.WaitGroup
+	cancel func()
+
+	snapshotTotalGauge          prometheus.Gauge
+	walBytesCounter             prometheus.Counter
+	walIndexGauge               prometheus.Gauge
+	walOffsetGauge              prometheus.Gauge
+	putOperationTotalCounter    prometheus.Counter
+	putOperationBytesCounter    prometheus.Counter
+	getOperationTotalCounter    prometheus.Counter
+	getOperationBytesCounter    prometheus.Counter
+	listOperationTotalCounter   prometheus.Counter
+	deleteOperationTotalCounter prometheus.Counter
+	retryCounter                prometheus.Counter
+	circuitOpenGauge            prometheus.Gauge
+	circuitOpenCounter          prometheus.Counter
+
+	// SSH connection information. Host may include a port.
+	Host string
+	User string
+
+	// Authentication settings. Password and/or private key authentication
+	// may be used. The key file must be unencrypted.
+	Password string
+	KeyPath  string
+
+	// Path to an OpenSSH known_hosts file used to verify the server's host
+	// key. Defaults to ~/.ssh/known_hosts.
+	KnownHostsPath string
+
+	// If true, the server's host key is not verified. This allows a
+	// man-in-the-middle to intercept the connection so it must be set
+	// explicitly.
+	InsecureIgnoreHostKey bool
+
+	// Root path on the remote server.
+	Path string
+
+	// Time to wait for the SSH connection to be established.
+	DialTimeout time.Duration
+
+	// Time between syncs with the shadow WAL.
+	SyncInterval time.Duration
+
+	// Time to keep snapshots and related WAL files.
+	// Database is snapshotted after interval and older WAL files are discarded.
+	Retention time.Duration
+
+	// Tiered retention policy. Overrides Retention, if set.
+	RetentionPolicy litestream.RetentionPolicy
+
+	// Time between retention checks.
+	RetentionCheckInterval time.Duration
+
+	// Time between validation checks.
+	ValidationInterval time.Duration
+
+	// Codec used to compress snapshots & WAL files. Defaults to lz4.
+	Codec litestream.Codec
+
+	// If set, snapshots & compressed WAL files are encrypted. WAL data is
+	// written as encrypted segments instead of being appended to a plaintext
+	// WAL file if an encryption key is set.
+	Encryptor *litestream.Encryptor
+
+	// Policy used to retry failed uploads, lists & deletes.
+	RetryPolicy litestream.RetryPolicy
+
+	// Rejects operations after repeated transient failures so the replica
+	// backs off while the server is unavailable. Disabled if nil.
+	CircuitBreaker *litestream.CircuitBreaker
+
+	// If true, replica monitors database for changes automatically.
+	// Set to false if replica is being used synchronously (such as in tests).
+	MonitorEnabled bool
+}
+
+// NewReplica returns a new instance of Replica.
+func NewReplica(db *litestream.DB, name string) *Replica {
+	r := &Replica{
+		db:     db,
+		name:   name,
+		cancel: func() {},
+
+		DialTimeout:            DefaultDialTimeout,
+		SyncInterval:           DefaultSyncInterval,
+		Codec:                  &litestream.LZ4Codec{},
+		Retention:              DefaultRetention,
+		RetentionCheckInterval: DefaultRetentionCheckInterval,
+		RetryPolicy:            litestream.NewRetryPolicy(),
+		CircuitBreaker:         litestream.NewCircuitBreaker(),
+
+		MonitorEnabled: true,
+	}
+
+	var dbPath string
+	if db != nil {
+		dbPath = db.Path()
+	}
+	r.snapshotTotalGauge = internal.ReplicaSnapshotTotalGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walBytesCounter = internal.ReplicaWALBytesCounterVec.WithLabelValues(dbPath, r.Name())
+	r.walIndexGauge = internal.ReplicaWALIndexGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.walOffsetGauge = internal.ReplicaWALOffsetGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.putOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.putOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "PUT")
+	r.getOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.getOperationBytesCounter = operationBytesCounterVec.WithLabelValues(dbPath, r.Name(), "GET")
+	r.listOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "LIST")
+	r.deleteOperationTotalCounter = operationTotalCounterVec.WithLabelValues(dbPath, r.Name(), "DELETE")
+	r.retryCounter = internal.ReplicaRetryTotalCounterVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenGauge = internal.ReplicaCircuitOpenGaugeVec.WithLabelValues(dbPath, r.Name())
+	r.circuitOpenCounter = internal.ReplicaCircuitOpenTotalCounterVec.WithLabelValues(dbPath, r.Name())
+
+	return r
+}
+
+// Name returns the name of the replica. Returns the type if no name set.
+func (r *Replica) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return r.Type()
+}
+
+// Type returns the type of replica.
+func (r *Replica) Type() string {
+	return "sftp"
+}
+
+// DB returns the parent database reference.
+func (r *Replica) DB() *litestream.DB {
+	return r.db
+}
+
+// LastPos returns the last successfully replicated position.
+func (r *Replica) LastPos() litestream.Pos {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pos
+}
+
+// LastSyncError returns the error from the most recent sync, if any.
+func (r *Replica) LastSyncError() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.syncErr
+}
+
+// LastSnapshotAt returns the time of the most recent snapshot created or
+// listed by the replica. Returns a zero time if no snapshot has been seen.
+func (r *Replica) LastSnapshotAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshotAt
+}
+
+// setLastSnapshotAt updates the time of the most recent snapshot if t is later.
+func (r *Replica) setLastSnapshotAt(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.After(r.snapshotAt) {
+		r.snapshotAt = t
+	}
+}
+
+// MonitorBusySince returns the time the monitor began syncing the current
+// change. Returns a zero time if the monitor is waiting for changes.
+func (r *Replica) MonitorBusySince() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.monitorAt
+}
+
+// setMonitorBusySince sets the start time of the current monitor sync.
+func (r *Replica) setMonitorBusySince(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitorAt = t
+}
+
+// GenerationDir returns the path to a generation's root directory.
+func (r *Replica) GenerationDir(generation string) string {
+	return path.Join(r.Path, "generations", generation)
+}
+
+// SnapshotDir returns the path to a generation's snapshot directory.
+func (r *Replica) SnapshotDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "snapshots")
+}
+
+// SnapshotPath returns the path to a snapshot file.
+func (r *Replica) SnapshotPath(generation string, index int) string {
+	return path.Join(r.SnapshotDir(generation), fmt.Sprintf("%08x%s%s", index, litestream.SnapshotExt, r.Codec.Ext()))
+}
+
+// WALDir returns the path to a generation's WAL directory
+func (r *Replica) WALDir(generation string) string {
+	return path.Join(r.GenerationDir(generation), "wal")
+}
+
+// WALPath returns the path to an uncompressed WAL file.
+func (r *Replica) WALPath(generation string, index int) string {
+	return path.Join(r.WALDir(generation), litestream.FormatWALPath(index))
+}
+
+// DefaultKnownHostsPath returns the path to the current user's known hosts file.
+func DefaultKnownHostsPath() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot determine known hosts path: %w", err)
+	}
+	return filepath.Join(homedir, ".ssh", "known_hosts"), nil
+}
+
+// Init initializes the connection to the SFTP server. No-op if already connected.
+func (r *Replica) Init(ctx context.Context) (err error) {
+	_, err = r.client(ctx)
+	return err
+}
+
+// client returns the SFTP client, connecting if necessary.
+//
+// The connection is established without holding the replica lock so that an
+// unreachable server does not block status methods such as LastPos().
+func (r *Replica) client(ctx context.Context) (*sftp.Client, error) {
+	r.mu.RLock()
+	client := r.sftpClient
+	r.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+
+	sshClient, sftpClient, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Discard our connection if another goroutine connected first.
+	if r.sftpClient != nil {
+		_ = sftpClient.Close()
+		_ = sshClient.Close()
+		return r.sftpClient, nil
+	}
+	r.sshClient, r.sftpClient = sshClient, sftpClient
+	return sftpClient, nil
+}
+
+// dial opens a new SSH connection & starts an SFTP session over it.
+func (r *Replica) dial(ctx context.Context) (_ *ssh.Client, _ *sftp.Client, err error) {
+	if r.Host == "" {
+		return nil, nil, fmt.Errorf("sftp host required")
+	}
+
+	config := &ssh.ClientConfig{
+		User:    r.User,
+		Timeout: r.DialTimeout,
+	}
+
+	// Verify host key against the known hosts file unless explicitly disabled.
+	if r.InsecureIgnoreHostKey {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHostsPath := r.KnownHostsPath
+		if knownHostsPath == "" {
+			if knownHostsPath, err = DefaultKnownHostsPath(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if config.HostKeyCallback, err = knownhosts.New(knownHostsPath); err != nil {
+			return nil, nil, fmt.Errorf("cannot read known hosts file: %w", err)
+		}
+	}
+
+	// Attach private key authentication, if specified.
+	if r.KeyPath != "" {
+		buf, err := ioutil.ReadFile(r.KeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read sftp key path: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse sftp key path: %w", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+
+	// Attach password authentication, if specified.
+	if r.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(r.Password))
+	}
+
+	// Append default port if none is specified.
+	addr := r.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+
+	// Dial with context so connection can be canceled.
+	var dialer net.Dialer
+	dialer.Timeout = r.DialTimeout
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot connect to sftp server: %w", err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("cannot establish ssh connection: %w", err)
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, nil, fmt.Errorf("cannot start sftp session: %w", err)
+	}
+
+	return sshClient, sftpClient, nil
+}
+
+// resetOnConnError closes the connection if err is a connection error so
+// that the next operation will reconnect to the server.
+func (r *Replica) resetOnConnError(err error) {
+	if err == nil {
+		return
+	} else if _, ok := err.(*sftp.StatusError); ok {
+		return // server-side error, connection is still valid
+	} else if os.IsNotExist(err) || os.IsExist(err) || os.IsPermission(err) || err == io.EOF {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+}
+
+// Close closes the connection to the SFTP server, if open.
+func (r *Replica) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+func (r *Replica) close() (err error) {
+	if r.sftpClient != nil {
+		if e := r.sftpClient.Close(); e != nil && err == nil {
+			err = e
+		}
+		r.sftpClient = nil
+	}
+	if r.sshClient != nil {
+		if e := r.sshClient.Close(); e != nil && err == nil {
+			err = e
+		}
+		r.sshClient = nil
+	}
+	return err
+}
+
+// retry calls fn with a connected client using the replica's retry policy.
+// The connection is reset after a connection error so the next attempt
+// reconnects. Returns litestream.ErrCircuitOpen without calling fn if the
+// circuit breaker is open.
+func (r *Replica) retry(ctx context.Context, fn func(client *sftp.Client) error) error {
+	if err := r.CircuitBreaker.Allow(); err != nil {
+		r.circuitOpenCounter.Inc()
+		return err
+	}
+
+	var attempt int
+	err := r.RetryPolicy.Do(ctx, isRetryable, func() error {
+		if attempt++; attempt > 1 {
+			r.retryCounter.Inc()
+		}
+
+		client, err := r.client(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(client)
+		r.resetOnConnError(err)
+		return err
+	})
+
+	// Only transient errors indicate that the server is unavailable. A
+	// canceled operation says nothing about the server so its outcome is
+	// not recorded.
+	if err != nil && ctx.Err() == context.Canceled {
+		r.CircuitBreaker.Release()
+	} else {
+		r.CircuitBreaker.Record(err != nil && (isRetryable(err) || ctx.Err() != nil))
+	}
+	if r.CircuitBreaker.IsOpen() {
+		r.circuitOpenGauge.Set(1)
+	} else {
+		r.circuitOpenGauge.Set(0)
+	}
+	return err
+}
+
+// isRetryable returns true if err is a network error or the connection to the
+// server was lost. Errors returned by the server are not retried.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isTransient returns true if err is a transient error or the operation was
+// rejected by an open circuit breaker.
+func isTransient(err error) bool {
+	return errors.Is(err, litestream.ErrCircuitOpen) || isRetryable(err)
+}
+
+// readDir returns the entries of a remote directory.
+func (r *Replica) readDir(ctx context.Context, dir string) (fis []os.FileInfo, err error) {
+	if err := r.retry(ctx, func(client *sftp.Client) (err error) {
+		fis, err = client.ReadDir(dir)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	r.listOperationTotalCounter.Inc()
+	return fis, nil
+}
+
+// MaxSnapshotIndex returns the highest index for the snapshots.
+func (r *Replica) MaxSnapshotIndex(ctx context.Context, generation string) (int, error) {
+	fis, err := r.readDir(ctx, r.SnapshotDir(generation))
+	if err != nil {
+		return 0, err
+	}
+
+	index := -1
+	for _, fi := range fis {
+		if idx, _, err := litestream.ParseSnapshotPath(fi.Name()); err != nil {
+			continue
+		} else if index == -1 || idx > index {
+			index = idx
+		}
+	}
+	if index == -1 {
+		return 0, fmt.Errorf("no snapshots found")
+	}
+	return index, nil
+}
+
+// Generations returns a list of available generation names.
+func (r *Replica) Generations(ctx context.Context) ([]string, error) {
+	fis, err := r.readDir(ctx, path.Join(r.Path, "generations"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	for _, fi := range fis {
+		if !litestream.IsGenerationName(fi.Name()) {
+			continue
+		} else if !fi.IsDir() {
+			continue
+		}
+		generations = append(generations, fi.Name())
+	}
+	return generations, nil
+}
+
+// GenerationStats returns stats for a generation.
+func (r *Replica) GenerationStats(ctx context.Context, generation string) (stats litestream.GenerationStats, err error) {
+	// Determine stats for all snapshots.
+	n, min, max, err := r.fileStats(ctx, r.SnapshotDir(generation), litestream.IsSnapshotPath)
+	if err != nil {
+		return stats, err
+	}
+	stats.SnapshotN = n
+	stats.CreatedAt, stats.UpdatedAt = min, max
+
+	// Update stats if we have WAL files.
+	n, min, max, err = r.fileStats(ctx, r.WALDir(generation), litestream.IsWALPath)
+	if err != nil {
+		return stats, err
+	} else if n == 0 {
+		return stats, nil
+	}
+
+	stats.WALN = n
+	if stats.CreatedAt.IsZero() || min.Before(stats.CreatedAt) {
+		stats.CreatedAt = min
+	}
+	if stats.UpdatedAt.IsZero() || max.After(stats.UpdatedAt) {
+		stats.UpdatedAt = max
+	}
+	return stats, nil
+}
+
+// fileStats returns the count & time range of files in dir that match fn.
+func (r *Replica) fileStats(ctx context.Context, dir string, fn func(string) bool) (n int, min, max time.Time, err error) {
+	fis, err := r.readDir(ctx, dir)
+	if os.IsNotExist(err) {
+		return n, min, max, nil
+	} else if err != nil {
+		return n, min, max, err
+	}
+
+	for _, fi := range fis {
+		if !fn(fi.Name()) {
+			continue
+		}
+		modTime := fi.ModTime().UTC()
+
+		n++
+		if min.IsZero() || modTime.Before(min) {
+			min = modTime
+		}
+		if max.IsZero() || modTime.After(max) {
+			max = modTime
+		}
+	}
+	return n, min, max, nil
+}
+
+// Snapshots returns a list of available snapshots in the replica.
+func (r *Replica) Snapshots(ctx context.Context) ([]*litestream.SnapshotInfo, error) {
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.SnapshotInfo
+	for _, generation := range generations {
+		fis, err := r.readDir(ctx, r.SnapshotDir(generation))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, fi := range fis {
+			index, _, err := litestream.ParseSnapshotPath(fi.Name())
+			if err != nil {
+				continue
+			}
+
+			infos = append(infos, &litestream.SnapshotInfo{
+				Name:       fi.Name(),
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Size:       fi.Size(),
+				CreatedAt:  fi.ModTime().UTC(),
+			})
+		}
+	}
+
+	return infos, nil
+}
+
+// WALs returns a list of available WAL files in the replica.
+func (r *Replica) WALs(ctx context.Context) ([]*litestream.WALInfo, error) {
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []*litestream.WALInfo
+	for _, generation := range generations {
+		fis, err := r.readDir(ctx, r.WALDir(generation))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, fi := range fis {
+			index, offset, _, err := litestream.ParseWALPath(fi.Name())
+			if err != nil {
+				continue
+			}
+
+			infos = append(infos, &litestream.WALInfo{
+				Name:       fi.Name(),
+				Replica:    r.Name(),
+				Generation: generation,
+				Index:      index,
+				Offset:     offset,
+				Size:       fi.Size(),
+				CreatedAt:  fi.ModTime().UTC(),
+			})
+		}
+	}
+
+	return infos, nil
+}
+
+// Start starts replication for a given generation.
+func (r *Replica) Start(ctx context.Context) {
+	// Ignore if replica is being used sychronously.
+	if !r.MonitorEnabled {
+		return
+	}
+
+	// Stop previous replication.
+	r.Stop()
+
+	// Wrap context with cancelation.
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	// Start goroutines to manage replica data.
+	r.wg.Add(3)
+	go func() { defer r.wg.Done(); r.monitor(ctx) }()
+	go func() { defer r.wg.Done(); r.retainer(ctx) }()
+	go func() { defer r.wg.Done(); r.validator(ctx) }()
+}
+
+// Stop cancels any outstanding replication and blocks until finished.
+func (r *Replica) Stop() {
+	r.cancel()
+	r.wg.Wait()
+
+	if err := r.Close(); err != nil {
+		log.Printf("%s(%s): cannot close sftp connection: %s", r.db.Path(), r.Name(), err)
+	}
+}
+
+// monitor runs in a separate goroutine and continuously replicates the DB.
+func (r *Replica) monitor(ctx context.Context) {
+	ticker := time.NewTicker(r.SyncInterval)
+	defer ticker.Stop()
+
+	// Clear old temporary files that my have been left from a crash.
+	if err := r.retry(ctx, r.removeTmpFiles); err != nil {
+		log.Printf("%s(%s): monitor: cannot remove tmp files: %s", r.db.Path(), r.Name(), err)
+	}
+
+	// Continuously check for new data to replicate.
+	ch := make(chan struct{})
+	close(ch)
+	var notify <-chan struct{} = ch
+
+	for initial := true; ; initial = false {
+		// Enforce a minimum time between synchronization.
+		if !initial {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		// Wait for changes to the database.
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		}
+
+		// Fetch new notify channel before replicating data.
+		notify = r.db.Notify()
+
+		// Synchronize the shadow wal into the replication directory. The start
+		// time is tracked so a stalled sync can be detected by health checks.
+		r.setMonitorBusySince(time.Now())
+		err := r.Sync(ctx)
+		r.setMonitorBusySince(time.Time{})
+		if err != nil {
+			log.Printf("%s(%s): monitor error: %s", r.db.Path(), r.Name(), err)
+			continue
+		}
+	}
+}
+
+// retainer runs in a separate goroutine and handles retention.
+func (r *Replica) retainer(ctx context.Context) {
+	ticker := time.NewTicker(r.RetentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.EnforceRetention(ctx); err != nil {
+				log.Printf("%s(%s): retain error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// validator runs in a separate goroutine and handles periodic validation.
+func (r *Replica) validator(ctx context.Context) {
+	// Initialize counters since validation occurs infrequently.
+	for _, status := range []string{"ok", "error"} {
+		internal.ReplicaValidationTotalCounterVec.WithLabelValues(r.db.Path(), r.Name(), status).Add(0)
+	}
+
+	if r.ValidationInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.ValidationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := litestream.ValidateReplica(ctx, r); err != nil {
+				log.Printf("%s(%s): validation error: %s", r.db.Path(), r.Name(), err)
+				continue
+			}
+		}
+	}
+}
+
+// removeTmpFiles removes .tmp files left in the replica's generations from a crash.
+func (r *Replica) removeTmpFiles(client *sftp.Client) error {
+	walker := client.Walk(path.Join(r.Path, "generations"))
+	for walker.Step() {
+		if err := walker.Err(); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if walker.Stat().IsDir() || path.Ext(walker.Path()) != ".tmp" {
+			continue
+		}
+
+		if err := client.Remove(walker.Path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+	}
+	return nil
+}
+
+// CalcPos returns the position for the replica for the current generation.
+// Returns a zero value if there is no active generation.
+func (r *Replica) CalcPos(ctx context.Context, generation string) (pos litestream.Pos, err error) {
+	pos.Generation = generation
+
+	// Find maximum snapshot index.
+	if pos.Index, err = r.MaxSnapshotIndex(ctx, generation); err != nil {
+		return litestream.Pos{}, err
+	}
+
+	// Find the max WAL file within WAL.
+	fis, err := r.readDir(ctx, r.WALDir(generation))
+	if os.IsNotExist(err) {
+		return pos, nil // no replicated wal, start at snapshot index.
+	} else if err != nil {
+		return litestream.Pos{}, err
+	}
+
+	index, segmentOffset := -1, int64(-1)
+	for _, fi := range fis {
+		idx, off, ext, err := litestream.ParseWALPath(fi.Name())
+		if err != nil {
+			continue // invalid wal filename
+		} else if index == -1 || idx > index {
+			index, segmentOffset = idx, -1
+		}
+
+		// Track the offset of the latest segment for the current index.
+		if idx == index && fi.Name() == litestream.FormatWALPathWithOffset(idx, off)+strings.TrimPrefix(ext, litestream.WALExt) && off > segmentOffset {
+			segmentOffset = off
+		}
+	}
+	if index == -1 {
+		return pos, nil // wal directory exists but no wal files, return snapshot position
+	}
+	pos.Index = index
+
+	// Determine current offset from the uncompressed WAL file, if available.
+	var fi os.FileInfo
+	if err := r.retry(ctx, func(client *sftp.Client) (err error) {
+		fi, err = client.Stat(r.WALPath(pos.Generation, pos.Index))
+		return err
+	}); err == nil {
+		pos.Offset = fi.Size()
+		return pos, nil
+	} else if !os.IsNotExist(err) {
+		return litestream.Pos{}, err
+	}
+
+	// Otherwise restart from the beginning of the last segment so it is
+	// rewritten by the next sync. If there are no segments then the WAL
+	// file has been compressed so read it to determine its size.
+	if segmentOffset != -1 {
+		pos.Offset = segmentOffset
+		return pos, nil
+	}
+
+	rd, err := r.WALReader(ctx, pos.Generation, pos.Index)
+	if err != nil {
+		return litestream.Pos{}, err
+	}
+	defer rd.Close()
+
+	if pos.Offset, err = io.Copy(ioutil.Discard, rd); err != nil {
+		r.resetOnConnError(err)
+		return litestream.Pos{}, err
+	}
+	return pos, nil
+}
+
+// snapshot copies the entire database to the replica path.
+func (r *Replica) snapshot(ctx context.Context, generation string, index int) error {
+	// Acquire a read lock on the database during snapshot to prevent checkpoints.
+	tx, err := r.db.SQLDB().Begin()
+	if err != nil {
+		return err
+	} else if _, err := tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	startTime := time.Now()
+
+	f, err := os.Open(r.db.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshotPath := r.SnapshotPath(generation, index)
+	var n int64
+	var exists bool
+	if err := r.retry(ctx, func(client *sftp.Client) (err error) {
+		// Ignore if we already have a snapshot for the given WAL index.
+		if _, err := client.Stat(snapshotPath); err == nil {
+			exists = true
+			return nil
+		}
+
+		// Rewind in case a previous attempt read part of the database.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		} else if err := client.MkdirAll(path.Dir(snapshotPath)); err != nil {
+			return err
+		}
+		n, err = r.compressTo(client, f, snapshotPath)
+		return err
+	}); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n))
+
+	r.setLastSnapshotAt(time.Now())
+	log.Printf("%s(%s): snapshot: creating %s/%08x t=%s", r.db.Path(), r.Name(), generation, index, time.Since(startTime))
+	return nil
+}
+
+// compressTo writes a compressed & optionally encrypted copy of rd to a
+// temporary remote file and then atomically moves it to dst. Returns the
+// number of bytes written.
+func (r *Replica) compressTo(client *sftp.Client, rd io.Reader, dst string) (int64, error) {
+	w, err := client.OpenFile(dst+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+
+	ew, err := litestream.NewEncryptWriter(w, r.Encryptor)
+	if err != nil {
+		return 0, err
+	}
+
+	zw, err := r.Codec.NewWriter(ew)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(zw, rd); err != nil {
+		return 0, err
+	} else if err := zw.Close(); err != nil {
+		return 0, err
+	} else if err := ew.Close(); err != nil {
+		return 0, err
+	}
+
+	fi, err := w.Stat()
+	if err != nil {
+		return 0, err
+	} else if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := client.PosixRename(dst+".tmp", dst); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// snapshotN returns the number of snapshots for a generation.
+func (r *Replica) snapshotN(ctx context.Context, generation string) (int, error) {
+	fis, err := r.readDir(ctx, r.SnapshotDir(generation))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, fi := range fis {
+		if _, _, err := litestream.ParseSnapshotPath(fi.Name()); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Sync replays data from the shadow WAL and copies it to the SFTP server.
+func (r *Replica) Sync(ctx context.Context) (err error) {
+	// Track the sync error & clear last position if an error occurs. The
+	// position is kept after a transient error as the server is unchanged.
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.syncErr = err
+		if err != nil && !isTransient(err) {
+			r.pos = litestream.Pos{}
+		}
+	}()
+
+	// Find current position of database.
+	dpos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if dpos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	generation := dpos.Generation
+
+	// Calculate position if we don't have a previous position or if the generation changes.
+	// Ensure sync & retainer do not snapshot at the same time.
+	if lastPos := r.LastPos(); lastPos.IsZero() || lastPos.Generation != generation {
+		if err := func() error {
+			r.snapshotMu.Lock()
+			defer r.snapshotMu.Unlock()
+
+			// Create snapshot if no snapshots exist for generation.
+			if n, err := r.snapshotN(ctx, generation); err != nil {
+				return err
+			} else if n == 0 {
+				if err := r.snapshot(ctx, generation, dpos.Index); err != nil {
+					return err
+				}
+				r.snapshotTotalGauge.Set(1.0)
+			} else {
+				r.snapshotTotalGauge.Set(float64(n))
+			}
+
+			// Determine position, if necessary.
+			pos, err := r.CalcPos(ctx, generation)
+			if err != nil {
+				return fmt.Errorf("cannot determine replica position: %w", err)
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.pos = pos
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	// Read all WAL files since the last position.
+	for {
+		if r.Encryptor.HasEncryptionKey() {
+			err = r.retry(ctx, r.syncWALSegment)
+		} else {
+			err = r.retry(ctx, r.syncWAL)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Compress any old WAL files.
+	if err := r.retry(ctx, func(client *sftp.Client) error {
+		return r.compress(ctx, client, generation)
+	}); err != nil {
+		return fmt.Errorf("cannot compress: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Replica) syncWAL(client *sftp.Client) (err error) {
+	rd, err := r.db.ShadowWALReader(r.LastPos())
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+	defer rd.Close()
+
+	// Ensure parent directory exists for WAL file.
+	filename := r.WALPath(rd.Pos().Generation, rd.Pos().Index)
+	if err := client.MkdirAll(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	w, err := client.OpenFile(filename, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Seek & copy WAL contents.
+	if _, err := w.Seek(rd.Pos().Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Copy header if at offset zero.
+	var psalt uint64 // previous salt value
+	var n int64
+	if pos := rd.Pos(); pos.Offset == 0 {
+		buf := make([]byte, litestream.WALHeaderSize)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return err
+		}
+
+		psalt = binary.BigEndian.Uint64(buf[16:24])
+
+		nn, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		n += int64(nn)
+	}
+
+	// Copy frames.
+	pageSize := r.db.PageSize()
+	for {
+		buf := make([]byte, litestream.WALFrameHeaderSize+pageSize)
+		if _, err := io.ReadFull(rd, buf); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Verify salt matches the previous frame/header read.
+		salt := binary.BigEndian.Uint64(buf[8:16])
+		if psalt != 0 && psalt != salt {
+			return fmt.Errorf("replica salt mismatch: %s", path.Base(filename))
+		}
+		psalt = salt
+
+		nn, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		n += int64(nn)
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n))
+
+	// Save last replicated position.
+	r.mu.Lock()
+	r.pos = rd.Pos()
+	r.mu.Unlock()
+
+	// Track raw bytes processed & current position.
+	r.walBytesCounter.Add(float64(n))
+	r.walIndexGauge.Set(float64(rd.Pos().Index))
+	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
+
+	return nil
+}
+
+// syncWALSegment writes WAL data since the last position to a new compressed
+// & encrypted segment file. Used instead of syncWAL() when encrypting as
+// encrypted data cannot be appended to.
+func (r *Replica) syncWALSegment(client *sftp.Client) (err error) {
+	rd, err := r.db.ShadowWALReader(r.LastPos())
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("wal reader: %w", err)
+	}
+	defer rd.Close()
+
+	// Segment filename includes the starting offset of the WAL data.
+	pos := rd.Pos()
+	filename := path.Join(r.WALDir(pos.Generation), litestream.FormatWALPathWithOffset(pos.Index, pos.Offset)+r.Codec.Ext())
+	if err := client.MkdirAll(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	n, err := r.compressTo(client, rd, filename)
+	if err != nil {
+		return err
+	}
+	r.putOperationTotalCounter.Inc()
+	r.putOperationBytesCounter.Add(float64(n))
+
+	// Save last replicated position.
+	r.mu.Lock()
+	r.pos = rd.Pos()
+	r.mu.Unlock()
+
+	// Track raw bytes processed & current position.
+	r.walBytesCounter.Add(float64(rd.Pos().Offset - pos.Offset))
+	r.walIndexGauge.Set(float64(rd.Pos().Index))
+	r.walOffsetGauge.Set(float64(rd.Pos().Offset))
+
+	return nil
+}
+
+// compress compresses all WAL files before the current one. If encrypting,
+// the current WAL file is also compressed as WAL data is written to segments.
+func (r *Replica) compress(ctx context.Context, client *sftp.Client, generation string) error {
+	fis, err := client.ReadDir(r.WALDir(generation))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.listOperationTotalCounter.Inc()
+
+	var filenames []string
+	for _, fi := range fis {
+		if path.Ext(fi.Name()) == litestream.WALExt {
+			filenames = append(filenames, path.Join(r.WALDir(generation), fi.Name()))
+		}
+	}
+
+	// Ensure filenames are sorted & remove the last (active) WAL.
+	sort.Strings(filenames)
+	if !r.Encryptor.HasEncryptionKey() {
+		if len(filenames) <= 1 {
+			return nil // no uncompressed wal files or only one active file
+		}
+		filenames = filenames[:len(filenames)-1]
+	}
+
+	// Compress each file from oldest to newest.
+	for _, filename := range filenames {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := func() error {
+			f, err := client.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := r.compressTo(client, f, filename+r.Codec.Ext()); err != nil {
+				return err
+			}
+			return f.Close()
+		}(); err != nil {
+			return err
+		}
+
+		if err := client.Remove(filename); err != nil {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+	}
+
+	return nil
+}
+
+// SnapshotReader returns a reader for snapshot data at the given generation/index.
+// Returns os.ErrNotExist if no matching index is found.
+func (r *Replica) SnapshotReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	client, err := r.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := r.SnapshotDir(generation)
+	fis, err := client.ReadDir(dir)
+	if err != nil {
+		r.resetOnConnError(err)
+		return nil, err
+	}
+	r.listOperationTotalCounter.Inc()
+
+	for _, fi := range fis {
+		// Parse index from snapshot filename. Skip if no match.
+		idx, ext, err := litestream.ParseSnapshotPath(fi.Name())
+		if err != nil || index != idx {
+			continue
+		}
+
+		f, err := client.Open(path.Join(dir, fi.Name()))
+		if err != nil {
+			r.resetOnConnError(err)
+			return nil, err
+		}
+		r.getOperationTotalCounter.Inc()
+		r.getOperationBytesCounter.Add(float64(fi.Size()))
+
+		if ext == litestream.SnapshotExt {
+			return f, nil // not compressed, return as-is.
+		}
+
+		// If compressed, decrypt if necessary & wrap in a decompressing reader.
+		// Return with wrapper to ensure that the underlying file is closed.
+		dr, err := litestream.NewDecryptReader(f, r.Encryptor)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+
+		zr, err := litestream.NewCodecReader(dr, fi.Name())
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return internal.NewReadCloser(zr, f), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// WALReader returns a reader for WAL data at the given index.
+// Returns os.ErrNotExist if no matching index is found.
+func (r *Replica) WALReader(ctx context.Context, generation string, index int) (io.ReadCloser, error) {
+	return r.WALReaderFrom(ctx, generation, index, 0)
+}
+
+// WALReaderFrom returns a reader for WAL data in index starting at offset.
+// Segments which end before offset are not read.
+func (r *Replica) WALReaderFrom(ctx context.Context, generation string, index int, offset int64) (io.ReadCloser, error) {
+	client, err := r.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := r.WALDir(generation)
+	fis, err := client.ReadDir(dir)
+	if err != nil {
+		r.resetOnConnError(err)
+		return nil, err
+	}
+	r.listOperationTotalCounter.Inc()
+
+	// Find the WAL file and/or segments for the index, sorted by offset.
+	var filenames []string
+	for _, fi := range fis {
+		if idx, _, _, err := litestream.ParseWALPath(fi.Name()); err != nil || idx != index {
+			continue
+		}
+		filenames = append(filenames, path.Join(dir, fi.Name()))
+	}
+	if len(filenames) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	sort.Slice(filenames, func(i, j int) bool {
+		_, oi, _, _ := litestream.ParseWALPath(filenames[i])
+		_, oj, _, _ := litestream.ParseWALPath(filenames[j])
+		return oi < oj
+	})
+
+	// Skip segments which end before offset.
+	var start int64
+	for i := len(filenames) - 1; i >= 0; i-- {
+		if _, off, _, _ := litestream.ParseWALPath(filenames[i]); off <= offset {
+			filenames, start = filenames[i:], off
+			break
+		}
+	}
+
+	// Stream the file directly if the WAL is stored in a single file.
+	if len(filenames) == 1 {
+		f, err := r.openWALFile(client, filenames[0])
+		if err != nil {
+			return nil, err
+		}
+		return internal.Discard(f, offset-start)
+	}
+
+	// Otherwise concatenate segments into a buffer & ensure they are contiguous.
+	var buf bytes.Buffer
+	for _, filename := range filenames {
+		if _, off, _, _ := litestream.ParseWALPath(filename); off != start+int64(buf.Len()) {
+			return nil, fmt.Errorf("out of sequence wal segments: %s/%08x at offset %d, expected offset %d", generation, index, off, start+int64(buf.Len()))
+		}
+
+		if err := func() error {
+			f, err := r.openWALFile(client, filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(&buf, f)
+			return err
+		}(); err != nil {
+			r.resetOnConnError(err)
+			return nil, err
+		}
+	}
+	return internal.Discard(ioutil.NopCloser(&buf), offset-start)
+}
+
+// openWALFile opens a WAL file or segment. Compressed files are decrypted,
+// if necessary, and decompressed.
+func (r *Replica) openWALFile(client *sftp.Client, filename string) (io.ReadCloser, error) {
+	f, err := client.Open(filename)
+	if err != nil {
+		r.resetOnConnError(err)
+		return nil, err
+	}
+	r.getOperationTotalCounter.Inc()
+
+	if path.Ext(filename) == litestream.WALExt {
+		return f, nil // not compressed, return as-is.
+	}
+
+	// If compressed, wrap in a decompressing reader and return with wrapper
+	// to ensure that the underlying file is closed.
+	dr, err := litestream.NewDecryptReader(f, r.Encryptor)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	zr, err := litestream.NewCodecReader(dr, filename)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return internal.NewReadCloser(zr, f), nil
+}
+
+// Snapshot creates a snapshot of the database at its current position.
+// No snapshot is created if one already exists for the current WAL index.
+func (r *Replica) Snapshot(ctx context.Context) error {
+	// Ensure sync & retainer do not snapshot at the same time.
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	pos, err := r.db.Pos()
+	if err != nil {
+		return fmt.Errorf("cannot determine current generation: %w", err)
+	} else if pos.IsZero() {
+		return fmt.Errorf("no generation, waiting for data")
+	}
+	return r.snapshot(ctx, pos.Generation, pos.Index)
+}
+
+// EnforceRetention forces a new snapshot once the retention interval has passed.
+// Older snapshots and WAL files are then removed.
+func (r *Replica) EnforceRetention(ctx context.Context) (err error) {
+	// Ensure sync & retainer do not snapshot at the same time.
+	var all, snapshots, walSnapshots []*litestream.SnapshotInfo
+	if err := func() error {
+		r.snapshotMu.Lock()
+		defer r.snapshotMu.Unlock()
+
+		// Find current position of database.
+		pos, err := r.db.Pos()
+		if err != nil {
+			return fmt.Errorf("cannot determine current generation: %w", err)
+		} else if pos.IsZero() {
+			return fmt.Errorf("no generation, waiting for data")
+		}
+
+		// Obtain list of snapshots that are within the retention period.
+		if all, err = r.Snapshots(ctx); err != nil {
+			return fmt.Errorf("cannot obtain snapshot list: %w", err)
+		}
+		r.setLastSnapshotAt(litestream.LatestSnapshotTime(all))
+		now := time.Now()
+		snapshots, walSnapshots = litestream.RetainSnapshots(all, r.Retention, r.RetentionPolicy, now)
+
+		// If no retained snapshots with WAL exist or the retention policy has
+		// no snapshot for its finest interval, create a new snapshot.
+		if litestream.FindMinSnapshotByGeneration(walSnapshots, pos.Generation) == nil ||
+			(r.RetentionPolicy.SnapshotDue(all, pos.Generation, now) && !litestream.ContainsSnapshot(all, pos.Generation, pos.Index)) {
+			if err := r.snapshot(ctx, pos.Generation, pos.Index); err != nil {
+				return fmt.Errorf("cannot snapshot: %w", err)
+			}
+			info := &litestream.SnapshotInfo{Generation: pos.Generation, Index: pos.Index}
+			snapshots, walSnapshots = append(snapshots, info), append(walSnapshots, info)
+		}
+
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// Loop over generations and delete unretained snapshots & WAL files.
+	generations, err := r.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot obtain generations: %w", err)
+	}
+	for _, generation := range generations {
+		// Find earliest retained snapshot for this generation.
+		snapshot := litestream.FindMinSnapshotByGeneration(snapshots, generation)
+
+		// Delete generations if it has no snapshots being retained.
+		if snapshot == nil {
+			log.Printf("%s(%s): retainer: deleting generation %q has no retained snapshots, deleting", r.db.Path(), r.Name(), generation)
+			if err := r.retry(ctx, func(client *sftp.Client) error {
+				return r.removeAll(client, r.GenerationDir(generation))
+			}); err != nil {
+				return fmt.Errorf("cannot delete generation %q dir: %w", generation, err)
+			}
+			continue
+		}
+
+		// Otherwise delete unretained snapshots & all WAL files before the
+		// lowest index that retains WAL. Generations retained only by coarser
+		// policy tiers keep no WAL files.
+		walIndex := math.MaxInt32
+		if snapshot := litestream.FindMinSnapshotByGeneration(walSnapshots, generation); snapshot != nil {
+			walIndex = snapshot.Index
+		}
+		if err := r.retry(ctx, func(client *sftp.Client) error {
+			return r.deleteGenerationSnapshots(client, generation, all, snapshots)
+		}); err != nil {
+			return fmt.Errorf("cannot delete generation %q snapshots: %w", generation, err)
+		} else if err := r.retry(ctx, func(client *sftp.Client) error {
+			return r.deleteGenerationWALBefore(client, generation, walIndex)
+		}); err != nil {
+			return fmt.Errorf("cannot delete generation %q wal before index %d: %w", generation, walIndex, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteGenerationSnapshots deletes listed snapshots in a generation that are
+// not retained. Snapshots created since listing are left as-is.
+func (r *Replica) deleteGenerationSnapshots(client *sftp.Client, generation string, snapshots, retained []*litestream.SnapshotInfo) (err error) {
+	var n int
+	for _, snapshot := range snapshots {
+		if snapshot.Generation != generation || litestream.ContainsSnapshot(retained, generation, snapshot.Index) {
+			continue
+		}
+
+		if err := client.Remove(path.Join(r.SnapshotDir(generation), snapshot.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+		n++
+	}
+	if n > 0 {
+		log.Printf("%s(%s): retainer: deleting unretained snapshots in %s; n=%d", r.db.Path(), r.Name(), generation, n)
+	}
+
+	return nil
+}
+
+// deleteGenerationWALBefore deletes WAL files before a given index.
+func (r *Replica) deleteGenerationWALBefore(client *sftp.Client, generation string, index int) (err error) {
+	dir := r.WALDir(generation)
+	fis, err := client.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.listOperationTotalCounter.Inc()
+
+	var n int
+	for _, fi := range fis {
+		idx, _, _, err := litestream.ParseWALPath(fi.Name())
+		if err != nil {
+			continue
+		} else if idx >= index {
+			continue
+		}
+
+		if err := client.Remove(path.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+		n++
+	}
+	if n > 0 {
+		log.Printf("%s(%s): retainer: deleting wal files before %s/%08x n=%d", r.db.Path(), r.Name(), generation, index, n)
+	}
+
+	return nil
+}
+
+// removeAll recursively removes a remote directory and all of its contents.
+func (r *Replica) removeAll(client *sftp.Client, dir string) error {
+	// Collect files & directories. Directories are collected in walk order
+	// so they must be removed in reverse to ensure they are empty.
+	var dirs []string
+	walker := client.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if walker.Stat().IsDir() {
+			dirs = append(dirs, walker.Path())
+			continue
+		}
+
+		if err := client.Remove(walker.Path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.deleteOperationTotalCounter.Inc()
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := client.RemoveDirectory(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTP metrics.
+var (
+	operationTotalCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "sftp",
+		Name:      "operation_total",
+		Help:      "The number of SFTP operations performed",
+	}, []string{"db", "name", "type"})
+
+	operationBytesCounterVec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "litestream",
+		Subsystem: "sftp",
+		Name:      "operation_bytes",
+		Help:      "The number of bytes used by SFTP operations",
+	}, []string{"db", "name", "type"})
+)
@@ -0,0 +1,615 @@
+package sftp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/litestream"
+	"github.com/benbjohnson/litestream/internal/testingutil"
+	"github.com/benbjohnson/litestream/sftp"
+	_ "github.com/mattn/go-sqlite3"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestReplica_Sync(t *testing.T) {
+	// Ensure replica can sync to a server and be restored from it.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		}
+
+		// Write to the database multiple times and sync periodically so that
+		// checkpoints occur and older WAL files are compressed.
+		n := db.MinCheckpointPageN * 2
+		for i := 0; i < n; i++ {
+			if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+				t.Fatal(err)
+			}
+
+			if i%100 == 0 || i == n-1 {
+				if err := db.Sync(); err != nil {
+					t.Fatal(err)
+				} else if err := r.Sync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Ensure positions match.
+		pos, err := db.Pos()
+		if err != nil {
+			t.Fatal(err)
+		} else if pos.Index == 0 {
+			t.Fatal("expected multiple wal indexes")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		} else if calcPos, err := r.CalcPos(context.Background(), pos.Generation); err != nil {
+			t.Fatal(err)
+		} else if got, want := calcPos, pos; got != want {
+			t.Fatalf("CalcPos()=%v, want %v", got, want)
+		}
+
+		// Restore from the replica & verify data.
+		outputPath := filepath.Join(t.TempDir(), "db")
+		opt := litestream.NewRestoreOptions()
+		opt.OutputPath, opt.Generation = outputPath, pos.Generation
+		if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+			t.Fatal(err)
+		}
+
+		other := testingutil.MustOpenSQLDB(t, outputPath)
+		defer testingutil.MustCloseSQLDB(t, other)
+
+		var count int
+		if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+			t.Fatal(err)
+		} else if got, want := count, n; got != want {
+			t.Fatalf("n=%d, want %d", got, want)
+		}
+	})
+
+	// Ensure replica can connect when the host key is in the known hosts file.
+	t.Run("KnownHosts", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.KnownHostsPath = s.MustWriteKnownHosts(t, s.HostKey.PublicKey())
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure replica refuses to connect if the known hosts file is missing.
+	t.Run("ErrKnownHostsNotFound", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+
+		if err := r.Init(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure replica can skip host key verification if explicitly requested.
+	t.Run("InsecureIgnoreHostKey", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+		r.InsecureIgnoreHostKey = true
+
+		if err := r.Init(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure replica rejects a server whose host key does not match.
+	t.Run("ErrKnownHostsMismatch", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.KnownHostsPath = s.MustWriteKnownHosts(t, MustGenerateSigner(t).PublicKey())
+
+		if err := r.Init(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure replica can authenticate with a private key file.
+	t.Run("KeyPath", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		key := MustGenerateKey(t)
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.AuthorizedKey = signer.PublicKey()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Password, r.KeyPath = "", MustWritePrivateKey(t, key)
+
+		if _, err := sqldb.Exec(`CREATE TABLE foo (bar TEXT);`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure replica returns an error if its private key is not authorized.
+	t.Run("ErrUnauthorizedKey", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+		s.AuthorizedKey = MustGenerateSigner(t).PublicKey()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Password, r.KeyPath = "", MustWritePrivateKey(t, MustGenerateKey(t))
+
+		if err := r.Init(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure a connection attempt does not block replica status methods.
+	t.Run("UnresponsiveServer", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		conns := make(chan net.Conn, 1)
+		go func() {
+			if conn, err := ln.Accept(); err == nil {
+				conns <- conn
+			}
+		}()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := sftp.NewReplica(db, "")
+		r.Host, r.User, r.Password = ln.Addr().String(), "user", "pass"
+		r.InsecureIgnoreHostKey = true
+
+		// Connect to a server which accepts the connection but never responds.
+		errc := make(chan error, 1)
+		go func() { errc <- r.Init(context.Background()) }()
+		conn := <-conns
+
+		done := make(chan struct{})
+		go func() {
+			r.LastPos()
+			r.LastSyncError()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("status methods blocked by connection attempt")
+		}
+
+		// Closing the connection fails the handshake.
+		conn.Close()
+		if err := <-errc; err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	// Ensure replica returns an error if the password is incorrect.
+	t.Run("ErrInvalidPassword", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.Password = "wrong"
+
+		if err := r.Init(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestReplica_Retry(t *testing.T) {
+	// Ensure the replica reconnects & retries after losing its connection.
+	t.Run("OK", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 2, MinBackoff: 100 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+
+		// Drop the connection & reopen the server while the retry is waiting.
+		s.SetFailing(t, true)
+		time.AfterFunc(10*time.Millisecond, func() { s.SetFailing(t, false) })
+		MustSyncRows(t, db, sqldb, r, 1)
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure the replica position is kept after a transient failure so the
+	// next sync does not recalculate it from the replica.
+	t.Run("KeepPos", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(t, true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		s.SetFailing(t, false)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+
+	// Ensure the replica does not connect to the server while the circuit
+	// breaker is open & that a successful trial closes it.
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		s := MustOpenServer(t)
+		defer s.Close()
+
+		db, sqldb := testingutil.MustOpenDBs(t)
+		defer testingutil.MustCloseDBs(t, db, sqldb)
+		now := time.Now()
+		r := s.NewReplica(t, db)
+		r.RetryPolicy = litestream.RetryPolicy{MaxAttempts: 1}
+		r.CircuitBreaker = &litestream.CircuitBreaker{Threshold: 1, Cooldown: time.Hour, Now: func() time.Time { return now }}
+		generation := MustSyncRows(t, db, sqldb, r, 1)
+		pos := r.LastPos()
+
+		s.SetFailing(t, true)
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			t.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		} else if err := r.Sync(context.Background()); err == nil {
+			t.Fatal("expected error")
+		} else if !r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected open circuit")
+		}
+
+		// Server is available again but the cooldown has not passed.
+		s.SetFailing(t, false)
+		connN := s.ConnN()
+		if err := r.Sync(context.Background()); !errors.Is(err, litestream.ErrCircuitOpen) {
+			t.Fatalf("unexpected error: %v", err)
+		} else if got := s.ConnN(); got != connN {
+			t.Fatalf("unexpected connections while circuit open: n=%d", got-connN)
+		} else if got, want := r.LastPos(), pos; got != want {
+			t.Fatalf("LastPos()=%v, want %v", got, want)
+		}
+
+		now = now.Add(time.Hour)
+		if err := r.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		} else if r.CircuitBreaker.IsOpen() {
+			t.Fatal("expected closed circuit")
+		}
+		MustRestoreRowCount(t, r, generation, 2)
+	})
+}
+
+// Server is an in-process SSH server that serves the SFTP subsystem.
+type Server struct {
+	mu    sync.Mutex
+	ln    net.Listener
+	addr  string
+	conns map[net.Conn]struct{}
+	connN int
+
+	HostKey ssh.Signer
+	config  *ssh.ServerConfig
+
+	// Public key accepted for the "user" account, if set.
+	AuthorizedKey ssh.PublicKey
+}
+
+// MustOpenServer returns a new, running SFTP server on a random local port.
+func MustOpenServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	s := &Server{HostKey: MustGenerateSigner(tb), conns: make(map[net.Conn]struct{})}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "user" && s.AuthorizedKey != nil && bytes.Equal(key.Marshal(), s.AuthorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	s.config.AddHostKey(s.HostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s.ln, s.addr = ln, ln.Addr().String()
+	go s.serve(ln)
+
+	return s
+}
+
+// Close stops the server listener & closes all open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	if s.ln == nil {
+		return nil
+	}
+	err := s.ln.Close()
+	s.ln = nil
+	return err
+}
+
+// SetFailing closes the server & its connections so operations fail with
+// connection errors. The server is reopened on the same address when
+// failing is set back to false.
+func (s *Server) SetFailing(tb testing.TB, failing bool) {
+	tb.Helper()
+	if failing {
+		if err := s.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ln = ln
+	go s.serve(ln)
+}
+
+// ConnN returns the number of connections accepted by the server.
+func (s *Server) ConnN() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connN
+}
+
+// Addr returns the network address of the server.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// NewReplica returns a new replica connected to the server using a temp directory.
+func (s *Server) NewReplica(tb testing.TB, db *litestream.DB) *sftp.Replica {
+	r := sftp.NewReplica(db, "")
+	r.Host, r.User, r.Password = s.Addr(), "user", "pass"
+	r.KnownHostsPath = s.MustWriteKnownHosts(tb, s.HostKey.PublicKey())
+	r.Path = tb.TempDir()
+	r.MonitorEnabled = false
+	db.Replicas = []litestream.Replica{r}
+	return r
+}
+
+// MustWriteKnownHosts writes a known hosts file with key for the server address.
+func (s *Server) MustWriteKnownHosts(tb testing.TB, key ssh.PublicKey) string {
+	tb.Helper()
+	filename := filepath.Join(tb.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, key)
+	if err := ioutil.WriteFile(filename, []byte(line+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}
+
+func (s *Server) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connN++
+		s.mu.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		// Only accept requests for the SFTP subsystem.
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+			}
+		}(requests)
+
+		go func() {
+			defer channel.Close()
+			server, err := pkgsftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+		}()
+	}
+}
+
+// MustGenerateSigner returns a new, random ed25519 signer.
+func MustGenerateSigner(tb testing.TB) ssh.Signer {
+	tb.Helper()
+	signer, err := ssh.NewSignerFromKey(MustGenerateKey(tb))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return signer
+}
+
+// MustGenerateKey returns a new, random ed25519 private key.
+func MustGenerateKey(tb testing.TB) ed25519.PrivateKey {
+	tb.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return key
+}
+
+// MustWritePrivateKey writes key to a PEM-encoded file & returns its path.
+func MustWritePrivateKey(tb testing.TB, key ed25519.PrivateKey) string {
+	tb.Helper()
+	buf, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	filename := filepath.Join(tb.TempDir(), "id_ed25519")
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: buf}), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return filename
+}
+
+// MustSyncRows inserts n rows into the "foo" table, syncing the database &
+// replica after each one. Returns the current generation.
+func MustSyncRows(tb testing.TB, db *litestream.DB, sqldb *sql.DB, r *sftp.Replica, n int) string {
+	tb.Helper()
+
+	if _, err := sqldb.Exec(`CREATE TABLE IF NOT EXISTS foo (bar TEXT);`); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := sqldb.Exec(`INSERT INTO foo (bar) VALUES ('baz')`); err != nil {
+			tb.Fatal(err)
+		} else if err := db.Sync(); err != nil {
+			tb.Fatal(err)
+		} else if err := r.Sync(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	pos, err := db.Pos()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pos.Generation
+}
+
+// MustRestoreRowCount restores the generation from r & verifies the number of
+// rows in the "foo" table.
+func MustRestoreRowCount(tb testing.TB, r *sftp.Replica, generation string, n int) {
+	tb.Helper()
+
+	outputPath := filepath.Join(tb.TempDir(), "db")
+	opt := litestream.NewRestoreOptions()
+	opt.OutputPath, opt.Generation = outputPath, generation
+	if err := litestream.RestoreReplica(context.Background(), r, opt); err != nil {
+		tb.Fatal(err)
+	}
+
+	other := testingutil.MustOpenSQLDB(tb, outputPath)
+	defer testingutil.MustCloseSQLDB(tb, other)
+
+	var count int
+	if err := other.QueryRow(`SELECT COUNT(1) FROM foo`).Scan(&count); err != nil {
+		tb.Fatal(err)
+	} else if got, want := count, n; got != want {
+		tb.Fatalf("n=%d, want %d", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package litestream
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Snapshot modes.
+const (
+	// SnapshotModeDirect streams the database file to the replica while
+	// holding a read transaction. Checkpoints are blocked until the snapshot
+	// has been fully written to the replica.
+	SnapshotModeDirect = "direct"
+
+	// SnapshotModeBackup copies the database file to a temporary file in the
+	// metadata directory while holding the same read transaction as direct
+	// mode. The read lock is only held during the local copy & is released
+	// before the copy is written to the replica.
+	//
+	// The online backup API & VACUUM INTO are not used as they include WAL
+	// frames which have not been copied to the shadow WAL, so the copy would
+	// not match the position the snapshot is recorded at. VACUUM INTO also
+	// renumbers database pages so subsequent WAL frames cannot be applied.
+	SnapshotModeBackup = "backup"
+)
+
+// ValidateSnapshotMode returns an error if mode is not a valid snapshot mode.
+// A blank mode is treated as SnapshotModeDirect.
+func ValidateSnapshotMode(mode string) error {
+	switch mode {
+	case "", SnapshotModeDirect, SnapshotModeBackup:
+		return nil
+	default:
+		return fmt.Errorf("invalid snapshot mode: %q", mode)
+	}
+}
+
+// SnapshotReader reads a consistent view of the database contents for a
+// snapshot. It must be closed to release the read lock or remove the
+// temporary copy of the database.
+type SnapshotReader struct {
+	f       *os.File
+	size    int64
+	tx      *sql.Tx // direct mode only
+	tmpPath string  // backup mode only
+
+	lockedAt     time.Time
+	lockDuration time.Duration
+	closed       bool
+}
+
+// OpenSnapshot returns a reader for a consistent view of the database using
+// the given snapshot mode.
+func (db *DB) OpenSnapshot(ctx context.Context, mode string) (*SnapshotReader, error) {
+	switch mode {
+	case "", SnapshotModeDirect:
+		return db.openDirectSnapshot(ctx)
+	case SnapshotModeBackup:
+		return db.openBackupSnapshot(ctx)
+	default:
+		return nil, fmt.Errorf("invalid snapshot mode: %q", mode)
+	}
+}
+
+// openDirectSnapshot acquires a read lock on the database to prevent
+// checkpoints & returns a reader for the database file. The lock is held
+// until the reader is closed.
+func (db *DB) openDirectSnapshot(ctx context.Context) (_ *SnapshotReader, err error) {
+	rd := &SnapshotReader{lockedAt: time.Now()}
+	if rd.tx, err = db.db.BeginTx(ctx, nil); err != nil {
+		return nil, err
+	} else if _, err := rd.tx.ExecContext(ctx, `SELECT COUNT(1) FROM _litestream_seq;`); err != nil {
+		_ = rd.tx.Rollback()
+		return nil, err
+	}
+
+	if rd.f, err = os.Open(db.Path()); err != nil {
+		_ = rd.tx.Rollback()
+		return nil, err
+	}
+
+	fi, err := rd.f.Stat()
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	rd.size = fi.Size()
+
+	return rd, nil
+}
+
+// openBackupSnapshot copies the database file to a temporary file in the
+// metadata directory while holding a read lock & returns a reader for the
+// copy. The read lock is released before returning.
+func (db *DB) openBackupSnapshot(ctx context.Context) (_ *SnapshotReader, err error) {
+	if err := mkdirAll(db.MetaPath(), db.dirmode, db.diruid, db.dirgid); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(db.MetaPath(), "snapshot-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	rd := &SnapshotReader{f: f, tmpPath: f.Name()}
+
+	// Copy the database file under the same read lock as a direct snapshot.
+	src, err := db.openDirectSnapshot(ctx)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	rd.lockedAt = src.lockedAt
+
+	n, err := io.Copy(f, src)
+	if e := src.Close(); e != nil && err == nil {
+		err = e
+	}
+	rd.lockDuration = src.LockDuration()
+	if err != nil {
+		_ = rd.Close()
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	rd.size = n
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// Read reads database contents into p.
+func (rd *SnapshotReader) Read(p []byte) (int, error) {
+	return rd.f.Read(p)
+}
+
+// Size returns the size of the database contents, in bytes.
+func (rd *SnapshotReader) Size() int64 {
+	return rd.size
+}
+
+// LockDuration returns the time the read lock on the database was held. For
+// direct snapshots, this is only known once the reader is closed.
+func (rd *SnapshotReader) LockDuration() time.Duration {
+	return rd.lockDuration
+}
+
+// Close releases the read lock or removes the temporary copy of the database.
+func (rd *SnapshotReader) Close() error {
+	if rd.closed {
+		return nil
+	}
+	rd.closed = true
+
+	err := rd.f.Close()
+
+	if rd.tx != nil {
+		if e := rd.tx.Rollback(); e != nil && err == nil {
+			err = e
+		}
+		rd.lockDuration = time.Since(rd.lockedAt)
+	}
+
+	if rd.tmpPath != "" {
+		if e := os.Remove(rd.tmpPath); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}